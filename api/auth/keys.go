@@ -0,0 +1,347 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var ErrUnknownKey = errors.New("Unknown signing key")
+
+// retireAfter is how long a key is kept once its successor signs: long
+// enough for the tokens it signed to expire after every instance has
+// picked up the successor on its hourly check.
+const retireAfter = 2 * TokenLifetime
+
+// unknownKeyReload is the least time between reloads caused by tokens
+// naming a key the ring does not know, so forged kids cannot flood the
+// store.
+const unknownKeyReload = 10 * time.Second
+
+// KeyRingConfig says where the signing keys live and how they are rotated.
+type KeyRingConfig struct {
+	// Store holds the keys. Every instance of the server must use the same
+	// one.
+	Store KeyStore
+	// Dir is used as a DirKeyStore when Store is nil.
+	Dir string
+	// Alg is the algorithm new keys are made for, RS256 or EdDSA.
+	Alg string
+	// RotateEvery is how long a key signs tokens before a new one takes over.
+	RotateEvery time.Duration
+	// HMACUntil is when HS256 tokens signed with API_SECRET stop being
+	// accepted.
+	HMACUntil time.Time
+}
+
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.Signer
+	created time.Time
+}
+
+// KeyRing holds every key tokens may currently be signed with. The newest
+// key signs, the others are kept until the tokens they signed have expired.
+// The keys are kept in a KeyStore so every instance of the server shares
+// them.
+type KeyRing struct {
+	config KeyRingConfig
+
+	mu   sync.RWMutex
+	keys []*signingKey
+
+	reloadMu sync.Mutex
+	reloaded time.Time
+}
+
+// LoadKeyRing reads the stored keys, making the first one if there is none
+// yet.
+func LoadKeyRing(config KeyRingConfig) (*KeyRing, error) {
+	if config.Alg == "" {
+		config.Alg = jwt.SigningMethodRS256.Alg()
+	}
+	if config.Alg != jwt.SigningMethodRS256.Alg() && config.Alg != EdDSA.Alg() {
+		return nil, fmt.Errorf("Unsupported signing algorithm '%s'", config.Alg)
+	}
+	if config.RotateEvery <= 0 {
+		return nil, errors.New("Keys must be rotated after a positive period")
+	}
+	if config.Store == nil {
+		err := os.MkdirAll(config.Dir, 0700)
+		if err != nil {
+			return nil, err
+		}
+		config.Store = DirKeyStore{Dir: config.Dir}
+	}
+	ring := &KeyRing{config: config}
+	err := ring.Rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Rotate picks up keys made by other instances, adds a new key once the
+// current one is due for rotation and drops keys no valid token can be
+// signed with any more. It holds the store's lock throughout, so when
+// several instances find the key due only the first makes a new one.
+func (k *KeyRing) Rotate(now time.Time) error {
+	var live []StoredKey
+	err := k.config.Store.Locked(func(store KeyStore) error {
+		keys, err := store.ListKeys()
+		if err != nil {
+			return err
+		}
+		sortKeys(keys)
+		if len(keys) == 0 || !now.Before(keys[len(keys)-1].Created.Add(k.config.RotateEvery)) {
+			key, err := k.generate(now)
+			if err != nil {
+				return err
+			}
+			err = store.AddKey(key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		old := retired(keys, now)
+		for _, id := range old {
+			err = store.RemoveKey(id)
+			if err != nil {
+				return err
+			}
+		}
+		live = keys[len(old):]
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return k.use(live)
+}
+
+// reload reads the stored keys again without making or removing any.
+func (k *KeyRing) reload(now time.Time) error {
+	keys, err := k.config.Store.ListKeys()
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return errors.New("The key store is empty")
+	}
+	sortKeys(keys)
+	return k.use(keys[len(retired(keys, now)):])
+}
+
+func (k *KeyRing) use(stored []StoredKey) error {
+	keys := []*signingKey{}
+	for _, key := range stored {
+		parsed, err := parseKey(key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key.ID, err)
+		}
+		keys = append(keys, parsed)
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// Run rotates the keys on every tick until the program exits.
+func (k *KeyRing) Run(check time.Duration) {
+	for now := range time.Tick(check) {
+		err := k.Rotate(now)
+		if err != nil {
+			fmt.Printf("Could not rotate signing keys: %v\n", err)
+		}
+	}
+}
+
+func (k *KeyRing) current() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys[len(k.keys)-1]
+}
+
+func (k *KeyRing) find(id string) (*signingKey, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.id == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// lookup finds the key a token names. Another instance may have made a key
+// since this one last rotated, so an unknown kid reloads the ring, at most
+// once every unknownKeyReload.
+func (k *KeyRing) lookup(id string) (*signingKey, bool) {
+	if key, ok := k.find(id); ok {
+		return key, true
+	}
+	k.reloadMu.Lock()
+	defer k.reloadMu.Unlock()
+	// a request waiting on the lock may find the key another one loaded
+	if key, ok := k.find(id); ok {
+		return key, true
+	}
+	now := time.Now()
+	if now.Sub(k.reloaded) < unknownKeyReload {
+		return nil, false
+	}
+	k.reloaded = now
+	err := k.reload(now)
+	if err != nil {
+		fmt.Printf("Could not reload signing keys: %v\n", err)
+		return nil, false
+	}
+	return k.find(id)
+}
+
+// AcceptsHMAC says whether tokens signed with API_SECRET are still valid.
+func (k *KeyRing) AcceptsHMAC(now time.Time) bool {
+	return now.Before(k.config.HMACUntil)
+}
+
+func (k *KeyRing) generate(now time.Time) (StoredKey, error) {
+	var private crypto.Signer
+	var err error
+	if k.config.Alg == EdDSA.Alg() {
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		return StoredKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return StoredKey{}, err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return StoredKey{}, err
+	}
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{createdHeader: now.UTC().Format(time.RFC3339)},
+		Bytes:   der,
+	}
+	return StoredKey{
+		ID:      now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix),
+		PEM:     pem.EncodeToMemory(block),
+		Created: now,
+	}, nil
+}
+
+// sortKeys puts the keys oldest first, so the last one signs.
+func sortKeys(keys []StoredKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].Created.Before(keys[j].Created)
+	})
+}
+
+// retired lists the sorted keys whose successor has been signing for
+// longer than retireAfter.
+func retired(keys []StoredKey, now time.Time) []string {
+	ids := []string{}
+	for i := 0; i < len(keys)-1 && keys[i+1].Created.Add(retireAfter).Before(now); i++ {
+		ids = append(ids, keys[i].ID)
+	}
+	return ids
+}
+
+func methodFor(private crypto.Signer) (jwt.SigningMethod, error) {
+	switch private.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case ed25519.PrivateKey:
+		return EdDSA, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %T", private)
+}
+
+func parseKey(stored StoredKey) (*signingKey, error) {
+	block, _ := pem.Decode(stored.PEM)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("not a PKCS8 private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported key type %T", parsed)
+	}
+	method, err := methodFor(private)
+	if err != nil {
+		return nil, err
+	}
+	return &signingKey{
+		id:      stored.ID,
+		method:  method,
+		private: private,
+		created: stored.Created,
+	}, nil
+}
+
+// JWK is the public half of a signing key as published in the JWKS.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS lists the public keys other services can check our tokens with.
+func (k *KeyRing) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
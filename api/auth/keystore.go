@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const createdHeader = "Created"
+
+// StoredKey is a PEM encoded PKCS8 private key as a KeyStore keeps it.
+type StoredKey struct {
+	ID      string
+	PEM     []byte
+	Created time.Time
+}
+
+// KeyStore keeps the signing keys somewhere every instance of the server
+// can read them.
+type KeyStore interface {
+	ListKeys() ([]StoredKey, error)
+	AddKey(key StoredKey) error
+	RemoveKey(id string) error
+	// Locked calls fn while holding a lock shared by every instance, with
+	// a store that works under that lock.
+	Locked(fn func(store KeyStore) error) error
+}
+
+// staleKeyLock is how old a lock file must be before it is taken to be
+// left over from an instance that died while rotating.
+const staleKeyLock = time.Minute
+
+// DirKeyStore keeps one key per file, named <kid>.pem. It is only shared
+// by instances that mount the same directory.
+type DirKeyStore struct {
+	Dir string
+}
+
+func (d DirKeyStore) ListKeys() ([]StoredKey, error) {
+	paths, err := filepath.Glob(filepath.Join(d.Dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	keys := []StoredKey{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key := StoredKey{ID: strings.TrimSuffix(filepath.Base(path), ".pem"), PEM: data}
+		// keys dropped in by hand have no header, their file time stands in
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: not a PEM file", filepath.Base(path))
+		}
+		key.Created, err = time.Parse(time.RFC3339, block.Headers[createdHeader])
+		if err != nil {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			key.Created = info.ModTime()
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (d DirKeyStore) AddKey(key StoredKey) error {
+	// write to a temporary file first so other instances never read half
+	// a key
+	path := filepath.Join(d.Dir, key.ID+".pem")
+	err := ioutil.WriteFile(path+".tmp", key.PEM, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (d DirKeyStore) RemoveKey(id string) error {
+	err := os.Remove(filepath.Join(d.Dir, id+".pem"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Locked takes the lock by creating a lock file, which only one instance
+// can do at a time.
+func (d DirKeyStore) Locked(fn func(store KeyStore) error) error {
+	path := filepath.Join(d.Dir, "rotate.lock")
+	deadline := time.Now().Add(staleKeyLock)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			f.Close()
+			break
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleKeyLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return errors.New("Timed out waiting for the key lock")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	defer os.Remove(path)
+	return fn(d)
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+var ErrInvalidToken = errors.New("Unauthorized")
+
+// Principal is who a request is made by, as read from its access token.
+type Principal struct {
+	UserID    uint
+	Role      string
+	TokenID   string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+type principalKey struct{}
+
+// RevocationList says whether a token was revoked before it expired, on
+// its own or with every token its user was issued until then.
+type RevocationList interface {
+	IsRevoked(jti string, uid uint, issuedAt time.Time) (bool, error)
+}
+
+var revocations RevocationList
+
+// UseRevocationList makes Authenticate refuse revoked tokens. The server
+// sets it up at startup.
+func UseRevocationList(list RevocationList) {
+	revocations = list
+}
+
+// Authenticate checks the request's token and returns its principal. It is
+// the only place tokens are parsed for a request.
+func Authenticate(r *http.Request) (*Principal, error) {
+	token, err := ParseToken(ExtractToken(r))
+	if err != nil {
+		return nil, err
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	principal, err := principalFromClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revocations != nil {
+		revoked, err := revocations.IsRevoked(principal.TokenID, principal.UserID, principal.IssuedAt)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrInvalidToken
+		}
+	}
+	return principal, nil
+}
+
+func principalFromClaims(claims jwt.MapClaims) (*Principal, error) {
+	uid, ok := claims["user_id"].(float64)
+	if !ok || uid < 1 || uid > math.MaxUint32 || uid != math.Trunc(uid) {
+		return nil, ErrInvalidToken
+	}
+	role, ok := claims["role"].(string)
+	if !ok || role == "" {
+		return nil, ErrInvalidToken
+	}
+	// jwt-go only checks exp when it is present, so a token without one
+	// would never expire
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	jti, _ := claims["jti"].(string)
+	// tokens issued before iat was added count as issued at the start of
+	// time, so revoking a user's tokens catches them too
+	var issuedAt time.Time
+	if iat, ok := claims["iat"].(float64); ok {
+		issuedAt = time.Unix(0, int64(iat*1e9))
+	}
+	return &Principal{
+		UserID:    uint(uid),
+		Role:      role,
+		TokenID:   jti,
+		IssuedAt:  issuedAt,
+		ExpiresAt: time.Unix(int64(exp), 0),
+	}, nil
+}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal the authentication middleware stored
+// on the request context.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
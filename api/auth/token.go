@@ -1,12 +1,13 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -19,35 +20,80 @@ type TokenParts struct {
 	user_id    uint
 }
 
+// TokenLifetime is how long an access token is valid for.
+const TokenLifetime = time.Hour
+
+var keyRing *KeyRing
+
+// UseKeyRing signs tokens with the ring's keys instead of API_SECRET. HS256
+// tokens are still accepted until the ring's migration window closes.
+func UseKeyRing(ring *KeyRing) {
+	keyRing = ring
+}
+
 func CreateToken(user models.User) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
 	claims := jwt.MapClaims{}
 	claims["authorized"] = true
 	claims["user_id"] = user.ID
 	claims["role"] = user.Role
-	claims["exp"] = time.Now().Add(time.Hour * 1).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(os.Getenv("API_SECRET")))
+	claims["jti"] = jti
+	now := time.Now()
+	// iat keeps microseconds so a token issued right after the user's
+	// tokens were revoked is not taken for one issued before
+	claims["iat"] = float64(now.UnixNano()/1e3) / 1e6
+	claims["exp"] = now.Add(TokenLifetime).Unix()
+	if keyRing == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(os.Getenv("API_SECRET")))
+	}
+	key := keyRing.current()
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
 }
 
-func TokenValid(r *http.Request) error {
-	tokenString := ExtractToken(r)
-	token, err := ParseToken(tokenString)
+// newTokenID gives every token a unique jti so it can be told apart from
+// others issued to the same user.
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
 	if err != nil {
-		return err
-	}
-	// if CreateToken
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		Pretty(claims)
+		return "", err
 	}
-	return nil
+	return hex.EncodeToString(b), nil
+}
+
+func TokenValid(r *http.Request) error {
+	_, err := Authenticate(r)
+	return err
 }
 
 func ParseToken(tokenString string) (*jwt.Token, error) {
 	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			if keyRing != nil && (!keyRing.AcceptsHMAC(time.Now()) || os.Getenv("API_SECRET") == "") {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+			return []byte(os.Getenv("API_SECRET")), nil
+		}
+		if keyRing == nil {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(os.Getenv("API_SECRET")), nil
+		kid, _ := token.Header["kid"].(string)
+		key, ok := keyRing.lookup(kid)
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		// the alg header must match the key, or a token could pick how
+		// its own signature is checked
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.private.Public(), nil
 	})
 }
 
@@ -67,33 +113,6 @@ func ExtractToken(r *http.Request) string {
 	return ""
 }
 
-func ExtractTokenIDAndRole(r *http.Request) (uint32, string, error) {
-	tokenString := ExtractToken(r)
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return 0, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(os.Getenv("API_SECRET")), nil
-	})
-	if err != nil {
-		return 0, "", err
-	}
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if ok && token.Valid {
-		uid, err := strconv.ParseUint(fmt.Sprintf("%.0f", claims["user_id"]), 10, 32)
-		if err != nil {
-			return 9, "", err
-		}
-
-		if role, ok := claims["role"]; ok {
-			return uint32(uid), fmt.Sprintf("%s", role), nil
-
-		}
-		return 9, "", err
-	}
-	return 0, "", nil
-}
-
 func Pretty(data interface{}) {
 	_, err := json.MarshalIndent(data, "", " ")
 	if err != nil {
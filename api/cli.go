@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/brianhumphreys/library_app/api/migrations"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/joho/godotenv"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// Exit codes shared by every command.
+const (
+	exitOK = iota
+	exitFailed
+	exitUsage
+	exitSchemaBehind
+	exitRowsRejected
+)
+
+const usage = `Usage: library_app COMMAND [FLAGS]
+
+Commands:
+  serve          run the web server, the default without a command
+  migrate        apply or roll back schema migrations
+  seed           fill an empty database with sample data
+  create-admin   add an admin account
+  import-books   add the books in a CSV file
+  export         write the catalog as MARC
+
+Run library_app COMMAND -h for the flags of a command.
+
+Exit codes: 0 done, 1 failed, 2 bad usage, 3 the schema needs migrate up,
+4 import-books rejected some rows.
+`
+
+// Main runs the command named by args and returns its exit code.
+func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	// without a .env file the settings come from the environment
+	godotenv.Load()
+	if len(args) == 0 {
+		return serve(args, stdout, stderr)
+	}
+	command, args := args[0], args[1:]
+	switch command {
+	case "serve":
+		return serve(args, stdout, stderr)
+	case "migrate":
+		return migrate(args, stdout, stderr)
+	case "seed":
+		return seedDatabase(args, stdout, stderr)
+	case "create-admin":
+		return createAdmin(args, stdin, stdout, stderr)
+	case "import-books":
+		return importBooks(args, stdin, stdout, stderr)
+	case "export":
+		return export(args, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "Unknown command %q\n\n%s", command, usage)
+	return exitUsage
+}
+
+// connect opens the database the server would use: DATABASE_URL when it
+// is set, otherwise the DB_* settings.
+func connect() (*gorm.DB, error) {
+	dsn, present := os.LookupEnv("DATABASE_URL")
+	if !present {
+		dsn = fmt.Sprintf("%s://%s:%s@%s:%s", os.Getenv("DB_NAME"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_HOST"), os.Getenv("DB_PORT"))
+	}
+	return gorm.Open(postgres.Open(dsn), &gorm.Config{})
+}
+
+// openDatabase connects and makes sure the schema is at the version this
+// build needs. Built in roles follow the code rather than a migration, so
+// they are brought up to date here. On failure it returns the exit code.
+func openDatabase(stderr io.Writer) (*gorm.DB, int) {
+	db, err := connect()
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not connect to the database: %v\n", err)
+		return nil, exitFailed
+	}
+	migrator, err := migrations.Open(db, migrations.Dir())
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load the migrations: %v\n", err)
+		return nil, exitFailed
+	}
+	err = migrator.Check()
+	var behind *migrations.BehindError
+	if errors.As(err, &behind) {
+		fmt.Fprintln(stderr, err)
+		return nil, exitSchemaBehind
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read the schema version: %v\n", err)
+		return nil, exitFailed
+	}
+	err = models.MigrateRoles(db)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not set up roles: %v\n", err)
+		return nil, exitFailed
+	}
+	return db, exitOK
+}
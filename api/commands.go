@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/controllers"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/seed"
+)
+
+const seedUsage = `Usage: library_app seed [-fixture NAME]
+
+Fills an empty, migrated database with sample data. A database that
+already has users is left alone and the command fails.
+
+Flags:
+  -fixture NAME   which data to load, demo by default, one of: %s
+`
+
+const createAdminUsage = `Usage: library_app create-admin -email EMAIL
+
+Adds a verified admin account. The password is read from ADMIN_PASSWORD,
+or else from the first line of standard input.
+
+Flags:
+  -email EMAIL    email of the new admin, required
+`
+
+const importBooksUsage = `Usage: library_app import-books [-dry-run] FILE.csv
+
+Adds the books in a CSV file with a header row naming the title, author,
+isbn and description columns, like the upload endpoint. Use - to read
+standard input. Rows that fail validation are listed and skipped, and the
+command exits with code 4.
+
+Flags:
+  -dry-run        check every row without saving anything
+`
+
+const exportUsage = `Usage: library_app export [-format FORMAT] [-o FILE]
+
+Writes the whole catalog as MARC.
+
+Flags:
+  -format FORMAT  marcxml, the default, or marc for MARC21 binary
+  -o FILE         file to write, standard output by default
+`
+
+// newFlags makes a flag set that prints text as its usage.
+func newFlags(name, text string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, text) }
+	return flags
+}
+
+func seedDatabase(args []string, stdout, stderr io.Writer) int {
+	flags := newFlags("seed", fmt.Sprintf(seedUsage, strings.Join(seed.Names(), ", ")), stderr)
+	fixture := flags.String("fixture", "demo", "which data to load")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	known := false
+	for _, name := range seed.Names() {
+		known = known || name == *fixture
+	}
+	if !known {
+		fmt.Fprintf(stderr, "There is no fixture named %q, pick one of: %s\n", *fixture, strings.Join(seed.Names(), ", "))
+		return exitUsage
+	}
+
+	db, code := openDatabase(stderr)
+	if code != exitOK {
+		return code
+	}
+	err := seed.Load(db, *fixture)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not seed the database: %v\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(stdout, "Loaded the %s fixture\n", *fixture)
+	return exitOK
+}
+
+// readPassword takes ADMIN_PASSWORD, so scripts need not pass the password
+// on the command line where other users could see it.
+func readPassword(stdin io.Reader) (string, error) {
+	if password := os.Getenv("ADMIN_PASSWORD"); password != "" {
+		return password, nil
+	}
+	line, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func createAdmin(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := newFlags("create-admin", createAdminUsage, stderr)
+	email := flags.String("email", "", "email of the new admin")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 0 || *email == "" {
+		flags.Usage()
+		return exitUsage
+	}
+	password, err := readPassword(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read the password: %v\n", err)
+		return exitFailed
+	}
+	verifiedAt := time.Now()
+	user := models.User{Email: *email, Password: password, Role: models.RoleAdmin, EmailVerifiedAt: &verifiedAt}
+	user.Prepare()
+	err = user.Validate("")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitUsage
+	}
+
+	db, code := openDatabase(stderr)
+	if code != exitOK {
+		return code
+	}
+	taken, err := models.FindTakenEmails(db, []string{user.Email})
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not check the email: %v\n", err)
+		return exitFailed
+	}
+	if len(taken) > 0 {
+		fmt.Fprintf(stderr, "%s already has an account\n", user.Email)
+		return exitFailed
+	}
+	// the zero actor id records the change as made by the system
+	_, err = user.CreateUserAs(db, models.Actor{Role: models.RoleAdmin})
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not create the admin: %v\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(stdout, "Created admin %d: %s\n", user.ID, user.Email)
+	return exitOK
+}
+
+func importBooks(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := newFlags("import-books", importBooksUsage, stderr)
+	dryRun := flags.Bool("dry-run", false, "check every row without saving anything")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	name := flags.Arg(0)
+	file := stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return exitFailed
+		}
+		defer f.Close()
+		file = f
+	}
+
+	db, code := openDatabase(stderr)
+	if code != exitOK {
+		return code
+	}
+	server := controllers.Server{DB: db}
+	report, err := server.ImportBooksCsv(file, *dryRun, models.Actor{})
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not import %s: %v\n", name, err)
+		return exitFailed
+	}
+
+	for _, rowErr := range report.Errors {
+		fmt.Fprintf(stderr, "row %d %s: %s\n", rowErr.Row, rowErr.Key, rowErr.Error)
+	}
+	verb := "created"
+	if report.DryRun {
+		verb = "would be created"
+	}
+	fmt.Fprintf(stdout, "%d rows, %d %s, %d rejected\n", report.Rows, report.Valid, verb, report.Invalid)
+	if report.Invalid > 0 {
+		return exitRowsRejected
+	}
+	return exitOK
+}
+
+func export(args []string, stdout, stderr io.Writer) int {
+	flags := newFlags("export", exportUsage, stderr)
+	format := flags.String("format", "marcxml", "marcxml or marc")
+	output := flags.String("o", "", "file to write")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	if *format != "marcxml" && *format != "marc" {
+		fmt.Fprintln(stderr, controllers.ErrExportFormat)
+		return exitUsage
+	}
+
+	db, code := openDatabase(stderr)
+	if code != exitOK {
+		return code
+	}
+	server := controllers.Server{DB: db}
+	if *output == "" {
+		err := server.ExportCatalog(stdout, *format)
+		if err != nil {
+			fmt.Fprintf(stderr, "The export stopped: %v\n", err)
+			return exitFailed
+		}
+		return exitOK
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return exitFailed
+	}
+	err = server.ExportCatalog(f, *format)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// a cut short export would pass for the whole catalog
+		os.Remove(*output)
+		fmt.Fprintf(stderr, "The export stopped: %v\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(stdout, "Exported the catalog to %s\n", *output)
+	return exitOK
+}
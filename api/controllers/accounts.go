@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/views"
+	"github.com/gorilla/mux"
+)
+
+func (server *Server) GetAccount(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// patrons can see their own account, desk staff can see everyone's
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	if principal.UserID != uint(uid) && !server.can(principal, models.PermAccountsManage) {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+		return
+	}
+
+	account, err := models.GetAccountOfUserWithID(server.DB, uint(uid))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewAccount(account))
+}
+
+func (server *Server) CreatePayment(w http.ResponseWriter, r *http.Request) {
+	server.creditAccount(w, r, models.LedgerPayment)
+}
+
+func (server *Server) CreateWaiver(w http.ResponseWriter, r *http.Request) {
+	server.creditAccount(w, r, models.LedgerWaiver)
+}
+
+func (server *Server) creditAccount(w http.ResponseWriter, r *http.Request, kind string) {
+	vars := mux.Vars(r)
+	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	entry := models.LedgerEntry{}
+	err = json.Unmarshal(body, &entry)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	entry.Prepare()
+	err = entry.ValidateCredit()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	entry.UserId = uint(uid)
+	entry.Kind = kind
+	fmt.Printf("Recording %s of %d cents for user: %d\n", kind, entry.AmountCents, uid)
+	entryCreated, err := entry.CreditAccount(server.DB, actorOf(r, principal))
+	if errors.Is(err, models.ErrCreditExceedsBalance) {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, views.NewLedgerEntry(entryCreated))
+}
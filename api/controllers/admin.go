@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+	"github.com/brianhumphreys/library_app/api/views"
+)
+
+// CreateAdminUser adds an account with any role, for staff who manage
+// roles. Only admins can create other admins. The account still has to
+// verify its email address.
+func (server *Server) CreateAdminUser(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user := models.User{}
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user.Prepare()
+	user.EmailVerifiedAt = nil
+	err = user.Validate("")
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	userCreated, err := user.CreateUserAs(server.DB, actorOf(r, principal))
+	if errors.Is(err, models.ErrRoleNotFound) {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if errors.Is(err, models.ErrAdminOnly) {
+		responses.ERROR(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		formattedError := formaterror.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	err = server.sendVerification(userCreated)
+	if err != nil {
+		fmt.Printf("Could not send a verification email to user %d: %v\n", userCreated.ID, err)
+	}
+	fmt.Printf("User %d created user %d with role %s\n", principal.UserID, userCreated.ID, userCreated.Role)
+	w.Header().Set("Location", fmt.Sprintf("%s/api/v1/users/%d", r.Host, userCreated.ID))
+	responses.JSON(w, http.StatusCreated, views.NewAdminUser(userCreated))
+}
+
+// BootstrapAdmin creates the first admin from ADMIN_EMAIL and
+// ADMIN_PASSWORD when the library has none yet. The variables can be
+// removed once it has run.
+func (server *Server) BootstrapAdmin() error {
+	email := os.Getenv("ADMIN_EMAIL")
+	password := os.Getenv("ADMIN_PASSWORD")
+	if email == "" || password == "" {
+		return nil
+	}
+	admin, err := models.BootstrapAdmin(server.DB, email, password)
+	if err != nil {
+		return fmt.Errorf("Could not create the first admin: %v", err)
+	}
+	if admin != nil {
+		fmt.Printf("Created the first admin: %s\n", admin.Email)
+	}
+	return nil
+}
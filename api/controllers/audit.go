@@ -0,0 +1,112 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/middlewares"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+)
+
+// actorOf is who the audit log records for a change made by the request.
+// The principal is nil when nobody is signed in, such as at signup.
+func actorOf(r *http.Request, principal *auth.Principal) models.Actor {
+	actor := models.Actor{
+		RequestID: middlewares.RequestIDFrom(r.Context()),
+		IP:        clientIP(r),
+	}
+	if principal != nil {
+		actor.UserID = principal.UserID
+		actor.Role = principal.Role
+	}
+	return actor
+}
+
+func parseAuditID(v, name string) (*uint, error) {
+	if v == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a number", name)
+	}
+	value := uint(id)
+	return &value, nil
+}
+
+// GetAuditLog lists audit entries, newest first, filtered by actor_id,
+// action, target_type, target_id, request_id, from and to.
+func (server *Server) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	page, err := pageRequestFrom(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	search := models.AuditSearch{
+		PageRequest: page,
+		Action:      params.Get("action"),
+		TargetType:  params.Get("target_type"),
+		RequestId:   params.Get("request_id"),
+	}
+	search.ActorId, err = parseAuditID(params.Get("actor_id"), "actor_id")
+	if err == nil {
+		search.TargetId, err = parseAuditID(params.Get("target_id"), "target_id")
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	search.From, err = parseSearchTime(params.Get("from"))
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, errors.New("from must be a date"))
+		return
+	}
+	search.To, err = parseSearchTime(params.Get("to"))
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, errors.New("to must be a date"))
+		return
+	}
+
+	search.Prepare()
+	err = search.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	result, err := models.FindAuditEntries(server.DB, &search)
+	if err != nil {
+		respondListError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, result)
+}
+
+// VerifyAuditLog checks the hash chain of the whole log. A broken chain is
+// reported with the first entry that does not fit.
+func (server *Server) VerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	checked, err := models.VerifyAuditChain(server.DB)
+	var broken *models.AuditChainError
+	if errors.As(err, &broken) {
+		responses.JSON(w, http.StatusOK, map[string]interface{}{
+			"valid":    false,
+			"checked":  checked,
+			"entry_id": broken.EntryID,
+			"error":    broken.Error(),
+		})
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, map[string]interface{}{
+		"valid":   true,
+		"checked": checked,
+	})
+}
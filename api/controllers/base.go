@@ -1,81 +1,149 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
-	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/mailer"
+	"github.com/brianhumphreys/library_app/api/metadata"
 	"github.com/brianhumphreys/library_app/api/models"
 )
 
 type Server struct {
-	DB     *gorm.DB
-	Router *mux.Router
+	DB       *gorm.DB
+	Router   *mux.Router
+	Metadata metadata.MetadataProvider
+	Keys     *auth.KeyRing
+	Mailer   mailer.Mailer
 }
 
-func (server *Server) Initialize(Dbdriver, DbUser, DbPassword, DbPort, DbHost, DbName string) {
+// metadataCacheTTL is how long looked up book details are reused.
+const metadataCacheTTL = 24 * time.Hour
 
-	var err error
+// metadataCacheSize is how many lookups are kept, a few megabytes at most.
+const metadataCacheSize = 10000
 
-	DBURL := fmt.Sprintf("%s://%s:%s@%s:%s", DbName, DbUser, DbPassword, DbHost, DbPort)
+func newMetadataProvider() metadata.MetadataProvider {
+	return metadata.NewCache(metadata.NewOpenLibrary(os.Getenv("OPENLIBRARY_URL")), metadataCacheTTL, metadataCacheSize)
+}
 
-	val, present := os.LookupEnv("DATABASE_URL")
-	if present {
-		server.DB, err = gorm.Open(postgres.Open(val), &gorm.Config{})
-	} else {
-		server.DB, err = gorm.Open(postgres.Open(DBURL), &gorm.Config{})
+// newMailer sends through SMTP_ADDR, which has to be set unless
+// MAILER=console. The console mailer prints whole messages, reset and
+// verification links included, into the logs, so it is for development
+// only and never picked on its own.
+func newMailer() (mailer.Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "", "smtp":
+		addr := os.Getenv("SMTP_ADDR")
+		if addr == "" {
+			return nil, errors.New("SMTP_ADDR is not set, set it or MAILER=console to print mail in development")
+		}
+		return mailer.NewSMTP(addr, os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD")), nil
+	case "console":
+		fmt.Println("MAILER=console prints every mail, sign in links included, do not use it in production")
+		return mailer.Console{}, nil
 	}
+	return nil, errors.New("MAILER must be 'smtp' or 'console'")
+}
 
-	if err != nil {
-		fmt.Printf("Connection with %s could not be obtained: ", Dbdriver)
-		log.Fatal("Additional output:", err)
-	} else {
-		fmt.Printf("Connection with %s was successful", Dbdriver)
+// keyRotationCheck is how often the signing keys are checked for rotation.
+const keyRotationCheck = time.Hour
+
+// newKeyRing sets up asymmetric token signing when JWT_KEYS is database,
+// which every instance shares, or JWT_KEYS_DIR names a directory, which
+// only suits instances that mount the same one. Without either tokens keep
+// being signed with API_SECRET.
+func newKeyRing(db *gorm.DB) (*auth.KeyRing, error) {
+	var store auth.KeyStore
+	dir := os.Getenv("JWT_KEYS_DIR")
+	switch os.Getenv("JWT_KEYS") {
+	case "database":
+		if dir != "" {
+			return nil, errors.New("JWT_KEYS_DIR cannot be set with JWT_KEYS=database")
+		}
+		store = DatabaseKeyStore{DB: db}
+	case "":
+		if dir == "" {
+			return nil, nil
+		}
+	default:
+		return nil, errors.New("JWT_KEYS must be 'database' or unset")
 	}
-
-	server.DB.AutoMigrate(&models.User{}, &models.Book{})
-
-	server.Router = mux.NewRouter()
-
-	server.initializeRoutes()
+	days := 30
+	if val := os.Getenv("JWT_KEY_ROTATION_DAYS"); val != "" {
+		parsed, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_KEY_ROTATION_DAYS: %v", err)
+		}
+		days = parsed
+	}
+	// HS256 tokens issued before the switch are good until they expire,
+	// unless JWT_HS256_UNTIL keeps them around for longer
+	hmacUntil := time.Now().Add(auth.TokenLifetime)
+	if val := os.Getenv("JWT_HS256_UNTIL"); val != "" {
+		parsed, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_HS256_UNTIL: %v", err)
+		}
+		hmacUntil = parsed
+	}
+	return auth.LoadKeyRing(auth.KeyRingConfig{
+		Store:       store,
+		Dir:         dir,
+		Alg:         os.Getenv("JWT_ALG"),
+		RotateEvery: time.Duration(days) * 24 * time.Hour,
+		HMACUntil:   hmacUntil,
+	})
 }
 
-func (server *Server) InitializeDev() {
-
-	var err error
-
-	val, present := os.LookupEnv("DATABASE_URL")
-	if present {
-		server.DB, err = gorm.Open(postgres.Open(val), &gorm.Config{})
-	} else {
-		log.Fatalf("Could not load you .env file: %v", err)
+func (server *Server) initializeKeyRing() error {
+	ring, err := newKeyRing(server.DB)
+	if err != nil {
+		return fmt.Errorf("Could not load the signing keys: %v", err)
 	}
+	server.Keys = ring
+	if ring != nil {
+		auth.UseKeyRing(ring)
+		go ring.Run(keyRotationCheck)
+	}
+	return nil
+}
 
+// Initialize sets the server up on a database whose schema is already
+// migrated.
+func (server *Server) Initialize(db *gorm.DB) error {
+	server.DB = db
+	auth.UseRevocationList(models.TokenRevocations{DB: server.DB})
+	err := server.initializeKeyRing()
 	if err != nil {
-		fmt.Printf("Connection with database could not be obtained: ")
-		log.Fatal("Additional output:", err)
-	} else {
-		fmt.Printf("Connection with database was successful")
+		return err
 	}
-
-	server.DB.AutoMigrate(&models.User{}, &models.Book{})
-
+	server.Mailer, err = newMailer()
+	if err != nil {
+		return err
+	}
+	server.Metadata = newMetadataProvider()
 	server.Router = mux.NewRouter()
 
 	server.initializeRoutes()
+	return nil
 }
 
-func (server *Server) Run(addr string) {
+func (server *Server) Run(addr string) error {
 	// fmt.Println("Server is running on port 8080")
 	// c := cors.New(cors.Options{
 	// 	AllowedOrigins: []string{"http://localhost:3000"},
 	// 	AllowedMethods: []string{"GET", "POST", "PATCH"},
 	// 	AllowedHeaders: []string{"Bearer", "Content_Type", "Authorization"}})
 	// handler := c.Handler(server.Router)
-	log.Fatal(http.ListenAndServe(addr, server.Router))
+	fmt.Printf("Listening on %s\n", addr)
+	return http.ListenAndServe(addr, server.Router)
 }
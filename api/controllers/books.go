@@ -7,11 +7,13 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"time"
 
-	"github.com/brianhumphreys/library_app/api/auth"
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/brianhumphreys/library_app/api/responses"
 	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+	"github.com/brianhumphreys/library_app/api/utils/isbn"
+	"github.com/brianhumphreys/library_app/api/views"
 	"github.com/gorilla/mux"
 )
 
@@ -30,13 +32,8 @@ func (server *Server) CreateBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, role, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
-		return
-	}
-	if role != "admin" {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
 
@@ -47,8 +44,11 @@ func (server *Server) CreateBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	book.Available = true
-	bookCreated, err := book.SaveBook(server.DB)
+	bookCreated, err := book.CreateBookAs(server.DB, actorOf(r, principal))
+	if errors.Is(err, models.ErrDuplicateIsbn) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
 		formattedError := formaterror.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
@@ -57,18 +57,94 @@ func (server *Server) CreateBook(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("Found book with ID: %d\n", bookCreated.ID)
 
 	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", r.Host, r.URL.Path, bookCreated.ID))
-	responses.JSON(w, http.StatusCreated, bookCreated)
+	responses.JSON(w, http.StatusCreated, views.NewBook(bookCreated))
 }
 
 func (server *Server) GetBooks(w http.ResponseWriter, r *http.Request) {
 	book := models.Book{}
 
-	books, err := book.FindAllBooks(server.DB)
+	page, err := pageRequestFrom(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	books, err := book.FindAllBooks(server.DB, &page)
+	if err != nil {
+		respondListError(w, err)
+		return
+	}
+	data, err := views.BookPage(books)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, data)
+}
+
+func parseSearchTime(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (server *Server) SearchBooks(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	page, err := pageRequestFrom(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	search := models.BookSearch{
+		PageRequest: page,
+		Query:       params.Get("q"),
+		Author:      params.Get("author"),
+	}
+	if v := params.Get("available"); v != "" {
+		available, err := strconv.ParseBool(v)
+		if err != nil {
+			responses.ERROR(w, http.StatusBadRequest, errors.New("available must be true or false"))
+			return
+		}
+		search.Available = &available
+	}
+	search.CreatedFrom, err = parseSearchTime(params.Get("created_from"))
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, errors.New("created_from must be a date"))
+		return
+	}
+	search.CreatedTo, err = parseSearchTime(params.Get("created_to"))
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, errors.New("created_to must be a date"))
+		return
+	}
+
+	search.Prepare()
+	err = search.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	result, err := models.SearchBooks(server.DB, &search)
+	if err != nil {
+		respondListError(w, err)
+		return
+	}
+	_, err = views.BookPage(&result.Page)
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, books)
+	responses.JSON(w, http.StatusOK, result)
 }
 
 func (server *Server) GetBook(w http.ResponseWriter, r *http.Request) {
@@ -86,8 +162,28 @@ func (server *Server) GetBook(w http.ResponseWriter, r *http.Request) {
 	}
 	if len(*book) == 0 {
 		responses.ERROR(w, http.StatusNotFound, errors.New("This book was not found in the library"))
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewBook(&(*book)[0]))
+}
+
+func (server *Server) GetBookByIsbn(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	book, err := models.FindBookByIsbn(server.DB, vars["isbn"])
+	if errors.Is(err, isbn.ErrInvalid) {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	if errors.Is(err, models.ErrBookNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("This book was not found in the library"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
 	}
-	responses.JSON(w, http.StatusOK, (*book)[0])
+	responses.JSON(w, http.StatusOK, views.NewBook(book))
 }
 
 func (server *Server) UpdateBook(w http.ResponseWriter, r *http.Request) {
@@ -99,13 +195,8 @@ func (server *Server) UpdateBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, role, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
-		return
-	}
-	if role != "admin" {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
 
@@ -139,8 +230,11 @@ func (server *Server) UpdateBook(w http.ResponseWriter, r *http.Request) {
 
 	bookUpdate.ID = book.ID
 
-	bookUpdated, err := bookUpdate.UpdateABook(server.DB)
-
+	bookUpdated, err := bookUpdate.UpdateABook(server.DB, actorOf(r, principal))
+	if errors.Is(err, models.ErrDuplicateIsbn) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
 		formattedError := formaterror.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
@@ -149,7 +243,7 @@ func (server *Server) UpdateBook(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("Updated book with ID: %d\n", bookUpdated.ID)
 
-	responses.JSON(w, http.StatusOK, bookUpdated)
+	responses.JSON(w, http.StatusOK, views.NewBook(bookUpdated))
 }
 
 func (server *Server) DeleteBook(w http.ResponseWriter, r *http.Request) {
@@ -161,13 +255,8 @@ func (server *Server) DeleteBook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, role, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
-		return
-	}
-	if role != "admin" {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
 
@@ -179,7 +268,11 @@ func (server *Server) DeleteBook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	fmt.Printf("Deleting book with ID: %d\n", book.ID)
-	_, err = book.DeleteABook(server.DB)
+	_, err = book.DeleteABook(server.DB, actorOf(r, principal))
+	if errors.Is(err, models.ErrBookOnLoan) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
 	if err != nil {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
@@ -188,3 +281,36 @@ func (server *Server) DeleteBook(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Entity", fmt.Sprintf("%d", bid))
 	responses.JSON(w, http.StatusNoContent, "")
 }
+
+// RestoreBook brings back a deleted book with its copies.
+func (server *Server) RestoreBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	bid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	book, err := models.RestoreBook(server.DB, bid, actorOf(r, principal))
+	if errors.Is(err, models.ErrBookNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("Book not found"))
+		return
+	}
+	if errors.Is(err, models.ErrBookNotDeleted) || errors.Is(err, models.ErrDuplicateIsbn) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Restored book with ID: %d\n", book.ID)
+
+	responses.JSON(w, http.StatusOK, views.NewBook(book))
+}
@@ -6,10 +6,11 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
-	"github.com/brianhumphreys/library_app/api/auth"
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/views"
 	"github.com/gorilla/mux"
 )
 
@@ -26,53 +27,91 @@ func (s *Server) CheckoutABook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check that the user has the correct ID
-	tokenID, _, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
-	if tokenID != uint32(checkout.UserId) {
+	if principal.UserID != uint(checkout.UserId) {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
 		return
 	}
-
-	// check that book exists
-	book, err := models.FindBookByID(s.DB, checkout.BookId)
+	verified, err := models.IsEmailVerified(s.DB, principal.UserID)
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	if len(*book) == 0 {
-		responses.ERROR(w, http.StatusNotFound, errors.New("This book was not found in the library"))
+	if !verified {
+		responses.ERROR(w, http.StatusForbidden, models.ErrEmailNotVerified)
 		return
 	}
 
-	// check user has maxed out the number of books they are allowed to checkout
-	currentlyCheckedOutBooks, err := models.GetCurrentlyCheckedOutBooksOfUserWithID(s.DB, checkout.UserId)
+	// a copy scanned at the desk decides which book is being checked out
+	if checkout.CopyId != 0 {
+		item, err := models.FindCopyByID(s.DB, checkout.CopyId)
+		if err != nil {
+			respondCheckoutError(w, err)
+			return
+		}
+		checkout.BookId = item.BookId
+	}
+
+	// check that book exists
+	book, err := models.FindBookByID(s.DB, checkout.BookId)
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	if len(*currentlyCheckedOutBooks) >= 5 {
-		responses.ERROR(w, http.StatusTooManyRequests, errors.New("You have checked out too many books."))
+	if len(*book) == 0 {
+		responses.ERROR(w, http.StatusNotFound, errors.New("This book was not found in the library"))
 		return
 	}
 
-	// check if the book is already checked out
-	user_ids, err := models.GetCurrentOwnerOfBookWithID(s.DB, checkout.BookId)
+	// loan limits, fines and the due date all come from the circulation policy
+	checkout.DueAt = time.Time{}
+	checkout.ReturnedAt = nil
+	checkout.RenewalCount = 0
+	checkout.CheckedIn = false
+
+	fmt.Printf("Checking out book with ID: %d, by user: %d\n", checkout.BookId, checkout.UserId)
+	// check out the book, this fails with a conflict if someone else already has it
+	err = checkout.MakeACheckout(s.DB, actorOf(r, principal))
 	if err != nil {
-		responses.ERROR(w, http.StatusInternalServerError, err)
-		return
-	}
-	if len(user_ids) > 0 {
-		responses.ERROR(w, http.StatusTeapot, errors.New("Someone has checked this book out"))
+		respondCheckoutError(w, err)
 		return
 	}
+	responses.JSON(w, http.StatusCreated, views.NewCheckout(&checkout))
+}
 
-	fmt.Printf("Checking out book with ID: %d, by user: %d\n", checkout.BookId, checkout.UserId)
-	// check out the book
-	checkout.MakeACheckout(s.DB)
-	responses.JSON(w, http.StatusCreated, checkout)
+func respondCheckoutError(w http.ResponseWriter, err error) {
+	var conflict *models.CheckoutConflictError
+	var denial *models.PolicyDenial
+	switch {
+	case errors.As(err, &denial):
+		responses.JSON(w, http.StatusForbidden, struct {
+			Error   string                `json:"error"`
+			Reasons []models.DenialReason `json:"reasons"`
+		}{
+			Error:   denial.Error(),
+			Reasons: denial.Reasons,
+		})
+	case errors.As(err, &conflict):
+		responses.ERROR(w, http.StatusConflict, conflict)
+	case errors.Is(err, models.ErrBookNotFound):
+		responses.ERROR(w, http.StatusNotFound, errors.New("This book was not found in the library"))
+	case errors.Is(err, models.ErrCheckoutNotFound):
+		responses.ERROR(w, http.StatusNotFound, errors.New("This checkout was not found"))
+	case errors.Is(err, models.ErrCopyNotFound):
+		responses.ERROR(w, http.StatusNotFound, errors.New("This copy was not found in the library"))
+	case errors.Is(err, models.ErrHoldNotFound):
+		responses.ERROR(w, http.StatusNotFound, errors.New("This hold was not found"))
+	case errors.Is(err, models.ErrCheckoutNotOwned), errors.Is(err, models.ErrHoldNotOwned):
+		responses.ERROR(w, http.StatusForbidden, err)
+	case errors.Is(err, models.ErrHoldAlreadyHeld), errors.Is(err, models.ErrHoldOnOwnBook), errors.Is(err, models.ErrHoldBookOnShelf),
+		errors.Is(err, models.ErrHoldNotActive):
+		responses.ERROR(w, http.StatusConflict, err)
+	default:
+		responses.ERROR(w, http.StatusInternalServerError, err)
+	}
 }
 
 func (server *Server) CheckinABook(w http.ResponseWriter, r *http.Request) {
@@ -82,15 +121,15 @@ func (server *Server) CheckinABook(w http.ResponseWriter, r *http.Request) {
 	err := decoder.Decode(&checkin)
 	if err != nil {
 		responses.ERROR(w, http.StatusBadRequest, err)
+		return
 	}
 
 	// check that the user has the correct ID
-	tokenID, _, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
-	if tokenID != uint32(checkin.UserId) {
+	if principal.UserID != uint(checkin.UserId) {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
 		return
 	}
@@ -104,8 +143,65 @@ func (server *Server) CheckinABook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// check in the book
-	checkin.CheckinABook(server.DB)
-	responses.JSON(w, http.StatusAccepted, checkin)
+	err = checkin.CheckinABook(server.DB, actorOf(r, principal))
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusAccepted, views.NewCheckout(&checkin))
+}
+
+func (server *Server) RenewACheckout(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	fmt.Printf("Renewing checkout with ID: %d, by user: %d\n", cid, principal.UserID)
+	checkout, err := models.RenewACheckout(server.DB, cid, principal.UserID, actorOf(r, principal))
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewCheckout(checkout))
+}
+
+func (server *Server) DeclareCheckoutLost(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	fmt.Printf("Declaring checkout with ID: %d lost\n", cid)
+	checkout, err := models.DeclareLost(server.DB, cid, actorOf(r, principal))
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewCheckout(checkout))
+}
+
+func (server *Server) GetOverdueCheckouts(w http.ResponseWriter, r *http.Request) {
+	overdue, err := models.FindOverdueCheckouts(server.DB, time.Now())
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewOverdues(*overdue))
 }
 
 func (server *Server) GetBookCheckoutHistoryOfUserWithID(w http.ResponseWriter, r *http.Request) {
@@ -118,19 +214,23 @@ func (server *Server) GetBookCheckoutHistoryOfUserWithID(w http.ResponseWriter,
 	}
 
 	// check that the user has the correct ID
-	tokenID, _, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
-	if tokenID != uint32(uid) {
+	if principal.UserID != uint(uid) {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
 		return
 	}
 
-	books, err := models.GetBookCheckoutHistoryOfUserWithID(server.DB, uint(uid))
+	page, err := pageRequestFrom(r)
 	if err != nil {
-		responses.ERROR(w, http.StatusInternalServerError, err)
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	books, err := models.GetBookCheckoutHistoryOfUserWithID(server.DB, uint(uid), &page)
+	if err != nil {
+		respondListError(w, err)
 		return
 	}
 	responses.JSON(w, http.StatusOK, books)
@@ -144,10 +244,18 @@ func (server *Server) GetUserCheckoutHistoryOfBookWithID(w http.ResponseWriter,
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
+	if _, ok := principalOf(w, r); !ok {
+		return
+	}
 
-	users, err := models.GetUserCheckoutHistoryOfBookWithID(server.DB, bid)
+	page, err := pageRequestFrom(r)
 	if err != nil {
-		responses.ERROR(w, http.StatusInternalServerError, err)
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	users, err := models.GetUserCheckoutHistoryOfBookWithID(server.DB, bid, &page)
+	if err != nil {
+		respondListError(w, err)
 		return
 	}
 	responses.JSON(w, http.StatusOK, users)
@@ -162,12 +270,11 @@ func (server *Server) GetCurrentlyCheckedOutBooksOfUserWithID(w http.ResponseWri
 	}
 
 	// check that the user has the correct ID
-	tokenID, _, err := auth.ExtractTokenIDAndRole(r)
-	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+	principal, ok := principalOf(w, r)
+	if !ok {
 		return
 	}
-	if tokenID != uint32(uid) {
+	if principal.UserID != uint(uid) {
 		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
 		return
 	}
@@ -177,5 +284,5 @@ func (server *Server) GetCurrentlyCheckedOutBooksOfUserWithID(w http.ResponseWri
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, books)
+	responses.JSON(w, http.StatusOK, views.NewBooks(*books))
 }
@@ -0,0 +1,152 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+	"github.com/brianhumphreys/library_app/api/views"
+	"github.com/gorilla/mux"
+)
+
+func (server *Server) CreateCopy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	book, err := models.FindBookByID(server.DB, bid)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(*book) == 0 {
+		responses.ERROR(w, http.StatusNotFound, errors.New("This book was not found in the library"))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	item := models.BookCopy{}
+	err = json.Unmarshal(body, &item)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	item.BookId = bid
+	item.Prepare()
+	err = item.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	itemCreated, err := item.SaveCopy(server.DB, actorOf(r, principal))
+	if err != nil {
+		formattedError := formaterror.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	fmt.Printf("Added copy %s of book with ID: %d\n", itemCreated.Barcode, bid)
+
+	w.Header().Set("Location", fmt.Sprintf("%s/api/v1/copies/%d", r.Host, itemCreated.ID))
+	responses.JSON(w, http.StatusCreated, views.NewCopy(itemCreated))
+}
+
+func (server *Server) GetCopiesOfBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	copies, err := models.FindCopiesOfBookWithID(server.DB, bid)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewCopies(*copies))
+}
+
+func (server *Server) UpdateCopy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	cid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	item, err := models.FindCopyByID(server.DB, cid)
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	itemUpdate := models.BookCopy{}
+	err = json.Unmarshal(body, &itemUpdate)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	itemUpdate.Prepare()
+	// leaving the status out keeps whatever circulation status the copy has
+	if itemUpdate.Status == "" {
+		itemUpdate.Status = item.Status
+	} else if err = itemUpdate.Validate(); err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if itemUpdate.ItemType == "" {
+		itemUpdate.ItemType = item.ItemType
+	}
+	if itemUpdate.Barcode == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Barcode"))
+		return
+	}
+
+	itemUpdate.ID = item.ID
+	itemUpdate.BookId = item.BookId
+	itemUpdated, err := itemUpdate.UpdateACopy(server.DB, actorOf(r, principal))
+	if err != nil {
+		var conflict *models.CheckoutConflictError
+		if errors.As(err, &conflict) {
+			respondCheckoutError(w, err)
+			return
+		}
+		formattedError := formaterror.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+
+	fmt.Printf("Updated copy with ID: %d\n", itemUpdated.ID)
+	responses.JSON(w, http.StatusOK, views.NewCopy(itemUpdated))
+}
@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/views"
+	"github.com/gorilla/mux"
+)
+
+func (server *Server) CreateHold(w http.ResponseWriter, r *http.Request) {
+
+	var hold models.Hold
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&hold)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// check that the user has the correct ID
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	if principal.UserID != uint(hold.UserId) {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+		return
+	}
+
+	hold.Status = ""
+	hold.CopyId = nil
+	hold.ReadyAt = nil
+	hold.ExpiresAt = nil
+
+	fmt.Printf("Placing hold on book with ID: %d, by user: %d\n", hold.BookId, hold.UserId)
+	err = hold.PlaceAHold(server.DB, actorOf(r, principal))
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusCreated, views.NewHold(&hold))
+}
+
+func (server *Server) GetHoldsOfUserWithID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// check that the user has the correct ID
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	if principal.UserID != uint(uid) {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+		return
+	}
+
+	holds, err := models.FindActiveHoldsOfUserWithID(server.DB, uint(uid))
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewHolds(*holds))
+}
+
+func (server *Server) GetHoldQueueOfBookWithID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	bid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	holds, err := models.FindHoldQueueOfBookWithID(server.DB, bid)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewHolds(*holds))
+}
+
+func (server *Server) CancelHold(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	hid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	hold, err := models.FindHoldByID(server.DB, hid)
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+	if principal.UserID != uint(hold.UserId) && !server.can(principal, models.PermHoldsManage) {
+		respondCheckoutError(w, models.ErrHoldNotOwned)
+		return
+	}
+
+	fmt.Printf("Cancelling hold with ID: %d\n", hold.ID)
+	err = hold.CancelAHold(server.DB, actorOf(r, principal))
+	if err != nil {
+		respondCheckoutError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewHold(hold))
+}
@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/brianhumphreys/library_app/api/metadata"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+	"github.com/brianhumphreys/library_app/api/utils/isbn"
+	"github.com/brianhumphreys/library_app/api/views"
+)
+
+type importRequest struct {
+	Isbn string `json:"isbn"`
+	Save bool   `json:"save"`
+	// Description is used when the provider has none for the book.
+	Description string `json:"description"`
+}
+
+func bookFromRecord(record *metadata.Record) models.Book {
+	return models.Book{
+		Title:           record.Title,
+		Author:          record.Author,
+		Isbn:            record.Isbn,
+		Description:     record.Description,
+		Publisher:       record.Publisher,
+		PublicationYear: record.PublicationYear,
+		Subjects:        models.StringList(record.Subjects),
+		CoverUrl:        record.CoverUrl,
+	}
+}
+
+// ImportBook fills in a book from the metadata provider. Without "save" it
+// only returns the preview so staff can check it first.
+func (server *Server) ImportBook(w http.ResponseWriter, r *http.Request) {
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	request := importRequest{}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	number, err := isbn.Normalize(request.Isbn)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	record, err := server.Metadata.LookupIsbn(r.Context(), number)
+	if errors.Is(err, metadata.ErrNotFound) {
+		responses.ERROR(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Metadata lookup for %s failed: %v\n", number, err)
+		responses.ERROR(w, http.StatusBadGateway, errors.New("The metadata service could not be reached"))
+		return
+	}
+
+	book := bookFromRecord(record)
+	book.Isbn = number
+	if book.Description == "" {
+		book.Description = request.Description
+	}
+	book.Prepare()
+	if !request.Save {
+		responses.JSON(w, http.StatusOK, views.NewBook(&book))
+		return
+	}
+
+	err = book.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	bookCreated, err := book.CreateBookAs(server.DB, actorOf(r, principal))
+	if errors.Is(err, models.ErrDuplicateIsbn) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		formattedError := formaterror.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	fmt.Printf("Imported book with ID: %d\n", bookCreated.ID)
+
+	w.Header().Set("Location", fmt.Sprintf("%s/api/v1/books/%d", r.Host, bookCreated.ID))
+	responses.JSON(w, http.StatusCreated, views.NewBook(bookCreated))
+}
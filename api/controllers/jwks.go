@@ -0,0 +1,19 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/responses"
+)
+
+// GetJWKS publishes the public keys tokens are signed with, so other
+// services can check them without knowing any secret.
+func (server *Server) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	set := auth.JWKS{Keys: []auth.JWK{}}
+	if server.Keys != nil {
+		set = server.Keys.JWKS()
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	responses.JSON(w, http.StatusOK, set)
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/models"
+	"gorm.io/gorm"
+)
+
+// DatabaseKeyStore keeps the signing keys in the signing_keys table, which
+// every instance of the server shares.
+type DatabaseKeyStore struct {
+	DB *gorm.DB
+}
+
+func (d DatabaseKeyStore) ListKeys() ([]auth.StoredKey, error) {
+	keys, err := models.FindSigningKeys(d.DB)
+	if err != nil {
+		return nil, err
+	}
+	stored := []auth.StoredKey{}
+	for _, key := range keys {
+		stored = append(stored, auth.StoredKey{ID: key.ID, PEM: []byte(key.Pem), Created: key.CreatedAt})
+	}
+	return stored, nil
+}
+
+func (d DatabaseKeyStore) AddKey(key auth.StoredKey) error {
+	row := models.SigningKey{ID: key.ID, Pem: string(key.PEM), CreatedAt: key.Created}
+	return row.SaveSigningKey(d.DB)
+}
+
+func (d DatabaseKeyStore) RemoveKey(id string) error {
+	return models.DeleteSigningKey(d.DB, id)
+}
+
+func (d DatabaseKeyStore) Locked(fn func(store auth.KeyStore) error) error {
+	return models.WithSigningKeyLock(d.DB, func(tx *gorm.DB) error {
+		return fn(DatabaseKeyStore{DB: tx})
+	})
+}
@@ -2,15 +2,22 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/brianhumphreys/library_app/api/auth"
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/brianhumphreys/library_app/api/responses"
-	"github.com/brianhumphreys/library_app/api/utils/formaterror"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 func (server *Server) Login(w http.ResponseWriter, r *http.Request) {
@@ -35,33 +42,213 @@ func (server *Server) Login(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("Loggin in user: %d\n", user.ID)
 
+	ip := clientIP(r)
+	attempt, err := models.ReserveLoginAttempt(server.DB, user.Email, ip)
+	if err != nil {
+		respondLoginError(w, err)
+		return
+	}
 	signedUser, token, err := server.SignIn(user.Email, user.Password)
+	finishErr := finishLoginAttempt(server.DB, attempt, err, models.ErrInvalidCredentials)
+	if finishErr != nil {
+		err = finishErr
+	}
+	if err != nil {
+		respondLoginError(w, err)
+		return
+	}
+	refreshToken, err := models.IssueRefreshToken(server.DB, signedUser.ID)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, sessionResponse(signedUser, token, refreshToken))
+}
+
+func sessionResponse(user *models.User, token, refreshToken string) map[string]interface{} {
+	return map[string]interface{}{
+		"token":         token,
+		"refresh_token": refreshToken,
+		"email":         user.Email,
+		"role":          user.Role,
+		"id":            user.ID,
+	}
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func readRefreshRequest(r *http.Request) (refreshRequest, error) {
+	request := refreshRequest{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return request, err
+	}
+	if len(body) == 0 {
+		return request, nil
+	}
+	err = json.Unmarshal(body, &request)
+	return request, err
+}
+
+// RefreshToken trades a refresh token for a new access token. The refresh
+// token is spent and a new one is returned in its place.
+func (server *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	request, err := readRefreshRequest(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.RefreshToken == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Refresh Token"))
+		return
+	}
+
+	user, refreshToken, err := models.RotateRefreshToken(server.DB, request.RefreshToken)
+	if errors.Is(err, models.ErrInvalidRefreshToken) {
+		responses.ERROR(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	token, err := auth.CreateToken(*user)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, sessionResponse(user, token, refreshToken))
+}
+
+// Logout revokes the access token the request was made with, along with the
+// refresh token in the body if there is one.
+func (server *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	request, err := readRefreshRequest(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err = models.RevokeToken(server.DB, principal.TokenID, principal.UserID, principal.ExpiresAt)
 	if err != nil {
-		formattedError := formaterror.FormatError(err.Error())
-		responses.ERROR(w, http.StatusUnprocessableEntity, formattedError)
+		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, map[string]interface{}{
-		"token": token,
-		"email": signedUser.Email,
-		"role":  signedUser.Role,
-		"id":    signedUser.ID,
-	})
+	if request.RefreshToken != "" {
+		err = models.RevokeRefreshToken(server.DB, request.RefreshToken)
+		if err != nil {
+			responses.ERROR(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// finishLoginAttempt settles a reserved attempt by how checking the
+// password went, wrong being the error a bad password gives.
+func finishLoginAttempt(db *gorm.DB, attempt *models.LoginAttempt, err, wrong error) error {
+	switch {
+	case err == nil:
+		return attempt.Succeed(db)
+	case errors.Is(err, wrong):
+		return attempt.Fail(db)
+	}
+	return attempt.Abandon(db)
+}
+
+func respondLoginError(w http.ResponseWriter, err error) {
+	var locked *models.LoginLockedError
+	switch {
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+		responses.ERROR(w, http.StatusTooManyRequests, locked)
+	case errors.Is(err, models.ErrInvalidCredentials):
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+	default:
+		responses.ERROR(w, http.StatusInternalServerError, err)
+	}
 }
 
+// clientIP is the address a request came from. Behind a proxy that appends
+// the client to X-Forwarded-For, such as the Heroku router, set
+// TRUST_PROXY_HEADERS so the proxy's own address is not used instead.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY_HEADERS") == "true" {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		last := strings.TrimSpace(forwarded[len(forwarded)-1])
+		if net.ParseIP(last) != nil {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     []byte
+)
+
+// SignIn checks the password and returns a token. Unknown emails and wrong
+// passwords fail the same way and take as long, so neither tells whether
+// an account exists. Throttling is up to the caller.
 func (server *Server) SignIn(email, password string) (*models.User, string, error) {
 	var err error
 
 	user := models.User{}
 
 	err = server.DB.Model(models.User{}).Where("email = ?", email).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = models.Hash("not a real password")
+		})
+		models.VerifyPassword(string(dummyHash), password)
+		return &models.User{}, "", models.ErrInvalidCredentials
+	}
 	if err != nil {
 		return &models.User{}, "", err
 	}
 	err = models.VerifyPassword(user.Password, password)
-	if err != nil && err == bcrypt.ErrMismatchedHashAndPassword {
-		return &models.User{}, "", err
+	if err != nil {
+		return &models.User{}, "", models.ErrInvalidCredentials
 	}
 	token, err := auth.CreateToken(user)
 	return &user, token, err
 }
+
+// UnlockUser lets someone locked out after failed logins try again
+// straight away.
+func (server *Server) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := models.UnlockUser(server.DB, uint(uid), actorOf(r, principal))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Unlocked logins of user: %d\n", user.ID)
+	w.Header().Set("Entity", fmt.Sprintf("%d", uid))
+	responses.JSON(w, http.StatusNoContent, "")
+}
@@ -0,0 +1,187 @@
+package controllers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/brianhumphreys/library_app/api/marc"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+)
+
+const (
+	maxMarcUpload   = 32 << 20
+	exportBatchSize = 200
+)
+
+type marcImportResult struct {
+	Record int    `json:"record"`
+	Isbn   string `json:"isbn,omitempty"`
+	Title  string `json:"title,omitempty"`
+	BookId uint   `json:"book_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type marcImportReport struct {
+	Imported int                `json:"imported"`
+	Failed   int                `json:"failed"`
+	Results  []marcImportResult `json:"results"`
+}
+
+// trimISBD drops the punctuation cataloguers put between MARC subfields.
+func trimISBD(s string, cutset string) string {
+	return strings.TrimSpace(strings.TrimRight(strings.TrimSpace(s), cutset))
+}
+
+func bookFromMarc(rec *marc.Record) models.Book {
+	number := strings.TrimSpace(rec.Subfield("020", "a"))
+	// 020 $a often carries a qualifier such as "(pbk.)"
+	if i := strings.IndexAny(number, " ("); i > 0 {
+		number = number[:i]
+	}
+	title := trimISBD(rec.Subfield("245", "a"), " /:;,=.")
+	if subtitle := trimISBD(rec.Subfield("245", "b"), " /:;,=."); subtitle != "" {
+		title = title + ": " + subtitle
+	}
+	return models.Book{
+		Title:       title,
+		Author:      trimISBD(rec.Subfield("100", "a"), " ,;:/"),
+		Isbn:        number,
+		Description: strings.TrimSpace(rec.Subfield("520", "a")),
+	}
+}
+
+func marcFromBook(book *models.Book) *marc.Record {
+	rec := marc.Record{Leader: marc.DefaultLeader}
+	rec.AddControlField("001", strconv.FormatUint(uint64(book.ID), 10))
+	rec.AddControlField("005", book.UpdatedAt.UTC().Format("20060102150405.0"))
+	rec.AddDataField("020", " ", " ", marc.Subfield{Code: "a", Value: book.Isbn})
+	rec.AddDataField("100", "1", " ", marc.Subfield{Code: "a", Value: html.UnescapeString(book.Author)})
+	rec.AddDataField("245", "1", "0", marc.Subfield{Code: "a", Value: html.UnescapeString(book.Title)})
+	rec.AddDataField("520", " ", " ", marc.Subfield{Code: "a", Value: html.UnescapeString(book.Description)})
+	return &rec
+}
+
+// marcReaderFor picks the binary or XML reader from ?format=, then the
+// content type, then by looking at the first byte of the upload.
+func marcReaderFor(r *http.Request, body *bufio.Reader) (marc.RecordReader, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		if strings.Contains(r.Header.Get("Content-Type"), "xml") {
+			format = "marcxml"
+		} else {
+			format = "marc"
+			head, _ := body.Peek(64)
+			if bytes.HasPrefix(bytes.TrimSpace(head), []byte("<")) {
+				format = "marcxml"
+			}
+		}
+	}
+	switch format {
+	case "marc":
+		return marc.NewReader(body), nil
+	case "marcxml":
+		return marc.NewXMLReader(body), nil
+	}
+	return nil, errors.New("format must be 'marc' or 'marcxml'")
+}
+
+func (server *Server) ImportMarcBooks(w http.ResponseWriter, r *http.Request) {
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	reader, err := marcReaderFor(r, bufio.NewReader(http.MaxBytesReader(w, r.Body, maxMarcUpload)))
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	actor := actorOf(r, principal)
+	report := marcImportReport{Results: []marcImportResult{}}
+	for i := 1; ; i++ {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		result := marcImportResult{Record: i}
+		if err == nil {
+			book := bookFromMarc(rec)
+			result.Isbn, result.Title = book.Isbn, book.Title
+			book.Prepare()
+			err = book.Validate()
+			if err == nil {
+				_, err = book.CreateBookAs(server.DB, actor)
+			}
+			result.BookId = book.ID
+		}
+		if err != nil {
+			result.Error = err.Error()
+			result.BookId = 0
+			report.Failed++
+		} else {
+			report.Imported++
+		}
+		report.Results = append(report.Results, result)
+	}
+	fmt.Printf("Imported %d MARC records, %d failed\n", report.Imported, report.Failed)
+	responses.JSON(w, http.StatusOK, report)
+}
+
+// ErrExportFormat is returned by ExportCatalog for a format it cannot write.
+var ErrExportFormat = errors.New("format must be 'marc' or 'marcxml'")
+
+// ExportBooks streams the whole catalog as MARCXML, or MARC21 binary with
+// ?format=marc.
+func (server *Server) ExportBooks(w http.ResponseWriter, r *http.Request) {
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "marcxml":
+		w.Header().Set("Content-Type", "application/marcxml+xml; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.xml"`)
+	case "marc":
+		w.Header().Set("Content-Type", "application/marc")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.mrc"`)
+	default:
+		responses.ERROR(w, http.StatusBadRequest, ErrExportFormat)
+		return
+	}
+
+	// the status is already sent once streaming starts, so later errors
+	// can only cut the export short
+	err := server.ExportCatalog(w, format)
+	if err != nil {
+		fmt.Printf("MARC export stopped: %v\n", err)
+	}
+}
+
+// ExportCatalog writes every book to w as "marcxml", the default, or
+// "marc" for MARC21 binary.
+func (server *Server) ExportCatalog(w io.Writer, format string) error {
+	var writer marc.RecordWriter
+	switch format {
+	case "", "marcxml":
+		writer = marc.NewXMLWriter(w)
+	case "marc":
+		writer = marc.NewWriter(w)
+	default:
+		return ErrExportFormat
+	}
+	err := models.EachBook(server.DB, exportBatchSize, func(book *models.Book) error {
+		return writer.Write(marcFromBook(book))
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
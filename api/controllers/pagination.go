@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+)
+
+// pageRequestFrom reads ?limit=&cursor=&sort= shared by every list endpoint.
+func pageRequestFrom(r *http.Request) (models.PageRequest, error) {
+	params := r.URL.Query()
+	page := models.PageRequest{
+		Cursor: params.Get("cursor"),
+		Sort:   params.Get("sort"),
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil {
+			return page, errors.New("limit must be a number")
+		}
+		page.Limit = limit
+	}
+	return page, nil
+}
+
+func respondListError(w http.ResponseWriter, err error) {
+	if errors.Is(err, models.ErrInvalidCursor) || errors.Is(err, models.ErrInvalidSort) {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	responses.ERROR(w, http.StatusInternalServerError, err)
+}
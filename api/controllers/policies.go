@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+	"github.com/brianhumphreys/library_app/api/views"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+func readPolicy(w http.ResponseWriter, r *http.Request) (*models.CirculationPolicy, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return nil, false
+	}
+	policy := models.CirculationPolicy{}
+	err = json.Unmarshal(body, &policy)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return nil, false
+	}
+	policy.Prepare()
+	err = policy.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return nil, false
+	}
+	return &policy, true
+}
+
+func (server *Server) CreatePolicy(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	policy, ok := readPolicy(w, r)
+	if !ok {
+		return
+	}
+
+	policyCreated, err := policy.SavePolicy(server.DB, actorOf(r, principal))
+	if err != nil {
+		formattedError := formaterror.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	fmt.Printf("Created policy for %s borrowing %s\n", policyCreated.PatronType, policyCreated.ItemType)
+
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", r.Host, r.URL.Path, policyCreated.ID))
+	responses.JSON(w, http.StatusCreated, policyCreated)
+}
+
+func (server *Server) GetPolicies(w http.ResponseWriter, r *http.Request) {
+	policies, err := models.FindAllPolicies(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, map[string]interface{}{
+		"policies": policies,
+		"default":  models.DefaultPolicy(),
+	})
+}
+
+func (server *Server) GetPolicy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	policy, err := models.FindPolicyByID(server.DB, pid)
+	if errors.Is(err, models.ErrPolicyNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("This policy was not found"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, policy)
+}
+
+func (server *Server) UpdatePolicy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	_, err = models.FindPolicyByID(server.DB, pid)
+	if errors.Is(err, models.ErrPolicyNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("This policy was not found"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	policy, ok := readPolicy(w, r)
+	if !ok {
+		return
+	}
+	policy.ID = uint(pid)
+	policyUpdated, err := policy.UpdateAPolicy(server.DB, actorOf(r, principal))
+	if err != nil {
+		formattedError := formaterror.FormatError(err.Error())
+		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		return
+	}
+	fmt.Printf("Updated policy with ID: %d\n", policyUpdated.ID)
+	responses.JSON(w, http.StatusOK, policyUpdated)
+}
+
+func (server *Server) DeletePolicy(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	pid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	policy, err := models.FindPolicyByID(server.DB, pid)
+	if errors.Is(err, models.ErrPolicyNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("This policy was not found"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	fmt.Printf("Deleting policy with ID: %d\n", policy.ID)
+	_, err = policy.DeleteAPolicy(server.DB, actorOf(r, principal))
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Entity", fmt.Sprintf("%d", pid))
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+func (server *Server) UpdatePatronType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user := models.User{}
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user.Prepare()
+	if user.PatronType == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Patron Type"))
+		return
+	}
+
+	updatedUser, err := user.UpdatePatronType(server.DB, uint(uid), actorOf(r, principal))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewAdminUser(updatedUser))
+}
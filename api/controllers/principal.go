@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+)
+
+// principalOf returns who is making the request, writing a 401 when nobody
+// is signed in. Routes behind the authentication middleware already carry
+// the principal. Any other route has its token checked here, so a route
+// that forgets the middleware still cannot be used anonymously.
+func principalOf(w http.ResponseWriter, r *http.Request) (*auth.Principal, bool) {
+	if principal, ok := auth.PrincipalFrom(r.Context()); ok {
+		return principal, true
+	}
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return nil, false
+	}
+	return principal, true
+}
+
+// optionalPrincipal is for routes open to everyone that show more to those
+// signed in. Anonymous requests and bad tokens get nil.
+func optionalPrincipal(r *http.Request) *auth.Principal {
+	if principal, ok := auth.PrincipalFrom(r.Context()); ok {
+		return principal
+	}
+	if auth.ExtractToken(r) == "" {
+		return nil
+	}
+	principal, err := auth.Authenticate(r)
+	if err != nil {
+		return nil
+	}
+	return principal
+}
+
+// requirePermission checks that the principal's role grants the permission,
+// writing the error response itself when it does not. It is for routes
+// that are not behind middlewares.RequirePermission, which checks it once
+// for the rest.
+func (server *Server) requirePermission(w http.ResponseWriter, r *http.Request, permission string) (*auth.Principal, bool) {
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return nil, false
+	}
+	allowed, err := models.RoleHasPermission(server.DB, principal.Role, permission)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	if !allowed {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+		return nil, false
+	}
+	return principal, true
+}
+
+// can is for handlers that let owners through without the permission. A
+// failed lookup counts as not allowed.
+func (server *Server) can(principal *auth.Principal, permission string) bool {
+	allowed, err := models.RoleHasPermission(server.DB, principal.Role, permission)
+	if err != nil {
+		fmt.Printf("Could not check %s for role %s: %v\n", permission, principal.Role, err)
+		return false
+	}
+	return allowed
+}
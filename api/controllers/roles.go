@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/views"
+	"github.com/gorilla/mux"
+	"gorm.io/gorm"
+)
+
+func respondRoleError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, models.ErrRoleNotFound):
+		responses.ERROR(w, http.StatusNotFound, err)
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+	case errors.Is(err, models.ErrRoleExists), errors.Is(err, models.ErrRoleInUse), errors.Is(err, models.ErrRoleBuiltIn),
+		errors.Is(err, models.ErrAdminRoleFixed), errors.Is(err, models.ErrLastAdmin):
+		responses.ERROR(w, http.StatusConflict, err)
+	case errors.Is(err, models.ErrAdminOnly):
+		responses.ERROR(w, http.StatusForbidden, err)
+	default:
+		responses.ERROR(w, http.StatusInternalServerError, err)
+	}
+}
+
+func readRole(w http.ResponseWriter, r *http.Request) (*models.Role, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return nil, false
+	}
+	role := models.Role{}
+	err = json.Unmarshal(body, &role)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return nil, false
+	}
+	role.Prepare()
+	err = role.Validate()
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return nil, false
+	}
+	return &role, true
+}
+
+func (server *Server) GetPermissions(w http.ResponseWriter, r *http.Request) {
+	responses.JSON(w, http.StatusOK, models.Permissions)
+}
+
+func (server *Server) CreateRole(w http.ResponseWriter, r *http.Request) {
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	role, ok := readRole(w, r)
+	if !ok {
+		return
+	}
+
+	roleCreated, err := role.SaveRole(server.DB, actorOf(r, principal))
+	if err != nil {
+		respondRoleError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", r.Host, r.RequestURI, roleCreated.ID))
+	responses.JSON(w, http.StatusCreated, roleCreated)
+}
+
+func (server *Server) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles, err := models.FindAllRoles(server.DB)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, roles)
+}
+
+func (server *Server) GetRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	rid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	role, err := models.FindRoleByID(server.DB, rid)
+	if err != nil {
+		respondRoleError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, role)
+}
+
+func (server *Server) UpdateRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	rid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+	role, ok := readRole(w, r)
+	if !ok {
+		return
+	}
+
+	role.ID = uint(rid)
+	roleUpdated, err := role.UpdateARole(server.DB, actorOf(r, principal))
+	if err != nil {
+		respondRoleError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, roleUpdated)
+}
+
+func (server *Server) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	rid, err := strconv.ParseUint(vars["id"], 10, 64)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	role, err := models.FindRoleByID(server.DB, rid)
+	if err != nil {
+		respondRoleError(w, err)
+		return
+	}
+	fmt.Printf("Deleting role: %s\n", role.Name)
+	_, err = role.DeleteARole(server.DB, actorOf(r, principal))
+	if err != nil {
+		respondRoleError(w, err)
+		return
+	}
+	w.Header().Set("Entity", fmt.Sprintf("%d", rid))
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+// UpdateUserRole gives a user another role. Their tokens carry the old
+// role, so they are revoked and the user has to log in again.
+func (server *Server) UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user := models.User{}
+	err = json.Unmarshal(body, &user)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	user.Prepare()
+	if user.Role == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Role"))
+		return
+	}
+
+	updatedUser, err := user.UpdateRole(server.DB, uint(uid), actorOf(r, principal))
+	if err != nil {
+		respondRoleError(w, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, views.NewAdminUser(updatedUser))
+}
@@ -1,26 +1,82 @@
 package controllers
 
-import "github.com/brianhumphreys/library_app/api/middlewares"
+import (
+	"github.com/brianhumphreys/library_app/api/middlewares"
+	"github.com/brianhumphreys/library_app/api/models"
+)
 
 func (s *Server) initializeRoutes() {
 
+	s.Router.Use(middlewares.RequestID)
+
+	s.Router.HandleFunc("/.well-known/jwks.json", middlewares.CORS(middlewares.SetMiddlewareJSON(s.GetJWKS))).Methods("GET", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/login", middlewares.CORS(middlewares.SetMiddlewareJSON(s.Login))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/token/refresh", middlewares.CORS(middlewares.SetMiddlewareJSON(s.RefreshToken))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/logout", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.Logout)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/password/forgot", middlewares.CORS(middlewares.SetMiddlewareJSON(s.ForgotPassword))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/password/reset", middlewares.CORS(middlewares.SetMiddlewareJSON(s.ResetPassword))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/verify", middlewares.CORS(middlewares.SetMiddlewareJSON(s.VerifyEmail))).Methods("GET", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/signup", middlewares.CORS(middlewares.SetMiddlewareJSON(s.CreateUser))).Methods("POST", "OPTIONS")
 
 	s.Router.HandleFunc("/api/v1/users", middlewares.SetMiddlewareJSON(s.GetUsers)).Methods("GET")
+	s.Router.HandleFunc("/api/v1/admin/audit", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermAuditRead, s.GetAuditLog)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/admin/audit/verify", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermAuditRead, s.VerifyAuditLog)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/admin/users", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.CreateAdminUser)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/import/csv", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermUsersWrite, s.UploadUsers)))).Methods("POST", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/users/{id}", middlewares.SetMiddlewareJSON(s.GetUser)).Methods("GET")
 	s.Router.HandleFunc("/api/v1/users/{id}", middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.UpdateUser))).Methods("PUT")
+	s.Router.HandleFunc("/api/v1/users/{id}/profile", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.UpdateProfile)))).Methods("PATCH", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/password", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.ChangePassword)))).Methods("POST", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/users/{id}", middlewares.SetMiddlewareAuthentication(s.DeleteUser)).Methods("DELETE")
+	s.Router.HandleFunc("/api/v1/users/{id}/restore", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermUsersWrite, s.RestoreUser)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/purge", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermUsersPurge, s.PurgeUser)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/patron-type", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermUsersWrite, s.UpdatePatronType)))).Methods("PUT", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/unlock", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermLoginsManage, s.UnlockUser)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/role", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.UpdateUserRole)))).Methods("PUT", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/account", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.GetAccount)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/payments", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermAccountsManage, s.CreatePayment)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/users/{id}/waivers", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermAccountsManage, s.CreateWaiver)))).Methods("POST", "OPTIONS")
 
-	s.Router.HandleFunc("/api/v1/books", middlewares.CORS(middlewares.SetMiddlewareJSON(s.CreateBook))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.CreateBook)))).Methods("POST", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/books", middlewares.CORS(middlewares.SetMiddlewareJSON(s.GetBooks))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/import", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.ImportBook)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/import/marc", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.ImportMarcBooks)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/import/csv", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.UploadBooks)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/export", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksExport, s.ExportBooks)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/isbn/{isbn}", middlewares.CORS(middlewares.SetMiddlewareJSON(s.GetBookByIsbn))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/search", middlewares.CORS(middlewares.SetMiddlewareJSON(s.SearchBooks))).Methods("GET", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/books/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(s.GetBook))).Methods("GET", "OPTIONS")
-	s.Router.HandleFunc("/api/v1/books/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(s.UpdateBook))).Methods("PUT", "OPTIONS")
-	s.Router.HandleFunc("/api/v1/books/{id}", middlewares.CORS(s.DeleteBook)).Methods("DELETE", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.UpdateBook)))).Methods("PUT", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/{id}", middlewares.CORS(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.DeleteBook))).Methods("DELETE", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/{id}/restore", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.RestoreBook)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/{id}/copies", middlewares.CORS(middlewares.SetMiddlewareJSON(s.GetCopiesOfBook))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/books/{id}/copies", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.CreateCopy)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/copies/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermBooksWrite, s.UpdateCopy)))).Methods("PUT", "OPTIONS")
 
 	s.Router.HandleFunc("/api/v1/checkouts/current-books/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.GetCurrentlyCheckedOutBooksOfUserWithID)))).Methods("GET", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/checkouts/all-books/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.GetBookCheckoutHistoryOfUserWithID)))).Methods("GET", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/checkouts/all-users/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.GetUserCheckoutHistoryOfBookWithID)))).Methods("GET", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/checkouts/checkout", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.CheckoutABook)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/checkouts/overdue", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermCheckoutsRead, s.GetOverdueCheckouts)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/checkouts/{id}/renew", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.RenewACheckout)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/checkouts/{id}/lost", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermCheckoutsOverride, s.DeclareCheckoutLost)))).Methods("POST", "OPTIONS")
 	s.Router.HandleFunc("/api/v1/checkouts/checkin", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.CheckinABook)))).Methods("POST", "OPTIONS")
+
+	s.Router.HandleFunc("/api/v1/holds", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.CreateHold)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/holds/user/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.GetHoldsOfUserWithID)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/holds/book/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermHoldsManage, s.GetHoldQueueOfBookWithID)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/holds/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(s.CancelHold)))).Methods("DELETE", "OPTIONS")
+
+	s.Router.HandleFunc("/api/v1/policies", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermPoliciesWrite, s.GetPolicies)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/policies", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermPoliciesWrite, s.CreatePolicy)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/policies/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermPoliciesWrite, s.GetPolicy)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/policies/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermPoliciesWrite, s.UpdatePolicy)))).Methods("PUT", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/policies/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermPoliciesWrite, s.DeletePolicy)))).Methods("DELETE", "OPTIONS")
+
+	s.Router.HandleFunc("/api/v1/permissions", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.GetPermissions)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/roles", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.GetRoles)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/roles", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.CreateRole)))).Methods("POST", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/roles/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.GetRole)))).Methods("GET", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/roles/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.UpdateRole)))).Methods("PUT", "OPTIONS")
+	s.Router.HandleFunc("/api/v1/roles/{id}", middlewares.CORS(middlewares.SetMiddlewareJSON(middlewares.RequirePermission(s.DB, models.PermRolesManage, s.DeleteRole)))).Methods("DELETE", "OPTIONS")
 }
@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+)
+
+const maxCsvUpload = 10 << 20
+
+// CsvRowError is a row of a CSV import that was not saved.
+type CsvRowError struct {
+	Row   int    `json:"row"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// CsvReport tells how a CSV import went, row by row.
+type CsvReport struct {
+	DryRun  bool          `json:"dry_run"`
+	Rows    int           `json:"rows"`
+	Valid   int           `json:"valid"`
+	Invalid int           `json:"invalid"`
+	Created int           `json:"created"`
+	Errors  []CsvRowError `json:"errors"`
+}
+
+type csvUpload struct {
+	columns map[string]int
+	rows    [][]string
+}
+
+// get returns a cell by its column name, or "" when the file has no such
+// column or the row is short.
+func (u *csvUpload) get(row []string, column string) string {
+	i, ok := u.columns[column]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return row[i]
+}
+
+// line is the row number a spreadsheet would show, counting the header.
+func (u *csvUpload) line(i int) int {
+	return i + 2
+}
+
+// readCsvUpload reads the "file" part of a multipart form.
+func readCsvUpload(w http.ResponseWriter, r *http.Request, required ...string) (*csvUpload, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCsvUpload)
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, errors.New("Upload a CSV file in the 'file' field")
+	}
+	defer file.Close()
+	return readCsv(file, required...)
+}
+
+// readCsv reads a whole CSV file. The first row names the columns and must
+// include every required column.
+func readCsv(file io.Reader, required ...string) (*csvUpload, error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("The CSV file is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	upload := csvUpload{columns: map[string]int{}}
+	for i, name := range header {
+		// spreadsheets often save a byte order mark before the first column
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		upload.columns[name] = i
+	}
+	for _, name := range required {
+		if _, ok := upload.columns[name]; !ok {
+			return nil, fmt.Errorf("The CSV file has no '%s' column", name)
+		}
+	}
+	upload.rows, err = reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+func uploadDryRun(r *http.Request) (bool, error) {
+	value := r.FormValue("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("dry_run must be 'true' or 'false'")
+	}
+	return dryRun, nil
+}
+
+func splitCsvList(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	return strings.Split(value, ";")
+}
+
+// finish puts the row errors in file order and counts them.
+func (report *CsvReport) finish() {
+	sort.SliceStable(report.Errors, func(i, j int) bool {
+		return report.Errors[i].Row < report.Errors[j].Row
+	})
+	report.Invalid = len(report.Errors)
+}
+
+// respondUploadReport sends the report as JSON, or with ?report=csv just the
+// row errors as a CSV file staff can fix and upload again.
+func respondUploadReport(w http.ResponseWriter, r *http.Request, name string, report CsvReport) {
+	report.finish()
+	if r.URL.Query().Get("report") != "csv" {
+		responses.JSON(w, http.StatusOK, report)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-errors.csv"`, name))
+	w.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"row", "key", "error"})
+	for _, rowError := range report.Errors {
+		writer.Write([]string{strconv.Itoa(rowError.Row), rowError.Key, rowError.Error})
+	}
+	writer.Flush()
+}
+
+// UploadBooks adds every valid row of a CSV file of books. Rows that fail
+// validation are reported and skipped, and the rest are saved together.
+func (server *Server) UploadBooks(w http.ResponseWriter, r *http.Request) {
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	upload, err := readCsvUpload(w, r, bookCsvColumns...)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	dryRun, err := uploadDryRun(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	report, err := server.importBooks(upload, dryRun, actorOf(r, principal))
+	if errors.Is(err, models.ErrDuplicateIsbn) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Uploaded %d book rows, %d created, %d failed\n", report.Rows, report.Created, len(report.Errors))
+	respondUploadReport(w, r, "books", report)
+}
+
+// ImportBooksCsv adds every valid row of a CSV file of books, like
+// UploadBooks, for imports that do not come in over HTTP.
+func (server *Server) ImportBooksCsv(file io.Reader, dryRun bool, actor models.Actor) (CsvReport, error) {
+	upload, err := readCsv(file, bookCsvColumns...)
+	if err != nil {
+		return CsvReport{}, err
+	}
+	return server.importBooks(upload, dryRun, actor)
+}
+
+var bookCsvColumns = []string{"title", "author", "isbn", "description"}
+
+func (server *Server) importBooks(upload *csvUpload, dryRun bool, actor models.Actor) (CsvReport, error) {
+	var err error
+	report := CsvReport{DryRun: dryRun, Rows: len(upload.rows), Errors: []CsvRowError{}}
+	books := []models.Book{}
+	lines := []int{}
+	seen := map[string]int{}
+	for i, row := range upload.rows {
+		book := models.Book{
+			Title:       upload.get(row, "title"),
+			Author:      upload.get(row, "author"),
+			Isbn:        upload.get(row, "isbn"),
+			Description: upload.get(row, "description"),
+			Publisher:   upload.get(row, "publisher"),
+			Subjects:    splitCsvList(upload.get(row, "subjects")),
+			CoverUrl:    upload.get(row, "cover_url"),
+		}
+		key := strings.TrimSpace(book.Isbn)
+		err = nil
+		if year := strings.TrimSpace(upload.get(row, "publication_year")); year != "" {
+			book.PublicationYear, err = strconv.Atoi(year)
+			if err != nil {
+				err = errors.New("Invalid Publication Year")
+			}
+		}
+		if err == nil {
+			book.Prepare()
+			err = book.Validate()
+		}
+		if err == nil {
+			if first, ok := seen[book.Isbn]; ok {
+				err = fmt.Errorf("This Isbn is already on row %d", first)
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, CsvRowError{Row: upload.line(i), Key: key, Error: err.Error()})
+			continue
+		}
+		seen[book.Isbn] = upload.line(i)
+		books = append(books, book)
+		lines = append(lines, upload.line(i))
+	}
+
+	isbns := make([]string, len(books))
+	for i := range books {
+		isbns[i] = books[i].Isbn
+	}
+	taken, err := models.FindTakenIsbns(server.DB, isbns)
+	if err != nil {
+		return CsvReport{}, err
+	}
+	if len(taken) > 0 {
+		isTaken := map[string]bool{}
+		for _, number := range taken {
+			isTaken[number] = true
+		}
+		free := []models.Book{}
+		for i := range books {
+			if isTaken[books[i].Isbn] {
+				report.Errors = append(report.Errors, CsvRowError{Row: lines[i], Key: books[i].Isbn, Error: models.ErrDuplicateIsbn.Error()})
+				continue
+			}
+			free = append(free, books[i])
+		}
+		books = free
+	}
+	report.Valid = len(books)
+
+	if !dryRun && len(books) > 0 {
+		err = models.SaveBooks(server.DB, books, actor)
+		if err != nil {
+			return CsvReport{}, err
+		}
+		report.Created = len(books)
+	}
+	report.finish()
+	return report, nil
+}
+
+// UploadUsers adds a patron account for every valid row of a CSV file with
+// email, password and an optional patron_type. Like patrons who sign up,
+// each is mailed a link to verify the address, in the background since a
+// file can have many rows.
+func (server *Server) UploadUsers(w http.ResponseWriter, r *http.Request) {
+
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	upload, err := readCsvUpload(w, r, "email", "password")
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	dryRun, err := uploadDryRun(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+
+	report := CsvReport{DryRun: dryRun, Rows: len(upload.rows), Errors: []CsvRowError{}}
+	users := []models.User{}
+	lines := []int{}
+	seen := map[string]int{}
+	for i, row := range upload.rows {
+		user := models.User{
+			Email:      upload.get(row, "email"),
+			Password:   upload.get(row, "password"),
+			Role:       models.RolePatron,
+			PatronType: upload.get(row, "patron_type"),
+		}
+		user.Prepare()
+		err = user.Validate("")
+		email := strings.ToLower(user.Email)
+		if err == nil {
+			if first, ok := seen[email]; ok {
+				err = fmt.Errorf("This Email is already on row %d", first)
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, CsvRowError{Row: upload.line(i), Key: user.Email, Error: err.Error()})
+			continue
+		}
+		seen[email] = upload.line(i)
+		users = append(users, user)
+		lines = append(lines, upload.line(i))
+	}
+
+	emails := make([]string, len(users))
+	for i := range users {
+		emails[i] = users[i].Email
+	}
+	taken, err := models.FindTakenEmails(server.DB, emails)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	if len(taken) > 0 {
+		isTaken := map[string]bool{}
+		for _, email := range taken {
+			isTaken[email] = true
+		}
+		free := []models.User{}
+		for i := range users {
+			if isTaken[users[i].Email] {
+				report.Errors = append(report.Errors, CsvRowError{Row: lines[i], Key: users[i].Email, Error: "Email Already Taken"})
+				continue
+			}
+			free = append(free, users[i])
+		}
+		users = free
+	}
+	report.Valid = len(users)
+
+	if !dryRun && len(users) > 0 {
+		err = models.SaveUsers(server.DB, users, actorOf(r, principal))
+		if err != nil {
+			formattedError := formaterror.FormatError(err.Error())
+			responses.ERROR(w, http.StatusInternalServerError, formattedError)
+			return
+		}
+		report.Created = len(users)
+		go server.sendVerifications(users)
+	}
+	fmt.Printf("Uploaded %d user rows, %d created, %d failed\n", report.Rows, report.Created, len(report.Errors))
+	respondUploadReport(w, r, "users", report)
+}
+
+func (server *Server) sendVerifications(users []models.User) {
+	for i := range users {
+		err := server.sendVerification(&users[i])
+		if err != nil {
+			fmt.Printf("Could not send a verification email to user %d: %v\n", users[i].ID, err)
+		}
+	}
+}
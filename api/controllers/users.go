@@ -12,7 +12,9 @@ import (
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/brianhumphreys/library_app/api/responses"
 	"github.com/brianhumphreys/library_app/api/utils/formaterror"
+	"github.com/brianhumphreys/library_app/api/views"
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 func (server *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
@@ -29,35 +31,67 @@ func (server *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
+	// everyone signing themselves up is a patron, staff accounts are made
+	// through the admin API
+	user.Role = models.RolePatron
 	user.Prepare()
+	// patron types are assigned by staff, not chosen at signup
+	user.PatronType = ""
+	user.EmailVerifiedAt = nil
 	err = user.Validate("")
 
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	userCreated, err := user.SaveUser(server.DB)
-
+	userCreated, err := user.CreateUserAs(server.DB, actorOf(r, nil))
+	if errors.Is(err, models.ErrRoleNotFound) {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
 	if err != nil {
 		formattedError := formaterror.FormatError(err.Error())
 		responses.ERROR(w, http.StatusInternalServerError, formattedError)
 		return
 	}
+	err = server.sendVerification(userCreated)
+	if err != nil {
+		fmt.Printf("Could not send a verification email to user %d: %v\n", userCreated.ID, err)
+	}
 	w.Header().Set("Location", fmt.Sprintf("%s%s/%d", r.Host, r.RequestURI, userCreated.ID))
 
-	responses.JSON(w, http.StatusCreated, userCreated)
+	responses.JSON(w, http.StatusCreated, views.NewSelfUser(userCreated))
 }
 
 func (server *Server) GetUsers(w http.ResponseWriter, r *http.Request) {
+	if _, ok := server.requirePermission(w, r, models.PermUsersRead); !ok {
+		return
+	}
 
 	user := models.User{}
 
-	users, err := user.FindAllUsers(server.DB)
+	page, err := pageRequestFrom(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	var users *models.Page
+	// deleted users are only listed when asked for, to restore or purge them
+	if r.URL.Query().Get("deleted") == "true" {
+		users, err = models.FindDeletedUsers(server.DB, &page)
+	} else {
+		users, err = user.FindAllUsers(server.DB, &page)
+	}
+	if err != nil {
+		respondListError(w, err)
+		return
+	}
+	data, err := views.AdminUserPage(users)
 	if err != nil {
 		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, users)
+	responses.JSON(w, http.StatusOK, data)
 }
 
 func (server *Server) GetUser(w http.ResponseWriter, r *http.Request) {
@@ -73,16 +107,43 @@ func (server *Server) GetUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, foundUser)
-}
 
-func (server *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
+	// anyone can look a user up, only the user and staff see the account
+	principal := optionalPrincipal(r)
+	switch {
+	case principal != nil && server.can(principal, models.PermUsersRead):
+		responses.JSON(w, http.StatusOK, views.NewAdminUser(foundUser))
+	case principal != nil && principal.UserID == foundUser.ID:
+		responses.JSON(w, http.StatusOK, views.NewSelfUser(foundUser))
+	default:
+		responses.JSON(w, http.StatusOK, views.NewPublicUser(foundUser))
+	}
+}
 
-	// check that ID is correct format before parsing body
-	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+// ownUserID reads the user ID from the URL and checks that it belongs to
+// whoever is calling.
+func ownUserID(w http.ResponseWriter, r *http.Request) (uint, *auth.Principal, bool) {
+	uid, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
 	if err != nil {
 		responses.ERROR(w, http.StatusBadRequest, err)
+		return 0, nil, false
+	}
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return 0, nil, false
+	}
+	if principal.UserID != uint(uid) {
+		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+		return 0, nil, false
+	}
+	return uint(uid), principal, true
+}
+
+// UpdateProfile changes the email address or display name of the caller.
+// A new email address has to be verified again before the user can borrow.
+func (server *Server) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	uid, principal, ok := ownUserID(w, r)
+	if !ok {
 		return
 	}
 	body, err := ioutil.ReadAll(r.Body)
@@ -90,60 +151,204 @@ func (server *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	user := models.User{}
-	err = json.Unmarshal(body, &user)
+	change := models.ProfileChange{}
+	err = json.Unmarshal(body, &change)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	tokenID, _, err := auth.ExtractTokenIDAndRole(r)
+	change.Prepare()
+	err = change.Validate()
 	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	if tokenID != uint32(uid) {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+
+	user, emailChanged, err := models.UpdateProfile(server.DB, uid, change, actorOf(r, principal))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if errors.Is(err, models.ErrEmailTaken) {
+		responses.ERROR(w, http.StatusConflict, err)
 		return
 	}
-	user.Prepare()
-	err = user.Validate("update")
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	if emailChanged {
+		err = server.sendVerification(user)
+		if err != nil {
+			fmt.Printf("Could not send a verification email to user %d: %v\n", user.ID, err)
+		}
+	}
+	responses.JSON(w, http.StatusOK, views.NewSelfUser(user))
+}
+
+// UpdateUser is the old PUT /api/v1/users/{id}, kept for clients that have
+// not moved to the profile endpoint yet. It only changes what a profile
+// update can: a role or password in the body is ignored.
+//
+// Deprecated: use UpdateProfile and ChangePassword.
+func (server *Server) UpdateUser(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", fmt.Sprintf(`</api/v1/users/%s/profile>; rel="successor-version"`, mux.Vars(r)["id"]))
+	server.UpdateProfile(w, r)
+}
+
+type passwordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// ChangePassword sets a new password for the caller, who has to give the
+// current one. Wrong guesses count as failed logins, so a stolen token
+// cannot be used to find the password. Every other session is ended and the
+// caller gets a fresh one.
+func (server *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	uid, principal, ok := ownUserID(w, r)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		responses.ERROR(w, http.StatusUnprocessableEntity, err)
 		return
 	}
-	updatedUser, err := user.UpdateAUser(server.DB, uint32(uid))
+	request := passwordChangeRequest{}
+	err = json.Unmarshal(body, &request)
 	if err != nil {
-		formattedError := formaterror.FormatError(err.Error())
-		responses.ERROR(w, http.StatusInternalServerError, formattedError)
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.CurrentPassword == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Current Password"))
+		return
+	}
+	if request.NewPassword == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Password"))
+		return
+	}
+
+	user, err := (&models.User{}).FindUserByID(server.DB, uid)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	ip := clientIP(r)
+	attempt, err := models.ReserveLoginAttempt(server.DB, user.Email, ip)
+	if err != nil {
+		respondLoginError(w, err)
+		return
+	}
+	changed, err := models.ChangePassword(server.DB, uid, request.CurrentPassword, request.NewPassword, actorOf(r, principal))
+	finishErr := finishLoginAttempt(server.DB, attempt, err, models.ErrWrongPassword)
+	if finishErr != nil {
+		err = finishErr
+	}
+	if errors.Is(err, models.ErrWrongPassword) {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	token, err := auth.CreateToken(*changed)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
 		return
 	}
-	responses.JSON(w, http.StatusOK, updatedUser)
+	refreshToken, err := models.IssueRefreshToken(server.DB, changed.ID)
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Changed the password of user: %d\n", changed.ID)
+	responses.JSON(w, http.StatusOK, sessionResponse(changed, token, refreshToken))
 }
 
 func (server *Server) DeleteUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-
 	user := models.User{}
 
-	uid, err := strconv.ParseUint(vars["id"], 10, 32)
+	uid, principal, ok := ownUserID(w, r)
+	if !ok {
+		return
+	}
+	_, err := user.DeleteAUser(server.DB, uid, actorOf(r, principal))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if errors.Is(err, models.ErrUserHasLoans) {
+		responses.ERROR(w, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Entity", fmt.Sprintf("%d", uid))
+	responses.JSON(w, http.StatusNoContent, "")
+}
+
+func respondDeletedUserError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		responses.ERROR(w, http.StatusNotFound, errors.New("User not found"))
+	case errors.Is(err, models.ErrUserNotDeleted), errors.Is(err, models.ErrUserHasLoans):
+		responses.ERROR(w, http.StatusConflict, err)
+	default:
+		responses.ERROR(w, http.StatusInternalServerError, err)
+	}
+}
+
+// RestoreUser brings back an account its owner deleted.
+func (server *Server) RestoreUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
 	if err != nil {
 		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	tokenID, _, err := auth.ExtractTokenIDAndRole(r)
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := models.RestoreUser(server.DB, uint(uid), actorOf(r, principal))
 	if err != nil {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		respondDeletedUserError(w, err)
 		return
 	}
-	if tokenID != 0 && tokenID != uint32(uid) {
-		responses.ERROR(w, http.StatusUnauthorized, errors.New(http.StatusText(http.StatusUnauthorized)))
+	fmt.Printf("Restored user with ID: %d\n", user.ID)
+	responses.JSON(w, http.StatusOK, views.NewAdminUser(user))
+}
+
+// PurgeUser erases a deleted account and the data kept about it, for
+// requests to be forgotten. The account has to be deleted first.
+func (server *Server) PurgeUser(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		responses.ERROR(w, http.StatusBadRequest, err)
 		return
 	}
-	_, err = user.DeleteAUser(server.DB, uint(uid))
+	principal, ok := principalOf(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := models.PurgeUser(server.DB, uint(uid), actorOf(r, principal))
 	if err != nil {
-		responses.ERROR(w, http.StatusInternalServerError, err)
+		respondDeletedUserError(w, err)
 		return
 	}
+	fmt.Printf("Purged user with ID: %d\n", user.ID)
 	w.Header().Set("Entity", fmt.Sprintf("%d", uid))
 	responses.JSON(w, http.StatusNoContent, "")
 }
@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/brianhumphreys/library_app/api/mailer"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/responses"
+	"gorm.io/gorm"
+)
+
+const defaultAppURL = "http://localhost:8080"
+
+// appURL is where the links in emails point to.
+func appURL() string {
+	val := os.Getenv("APP_URL")
+	if val == "" {
+		return defaultAppURL
+	}
+	return strings.TrimRight(val, "/")
+}
+
+// errNoMailer keeps a server that was set up by hand from printing links
+// anywhere.
+var errNoMailer = errors.New("No mailer is set up")
+
+func (server *Server) sendMail(msg mailer.Message) error {
+	if server.Mailer == nil {
+		return errNoMailer
+	}
+	return server.Mailer.Send(msg)
+}
+
+// sendVerification mails the user a link that confirms their address.
+func (server *Server) sendVerification(user *models.User) error {
+	token, err := models.NewAccountToken(user, models.PurposeVerifyEmail, models.VerifyEmailPeriod())
+	if err != nil {
+		return err
+	}
+	return server.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Please verify your email address",
+		Body: fmt.Sprintf("Welcome to the library!\n\nOpen this link to verify your email address:\n\n%s/api/v1/verify?token=%s\n\nThe link expires in %v.\n",
+			appURL(), url.QueryEscape(token), models.VerifyEmailPeriod()),
+	})
+}
+
+type passwordRequest struct {
+	Email    string `json:"email"`
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func readPasswordRequest(r *http.Request) (passwordRequest, error) {
+	request := passwordRequest{}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return request, err
+	}
+	err = json.Unmarshal(body, &request)
+	return request, err
+}
+
+// ForgotPassword mails a reset link. It answers the same whether or not
+// the email has an account, so it cannot be used to find out who does. The
+// account is looked up and mailed after the answer is sent, so the time it
+// takes tells nothing either. Requests are throttled by email and address.
+func (server *Server) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	request, err := readPasswordRequest(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	email := strings.TrimSpace(request.Email)
+	if email == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Email"))
+		return
+	}
+
+	err = models.ReservePasswordReset(server.DB, email, clientIP(r))
+	if err != nil {
+		respondLoginError(w, err)
+		return
+	}
+	go server.sendPasswordReset(email)
+	responses.JSON(w, http.StatusAccepted, map[string]string{
+		"message": "If this email has an account, a reset link is on its way",
+	})
+}
+
+// sendPasswordReset mails a reset link if the email has an account. Nobody
+// is waiting for it, so failures are only logged.
+func (server *Server) sendPasswordReset(email string) {
+	user := models.User{}
+	err := server.DB.Model(&models.User{}).Where("email = ?", email).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Could not look up a password reset: %v\n", err)
+		return
+	}
+	token, err := models.NewAccountToken(&user, models.PurposeResetPassword, models.PasswordResetPeriod())
+	if err == nil {
+		err = server.sendMail(mailer.Message{
+			To:      user.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Someone asked to reset the password of your library account.\n\nOpen this link to choose a new one:\n\n%s/reset-password?token=%s\n\nThe link expires in %v. If it was not you, ignore this email.\n",
+				appURL(), url.QueryEscape(token), models.PasswordResetPeriod()),
+		})
+	}
+	if err != nil {
+		fmt.Printf("Could not send a password reset to user %d: %v\n", user.ID, err)
+	}
+}
+
+func (server *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	request, err := readPasswordRequest(r)
+	if err != nil {
+		responses.ERROR(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	if request.Password == "" {
+		responses.ERROR(w, http.StatusUnprocessableEntity, errors.New("Required Password"))
+		return
+	}
+
+	user, err := models.ResetPassword(server.DB, request.Token, request.Password, actorOf(r, nil))
+	if errors.Is(err, models.ErrInvalidAccountToken) {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Reset the password of user: %d\n", user.ID)
+	responses.JSON(w, http.StatusOK, map[string]string{
+		"message": "Your password has been reset, please log in again",
+	})
+}
+
+func (server *Server) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	user, err := models.VerifyEmail(server.DB, token, actorOf(r, nil))
+	if errors.Is(err, models.ErrInvalidAccountToken) {
+		responses.ERROR(w, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		responses.ERROR(w, http.StatusInternalServerError, err)
+		return
+	}
+	responses.JSON(w, http.StatusOK, map[string]interface{}{
+		"email":             user.Email,
+		"email_verified_at": user.EmailVerifiedAt,
+	})
+}
@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidHeader = errors.New("Mail headers cannot contain line breaks")
+
+// Message is a plain text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m Message) validate() error {
+	if strings.ContainsAny(m.To, "\r\n") || strings.ContainsAny(m.Subject, "\r\n") {
+		return ErrInvalidHeader
+	}
+	if m.To == "" {
+		return errors.New("Mail needs a recipient")
+	}
+	return nil
+}
+
+// Mailer delivers messages to users.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Console prints messages instead of sending them, for running without a
+// mail server.
+type Console struct{}
+
+func (Console) Send(msg Message) error {
+	err := msg.validate()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Mail to %s: %s\n%s\n", msg.To, msg.Subject, msg.Body)
+	return nil
+}
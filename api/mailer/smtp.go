@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTP sends mail through a relay. Addr is host:port, so tests can point it
+// at a fake server.
+type SMTP struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTP logs in with the username and password when one is given. Go only
+// sends them over TLS, or to a server on localhost.
+func NewSMTP(addr, from, username, password string) *SMTP {
+	s := &SMTP{Addr: addr, From: from}
+	if username != "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		s.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+func (s *SMTP) Send(msg Message) error {
+	err := msg.validate()
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.Addr, s.Auth, s.From, []string{msg.To}, s.format(msg))
+}
+
+func (s *SMTP) format(msg Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(msg.Body)
+	return b.Bytes()
+}
@@ -0,0 +1,230 @@
+package marc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RecordReader is implemented by both the binary and the XML reader.
+type RecordReader interface {
+	Next() (*Record, error)
+}
+
+// RecordWriter is implemented by both the binary and the XML writer.
+type RecordWriter interface {
+	Write(rec *Record) error
+	Close() error
+}
+
+// Reader reads MARC21 binary records one at a time.
+type Reader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF after the last one. A record that
+// cannot be parsed is reported with an error wrapping ErrMalformed and the
+// reader moves on, so callers can keep going and collect every failure.
+// After an error the reader cannot recover from, Next returns io.EOF.
+func (r *Reader) Next() (*Record, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	// some tools put a newline between records
+	for {
+		b, err := r.r.Peek(1)
+		if err != nil {
+			r.done = true
+			return nil, err
+		}
+		if b[0] != '\n' && b[0] != '\r' {
+			break
+		}
+		r.r.Discard(1)
+	}
+
+	head, err := r.r.Peek(5)
+	if err != nil && err != io.EOF {
+		r.done = true
+		return nil, err
+	}
+	length, convErr := strconv.Atoi(string(head))
+	if err == io.EOF || convErr != nil || length <= leaderLength {
+		// skip to the end of this record and carry on with the next
+		_, err = r.r.ReadBytes(recordTerminator)
+		if err != nil && err != io.EOF {
+			r.done = true
+			return nil, err
+		}
+		return nil, malformed("invalid record length %q", head)
+	}
+
+	buf := make([]byte, length)
+	_, err = io.ReadFull(r.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		r.done = true
+		return nil, malformed("record is shorter than its length of %d", length)
+	}
+	if err != nil {
+		r.done = true
+		return nil, err
+	}
+	return parseRecord(buf)
+}
+
+func parseRecord(buf []byte) (*Record, error) {
+	if buf[len(buf)-1] != recordTerminator {
+		return nil, malformed("record does not end with a record terminator")
+	}
+	leader := string(buf[:leaderLength])
+	base, err := strconv.Atoi(leader[12:17])
+	if err != nil || base <= leaderLength || base > len(buf) {
+		return nil, malformed("invalid base address %q", leader[12:17])
+	}
+	if buf[base-1] != fieldTerminator {
+		return nil, malformed("directory does not end with a field terminator")
+	}
+	directory := buf[leaderLength : base-1]
+	if len(directory)%directoryEntry != 0 {
+		return nil, malformed("directory length %d is not a multiple of %d", len(directory), directoryEntry)
+	}
+
+	rec := Record{Leader: leader}
+	for i := 0; i < len(directory); i += directoryEntry {
+		entry := directory[i : i+directoryEntry]
+		tag := string(entry[:3])
+		flen, err1 := strconv.Atoi(string(entry[3:7]))
+		start, err2 := strconv.Atoi(string(entry[7:12]))
+		if err1 != nil || err2 != nil || flen < 1 || base+start+flen > len(buf)-1 {
+			return nil, malformed("invalid directory entry %q", entry)
+		}
+		data := buf[base+start : base+start+flen]
+		if data[len(data)-1] != fieldTerminator {
+			return nil, malformed("field %s does not end with a field terminator", tag)
+		}
+		data = data[:len(data)-1]
+
+		if isControlTag(tag) {
+			rec.AddControlField(tag, string(data))
+			continue
+		}
+		if len(data) < 2 {
+			return nil, malformed("field %s has no indicators", tag)
+		}
+		field := DataField{Tag: tag, Ind1: string(data[0]), Ind2: string(data[1])}
+		parts := bytes.Split(data[2:], []byte{subfieldDelimiter})
+		for _, part := range parts[1:] {
+			if len(part) == 0 {
+				continue
+			}
+			field.Subfields = append(field.Subfields, Subfield{Code: string(part[0]), Value: string(part[1:])})
+		}
+		rec.DataFields = append(rec.DataFields, field)
+	}
+	return &rec, nil
+}
+
+// Writer writes MARC21 binary records.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Write(rec *Record) error {
+	raw, err := Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(raw)
+	return err
+}
+
+// Close does nothing; binary records need no trailer.
+func (w *Writer) Close() error {
+	return nil
+}
+
+func indicator(s string) byte {
+	if len(s) == 0 {
+		return ' '
+	}
+	return s[0]
+}
+
+// Marshal encodes a record in MARC21 binary, computing the leader's record
+// length and base address and the directory.
+func Marshal(rec *Record) ([]byte, error) {
+	var directory, data bytes.Buffer
+	addEntry := func(tag string, field []byte) error {
+		if len(tag) != 3 {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		if len(field) > 9999 || data.Len() > 99999 {
+			return fmt.Errorf("field %s is too long for a MARC record", tag)
+		}
+		fmt.Fprintf(&directory, "%s%04d%05d", tag, len(field), data.Len())
+		data.Write(field)
+		return nil
+	}
+
+	for _, f := range rec.ControlFields {
+		if !isControlTag(f.Tag) {
+			return nil, fmt.Errorf("%s is not a control field tag", f.Tag)
+		}
+		err := addEntry(f.Tag, append([]byte(f.Value), fieldTerminator))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range rec.DataFields {
+		if isControlTag(f.Tag) {
+			return nil, fmt.Errorf("%s is a control field tag", f.Tag)
+		}
+		field := []byte{indicator(f.Ind1), indicator(f.Ind2)}
+		for _, s := range f.Subfields {
+			if len(s.Code) != 1 {
+				return nil, fmt.Errorf("invalid subfield code %q in field %s", s.Code, f.Tag)
+			}
+			field = append(field, subfieldDelimiter)
+			field = append(field, s.Code...)
+			field = append(field, s.Value...)
+		}
+		err := addEntry(f.Tag, append(field, fieldTerminator))
+		if err != nil {
+			return nil, err
+		}
+	}
+	directory.WriteByte(fieldTerminator)
+	data.WriteByte(recordTerminator)
+
+	base := leaderLength + directory.Len()
+	length := base + data.Len()
+	if length > 99999 {
+		return nil, fmt.Errorf("record is too long for MARC21")
+	}
+	leader := []byte(rec.Leader)
+	if len(leader) != leaderLength {
+		leader = []byte(DefaultLeader)
+	}
+	copy(leader[0:5], fmt.Sprintf("%05d", length))
+	leader[9] = 'a'
+	copy(leader[10:12], "22")
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+	copy(leader[20:24], "4500")
+
+	out := make([]byte, 0, length)
+	out = append(out, leader...)
+	out = append(out, directory.Bytes()...)
+	out = append(out, data.Bytes()...)
+	return out, nil
+}
@@ -0,0 +1,104 @@
+// Package marc reads and writes bibliographic records in MARC21 binary
+// (ISO 2709) and MARCXML.
+package marc
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	subfieldDelimiter = 0x1F
+	fieldTerminator   = 0x1E
+	recordTerminator  = 0x1D
+
+	leaderLength   = 24
+	directoryEntry = 12
+)
+
+var ErrMalformed = errors.New("malformed MARC record")
+
+// DefaultLeader describes a new, Unicode encoded monograph record. The
+// length and base address are filled in when the record is written.
+const DefaultLeader = "00000nam a2200000 i 4500"
+
+type Record struct {
+	Leader        string
+	ControlFields []ControlField
+	DataFields    []DataField
+}
+
+// ControlField is a 00X field, which has a value but no subfields.
+type ControlField struct {
+	Tag   string
+	Value string
+}
+
+type DataField struct {
+	Tag       string
+	Ind1      string
+	Ind2      string
+	Subfields []Subfield
+}
+
+type Subfield struct {
+	Code  string
+	Value string
+}
+
+func malformed(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrMalformed, fmt.Sprintf(format, args...))
+}
+
+func isControlTag(tag string) bool {
+	return len(tag) == 3 && tag[0] == '0' && tag[1] == '0'
+}
+
+// ControlField returns the value of the first control field with tag.
+func (r *Record) ControlField(tag string) string {
+	for _, f := range r.ControlFields {
+		if f.Tag == tag {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// Fields returns every data field with tag, in record order.
+func (r *Record) Fields(tag string) []DataField {
+	fields := []DataField{}
+	for _, f := range r.DataFields {
+		if f.Tag == tag {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// Subfield returns the first value of subfield code in the first field
+// with tag.
+func (r *Record) Subfield(tag, code string) string {
+	for _, f := range r.Fields(tag) {
+		if v := f.Subfield(code); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func (f DataField) Subfield(code string) string {
+	for _, s := range f.Subfields {
+		if s.Code == code {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+func (r *Record) AddControlField(tag, value string) {
+	r.ControlFields = append(r.ControlFields, ControlField{Tag: tag, Value: value})
+}
+
+func (r *Record) AddDataField(tag, ind1, ind2 string, subfields ...Subfield) {
+	r.DataFields = append(r.DataFields, DataField{Tag: tag, Ind1: ind1, Ind2: ind2, Subfields: subfields})
+}
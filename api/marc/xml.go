@@ -0,0 +1,165 @@
+package marc
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+const Namespace = "http://www.loc.gov/MARC21/slim"
+
+type xmlRecord struct {
+	XMLName       xml.Name          `xml:"record"`
+	Leader        string            `xml:"leader"`
+	ControlFields []xmlControlField `xml:"controlfield"`
+	DataFields    []xmlDataField    `xml:"datafield"`
+}
+
+type xmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlDataField struct {
+	Tag       string        `xml:"tag,attr"`
+	Ind1      string        `xml:"ind1,attr"`
+	Ind2      string        `xml:"ind2,attr"`
+	Subfields []xmlSubfield `xml:"subfield"`
+}
+
+type xmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+func (x *xmlRecord) record() (*Record, error) {
+	rec := Record{Leader: x.Leader}
+	for _, f := range x.ControlFields {
+		if !isControlTag(f.Tag) {
+			return nil, malformed("%q is not a control field tag", f.Tag)
+		}
+		rec.AddControlField(f.Tag, f.Value)
+	}
+	for _, f := range x.DataFields {
+		if len(f.Tag) != 3 || isControlTag(f.Tag) {
+			return nil, malformed("%q is not a data field tag", f.Tag)
+		}
+		field := DataField{Tag: f.Tag, Ind1: f.Ind1, Ind2: f.Ind2}
+		for _, s := range f.Subfields {
+			if len(s.Code) != 1 {
+				return nil, malformed("invalid subfield code %q in field %s", s.Code, f.Tag)
+			}
+			field.Subfields = append(field.Subfields, Subfield{Code: s.Code, Value: s.Value})
+		}
+		rec.DataFields = append(rec.DataFields, field)
+	}
+	return &rec, nil
+}
+
+func xmlFromRecord(rec *Record) xmlRecord {
+	x := xmlRecord{Leader: rec.Leader}
+	for _, f := range rec.ControlFields {
+		x.ControlFields = append(x.ControlFields, xmlControlField{Tag: f.Tag, Value: f.Value})
+	}
+	for _, f := range rec.DataFields {
+		field := xmlDataField{Tag: f.Tag, Ind1: string(indicator(f.Ind1)), Ind2: string(indicator(f.Ind2))}
+		for _, s := range f.Subfields {
+			field.Subfields = append(field.Subfields, xmlSubfield{Code: s.Code, Value: s.Value})
+		}
+		x.DataFields = append(x.DataFields, field)
+	}
+	return x
+}
+
+// XMLReader reads the records of a MARCXML collection, or a document that
+// is a single record.
+type XMLReader struct {
+	d    *xml.Decoder
+	done bool
+}
+
+func NewXMLReader(r io.Reader) *XMLReader {
+	return &XMLReader{d: xml.NewDecoder(r)}
+}
+
+// Next returns the next record, or io.EOF after the last one. A record with
+// bad tags is reported and skipped, but broken XML ends the read: the error
+// is returned once and Next returns io.EOF after it.
+func (r *XMLReader) Next() (*Record, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	for {
+		tok, err := r.d.Token()
+		if err == io.EOF {
+			r.done = true
+			return nil, io.EOF
+		}
+		if err != nil {
+			r.done = true
+			return nil, malformed("%v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+		x := xmlRecord{}
+		err = r.d.DecodeElement(&x, &start)
+		if err != nil {
+			r.done = true
+			return nil, malformed("%v", err)
+		}
+		return x.record()
+	}
+}
+
+// XMLWriter writes records into a MARCXML collection. Close must be called
+// to end the document.
+type XMLWriter struct {
+	w       io.Writer
+	enc     *xml.Encoder
+	started bool
+}
+
+func NewXMLWriter(w io.Writer) *XMLWriter {
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return &XMLWriter{w: w, enc: enc}
+}
+
+func (w *XMLWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+	_, err := io.WriteString(w.w, xml.Header)
+	if err != nil {
+		return err
+	}
+	return w.enc.EncodeToken(xml.StartElement{Name: xml.Name{Local: "collection"}, Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: Namespace}}})
+}
+
+func (w *XMLWriter) Write(rec *Record) error {
+	err := w.start()
+	if err != nil {
+		return err
+	}
+	x := xmlFromRecord(rec)
+	return w.enc.Encode(&x)
+}
+
+func (w *XMLWriter) Close() error {
+	err := w.start()
+	if err != nil {
+		return err
+	}
+	err = w.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: "collection"}})
+	if err != nil {
+		return err
+	}
+	err = w.enc.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w.w, "\n")
+	return err
+}
@@ -0,0 +1,116 @@
+package metadata
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("No metadata was found for this Isbn")
+
+// Record is what a provider knows about an edition. Fields the provider
+// does not have are left empty.
+type Record struct {
+	Isbn            string
+	Title           string
+	Author          string
+	Description     string
+	Publisher       string
+	PublicationYear int
+	Subjects        []string
+	CoverUrl        string
+}
+
+// MetadataProvider looks up bibliographic details for a normalized ISBN-13.
+type MetadataProvider interface {
+	LookupIsbn(ctx context.Context, isbn string) (*Record, error)
+}
+
+type cacheEntry struct {
+	isbn    string
+	record  *Record
+	err     error
+	expires time.Time
+}
+
+// Cache remembers lookups from another provider, including misses, so
+// repeated imports do not hit the remote service. It keeps at most size
+// entries, dropping the least recently used, and drops entries once they
+// expire.
+type Cache struct {
+	provider MetadataProvider
+	ttl      time.Duration
+	size     int
+	now      func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+func NewCache(provider MetadataProvider, ttl time.Duration, size int) *Cache {
+	return &Cache{
+		provider: provider,
+		ttl:      ttl,
+		size:     size,
+		now:      time.Now,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (c *Cache) LookupIsbn(ctx context.Context, isbn string) (*Record, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[isbn]; ok {
+		entry := el.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.order.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.record, entry.err
+		}
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	record, err := c.provider.LookupIsbn(ctx, isbn)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		// outages are not cached so the next try can succeed
+		return nil, err
+	}
+	c.mu.Lock()
+	c.add(&cacheEntry{isbn: isbn, record: record, err: err, expires: c.now().Add(c.ttl)})
+	c.mu.Unlock()
+	return record, err
+}
+
+// Len is how many lookups the cache holds.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *Cache) add(entry *cacheEntry) {
+	// another request may have looked the same number up meanwhile
+	if el, ok := c.entries[entry.isbn]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.isbn] = c.order.PushFront(entry)
+
+	now := c.now()
+	for c.order.Len() > 0 {
+		last := c.order.Back()
+		if c.order.Len() <= c.size && now.Before(last.Value.(*cacheEntry).expires) {
+			return
+		}
+		c.remove(last)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).isbn)
+}
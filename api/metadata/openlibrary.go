@@ -0,0 +1,124 @@
+package metadata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultOpenLibraryURL = "https://openlibrary.org"
+
+var yearPattern = regexp.MustCompile(`\b(1[5-9]|20)[0-9]{2}\b`)
+
+// OpenLibrary reads the Open Library books API. BaseURL can point at any
+// server that speaks the same JSON, such as a stub in tests.
+type OpenLibrary struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewOpenLibrary(baseURL string) *OpenLibrary {
+	if baseURL == "" {
+		baseURL = DefaultOpenLibraryURL
+	}
+	return &OpenLibrary{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type openLibraryName struct {
+	Name string `json:"name"`
+}
+
+type openLibraryBook struct {
+	Title       string            `json:"title"`
+	Subtitle    string            `json:"subtitle"`
+	Authors     []openLibraryName `json:"authors"`
+	Publishers  []openLibraryName `json:"publishers"`
+	PublishDate string            `json:"publish_date"`
+	Subjects    []openLibraryName `json:"subjects"`
+	Notes       string            `json:"notes"`
+	Excerpts    []struct {
+		Text string `json:"text"`
+	} `json:"excerpts"`
+	Cover struct {
+		Large  string `json:"large"`
+		Medium string `json:"medium"`
+	} `json:"cover"`
+}
+
+func (o *OpenLibrary) LookupIsbn(ctx context.Context, isbn string) (*Record, error) {
+	key := "ISBN:" + isbn
+	query := url.Values{}
+	query.Set("bibkeys", key)
+	query.Set("format", "json")
+	query.Set("jscmd", "data")
+
+	req, err := http.NewRequest("GET", o.BaseURL+"/api/books?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open library responded with %s", resp.Status)
+	}
+
+	found := map[string]openLibraryBook{}
+	err = json.NewDecoder(resp.Body).Decode(&found)
+	if err != nil {
+		return nil, err
+	}
+	book, ok := found[key]
+	if !ok || book.Title == "" {
+		return nil, ErrNotFound
+	}
+
+	record := Record{
+		Isbn:      isbn,
+		Title:     book.Title,
+		Author:    joinNames(book.Authors, ", "),
+		Publisher: joinNames(book.Publishers, ", "),
+		CoverUrl:  book.Cover.Large,
+	}
+	if record.CoverUrl == "" {
+		record.CoverUrl = book.Cover.Medium
+	}
+	if year := yearPattern.FindString(book.PublishDate); year != "" {
+		record.PublicationYear, _ = strconv.Atoi(year)
+	}
+	for _, s := range book.Subjects {
+		if s.Name != "" {
+			record.Subjects = append(record.Subjects, s.Name)
+		}
+	}
+	switch {
+	case book.Notes != "":
+		record.Description = book.Notes
+	case len(book.Excerpts) > 0:
+		record.Description = book.Excerpts[0].Text
+	default:
+		record.Description = book.Subtitle
+	}
+	return &record, nil
+}
+
+func joinNames(names []openLibraryName, sep string) string {
+	parts := []string{}
+	for _, n := range names {
+		if n.Name != "" {
+			parts = append(parts, n.Name)
+		}
+	}
+	return strings.Join(parts, sep)
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/brianhumphreys/library_app/api/migrations"
+)
+
+const migrateUsage = `Usage: library_app migrate [-dir DIR] COMMAND
+
+Commands:
+  up            apply every pending migration
+  down          roll back the newest applied migration
+  status        list migrations and when they were applied
+  to VERSION    migrate up or down to VERSION, 0 rolls back everything
+
+Flags:
+  -dir DIR      directory holding the migration files, $MIGRATIONS_DIR when
+                it is set, otherwise migrations next to the binary, next to
+                its bin directory or in the working directory
+`
+
+func migrate(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, migrateUsage) }
+	dir := flags.String("dir", migrations.Dir(), "directory holding the migration files")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+
+	command := args[0]
+	var target int64
+	switch command {
+	case "up", "down", "status":
+		if len(args) != 1 {
+			flags.Usage()
+			return exitUsage
+		}
+	case "to":
+		if len(args) != 2 {
+			flags.Usage()
+			return exitUsage
+		}
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || version < 0 {
+			fmt.Fprintf(stderr, "%q is not a version\n", args[1])
+			return exitUsage
+		}
+		target = version
+	default:
+		flags.Usage()
+		return exitUsage
+	}
+
+	db, err := connect()
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not connect to the database: %v\n", err)
+		return exitFailed
+	}
+	migrator, err := migrations.Open(db, *dir)
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not load the migrations from %s: %v\n", *dir, err)
+		return exitFailed
+	}
+
+	if command == "status" {
+		statuses, err := migrator.Status()
+		if err != nil {
+			fmt.Fprintf(stderr, "Could not read the schema version: %v\n", err)
+			return exitFailed
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.AppliedAt != nil {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			if !s.Known {
+				state += ", not known to this release"
+			}
+			fmt.Fprintf(stdout, "%04d %-30s %s\n", s.Version, s.Name, state)
+		}
+		return exitOK
+	}
+
+	var ran []int64
+	switch command {
+	case "up":
+		ran, err = migrator.Up()
+	case "down":
+		ran, err = migrator.Down()
+	case "to":
+		ran, err = migrator.To(target)
+	}
+	for _, version := range ran {
+		fmt.Fprintf(stdout, "Ran migration %d\n", version)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Migration failed: %v\n", err)
+		return exitFailed
+	}
+	current, err := migrator.Current()
+	if err != nil {
+		fmt.Fprintf(stderr, "Could not read the schema version: %v\n", err)
+		return exitFailed
+	}
+	fmt.Fprintf(stdout, "The schema is at version %d\n", current)
+	return exitOK
+}
@@ -0,0 +1,386 @@
+// Package migrations keeps the database schema in step with the code. Each
+// version is a pair of SQL files, NNNN_name.up.sql and NNNN_name.down.sql,
+// read from a directory at runtime. Applied versions are recorded in the
+// schema_migrations table.
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const defaultDir = "migrations"
+
+// migrationLock is the advisory lock held while a version is applied or
+// rolled back, so two releases starting at once do not both run it.
+const migrationLock = 7146854
+
+// ErrNoMigrations is returned by Open when the directory holds none.
+var ErrNoMigrations = errors.New("No migrations were found")
+
+var fileName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// Migration is one version of the schema.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a known or applied version. Known is false for a version that
+// was applied by a newer release than this one.
+type Status struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Known     bool       `json:"known"`
+	AppliedAt *time.Time `json:"applied_at"`
+}
+
+// BehindError is returned by Check while versions are waiting to be
+// applied.
+type BehindError struct {
+	Pending []int64
+}
+
+func (e *BehindError) Error() string {
+	versions := make([]string, len(e.Pending))
+	for i, v := range e.Pending {
+		versions[i] = strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprintf("The database schema is behind, run `migrate up` to apply version %s", strings.Join(versions, ", "))
+}
+
+// schemaMigration is a row of schema_migrations.
+type schemaMigration struct {
+	Version   int64 `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Dir reads MIGRATIONS_DIR. Without it the migrations directory is looked
+// for next to the binary, then next to the bin directory the binary is in,
+// and last in the working directory, so commands work from anywhere.
+func Dir() string {
+	if dir := os.Getenv("MIGRATIONS_DIR"); dir != "" {
+		return dir
+	}
+	candidates := []string{}
+	if exe, err := os.Executable(); err == nil {
+		if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+			exe = resolved
+		}
+		base := filepath.Dir(exe)
+		candidates = append(candidates, filepath.Join(base, defaultDir), filepath.Join(filepath.Dir(base), defaultDir))
+	}
+	candidates = append(candidates, defaultDir)
+	for _, dir := range candidates {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			return dir
+		}
+	}
+	return defaultDir
+}
+
+// Load reads every migration in dir, oldest first. Each version needs both
+// its up and its down file.
+func Load(dir string) ([]Migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".sql" {
+			continue
+		}
+		parts := fileName.FindStringSubmatch(file.Name())
+		if parts == nil {
+			return nil, fmt.Errorf("%s is not named like 0001_name.up.sql", file.Name())
+		}
+		version, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("%s does not start with a version above 0", file.Name())
+		}
+		sql, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = m
+		}
+		if m.Name != parts[2] {
+			return nil, fmt.Errorf("version %d is named both %s and %s", version, m.Name, parts[2])
+		}
+		if parts[3] == "up" {
+			m.Up = string(sql)
+		} else {
+			m.Down = string(sql)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("version %d needs both an up and a down file", m.Version)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Migrator applies and rolls back migrations on one database.
+type Migrator struct {
+	db         *gorm.DB
+	migrations []Migration
+}
+
+func NewMigrator(db *gorm.DB, migrations []Migration) *Migrator {
+	return &Migrator{db: db, migrations: migrations}
+}
+
+// Latest is the version the loaded migrations bring the schema to.
+func (m *Migrator) Latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].Version
+}
+
+func (m *Migrator) find(version int64) (*Migration, bool) {
+	for i := range m.migrations {
+		if m.migrations[i].Version == version {
+			return &m.migrations[i], true
+		}
+	}
+	return nil, false
+}
+
+func (m *Migrator) ensureTable() error {
+	return m.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`).Error
+}
+
+func (m *Migrator) applied() ([]schemaMigration, error) {
+	err := m.ensureTable()
+	if err != nil {
+		return nil, err
+	}
+	rows := []schemaMigration{}
+	err = m.db.Order("version asc").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// Status lists every known version along with any applied version this
+// release does not know about, oldest first.
+func (m *Migrator) Status() ([]Status, error) {
+	rows, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Status{}
+	for _, mig := range m.migrations {
+		byVersion[mig.Version] = &Status{Version: mig.Version, Name: mig.Name, Known: true}
+	}
+	for _, row := range rows {
+		appliedAt := row.AppliedAt
+		s, ok := byVersion[row.Version]
+		if !ok {
+			s = &Status{Version: row.Version, Name: row.Name}
+			byVersion[row.Version] = s
+		}
+		s.AppliedAt = &appliedAt
+	}
+	statuses := []Status{}
+	for _, s := range byVersion {
+		statuses = append(statuses, *s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
+}
+
+// Current is the newest applied version, 0 for an empty database.
+func (m *Migrator) Current() (int64, error) {
+	rows, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return rows[len(rows)-1].Version, nil
+}
+
+func (m *Migrator) pending() ([]int64, error) {
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+	pending := []int64{}
+	for _, s := range statuses {
+		if s.Known && s.AppliedAt == nil {
+			pending = append(pending, s.Version)
+		}
+	}
+	return pending, nil
+}
+
+// Check returns a *BehindError unless every known version has been
+// applied. A database migrated by a newer release passes, so a rollback of
+// the code alone keeps working.
+func (m *Migrator) Check() error {
+	pending, err := m.pending()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return &BehindError{Pending: pending}
+	}
+	return nil
+}
+
+// run applies or rolls back one version in its own transaction. It checks
+// again under the lock, so a version another process just ran is skipped
+// and run reports false.
+func (m *Migrator) run(mig *Migration, up bool) (bool, error) {
+	ran := false
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationLock).Error
+		if err != nil {
+			return err
+		}
+		var count int64
+		err = tx.Model(&schemaMigration{}).Where("version = ?", mig.Version).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if up == (count > 0) {
+			return nil
+		}
+
+		sql := mig.Down
+		if up {
+			sql = mig.Up
+		}
+		// no arguments, so the file is sent as is and may hold many statements
+		err = tx.Exec(sql).Error
+		if err != nil {
+			return fmt.Errorf("version %d %s: %v", mig.Version, mig.Name, err)
+		}
+		ran = true
+		if up {
+			return tx.Create(&schemaMigration{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error
+		}
+		return tx.Where("version = ?", mig.Version).Delete(&schemaMigration{}).Error
+	})
+	return ran && err == nil, err
+}
+
+// Up applies every pending version, oldest first, and returns the ones it
+// applied.
+func (m *Migrator) Up() ([]int64, error) {
+	return m.To(m.Latest())
+}
+
+// Down rolls back the newest applied version.
+func (m *Migrator) Down() ([]int64, error) {
+	rows, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return []int64{}, nil
+	}
+	target := int64(0)
+	if len(rows) > 1 {
+		target = rows[len(rows)-2].Version
+	}
+	return m.To(target)
+}
+
+// To applies pending versions up to and including version, and rolls back
+// applied versions above it, newest first. It returns the versions it ran.
+func (m *Migrator) To(version int64) ([]int64, error) {
+	if version != 0 {
+		if _, ok := m.find(version); !ok {
+			return nil, fmt.Errorf("There is no migration with version %d", version)
+		}
+	}
+	statuses, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	ran := []int64{}
+	for i := len(statuses) - 1; i >= 0; i-- {
+		s := statuses[i]
+		if s.Version <= version || s.AppliedAt == nil {
+			continue
+		}
+		mig, ok := m.find(s.Version)
+		if !ok {
+			return ran, fmt.Errorf("Version %d was applied by a newer release and cannot be rolled back by this one", s.Version)
+		}
+		done, err := m.run(mig, false)
+		if err != nil {
+			return ran, err
+		}
+		if done {
+			ran = append(ran, s.Version)
+		}
+	}
+	for _, s := range statuses {
+		if s.Version > version || s.AppliedAt != nil || !s.Known {
+			continue
+		}
+		mig, _ := m.find(s.Version)
+		done, err := m.run(mig, true)
+		if err != nil {
+			return ran, err
+		}
+		if done {
+			ran = append(ran, s.Version)
+		}
+	}
+	return ran, nil
+}
+
+// Open loads the migrations in dir for db.
+func Open(db *gorm.DB, dir string) (*Migrator, error) {
+	migrations, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(migrations) == 0 {
+		return nil, ErrNoMigrations
+	}
+	return NewMigrator(db, migrations), nil
+}
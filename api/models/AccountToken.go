@@ -0,0 +1,218 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+
+	defaultVerifyEmailHours     = 48
+	defaultPasswordResetMinutes = 60
+)
+
+var (
+	ErrInvalidAccountToken = errors.New("This link is invalid or has expired")
+	ErrEmailNotVerified    = errors.New("Please verify your email address first")
+	errNoAccountSecret     = errors.New("ACCOUNT_TOKEN_SECRET is not set")
+)
+
+// accountClaims is what an emailed link carries. State is a fingerprint of
+// the part of the account the link changes, so once it has been used the
+// fingerprint no longer matches and the link stops working.
+type accountClaims struct {
+	Purpose string `json:"p"`
+	UserId  uint   `json:"u"`
+	Expires int64  `json:"e"`
+	State   string `json:"s"`
+}
+
+func VerifyEmailPeriod() time.Duration {
+	return time.Duration(envInt("VERIFY_EMAIL_HOURS", defaultVerifyEmailHours)) * time.Hour
+}
+
+func PasswordResetPeriod() time.Duration {
+	return time.Duration(envInt("PASSWORD_RESET_MINUTES", defaultPasswordResetMinutes)) * time.Minute
+}
+
+// accountSecret signs the links. It falls back to API_SECRET so existing
+// setups keep working.
+func accountSecret() ([]byte, error) {
+	secret := os.Getenv("ACCOUNT_TOKEN_SECRET")
+	if secret == "" {
+		secret = os.Getenv("API_SECRET")
+	}
+	if secret == "" {
+		return nil, errNoAccountSecret
+	}
+	return []byte(secret), nil
+}
+
+func (u *User) accountState(purpose string) string {
+	h := sha256.New()
+	h.Write([]byte(purpose + "\x00" + u.Email + "\x00"))
+	switch purpose {
+	case PurposeResetPassword:
+		h.Write([]byte(u.Password))
+	case PurposeVerifyEmail:
+		if u.EmailVerifiedAt != nil {
+			h.Write([]byte("verified"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func signAccountPayload(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewAccountToken makes a link token that lets the user do one thing with
+// their account, once, before it expires.
+func NewAccountToken(user *User, purpose string, ttl time.Duration) (string, error) {
+	secret, err := accountSecret()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(accountClaims{
+		Purpose: purpose,
+		UserId:  user.ID,
+		Expires: time.Now().Add(ttl).Unix(),
+		State:   user.accountState(purpose),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signAccountPayload(secret, payload), nil
+}
+
+// lockUserByAccountToken checks the token and locks the user it was made
+// for, so the same link cannot be used twice at once.
+func lockUserByAccountToken(tx *gorm.DB, token, purpose string) (*User, error) {
+	secret, err := accountSecret()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(signAccountPayload(secret, parts[0]))) {
+		return nil, ErrInvalidAccountToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidAccountToken
+	}
+	claims := accountClaims{}
+	err = json.Unmarshal(data, &claims)
+	if err != nil || claims.Purpose != purpose || time.Now().Unix() >= claims.Expires {
+		return nil, ErrInvalidAccountToken
+	}
+
+	user := User{}
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", claims.UserId).Take(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidAccountToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(claims.State), []byte(user.accountState(purpose))) {
+		return nil, ErrInvalidAccountToken
+	}
+	return &user, nil
+}
+
+// actAsUser makes whoever holds a link act as the user it was sent to.
+func actAsUser(actor Actor, user *User) Actor {
+	actor.UserID = user.ID
+	actor.Role = user.Role
+	return actor
+}
+
+// VerifyEmail marks the address the token was sent to as verified. The
+// actor only says where the request came from.
+func VerifyEmail(db *gorm.DB, token string, actor Actor) (*User, error) {
+	var user *User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, err = lockUserByAccountToken(tx, token, PurposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		err = tx.Model(&User{}).Where("id = ?", user.ID).UpdateColumn("email_verified_at", now).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actAsUser(actor, user), "user.verify_email", "user", user.ID, nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// ResetPassword sets a new password and ends every session the old one
+// started. The reset link went to the user's mailbox, so it verifies the
+// address as well.
+func ResetPassword(db *gorm.DB, token, password string, actor Actor) (*User, error) {
+	var user *User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, err = lockUserByAccountToken(tx, token, PurposeResetPassword)
+		if err != nil {
+			return err
+		}
+		hashedPassword, err := Hash(password)
+		if err != nil {
+			return err
+		}
+		columns := map[string]interface{}{"password": string(hashedPassword)}
+		if user.EmailVerifiedAt == nil {
+			now := time.Now()
+			user.EmailVerifiedAt = &now
+			columns["email_verified_at"] = now
+		}
+		err = tx.Model(&User{}).Where("id = ?", user.ID).UpdateColumns(columns).Error
+		if err != nil {
+			return err
+		}
+		err = RevokeUserTokens(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		err = RevokeUserAccessTokens(tx, user.ID)
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actAsUser(actor, user), "user.password_reset", "user", user.ID, nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// IsEmailVerified says whether the user has confirmed their address.
+func IsEmailVerified(db *gorm.DB, uid uint) (bool, error) {
+	user := User{}
+	err := db.Model(&User{}).Select("email_verified_at").Where("id = ?", uid).Take(&user).Error
+	if err != nil {
+		return false, err
+	}
+	return user.EmailVerifiedAt != nil, nil
+}
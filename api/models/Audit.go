@@ -0,0 +1,242 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	AuditUserCreate     = "user.create"
+	AuditUserRole       = "user.role"
+	AuditAdminBootstrap = "admin.bootstrap"
+)
+
+// auditChainLock is the advisory lock held while an entry is appended, so
+// two writers never link to the same previous entry.
+const auditChainLock = 7146853
+
+const auditVerifyBatch = 500
+
+// Actor is who makes a change and from where. The zero Actor is the system
+// itself, such as when the first admin is created at startup.
+type Actor struct {
+	UserID    uint
+	Role      string
+	RequestID string
+	IP        string
+}
+
+// AuditUser is what the audit log keeps about a user. The log cannot be
+// changed, so it holds nothing that names the person and a purge leaves
+// only an ID behind.
+type AuditUser struct {
+	ID            uint   `json:"id"`
+	Role          string `json:"role"`
+	PatronType    string `json:"patron_type"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func NewAuditUser(u *User) AuditUser {
+	return AuditUser{
+		ID:            u.ID,
+		Role:          u.Role,
+		PatronType:    u.PatronType,
+		EmailVerified: u.EmailVerifiedAt != nil,
+	}
+}
+
+// AuditEntry records who changed what. Before and After hold the changed
+// fields as JSON. Entries are only ever added: each one carries the hash of
+// the one before it, so editing or removing an entry breaks the chain from
+// there on.
+type AuditEntry struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	ActorId    uint      `gorm:"not null;index" json:"actor_id"`
+	Action     string    `gorm:"size:100;not null;index" json:"action"`
+	TargetType string    `gorm:"size:50;not null;index:idx_audit_target" json:"target_type"`
+	TargetId   uint      `gorm:"not null;index:idx_audit_target" json:"target_id"`
+	Before     string    `gorm:"type:text" json:"before"`
+	After      string    `gorm:"type:text" json:"after"`
+	RequestId  string    `gorm:"size:64;index" json:"request_id"`
+	Ip         string    `gorm:"size:64" json:"ip"`
+	PrevHash   string    `gorm:"size:64;not null" json:"prev_hash"`
+	Hash       string    `gorm:"size:64;not null;unique" json:"hash"`
+	CreatedAt  time.Time `gorm:"index" json:"created_at"`
+}
+
+// AuditChainError is returned by VerifyAuditChain when an entry does not
+// match its hash or does not follow the entry before it.
+type AuditChainError struct {
+	EntryID uint
+}
+
+func (e *AuditChainError) Error() string {
+	return fmt.Sprintf("The audit log was changed at entry %d", e.EntryID)
+}
+
+// computeHash covers every field but the id, which the database assigns.
+func (a *AuditEntry) computeHash() string {
+	fields := []string{
+		fmt.Sprint(a.ActorId), a.Action, a.TargetType, fmt.Sprint(a.TargetId),
+		a.Before, a.After, a.RequestId, a.Ip,
+		a.CreatedAt.UTC().Format(time.RFC3339Nano), a.PrevHash,
+	}
+	h := sha256.New()
+	for _, f := range fields {
+		// length prefixes keep "ab"+"c" and "a"+"bc" apart
+		fmt.Fprintf(h, "%d:%s;", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func auditJSON(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// RecordAudit appends an entry. Pass the transaction making the change, so
+// the entry is only kept if the change is.
+func RecordAudit(db *gorm.DB, actor Actor, action, targetType string, targetID uint, before, after interface{}) error {
+	entry := AuditEntry{
+		ActorId:    actor.UserID,
+		Action:     action,
+		TargetType: targetType,
+		TargetId:   targetID,
+		RequestId:  actor.RequestID,
+		Ip:         actor.IP,
+		// Postgres keeps microseconds, the hash has to match what is read back
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	}
+	var err error
+	entry.Before, err = auditJSON(before)
+	if err != nil {
+		return err
+	}
+	entry.After, err = auditJSON(after)
+	if err != nil {
+		return err
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", auditChainLock).Error
+		if err != nil {
+			return err
+		}
+		last := AuditEntry{}
+		err = tx.Order("id desc").Limit(1).Find(&last).Error
+		if err != nil {
+			return err
+		}
+		entry.PrevHash = last.Hash
+		entry.Hash = entry.computeHash()
+		return tx.Create(&entry).Error
+	})
+}
+
+// VerifyAuditChain walks the whole log and returns an *AuditChainError
+// for the first entry that was changed, or that follows a removed one. It
+// also returns how many entries were checked.
+func VerifyAuditChain(db *gorm.DB) (int64, error) {
+	var checked int64
+	var lastID uint
+	prevHash := ""
+	for {
+		entries := []AuditEntry{}
+		err := db.Where("id > ?", lastID).Order("id asc").Limit(auditVerifyBatch).Find(&entries).Error
+		if err != nil {
+			return checked, err
+		}
+		for i := range entries {
+			entry := &entries[i]
+			if entry.PrevHash != prevHash || entry.computeHash() != entry.Hash {
+				return checked, &AuditChainError{EntryID: entry.ID}
+			}
+			prevHash = entry.Hash
+			lastID = entry.ID
+			checked++
+		}
+		if len(entries) < auditVerifyBatch {
+			return checked, nil
+		}
+	}
+}
+
+var (
+	auditSortColumns = map[string]sortColumn{
+		"created_at": {Expr: "audit_entries.created_at", Kind: sortTime, Field: "CreatedAt"},
+	}
+	auditIDColumn = sortColumn{Expr: "audit_entries.id", Field: "ID"}
+)
+
+// AuditSearch filters the audit log. Empty fields match everything.
+type AuditSearch struct {
+	PageRequest
+	ActorId    *uint
+	Action     string
+	TargetType string
+	TargetId   *uint
+	RequestId  string
+	From       *time.Time
+	To         *time.Time
+}
+
+func (s *AuditSearch) Prepare() {
+	s.Action = strings.ToLower(strings.TrimSpace(s.Action))
+	s.TargetType = strings.ToLower(strings.TrimSpace(s.TargetType))
+	s.RequestId = strings.TrimSpace(s.RequestId)
+	s.PageRequest.Prepare("-created_at")
+}
+
+func (s *AuditSearch) Validate() error {
+	if _, ok := auditSortColumns[strings.TrimPrefix(s.Sort, "-")]; !ok {
+		return ErrInvalidSort
+	}
+	if s.From != nil && s.To != nil && s.To.Before(*s.From) {
+		return errors.New("to must not be before from")
+	}
+	return nil
+}
+
+func FindAuditEntries(db *gorm.DB, s *AuditSearch) (*Page, error) {
+	query := db.Model(&AuditEntry{})
+	if s.ActorId != nil {
+		query = query.Where("audit_entries.actor_id = ?", *s.ActorId)
+	}
+	if s.Action != "" {
+		// "book" matches every action on books
+		if strings.Contains(s.Action, ".") {
+			query = query.Where("audit_entries.action = ?", s.Action)
+		} else {
+			query = query.Where("audit_entries.action LIKE ?", s.Action+".%")
+		}
+	}
+	if s.TargetType != "" {
+		query = query.Where("audit_entries.target_type = ?", s.TargetType)
+	}
+	if s.TargetId != nil {
+		query = query.Where("audit_entries.target_id = ?", *s.TargetId)
+	}
+	if s.RequestId != "" {
+		query = query.Where("audit_entries.request_id = ?", s.RequestId)
+	}
+	if s.From != nil {
+		query = query.Where("audit_entries.created_at >= ?", *s.From)
+	}
+	if s.To != nil {
+		query = query.Where("audit_entries.created_at <= ?", *s.To)
+	}
+	entries := []AuditEntry{}
+	return paginate(query, &s.PageRequest, auditSortColumns, auditIDColumn, &entries)
+}
@@ -1,21 +1,67 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html"
+	"net/url"
 	"strings"
 
+	"github.com/brianhumphreys/library_app/api/utils/isbn"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrDuplicateIsbn  = errors.New("A book with this Isbn is already in the library")
+	ErrBookOnLoan     = errors.New("A book cannot be deleted while copies of it are on loan")
+	ErrBookNotDeleted = errors.New("This book has not been deleted")
 )
 
 type Book struct {
 	gorm.Model
-	Title       string `gorm:"size:255;not null" json:"title"`
-	Author      string `gorm:"size:255;not null" json:"author"`
-	Isbn        string `gorm:"size:255;not null" json:"isbn"`
-	Description string `gorm:"size:4096;not null" json:"description"`
-	Available   bool   `gorm:"not null" json:"available"`
+	Title           string     `gorm:"size:255;not null" json:"title"`
+	Author          string     `gorm:"size:255;not null" json:"author"`
+	Isbn            string     `gorm:"size:255;not null" json:"isbn"`
+	Description     string     `gorm:"size:4096;not null" json:"description"`
+	Publisher       string     `gorm:"size:255" json:"publisher"`
+	PublicationYear int        `json:"publication_year"`
+	Subjects        StringList `json:"subjects"`
+	CoverUrl        string     `gorm:"size:512" json:"cover_url"`
+	Available       bool       `gorm:"-" json:"available"`
+	CopiesTotal     int        `gorm:"-" json:"copies_total"`
+	CopiesAvailable int        `gorm:"-" json:"copies_available"`
+	Copies          []BookCopy `gorm:"-" json:"copies,omitempty"`
+}
+
+// StringList is kept in a text column as a JSON array.
+type StringList []string
+
+func (StringList) GormDataType() string {
+	return "text"
+}
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	raw, err := json.Marshal(l)
+	return string(raw), err
+}
+
+func (l *StringList) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case string:
+		return json.Unmarshal([]byte(v), l)
+	case []byte:
+		return json.Unmarshal(v, l)
+	}
+	return fmt.Errorf("cannot scan %T into a StringList", src)
 }
 
 func (b *Book) Prepare() {
@@ -23,6 +69,19 @@ func (b *Book) Prepare() {
 	b.Author = html.EscapeString(strings.TrimSpace(b.Author))
 	b.Isbn = html.EscapeString(strings.TrimSpace(b.Isbn))
 	b.Description = html.EscapeString(strings.TrimSpace(b.Description))
+	b.Publisher = html.EscapeString(strings.TrimSpace(b.Publisher))
+	b.CoverUrl = strings.TrimSpace(b.CoverUrl)
+	subjects := StringList{}
+	for _, subject := range b.Subjects {
+		subject = html.EscapeString(strings.TrimSpace(subject))
+		if subject != "" {
+			subjects = append(subjects, subject)
+		}
+	}
+	b.Subjects = subjects
+	for i := range b.Copies {
+		b.Copies[i].Prepare()
+	}
 	// b.Description = html.EscapeString(strings.TrimSpace(b.Description))
 }
 
@@ -39,27 +98,114 @@ func (b *Book) Validate() error {
 	if b.Description == "" {
 		return errors.New("Required Description")
 	}
+	normalized, err := isbn.Normalize(b.Isbn)
+	if err != nil {
+		return err
+	}
+	b.Isbn = normalized
+	if b.PublicationYear < 0 {
+		return errors.New("Invalid Publication Year")
+	}
+	if b.CoverUrl != "" {
+		cover, err := url.Parse(b.CoverUrl)
+		if err != nil || (cover.Scheme != "http" && cover.Scheme != "https") || cover.Host == "" {
+			return errors.New("Invalid Cover Url")
+		}
+	}
+	for i := range b.Copies {
+		if err := b.Copies[i].validateStatus(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// SaveBook creates the book along with its copies. A book saved without any
+// copies gets a single available copy so it can be lent straight away.
 func (b *Book) SaveBook(db *gorm.DB) (*Book, error) {
 	var err error
-	err = db.Create(&b).Error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := checkIsbnIsFree(tx, b.Isbn, 0)
+		if err != nil {
+			return err
+		}
+		err = tx.Create(&b).Error
+		if err != nil {
+			return duplicateIsbnError(err)
+		}
+		if len(b.Copies) == 0 {
+			b.Copies = []BookCopy{{Status: CopyAvailable}}
+		}
+		for i := range b.Copies {
+			b.Copies[i].BookId = uint64(b.ID)
+			if b.Copies[i].Barcode == "" {
+				b.Copies[i].Barcode = defaultBarcode(b.ID, i+1)
+			}
+			if b.Copies[i].Status == "" {
+				b.Copies[i].Status = CopyAvailable
+			}
+			err = tx.Create(&b.Copies[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return &Book{}, err
 	}
+	counted := []Book{*b}
+	err = withCopyCounts(db, counted)
+	if err != nil {
+		return &Book{}, err
+	}
+	b.Available, b.CopiesTotal, b.CopiesAvailable = counted[0].Available, counted[0].CopiesTotal, counted[0].CopiesAvailable
 	return b, nil
 }
 
-func (p *Book) FindAllBooks(db *gorm.DB) (*[]Book, error) {
-	var err error
+// CreateBookAs saves the book like SaveBook and records it in the audit log
+// in the same transaction.
+func (b *Book) CreateBookAs(db *gorm.DB, actor Actor) (*Book, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := b.SaveBook(tx)
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "book.create", "book", b.ID, nil, b)
+	})
+	if err != nil {
+		return &Book{}, err
+	}
+	return b, nil
+}
+
+// SaveBooks adds a batch of books in one transaction, so either every book
+// is saved and audited or none are.
+func SaveBooks(db *gorm.DB, books []Book, actor Actor) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range books {
+			_, err := books[i].CreateBookAs(tx, actor)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *Book) FindAllBooks(db *gorm.DB, req *PageRequest) (*Page, error) {
+	req.Prepare("-updated_at")
 	books := []Book{}
-	err = db.Order("updated_at desc").Limit(100).Find(&books).Error
-	// err = db.Table("books").Select("books.id as id, books.title as title, books.author as author, books.isbn as isbn, books.description as description, books.created_at as created_at, books.updated_at as updated_at, checkouts.user_id as user_id, checkouts.checked_in as checked_in").Order("books.updated_at desc").Limit(100).Joins("LEFT JOIN checkouts on checkouts.book_id = books.id").Find(&booksAvailable).Error
+	page, err := paginate(db.Model(&Book{}), req, bookSortColumns, bookIDColumn, &books)
 	if err != nil {
-		return &[]Book{}, err
+		return nil, err
 	}
-	return &books, nil
+	err = withCopyCounts(db, books)
+	if err != nil {
+		return nil, err
+	}
+	page.Data = books
+	return page, nil
 }
 
 func FindBookByID(db *gorm.DB, bid uint64) (*[]Book, error) {
@@ -67,6 +213,9 @@ func FindBookByID(db *gorm.DB, bid uint64) (*[]Book, error) {
 
 	books := []Book{}
 	err = db.Where("id = ?", bid).Find(&books).Error
+	if err == nil {
+		err = withCopyCounts(db, books)
+	}
 	if err != nil {
 		return &[]Book{}, err
 	}
@@ -74,38 +223,198 @@ func FindBookByID(db *gorm.DB, bid uint64) (*[]Book, error) {
 	return &books, nil
 }
 
-func (b *Book) UpdateABook(db *gorm.DB) (*Book, error) {
-	var err error
+func (b *Book) UpdateABook(db *gorm.DB, actor Actor) (*Book, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		books, err := FindBookByID(tx, uint64(b.ID))
+		if err != nil {
+			return err
+		}
+		if len(*books) == 0 {
+			return errors.New("book does not exist")
+		}
+		current := (*books)[0]
 
-	books, err := FindBookByID(db, uint64(b.ID))
+		b.Available = current.Available
+		b.CopiesTotal = current.CopiesTotal
+		b.CopiesAvailable = current.CopiesAvailable
+		err = checkIsbnIsFree(tx, b.Isbn, b.ID)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&Book{}).Where("id = ?", b.ID).Updates(Book{
+			Title:           b.Title,
+			Author:          b.Author,
+			Isbn:            b.Isbn,
+			Description:     b.Description,
+			Publisher:       b.Publisher,
+			PublicationYear: b.PublicationYear,
+			Subjects:        b.Subjects,
+			CoverUrl:        b.CoverUrl,
+		}).Error
+		fmt.Println(err)
+		if err != nil {
+			return duplicateIsbnError(err)
+		}
+		return RecordAudit(tx, actor, "book.update", "book", b.ID, current, b)
+	})
 	if err != nil {
 		return &Book{}, err
 	}
-	if len(*books) == 0 {
-		return &Book{}, errors.New("book does not exist")
-	}
+	return b, nil
+}
 
-	b.Available = (*books)[0].Available
-	err = db.Model(&Book{}).Where("id = ?", b.ID).Updates(Book{
-		Title:       b.Title,
-		Author:      b.Author,
-		Isbn:        b.Isbn,
-		Description: b.Description,
-		Available:   (*books)[0].Available,
+// EachBook calls fn for every book in id order, reading the catalog in
+// batches so exports do not hold it all in memory.
+func EachBook(db *gorm.DB, batchSize int, fn func(*Book) error) error {
+	books := []Book{}
+	return db.Model(&Book{}).FindInBatches(&books, batchSize, func(tx *gorm.DB, batch int) error {
+		for i := range books {
+			err := fn(&books[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
 	}).Error
-	fmt.Println(err)
+}
+
+// FindBookByIsbn looks a book up by either its ISBN-10 or ISBN-13.
+func FindBookByIsbn(db *gorm.DB, number string) (*Book, error) {
+	normalized, err := isbn.Normalize(number)
 	if err != nil {
-		return &Book{}, err
+		return nil, err
 	}
-	return b, nil
+	books := []Book{}
+	err = db.Where("isbn = ?", normalized).Limit(1).Find(&books).Error
+	if err == nil {
+		err = withCopyCounts(db, books)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(books) == 0 {
+		return nil, ErrBookNotFound
+	}
+	return &books[0], nil
 }
 
-func (b *Book) DeleteABook(db *gorm.DB) (int64, error) {
-	db.Delete(&b)
+// FindTakenIsbns returns which of the given ISBNs are already in the library.
+func FindTakenIsbns(db *gorm.DB, numbers []string) ([]string, error) {
+	taken := []string{}
+	if len(numbers) == 0 {
+		return taken, nil
+	}
+	err := db.Model(&Book{}).Where("isbn IN ?", numbers).Pluck("isbn", &taken).Error
+	if err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
 
-	if db.Error != nil {
-		return 0, db.Error
+func checkIsbnIsFree(db *gorm.DB, number string, bid uint) error {
+	var count int64
+	err := db.Model(&Book{}).Where("isbn = ? AND id <> ?", number, bid).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicateIsbn
 	}
+	return nil
+}
+
+// duplicateIsbnError catches the unique index firing when two admins add the
+// same book at once.
+func duplicateIsbnError(err error) error {
+	if strings.Contains(err.Error(), "idx_books_isbn") {
+		return ErrDuplicateIsbn
+	}
+	return err
+}
+
+// DeleteABook soft deletes the book and cancels the holds on it. It is
+// refused while any copy is still out on loan.
+func (b *Book) DeleteABook(db *gorm.DB, actor Actor) (int64, error) {
+	var deleted int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		current, err := lockBookForCheckout(tx, uint64(b.ID))
+		if err != nil {
+			return err
+		}
+		var onLoan int64
+		err = tx.Model(&Checkout{}).Where("book_id = ? AND checked_in = false", b.ID).Count(&onLoan).Error
+		if err != nil {
+			return err
+		}
+		if onLoan > 0 {
+			return ErrBookOnLoan
+		}
+
+		holds := []Hold{}
+		err = activeHolds(tx, uint64(b.ID)).Find(&holds).Error
+		if err != nil {
+			return err
+		}
+		for _, hold := range holds {
+			err = tx.Model(&Hold{}).Where("id = ?", hold.ID).Update("status", HoldCancelled).Error
+			if err != nil {
+				return err
+			}
+			if hold.CopyId != nil {
+				err = setCopyStatus(tx, uint(*hold.CopyId), CopyAvailable)
+				if err != nil {
+					return err
+				}
+			}
+		}
 
-	return db.RowsAffected, nil
+		result := tx.Delete(&Book{}, b.ID)
+		deleted = result.RowsAffected
+		if result.Error != nil {
+			return result.Error
+		}
+		return RecordAudit(tx, actor, "book.delete", "book", b.ID, current, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// RestoreBook undoes DeleteABook. Holds cancelled by the delete stay
+// cancelled.
+func RestoreBook(db *gorm.DB, bid uint64, actor Actor) (*Book, error) {
+	book := Book{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", bid).Take(&book).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrBookNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !book.DeletedAt.Valid {
+			return ErrBookNotDeleted
+		}
+		// another book may have taken the isbn in the meantime
+		err = checkIsbnIsFree(tx, book.Isbn, book.ID)
+		if err != nil {
+			return err
+		}
+		err = tx.Unscoped().Model(&Book{}).Where("id = ?", bid).Update("deleted_at", nil).Error
+		if err != nil {
+			return duplicateIsbnError(err)
+		}
+		book.DeletedAt = gorm.DeletedAt{}
+		return RecordAudit(tx, actor, "book.restore", "book", book.ID, nil, book)
+	})
+	if err != nil {
+		return nil, err
+	}
+	books := []Book{book}
+	err = withCopyCounts(db, books)
+	if err != nil {
+		return nil, err
+	}
+	return &books[0], nil
 }
@@ -0,0 +1,204 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	CopyAvailable   = "available"
+	CopyCheckedOut  = "checked_out"
+	CopyOnHoldShelf = "on_hold_shelf"
+	CopyLost        = "lost"
+	CopyInRepair    = "in_repair"
+	CopyWithdrawn   = "withdrawn"
+)
+
+var ErrCopyNotFound = errors.New("copy does not exist")
+
+// BookCopy is a physical item on the shelf. Book holds the bibliographic
+// record and each copy carries its own circulation status.
+type BookCopy struct {
+	gorm.Model
+	BookId        uint64 `gorm:"not null;index" json:"book_id"`
+	Barcode       string `gorm:"size:64;not null;unique" json:"barcode"`
+	ShelfLocation string `gorm:"size:255" json:"shelf_location"`
+	Condition     string `gorm:"size:100" json:"condition"`
+	ItemType      string `gorm:"size:50;not null;default:standard" json:"item_type"`
+	Status        string `gorm:"size:20;not null;default:available;index" json:"status"`
+}
+
+func (bc *BookCopy) Prepare() {
+	bc.Barcode = html.EscapeString(strings.TrimSpace(bc.Barcode))
+	bc.ShelfLocation = html.EscapeString(strings.TrimSpace(bc.ShelfLocation))
+	bc.Condition = html.EscapeString(strings.TrimSpace(bc.Condition))
+	bc.ItemType = html.EscapeString(strings.ToLower(strings.TrimSpace(bc.ItemType)))
+	bc.Status = strings.ToLower(strings.TrimSpace(bc.Status))
+}
+
+func (bc *BookCopy) Validate() error {
+	if bc.Barcode == "" {
+		return errors.New("Required Barcode")
+	}
+	return bc.validateStatus()
+}
+
+func (bc *BookCopy) validateStatus() error {
+	if bc.ItemType == "" {
+		bc.ItemType = DefaultItemType
+	}
+	switch bc.Status {
+	case "":
+		bc.Status = CopyAvailable
+	case CopyAvailable, CopyLost, CopyInRepair, CopyWithdrawn:
+	default:
+		// checked_out and on_hold_shelf are only ever set by circulation
+		return errors.New("Status must be 'available', 'lost', 'in_repair' or 'withdrawn'")
+	}
+	return nil
+}
+
+func defaultBarcode(bid uint, n int) string {
+	return fmt.Sprintf("B%06d-%02d", bid, n)
+}
+
+func (bc *BookCopy) SaveCopy(db *gorm.DB, actor Actor) (*BookCopy, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&bc).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "copy.create", "copy", bc.ID, nil, bc)
+	})
+	if err != nil {
+		return &BookCopy{}, err
+	}
+	return bc, nil
+}
+
+func FindCopyByID(db *gorm.DB, cid uint64) (*BookCopy, error) {
+	item := BookCopy{}
+	err := db.Model(&BookCopy{}).Where("id = ?", cid).Take(&item).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCopyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func FindCopiesOfBookWithID(db *gorm.DB, bid uint64) (*[]BookCopy, error) {
+	var err error
+	copies := []BookCopy{}
+	err = db.Model(&BookCopy{}).Where("book_id = ?", bid).Order("id asc").Limit(100).Find(&copies).Error
+	if err != nil {
+		return nil, err
+	}
+	return &copies, nil
+}
+
+// UpdateACopy changes the shelf details of a copy. Copies that are out on
+// loan or waiting on the hold shelf keep their circulation status.
+func (bc *BookCopy) UpdateACopy(db *gorm.DB, actor Actor) (*BookCopy, error) {
+	var err error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		_, err := lockBookForCheckout(tx, bc.BookId)
+		if err != nil {
+			return err
+		}
+		current := BookCopy{}
+		err = tx.Where("id = ?", bc.ID).Take(&current).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != bc.Status && (current.Status == CopyCheckedOut || current.Status == CopyOnHoldShelf) {
+			return &CheckoutConflictError{BookId: bc.BookId, Reason: "This copy is in circulation and its status cannot be changed"}
+		}
+		err = tx.Model(&BookCopy{}).Where("id = ?", bc.ID).Updates(map[string]interface{}{
+			"barcode":        bc.Barcode,
+			"shelf_location": bc.ShelfLocation,
+			"condition":      bc.Condition,
+			"item_type":      bc.ItemType,
+			"status":         bc.Status,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "copy.update", "copy", bc.ID, current, bc)
+	})
+	if err != nil {
+		return &BookCopy{}, err
+	}
+	return bc, nil
+}
+
+func GetCurrentOwnerOfCopyWithID(db *gorm.DB, cid uint64) ([]uint64, error) {
+	var err error
+	var uid []uint64
+	err = db.Table("checkouts").Select("user_id").Where("copy_id = ? AND checked_in = false", cid).Where(notDeleted("checkouts")).Find(&uid).Error
+	if err != nil {
+		return nil, err
+	}
+	return uid, nil
+}
+
+// lockAvailableCopy picks the lowest numbered copy of a book that is free
+// to lend. The caller must hold the lock on the book row.
+func lockAvailableCopy(tx *gorm.DB, bid uint64) (*BookCopy, error) {
+	item := BookCopy{}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("book_id = ? AND status = ?", bid, CopyAvailable).Order("id asc").Take(&item).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func setCopyStatus(tx *gorm.DB, cid uint, status string) error {
+	return tx.Model(&BookCopy{}).Where("id = ?", cid).Update("status", status).Error
+}
+
+type copyCount struct {
+	BookId uint64
+	Status string
+	Total  int
+}
+
+// withCopyCounts fills in the copy totals reported alongside each book.
+func withCopyCounts(db *gorm.DB, books []Book) error {
+	if len(books) == 0 {
+		return nil
+	}
+	ids := make([]uint, len(books))
+	for i := range books {
+		ids[i] = books[i].ID
+	}
+	counts := []copyCount{}
+	err := db.Model(&BookCopy{}).Select("book_id, status, count(*) as total").Where("book_id IN ?", ids).Group("book_id, status").Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+	for i := range books {
+		books[i].CopiesTotal = 0
+		books[i].CopiesAvailable = 0
+		for _, c := range counts {
+			if c.BookId != uint64(books[i].ID) || c.Status == CopyWithdrawn {
+				continue
+			}
+			books[i].CopiesTotal += c.Total
+			if c.Status == CopyAvailable {
+				books[i].CopiesAvailable += c.Total
+			}
+		}
+		books[i].Available = books[i].CopiesAvailable > 0
+	}
+	return nil
+}
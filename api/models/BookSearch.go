@@ -0,0 +1,189 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/utils/isbn"
+	"gorm.io/gorm"
+)
+
+const authorFacetLimit = 20
+
+// bookSearchVector must match the expression of idx_books_search exactly or
+// Postgres will not use the index.
+const bookSearchVector = "(setweight(to_tsvector('english', books.title), 'A') || " +
+	"setweight(to_tsvector('english', books.author), 'B') || " +
+	"setweight(to_tsvector('simple', books.isbn), 'A') || " +
+	"setweight(to_tsvector('english', books.description), 'C'))"
+
+const bookSearchRank = "ts_rank(" + bookSearchVector + ", plainto_tsquery('english', ?))"
+
+const bookHasAvailableCopy = "EXISTS (SELECT 1 FROM book_copies WHERE book_copies.book_id = books.id AND book_copies.status = 'available' AND book_copies.deleted_at IS NULL)"
+
+var (
+	bookSortColumns = map[string]sortColumn{
+		"title":      {Expr: "books.title", Kind: sortText, Field: "Title"},
+		"author":     {Expr: "books.author", Kind: sortText, Field: "Author"},
+		"created_at": {Expr: "books.created_at", Kind: sortTime, Field: "CreatedAt"},
+		"updated_at": {Expr: "books.updated_at", Kind: sortTime, Field: "UpdatedAt"},
+	}
+	bookIDColumn = sortColumn{Expr: "books.id", Field: "ID"}
+)
+
+// BookSearch is a catalog query. Besides the usual book sorts it can be
+// sorted by "relevance" when there is a text query.
+type BookSearch struct {
+	PageRequest
+	Query       string
+	Author      string
+	Available   *bool
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+}
+
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type BookFacets struct {
+	Author       []FacetCount `json:"author"`
+	Availability []FacetCount `json:"availability"`
+}
+
+type BookSearchResult struct {
+	Page
+	Facets BookFacets `json:"facets"`
+}
+
+type bookHit struct {
+	Book
+	Rank float64
+}
+
+func (s *BookSearch) Prepare() {
+	s.Query = strings.TrimSpace(s.Query)
+	s.Author = strings.TrimSpace(s.Author)
+	defaultSort := "-updated_at"
+	if s.Query != "" {
+		defaultSort = "-relevance"
+	}
+	s.PageRequest.Prepare(defaultSort)
+	if s.Sort == "relevance" {
+		// the best match first is the only useful order for relevance
+		s.Sort = "-relevance"
+	}
+}
+
+func (s *BookSearch) Validate() error {
+	if strings.TrimPrefix(s.Sort, "-") == "relevance" {
+		if s.Query == "" {
+			return errors.New("Sorting by relevance needs a search query")
+		}
+	} else if _, ok := bookSortColumns[strings.TrimPrefix(s.Sort, "-")]; !ok {
+		return ErrInvalidSort
+	}
+	if s.CreatedFrom != nil && s.CreatedTo != nil && s.CreatedTo.Before(*s.CreatedFrom) {
+		return errors.New("created_to must not be before created_from")
+	}
+	return nil
+}
+
+// filter applies everything except the cursor, so facets count the whole
+// result set rather than one page of it.
+func (s *BookSearch) filter(db *gorm.DB) *gorm.DB {
+	if s.Query != "" {
+		number, err := isbn.Normalize(s.Query)
+		if err != nil {
+			number = s.Query
+		}
+		db = db.Where("("+bookSearchVector+" @@ plainto_tsquery('english', ?) OR books.isbn = ?)", s.Query, number)
+	}
+	if s.Author != "" {
+		// a facet value, matched whole so % and _ are not wildcards
+		db = db.Where("lower(books.author) = lower(?)", s.Author)
+	}
+	if s.Available != nil {
+		if *s.Available {
+			db = db.Where(bookHasAvailableCopy)
+		} else {
+			db = db.Where("NOT " + bookHasAvailableCopy)
+		}
+	}
+	if s.CreatedFrom != nil {
+		db = db.Where("books.created_at >= ?", *s.CreatedFrom)
+	}
+	if s.CreatedTo != nil {
+		db = db.Where("books.created_at < ?", *s.CreatedTo)
+	}
+	return db
+}
+
+func (s *BookSearch) sortColumns() map[string]sortColumn {
+	if s.Query == "" {
+		return bookSortColumns
+	}
+	sorts := map[string]sortColumn{
+		"relevance": {Expr: bookSearchRank, Vars: []interface{}{s.Query}, Kind: sortNumber, Field: "Rank"},
+	}
+	for k, v := range bookSortColumns {
+		sorts[k] = v
+	}
+	return sorts
+}
+
+// SearchBooks runs a catalog query and returns one page of books with the
+// facet counts for the whole result set.
+func SearchBooks(db *gorm.DB, s *BookSearch) (*BookSearchResult, error) {
+	query := s.filter(db.Model(&Book{}))
+	if s.Query != "" {
+		query = query.Select("books.*, "+bookSearchRank+" AS rank", s.Query)
+	}
+	hits := []bookHit{}
+	page, err := paginate(query, &s.PageRequest, s.sortColumns(), bookIDColumn, &hits)
+	if err != nil {
+		return nil, err
+	}
+
+	books := make([]Book, len(hits))
+	for i := range hits {
+		books[i] = hits[i].Book
+	}
+	err = withCopyCounts(db, books)
+	if err != nil {
+		return nil, err
+	}
+	page.Data = books
+
+	result := BookSearchResult{Page: *page}
+	result.Facets, err = s.facets(db)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (s *BookSearch) facets(db *gorm.DB) (BookFacets, error) {
+	facets := BookFacets{Author: []FacetCount{}, Availability: []FacetCount{}}
+	err := s.filter(db.Model(&Book{})).Select("books.author AS value, count(*) AS count").Group("books.author").Order("count desc, value asc").Limit(authorFacetLimit).Scan(&facets.Author).Error
+	if err != nil {
+		return facets, err
+	}
+
+	var available, total int64
+	err = s.filter(db.Model(&Book{})).Count(&total).Error
+	if err != nil {
+		return facets, err
+	}
+	err = s.filter(db.Model(&Book{})).Where(bookHasAvailableCopy).Count(&available).Error
+	if err != nil {
+		return facets, err
+	}
+	facets.Availability = []FacetCount{
+		{Value: "available", Count: available},
+		{Value: "unavailable", Count: total - available},
+	}
+	return facets, nil
+}
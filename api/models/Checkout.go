@@ -2,55 +2,144 @@ package models
 
 import (
 	"errors"
-	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+const (
+	defaultLoanPeriodDays = 14
+	defaultMaxRenewals    = 2
+)
+
+var (
+	ErrBookNotFound     = errors.New("book does not exist")
+	ErrCheckoutNotFound = errors.New("checkout does not exist")
+	ErrCheckoutNotOwned = errors.New("You do not currently have this book checked out")
+)
+
+// CheckoutConflictError is returned when a checkout or checkin loses a race
+// against another request for the same book.
+type CheckoutConflictError struct {
+	BookId uint64
+	Reason string
+}
+
+func (e *CheckoutConflictError) Error() string {
+	return e.Reason
+}
+
 type Checkout struct {
 	gorm.Model
-	UserId    uint   `gorm:"size:100;not null;" json:"user_id"`
-	BookId    uint64 `gorm:"size:100;not null;" json:"book_id"`
-	CheckedIn bool   `json:"checked_in"`
+	UserId       uint       `gorm:"size:100;not null;" json:"user_id"`
+	BookId       uint64     `gorm:"size:100;not null;" json:"book_id"`
+	CopyId       uint64     `gorm:"not null;default:0;index" json:"copy_id"`
+	CheckedIn    bool       `json:"checked_in"`
+	DueAt        time.Time  `gorm:"index" json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at"`
+	RenewalCount int        `gorm:"not null;default:0" json:"renewal_count"`
 }
 
 type BookRecord struct {
-	Title      string `gorm:"size:512;" json:"title"`
-	Author     string `gorm:"size:100;" json:"author"`
-	CheckedIn  string `gorm:"size:100;" json:"checked_in"`
-	CheckedOut string `gorm:"size:100;" json:"checked_out"`
+	CheckoutId uint       `json:"checkout_id"`
+	Title      string     `gorm:"size:512;" json:"title"`
+	Author     string     `gorm:"size:100;" json:"author"`
+	CheckedOut time.Time  `json:"checked_out"`
+	DueAt      time.Time  `json:"due_at"`
+	ReturnedAt *time.Time `json:"returned_at"`
 }
 
 type UserRecord struct {
-	Email      string `gorm:"size:512;" json:"email"`
-	CheckedIn  string `gorm:"size:100;" json:"checked_in"`
-	CheckedOut string `gorm:"size:100;" json:"checked_out"`
+	CheckoutId uint       `json:"checkout_id"`
+	Email      string     `gorm:"size:512;" json:"email"`
+	CheckedOut time.Time  `json:"checked_out"`
+	DueAt      time.Time  `json:"due_at"`
+	ReturnedAt *time.Time `json:"returned_at"`
 }
 
-func GetBookCheckoutHistoryOfUserWithID(db *gorm.DB, uid uint) (*[]BookRecord, error) {
-	var err error
-	books := []BookRecord{}
-	err = db.Table("checkouts").Order("checkouts.created_at desc").Select("books.title as title, books.author as author, checkouts.updated_at as checked_in, checkouts.created_at as checked_out").Joins("RIGHT JOIN books on books.id = checkouts.book_id").Where("checkouts.user_id = ?", uid).Limit(100).Find(&books).Error
-	if err != nil {
-		return nil, err
+type OverdueRecord struct {
+	CheckoutId uint      `json:"checkout_id"`
+	UserId     uint      `json:"user_id"`
+	Email      string    `json:"email"`
+	BookId     uint64    `json:"book_id"`
+	Title      string    `json:"title"`
+	CheckedOut time.Time `json:"checked_out"`
+	DueAt      time.Time `json:"due_at"`
+	DaysLate   int       `gorm:"-" json:"days_late"`
+}
+
+// LoanPeriod reads LOAN_PERIOD_DAYS, falling back to two weeks. It is the
+// loan period of the default circulation policy.
+func LoanPeriod() time.Duration {
+	return time.Duration(envInt("LOAN_PERIOD_DAYS", defaultLoanPeriodDays)) * 24 * time.Hour
+}
+
+// MaxRenewals reads MAX_RENEWALS, falling back to two renewals per loan.
+func MaxRenewals() int {
+	return envInt("MAX_RENEWALS", defaultMaxRenewals)
+}
+
+func envInt(key string, fallback int) int {
+	val, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || val < 0 {
+		return fallback
 	}
-	return &books, nil
+	return val
 }
 
-func GetUserCheckoutHistoryOfBookWithID(db *gorm.DB, bid uint64) (*[]UserRecord, error) {
-	var err error
-	users := []UserRecord{}
-	err = db.Table("checkouts").Order("checkouts.created_at desc").Select("users.email as email, checkouts.updated_at as checked_in, checkouts.created_at as checked_out").Joins("RIGHT JOIN users on checkouts.user_id = users.id").Where("checkouts.book_id = ?", bid).Limit(100).Find(&users).Error
-	if err != nil {
-		return nil, err
+func (c *Checkout) BeforeCreate(db *gorm.DB) error {
+	if c.DueAt.IsZero() {
+		c.DueAt = time.Now().Add(LoanPeriod())
+	}
+	return nil
+}
+
+var (
+	bookRecordSortColumns = map[string]sortColumn{
+		"checked_out": {Expr: "checkouts.created_at", Kind: sortTime, Field: "CheckedOut"},
+		"due_at":      {Expr: "checkouts.due_at", Kind: sortTime, Field: "DueAt"},
+		"title":       {Expr: "books.title", Kind: sortText, Field: "Title"},
+	}
+	userRecordSortColumns = map[string]sortColumn{
+		"checked_out": {Expr: "checkouts.created_at", Kind: sortTime, Field: "CheckedOut"},
+		"due_at":      {Expr: "checkouts.due_at", Kind: sortTime, Field: "DueAt"},
+		"email":       {Expr: "users.email", Kind: sortText, Field: "Email"},
+	}
+	checkoutIDColumn = sortColumn{Expr: "checkouts.id", Field: "CheckoutId"}
+)
+
+// notDeleted keeps soft deleted rows of the given tables out of a Table()
+// query. gorm only does that by itself for queries on a model.
+func notDeleted(tables ...string) string {
+	conditions := make([]string, len(tables))
+	for i, table := range tables {
+		conditions[i] = table + ".deleted_at IS NULL"
 	}
-	return &users, nil
+	return strings.Join(conditions, " AND ")
+}
+
+func GetBookCheckoutHistoryOfUserWithID(db *gorm.DB, uid uint, req *PageRequest) (*Page, error) {
+	req.Prepare("-checked_out")
+	books := []BookRecord{}
+	query := db.Table("checkouts").Select("checkouts.id as checkout_id, books.title as title, books.author as author, checkouts.created_at as checked_out, checkouts.due_at as due_at, checkouts.returned_at as returned_at").Joins("JOIN books on books.id = checkouts.book_id").Where("checkouts.user_id = ?", uid).Where(notDeleted("checkouts", "books"))
+	return paginate(query, req, bookRecordSortColumns, checkoutIDColumn, &books)
+}
+
+func GetUserCheckoutHistoryOfBookWithID(db *gorm.DB, bid uint64, req *PageRequest) (*Page, error) {
+	req.Prepare("-checked_out")
+	users := []UserRecord{}
+	query := db.Table("checkouts").Select("checkouts.id as checkout_id, users.email as email, checkouts.created_at as checked_out, checkouts.due_at as due_at, checkouts.returned_at as returned_at").Joins("JOIN users on checkouts.user_id = users.id").Where("checkouts.book_id = ?", bid).Where(notDeleted("checkouts", "users"))
+	return paginate(query, req, userRecordSortColumns, checkoutIDColumn, &users)
 }
 
 func GetCurrentOwnerOfBookWithID(db *gorm.DB, bid uint64) ([]uint64, error) {
 	var err error
 	var uid []uint64
-	err = db.Table("checkouts").Select("user_id").Where("book_id = ? AND checked_in = false", bid).Find(&uid).Error
+	err = db.Table("checkouts").Select("user_id").Where("book_id = ? AND checked_in = false", bid).Where(notDeleted("checkouts")).Find(&uid).Error
 	if err != nil {
 		return nil, err
 	}
@@ -60,69 +149,252 @@ func GetCurrentOwnerOfBookWithID(db *gorm.DB, bid uint64) ([]uint64, error) {
 func GetCurrentlyCheckedOutBooksOfUserWithID(db *gorm.DB, uid uint) (*[]Book, error) {
 	var err error
 	books := []Book{}
-	err = db.Table("users").Select("books.id, books.title, books.author, books.isbn, books.description").Joins("JOIN checkouts on checkouts.user_id = users.id").Joins("JOIN books on books.id = checkouts.book_id").Where("checkouts.user_id = ? AND checkouts.checked_in = false AND books.deleted_at is NULL", uid).Limit(100).Find(&books).Error
+	err = db.Table("users").Select("books.id, books.title, books.author, books.isbn, books.description").Joins("JOIN checkouts on checkouts.user_id = users.id").Joins("JOIN books on books.id = checkouts.book_id").Where("checkouts.user_id = ? AND checkouts.checked_in = false", uid).Where(notDeleted("users", "checkouts", "books")).Limit(100).Find(&books).Error
 	if err != nil {
 		return nil, err
 	}
-	for i := range books {
-		fmt.Println(books[i].Title)
-	}
 	return &books, nil
 }
 
-func (c *Checkout) MakeACheckout(db *gorm.DB) error {
-	var err error
+func lockBookForCheckout(tx *gorm.DB, bid uint64) (*Book, error) {
+	book := Book{}
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", bid).Take(&book).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrBookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
+
+// MakeACheckout lends a copy of the book to the patron. A specific copy can
+// be requested through CopyId, otherwise the first free copy is taken.
+func (c *Checkout) MakeACheckout(db *gorm.DB, actor Actor) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		book, err := lockBookForCheckout(tx, c.BookId)
+		if err != nil {
+			return err
+		}
+
+		// the book row is locked, so no other checkout can slip in between these checks and the insert
+		var open int64
+		err = tx.Model(&Checkout{}).Where("book_id = ? AND user_id = ? AND checked_in = false", book.ID, c.UserId).Count(&open).Error
+		if err != nil {
+			return err
+		}
+		if open > 0 {
+			return &CheckoutConflictError{BookId: c.BookId, Reason: "You already have this book checked out"}
+		}
+
+		now := time.Now()
+		err = advanceHoldQueue(tx, book, now)
+		if err != nil {
+			return err
+		}
+
+		item, err := c.pickCopy(tx, book)
+		if err != nil {
+			return err
+		}
+
+		err = lockPatron(tx, c.UserId)
+		if err != nil {
+			return err
+		}
+		policy, err := EvaluateCirculation(tx, CirculationRequest{Action: ActionCheckout, UserId: c.UserId, BookId: c.BookId, ItemType: item.ItemType})
+		if err != nil {
+			return err
+		}
+		if c.DueAt.IsZero() {
+			c.DueAt = now.Add(policy.LoanPeriod())
+		}
+
+		err = setCopyStatus(tx, item.ID, CopyCheckedOut)
+		if err != nil {
+			return err
+		}
+		c.CopyId = uint64(item.ID)
+		err = tx.Create(&c).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "checkout.create", "checkout", c.ID, nil, c)
+	})
+}
 
-	books, err := FindBookByID(db, c.BookId)
+// pickCopy chooses the copy to lend. A patron whose hold is ready takes the
+// copy set aside for them, everyone else can only take a free copy.
+func (c *Checkout) pickCopy(tx *gorm.DB, book *Book) (*BookCopy, error) {
+	held, err := readyHoldOfUser(tx, uint64(book.ID), c.UserId)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if len(*books) == 0 {
-		return errors.New("book does not exist")
+	if held != nil && held.CopyId != nil {
+		if c.CopyId != 0 && c.CopyId != *held.CopyId {
+			return nil, &CheckoutConflictError{BookId: c.BookId, Reason: "Please take the copy set aside for you on the hold shelf"}
+		}
+		err = tx.Model(&Hold{}).Where("id = ?", held.ID).Update("status", HoldFulfilled).Error
+		if err != nil {
+			return nil, err
+		}
+		return FindCopyByID(tx, *held.CopyId)
 	}
 
-	// todo: create transactions
-	err = db.Model(&Book{}).Where("id = ?", (*books)[0].ID).Update("available", false).Error
-	if err != nil {
-		return err
+	if c.CopyId != 0 {
+		item, err := FindCopyByID(tx, c.CopyId)
+		if err != nil {
+			return nil, err
+		}
+		if item.BookId != uint64(book.ID) {
+			return nil, ErrCopyNotFound
+		}
+		if item.Status != CopyAvailable {
+			return nil, &CheckoutConflictError{BookId: c.BookId, Reason: "This copy is not available"}
+		}
+		return item, nil
 	}
 
-	err = db.Create(&c).Error
+	item, err := lockAvailableCopy(tx, uint64(book.ID))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	if item == nil {
+		var held int64
+		err = tx.Model(&BookCopy{}).Where("book_id = ? AND status = ?", book.ID, CopyOnHoldShelf).Count(&held).Error
+		if err != nil {
+			return nil, err
+		}
+		if held > 0 {
+			return nil, &CheckoutConflictError{BookId: c.BookId, Reason: "This book is on hold for another patron"}
+		}
+		return nil, &CheckoutConflictError{BookId: c.BookId, Reason: "Someone has checked this book out"}
+	}
+	return item, nil
 }
 
 func (c *Checkout) HasUserCheckedBook(db *gorm.DB) error {
 	var err error
-	err = db.Table("checkouts").Where("user_id = ? AND book_id = ? AND checked_in = false", c.UserId, c.BookId).First(&c).Error
+	err = db.Table("checkouts").Where("user_id = ? AND book_id = ? AND checked_in = false", c.UserId, c.BookId).Where(notDeleted("checkouts")).First(&c).Error
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (c *Checkout) CheckinABook(db *gorm.DB) error {
-	var err error
+func (c *Checkout) CheckinABook(db *gorm.DB, actor Actor) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		book, err := lockBookForCheckout(tx, c.BookId)
+		if err != nil {
+			return err
+		}
 
-	books, err := FindBookByID(db, c.BookId)
-	if err != nil {
-		return err
+		loan := Checkout{}
+		err = tx.Where("user_id = ? AND book_id = ? AND checked_in = false", c.UserId, book.ID).Take(&loan).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &CheckoutConflictError{BookId: c.BookId, Reason: "This book has already been checked in"}
+		}
+		if err != nil {
+			return err
+		}
+
+		returnedAt := time.Now()
+		err = tx.Model(&Checkout{}).Where("id = ?", loan.ID).Updates(map[string]interface{}{
+			"checked_in":  true,
+			"returned_at": returnedAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+		err = chargeFine(tx, &loan, returnedAt)
+		if err != nil {
+			return err
+		}
+
+		// the copy goes to the hold shelf if anyone is waiting for the book
+		if loan.CopyId != 0 {
+			err = setCopyStatus(tx, uint(loan.CopyId), CopyAvailable)
+			if err != nil {
+				return err
+			}
+		}
+		err = advanceHoldQueue(tx, book, returnedAt)
+		if err != nil {
+			return err
+		}
+
+		*c = loan
+		c.CheckedIn = true
+		c.ReturnedAt = &returnedAt
+		return RecordAudit(tx, actor, "checkout.checkin", "checkout", c.ID, nil, c)
+	})
+}
+
+func FindCheckoutByID(db *gorm.DB, cid uint64) (*Checkout, error) {
+	checkout := Checkout{}
+	err := db.Model(&Checkout{}).Where("id = ?", cid).Take(&checkout).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCheckoutNotFound
 	}
-	if len(*books) == 0 {
-		return errors.New("book does not exist")
+	if err != nil {
+		return nil, err
 	}
+	return &checkout, nil
+}
 
-	// todo: create transactions
-	err = db.Model(&Book{}).Where("id = ?", (*books)[0].ID).Update("available", true).Error
+func RenewACheckout(db *gorm.DB, cid uint64, uid uint, actor Actor) (*Checkout, error) {
+	checkout := Checkout{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", cid).Take(&checkout).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCheckoutNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if checkout.UserId != uid || checkout.CheckedIn {
+			return ErrCheckoutNotOwned
+		}
+		itemType, err := itemTypeOfCopy(tx, checkout.CopyId)
+		if err != nil {
+			return err
+		}
+		err = lockPatron(tx, uid)
+		if err != nil {
+			return err
+		}
+		policy, err := EvaluateCirculation(tx, CirculationRequest{Action: ActionRenew, UserId: uid, BookId: checkout.BookId, ItemType: itemType, Checkout: &checkout})
+		if err != nil {
+			return err
+		}
+
+		// a renewal always gives a full loan period from today, even if the book is overdue
+		checkout.DueAt = time.Now().Add(policy.LoanPeriod())
+		checkout.RenewalCount++
+		err = tx.Model(&Checkout{}).Where("id = ?", checkout.ID).Updates(map[string]interface{}{
+			"due_at":        checkout.DueAt,
+			"renewal_count": checkout.RenewalCount,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "checkout.renew", "checkout", checkout.ID, nil, checkout)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return &checkout, nil
+}
 
-	err = db.Model(&c).Where("book_id = ? AND checked_in = false", c.BookId).Update("checked_in", true).Error
+func FindOverdueCheckouts(db *gorm.DB, now time.Time) (*[]OverdueRecord, error) {
+	var err error
+	records := []OverdueRecord{}
+	err = db.Table("checkouts").Order("checkouts.due_at asc").Select("checkouts.id as checkout_id, checkouts.user_id as user_id, users.email as email, checkouts.book_id as book_id, books.title as title, checkouts.created_at as checked_out, checkouts.due_at as due_at").Joins("JOIN users on users.id = checkouts.user_id").Joins("JOIN books on books.id = checkouts.book_id").Where("checkouts.checked_in = false AND checkouts.due_at < ?", now).Where(notDeleted("checkouts", "users", "books")).Limit(100).Find(&records).Error
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	for i := range records {
+		records[i].DaysLate = int(now.Sub(records[i].DueAt).Hours() / 24)
+	}
+	return &records, nil
 }
@@ -0,0 +1,279 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	HoldWaiting   = "waiting"
+	HoldReady     = "ready"
+	HoldFulfilled = "fulfilled"
+	HoldCancelled = "cancelled"
+	HoldExpired   = "expired"
+
+	defaultHoldPickupDays = 7
+)
+
+var (
+	ErrHoldNotFound    = errors.New("hold does not exist")
+	ErrHoldNotOwned    = errors.New("You can only cancel your own holds")
+	ErrHoldNotActive   = errors.New("This hold is no longer active")
+	ErrHoldAlreadyHeld = errors.New("You already have a hold on this book")
+	ErrHoldOnOwnBook   = errors.New("You currently have this book checked out")
+	ErrHoldBookOnShelf = errors.New("This book is available, check it out instead")
+)
+
+// Hold is a patron's place in the FIFO queue for a book. A hold is "ready"
+// once a copy has been set aside on the hold shelf for it.
+type Hold struct {
+	gorm.Model
+	UserId    uint       `gorm:"not null;index" json:"user_id"`
+	BookId    uint64     `gorm:"not null;index" json:"book_id"`
+	Status    string     `gorm:"size:20;not null;default:waiting" json:"status"`
+	CopyId    *uint64    `json:"copy_id"`
+	ReadyAt   *time.Time `json:"ready_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Position  int        `gorm:"-" json:"position,omitempty"`
+}
+
+// HoldPickupPeriod reads HOLD_PICKUP_DAYS, falling back to one week.
+func HoldPickupPeriod() time.Duration {
+	return time.Duration(envInt("HOLD_PICKUP_DAYS", defaultHoldPickupDays)) * 24 * time.Hour
+}
+
+func activeHolds(tx *gorm.DB, bid uint64) *gorm.DB {
+	return tx.Model(&Hold{}).Where("book_id = ? AND status IN ?", bid, []string{HoldWaiting, HoldReady})
+}
+
+// advanceHoldQueue expires ready holds whose pickup window has passed and
+// sets free copies aside on the hold shelf for the patrons waiting longest.
+// The caller must hold the lock on the book row.
+func advanceHoldQueue(tx *gorm.DB, book *Book, now time.Time) error {
+	stale := []Hold{}
+	err := tx.Model(&Hold{}).Where("book_id = ? AND status = ? AND expires_at <= ?", book.ID, HoldReady, now).Find(&stale).Error
+	if err != nil {
+		return err
+	}
+	for _, hold := range stale {
+		err = tx.Model(&Hold{}).Where("id = ?", hold.ID).Update("status", HoldExpired).Error
+		if err != nil {
+			return err
+		}
+		if hold.CopyId != nil {
+			err = setCopyStatus(tx, uint(*hold.CopyId), CopyAvailable)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		head := Hold{}
+		err = tx.Model(&Hold{}).Where("book_id = ? AND status = ?", book.ID, HoldWaiting).Order("id asc").Take(&head).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		item, err := lockAvailableCopy(tx, uint64(book.ID))
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return nil
+		}
+
+		policy, err := policyForUser(tx, head.UserId, item.ItemType)
+		if err != nil {
+			return err
+		}
+		copyID := uint64(item.ID)
+		expiresAt := now.Add(policy.HoldPickupPeriod())
+		err = tx.Model(&Hold{}).Where("id = ?", head.ID).Updates(map[string]interface{}{
+			"status":     HoldReady,
+			"copy_id":    copyID,
+			"ready_at":   now,
+			"expires_at": expiresAt,
+		}).Error
+		if err != nil {
+			return err
+		}
+		err = setCopyStatus(tx, item.ID, CopyOnHoldShelf)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readyHoldOfUser(tx *gorm.DB, bid uint64, uid uint) (*Hold, error) {
+	hold := Hold{}
+	err := tx.Model(&Hold{}).Where("book_id = ? AND user_id = ? AND status = ?", bid, uid, HoldReady).Take(&hold).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+func (h *Hold) PlaceAHold(db *gorm.DB, actor Actor) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		book, err := lockBookForCheckout(tx, h.BookId)
+		if err != nil {
+			return err
+		}
+
+		err = lockPatron(tx, h.UserId)
+		if err != nil {
+			return err
+		}
+		_, err = EvaluateCirculation(tx, CirculationRequest{Action: ActionHold, UserId: h.UserId, BookId: h.BookId})
+		if err != nil {
+			return err
+		}
+
+		var count int64
+		err = activeHolds(tx, h.BookId).Where("user_id = ?", h.UserId).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrHoldAlreadyHeld
+		}
+
+		err = tx.Model(&Checkout{}).Where("book_id = ? AND user_id = ? AND checked_in = false", h.BookId, h.UserId).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrHoldOnOwnBook
+		}
+
+		err = advanceHoldQueue(tx, book, time.Now())
+		if err != nil {
+			return err
+		}
+		item, err := lockAvailableCopy(tx, h.BookId)
+		if err != nil {
+			return err
+		}
+		if item != nil {
+			return ErrHoldBookOnShelf
+		}
+
+		err = activeHolds(tx, h.BookId).Count(&count).Error
+		if err != nil {
+			return err
+		}
+
+		h.Status = HoldWaiting
+		err = tx.Create(&h).Error
+		if err != nil {
+			return err
+		}
+		h.Position = int(count) + 1
+		return RecordAudit(tx, actor, "hold.create", "hold", h.ID, nil, h)
+	})
+}
+
+func FindHoldByID(db *gorm.DB, hid uint64) (*Hold, error) {
+	hold := Hold{}
+	err := db.Model(&Hold{}).Where("id = ?", hid).Take(&hold).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrHoldNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hold, nil
+}
+
+func (h *Hold) CancelAHold(db *gorm.DB, actor Actor) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		book, err := lockBookForCheckout(tx, h.BookId)
+		if err != nil {
+			return err
+		}
+
+		// a checkin may have set a copy aside for the hold since the caller
+		// read it, so go by the row as it is now
+		current := Hold{}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", h.ID).Take(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrHoldNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if current.Status != HoldWaiting && current.Status != HoldReady {
+			return ErrHoldNotActive
+		}
+		err = tx.Model(&Hold{}).Where("id = ?", h.ID).Update("status", HoldCancelled).Error
+		if err != nil {
+			return err
+		}
+
+		// a cancelled ready hold frees its copy for the next patron in line
+		if current.Status == HoldReady && current.CopyId != nil {
+			err = setCopyStatus(tx, uint(*current.CopyId), CopyAvailable)
+			if err != nil {
+				return err
+			}
+			err = advanceHoldQueue(tx, book, time.Now())
+			if err != nil {
+				return err
+			}
+		}
+		*h = current
+		h.Status = HoldCancelled
+		return RecordAudit(tx, actor, "hold.cancel", "hold", h.ID, nil, h)
+	})
+}
+
+func withQueuePositions(db *gorm.DB, holds []Hold) error {
+	for i := range holds {
+		if holds[i].Status != HoldWaiting && holds[i].Status != HoldReady {
+			continue
+		}
+		var ahead int64
+		err := activeHolds(db, holds[i].BookId).Where("id < ?", holds[i].ID).Count(&ahead).Error
+		if err != nil {
+			return err
+		}
+		holds[i].Position = int(ahead) + 1
+	}
+	return nil
+}
+
+func FindActiveHoldsOfUserWithID(db *gorm.DB, uid uint) (*[]Hold, error) {
+	var err error
+	holds := []Hold{}
+	err = db.Model(&Hold{}).Where("user_id = ? AND status IN ?", uid, []string{HoldWaiting, HoldReady}).Order("created_at asc").Limit(100).Find(&holds).Error
+	if err != nil {
+		return nil, err
+	}
+	err = withQueuePositions(db, holds)
+	if err != nil {
+		return nil, err
+	}
+	return &holds, nil
+}
+
+func FindHoldQueueOfBookWithID(db *gorm.DB, bid uint64) (*[]Hold, error) {
+	var err error
+	holds := []Hold{}
+	err = activeHolds(db, bid).Order("id asc").Limit(100).Find(&holds).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range holds {
+		holds[i].Position = i + 1
+	}
+	return &holds, nil
+}
@@ -0,0 +1,227 @@
+package models
+
+import (
+	"errors"
+	"html"
+	"math"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	LedgerFine     = "fine"
+	LedgerLostItem = "lost_item"
+	LedgerPayment  = "payment"
+	LedgerWaiver   = "waiver"
+
+	defaultFinePerDayCents     = 25
+	defaultFineCapCents        = 1000
+	defaultLostItemChargeCents = 2500
+	defaultBlockingBalance     = 1000
+)
+
+var ErrCreditExceedsBalance = errors.New("Amount is more than the balance owed")
+
+// LedgerEntry is one line on a patron's account. Charges are positive and
+// payments and waivers are negative, so the balance is the sum of amounts.
+type LedgerEntry struct {
+	gorm.Model
+	UserId      uint   `gorm:"not null;index" json:"user_id"`
+	CheckoutId  *uint  `gorm:"index" json:"checkout_id"`
+	Kind        string `gorm:"size:20;not null" json:"kind"`
+	AmountCents int64  `gorm:"not null" json:"amount_cents"`
+	Note        string `gorm:"size:512" json:"note"`
+	CreatedBy   uint   `json:"created_by"`
+}
+
+type Account struct {
+	UserId       uint          `json:"user_id"`
+	BalanceCents int64         `json:"balance_cents"`
+	Entries      []LedgerEntry `json:"entries"`
+}
+
+// FinePerDayCents reads FINE_PER_DAY_CENTS, falling back to 25 cents. This
+// and the charges below make up the default circulation policy.
+func FinePerDayCents() int64 {
+	return int64(envInt("FINE_PER_DAY_CENTS", defaultFinePerDayCents))
+}
+
+// FineCapCents reads FINE_CAP_CENTS, the most a single late return can cost.
+func FineCapCents() int64 {
+	return int64(envInt("FINE_CAP_CENTS", defaultFineCapCents))
+}
+
+// LostItemChargeCents reads LOST_ITEM_CHARGE_CENTS.
+func LostItemChargeCents() int64 {
+	return int64(envInt("LOST_ITEM_CHARGE_CENTS", defaultLostItemChargeCents))
+}
+
+// BlockingBalanceCents reads BLOCKING_BALANCE_CENTS. Patrons who owe more
+// than this cannot check out books.
+func BlockingBalanceCents() int64 {
+	return int64(envInt("BLOCKING_BALANCE_CENTS", defaultBlockingBalance))
+}
+
+// OverdueFine charges per started day late, up to the cap.
+func OverdueFine(dueAt, returnedAt time.Time, perDay, maxFine int64) int64 {
+	if !returnedAt.After(dueAt) {
+		return 0
+	}
+	days := int64(math.Ceil(returnedAt.Sub(dueAt).Hours() / 24))
+	fine := days * perDay
+	if fine > maxFine {
+		return maxFine
+	}
+	return fine
+}
+
+func (le *LedgerEntry) Prepare() {
+	le.Note = html.EscapeString(strings.TrimSpace(le.Note))
+}
+
+// ValidateCredit checks a payment or waiver entered at the desk.
+func (le *LedgerEntry) ValidateCredit() error {
+	if le.AmountCents <= 0 {
+		return errors.New("Amount must be more than zero")
+	}
+	return nil
+}
+
+func policyForLoan(tx *gorm.DB, loan *Checkout) (*CirculationPolicy, error) {
+	itemType, err := itemTypeOfCopy(tx, loan.CopyId)
+	if err != nil {
+		return nil, err
+	}
+	return policyForUser(tx, loan.UserId, itemType)
+}
+
+func chargeFine(tx *gorm.DB, loan *Checkout, returnedAt time.Time) error {
+	policy, err := policyForLoan(tx, loan)
+	if err != nil {
+		return err
+	}
+	fine := OverdueFine(loan.DueAt, returnedAt, policy.FinePerDayCents, policy.FineCapCents)
+	if fine == 0 {
+		return nil
+	}
+	return tx.Create(&LedgerEntry{
+		UserId:      loan.UserId,
+		CheckoutId:  &loan.ID,
+		Kind:        LedgerFine,
+		AmountCents: fine,
+		Note:        "Overdue fine",
+	}).Error
+}
+
+func GetBalanceOfUserWithID(db *gorm.DB, uid uint) (int64, error) {
+	var balance int64
+	err := db.Model(&LedgerEntry{}).Select("COALESCE(SUM(amount_cents), 0)").Where("user_id = ?", uid).Scan(&balance).Error
+	if err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func GetAccountOfUserWithID(db *gorm.DB, uid uint) (*Account, error) {
+	var err error
+	account := Account{UserId: uid, Entries: []LedgerEntry{}}
+	err = db.Model(&LedgerEntry{}).Where("user_id = ?", uid).Order("created_at desc").Limit(100).Find(&account.Entries).Error
+	if err != nil {
+		return nil, err
+	}
+	account.BalanceCents, err = GetBalanceOfUserWithID(db, uid)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// CreditAccount records a payment or waiver. The user row is locked so two
+// desks cannot both take the same balance.
+func (le *LedgerEntry) CreditAccount(db *gorm.DB, actor Actor) (*LedgerEntry, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", le.UserId).Take(&User{}).Error
+		if err != nil {
+			return err
+		}
+		balance, err := GetBalanceOfUserWithID(tx, le.UserId)
+		if err != nil {
+			return err
+		}
+		if le.AmountCents > balance {
+			return ErrCreditExceedsBalance
+		}
+		le.AmountCents = -le.AmountCents
+		le.CreatedBy = actor.UserID
+		err = tx.Create(&le).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "ledger."+le.Kind, "user", le.UserId, nil, le)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return le, nil
+}
+
+// DeclareLost closes an open loan whose copy will not come back and charges
+// the patron for it.
+func DeclareLost(db *gorm.DB, cid uint64, actor Actor) (*Checkout, error) {
+	loan := Checkout{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("id = ?", cid).Take(&loan).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrCheckoutNotFound
+		}
+		if err != nil {
+			return err
+		}
+		_, err = lockBookForCheckout(tx, loan.BookId)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("id = ?", cid).Take(&loan).Error
+		if err != nil {
+			return err
+		}
+		if loan.CheckedIn {
+			return &CheckoutConflictError{BookId: loan.BookId, Reason: "This book has already been checked in"}
+		}
+
+		err = tx.Model(&Checkout{}).Where("id = ?", loan.ID).Update("checked_in", true).Error
+		if err != nil {
+			return err
+		}
+		loan.CheckedIn = true
+		policy, err := policyForLoan(tx, &loan)
+		if err != nil {
+			return err
+		}
+		if loan.CopyId != 0 {
+			err = setCopyStatus(tx, uint(loan.CopyId), CopyLost)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Create(&LedgerEntry{
+			UserId:      loan.UserId,
+			CheckoutId:  &loan.ID,
+			Kind:        LedgerLostItem,
+			AmountCents: policy.LostItemChargeCents,
+			Note:        "Lost item",
+			CreatedBy:   actor.UserID,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "checkout.lost", "checkout", loan.ID, nil, loan)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &loan, nil
+}
@@ -0,0 +1,317 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultLoginMaxAttempts       = 5
+	defaultLoginMaxIPAttempts     = 20
+	defaultLoginLockoutSeconds    = 30
+	defaultLoginLockoutMaxMinutes = 60
+	defaultResetMaxRequests       = 3
+	defaultResetMaxIPRequests     = 20
+)
+
+var ErrInvalidCredentials = errors.New("Incorrect email or password")
+
+// LoginLockedError is returned while an account or an address is locked
+// out after too many failed logins, or too many password reset requests.
+type LoginLockedError struct {
+	RetryAfter time.Duration
+	Resets     bool
+}
+
+func (e *LoginLockedError) Error() string {
+	if e.Resets {
+		return "Too many password reset requests, please try again later"
+	}
+	return "Too many failed logins, please try again later"
+}
+
+// LoginThrottle counts failed logins, and logins still being checked, for
+// one account or one client address. Accounts are tracked by the email
+// that was typed, whether or not it exists, so a lockout tells nothing
+// about who has an account. Password reset requests are counted as
+// failures under subjects of their own.
+type LoginThrottle struct {
+	Subject       string `gorm:"primaryKey;size:200"`
+	Failures      int    `gorm:"not null;default:0"`
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+	Pending       int `gorm:"not null;default:0"`
+	PendingAt     *time.Time
+}
+
+func accountSubject(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipSubject(ip string) string {
+	return "ip:" + ip
+}
+
+func resetSubject(email string) string {
+	return "reset:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func loginLockoutMax() time.Duration {
+	return time.Duration(envInt("LOGIN_LOCKOUT_MAX_MINUTES", defaultLoginLockoutMaxMinutes)) * time.Minute
+}
+
+// loginBackoff doubles the lockout with every failure past the limit, up
+// to LOGIN_LOCKOUT_MAX_MINUTES.
+func loginBackoff(over int) time.Duration {
+	max := loginLockoutMax()
+	wait := time.Duration(envInt("LOGIN_LOCKOUT_SECONDS", defaultLoginLockoutSeconds)) * time.Second
+	for i := 0; i < over && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// pendingLoginTimeout is how long a reserved login counts against the
+// limits when it is never finished, say because the server stopped.
+const pendingLoginTimeout = time.Minute
+
+// LoginAttempt is a login counted against the throttles before the
+// password is checked, so a burst of parallel guesses cannot all get in
+// under the limit. It has to be finished with Fail, Succeed or Abandon.
+type LoginAttempt struct {
+	email string
+	ip    string
+}
+
+type loginSubject struct {
+	subject string
+	limit   int
+}
+
+// subjects lists the account before the address, the order every
+// transaction locks them in.
+func (a *LoginAttempt) subjects() []loginSubject {
+	return []loginSubject{
+		{accountSubject(a.email), envInt("LOGIN_MAX_ATTEMPTS", defaultLoginMaxAttempts)},
+		{ipSubject(a.ip), envInt("LOGIN_MAX_IP_ATTEMPTS", defaultLoginMaxIPAttempts)},
+	}
+}
+
+// lockThrottle takes the throttle row of a subject for update, making it
+// when the subject has none yet.
+func lockThrottle(tx *gorm.DB, subject string, now time.Time) (*LoginThrottle, error) {
+	err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&LoginThrottle{Subject: subject}).Error
+	if err != nil {
+		return nil, err
+	}
+	throttle := LoginThrottle{}
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("subject = ?", subject).Take(&throttle).Error
+	if err != nil {
+		return nil, err
+	}
+	// failures are forgotten once nothing has gone wrong for a while, and
+	// attempts that were never finished stop counting
+	if now.Sub(throttle.LastFailureAt) > loginLockoutMax() {
+		throttle.Failures = 0
+	}
+	if throttle.PendingAt == nil || now.Sub(*throttle.PendingAt) > pendingLoginTimeout {
+		throttle.Pending = 0
+	}
+	return &throttle, nil
+}
+
+// ReserveLoginAttempt returns a *LoginLockedError while the account or the
+// address may not try to log in, or while the attempts already under way
+// could use up what is left of their limit. Otherwise the attempt is counted
+// as pending until it is finished.
+func ReserveLoginAttempt(db *gorm.DB, email, ip string) (*LoginAttempt, error) {
+	attempt := &LoginAttempt{email: email, ip: ip}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		throttles := []*LoginThrottle{}
+		var wait time.Duration
+		for _, subject := range attempt.subjects() {
+			throttle, err := lockThrottle(tx, subject.subject, now)
+			if err != nil {
+				return err
+			}
+			if throttle.LockedUntil != nil && throttle.LockedUntil.Sub(now) > wait {
+				wait = throttle.LockedUntil.Sub(now)
+			}
+			// past the limit a lockout lets one attempt through at a time
+			if throttle.Pending > 0 && throttle.Failures+throttle.Pending >= subject.limit && wait < time.Second {
+				wait = time.Second
+			}
+			throttles = append(throttles, throttle)
+		}
+		if wait > 0 {
+			return &LoginLockedError{RetryAfter: wait}
+		}
+		for _, throttle := range throttles {
+			throttle.Pending++
+			throttle.PendingAt = &now
+			err := tx.Save(throttle).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// Fail counts the attempt as a failed login against both the account and
+// the address. The address gets a higher limit, since many patrons can
+// share one.
+func (a *LoginAttempt) Fail(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for _, subject := range a.subjects() {
+			throttle, err := lockThrottle(tx, subject.subject, now)
+			if err != nil {
+				return err
+			}
+			throttle.release()
+			throttle.Failures++
+			throttle.LastFailureAt = now
+			if throttle.Failures >= subject.limit {
+				until := now.Add(loginBackoff(throttle.Failures - subject.limit))
+				throttle.LockedUntil = &until
+			}
+			err = tx.Save(throttle).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Succeed forgets the failed logins of the account. The address keeps its
+// count, or one good account could be used to keep guessing the passwords
+// of others.
+func (a *LoginAttempt) Succeed(db *gorm.DB) error {
+	return a.finish(db, true)
+}
+
+// Abandon stops counting an attempt that ended before the password could
+// be checked.
+func (a *LoginAttempt) Abandon(db *gorm.DB) error {
+	return a.finish(db, false)
+}
+
+func (a *LoginAttempt) finish(db *gorm.DB, succeeded bool) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		for i, subject := range a.subjects() {
+			if succeeded && i == 0 {
+				err := tx.Where("subject = ?", subject.subject).Delete(&LoginThrottle{}).Error
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			throttle, err := lockThrottle(tx, subject.subject, now)
+			if err != nil {
+				return err
+			}
+			throttle.release()
+			err = tx.Save(throttle).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (t *LoginThrottle) release() {
+	if t.Pending > 0 {
+		t.Pending--
+	}
+}
+
+// ReservePasswordReset counts a request for a reset link against the email
+// and the address it came from. It returns a *LoginLockedError once either
+// has asked too often, and the lockout grows like the one for logins.
+func ReservePasswordReset(db *gorm.DB, email, ip string) error {
+	subjects := []loginSubject{
+		{resetSubject(email), envInt("RESET_MAX_REQUESTS", defaultResetMaxRequests)},
+		{"reset-ip:" + ip, envInt("RESET_MAX_IP_REQUESTS", defaultResetMaxIPRequests)},
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		throttles := []*LoginThrottle{}
+		var wait time.Duration
+		for _, subject := range subjects {
+			throttle, err := lockThrottle(tx, subject.subject, now)
+			if err != nil {
+				return err
+			}
+			if throttle.LockedUntil != nil && throttle.LockedUntil.Sub(now) > wait {
+				wait = throttle.LockedUntil.Sub(now)
+			}
+			throttles = append(throttles, throttle)
+		}
+		if wait > 0 {
+			return &LoginLockedError{RetryAfter: wait, Resets: true}
+		}
+		for i, throttle := range throttles {
+			throttle.Failures++
+			throttle.LastFailureAt = now
+			if throttle.Failures >= subjects[i].limit {
+				until := now.Add(loginBackoff(throttle.Failures - subjects[i].limit))
+				throttle.LockedUntil = &until
+			}
+			err := tx.Save(throttle).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ClearLoginFailures forgets the failed logins of an account.
+func ClearLoginFailures(db *gorm.DB, email string) error {
+	return db.Where("subject = ?", accountSubject(email)).Delete(&LoginThrottle{}).Error
+}
+
+// UnlockUser lifts a lockout on the user's account.
+func UnlockUser(db *gorm.DB, uid uint, actor Actor) (*User, error) {
+	user := User{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&User{}).Where("id = ?", uid).Take(&user).Error
+		if err != nil {
+			return err
+		}
+		err = ClearLoginFailures(tx, user.Email)
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "user.unlock", "user", uid, nil, nil)
+	})
+	if err != nil {
+		return &User{}, err
+	}
+	return &user, nil
+}
+
+func FindLoginThrottle(db *gorm.DB, email string) (*LoginThrottle, error) {
+	throttle := LoginThrottle{}
+	err := db.Where("subject = ?", accountSubject(email)).Take(&throttle).Error
+	if err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
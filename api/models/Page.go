@@ -0,0 +1,186 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+const (
+	sortText = iota
+	sortTime
+	sortNumber
+)
+
+var (
+	ErrInvalidCursor = errors.New("Invalid cursor")
+	ErrInvalidSort   = errors.New("Invalid sort")
+)
+
+// PageRequest is what a client asks of a list endpoint. Sort is a column
+// name, prefixed with "-" for descending order.
+type PageRequest struct {
+	Limit  int
+	Cursor string
+	Sort   string
+}
+
+// Page is the envelope every list endpoint responds with. Total counts every
+// row the query matches, not just this page.
+type Page struct {
+	Data       interface{} `json:"data"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	HasMore    bool        `json:"has_more"`
+	Total      int64       `json:"total"`
+}
+
+// sortColumn is a column clients may sort by. Field names the struct field
+// holding the column's value in the scanned rows.
+type sortColumn struct {
+	Expr  string
+	Vars  []interface{}
+	Kind  int
+	Field string
+}
+
+// pageCursor marks the last row a client has seen: the value of the sort
+// column and the row id to break ties. Clients treat it as opaque.
+type pageCursor struct {
+	Value string `json:"v"`
+	ID    uint   `json:"id"`
+}
+
+func encodeCursor(c pageCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := pageCursor{}
+	err = json.Unmarshal(raw, &c)
+	if err != nil || c.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func (p *PageRequest) Prepare(defaultSort string) {
+	p.Cursor = strings.TrimSpace(p.Cursor)
+	p.Sort = strings.ToLower(strings.TrimSpace(p.Sort))
+	if p.Sort == "" {
+		p.Sort = defaultSort
+	}
+	if p.Limit <= 0 {
+		p.Limit = defaultPageLimit
+	}
+	if p.Limit > maxPageLimit {
+		p.Limit = maxPageLimit
+	}
+}
+
+func (p *PageRequest) sortColumn(sorts map[string]sortColumn) (sortColumn, bool, error) {
+	col, ok := sorts[strings.TrimPrefix(p.Sort, "-")]
+	if !ok {
+		return sortColumn{}, false, ErrInvalidSort
+	}
+	return col, strings.HasPrefix(p.Sort, "-"), nil
+}
+
+func formatCursorValue(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x.Format(time.RFC3339Nano)
+	case *time.Time:
+		return x.Format(time.RFC3339Nano)
+	case float32, float64:
+		return strconv.FormatFloat(v.Float(), 'g', -1, 64)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+func parseCursorValue(v string, kind int) (interface{}, error) {
+	switch kind {
+	case sortTime:
+		return time.Parse(time.RFC3339Nano, v)
+	case sortNumber:
+		return strconv.ParseFloat(v, 64)
+	default:
+		return v, nil
+	}
+}
+
+// paginate reads one page of query into dest, a pointer to a slice of
+// structs, ordering by the requested sort column and then by id so rows with
+// equal sort values are never skipped or repeated.
+func paginate(query *gorm.DB, req *PageRequest, sorts map[string]sortColumn, id sortColumn, dest interface{}) (*Page, error) {
+	col, desc, err := req.sortColumn(sorts)
+	if err != nil {
+		return nil, err
+	}
+	cursor, err := decodeCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	query = query.Session(&gorm.Session{})
+	page := Page{}
+	err = query.Session(&gorm.Session{NewDB: true}).Table("(?) AS page_rows", query).Count(&page.Total).Error
+	if err != nil {
+		return nil, err
+	}
+
+	direction, op := "asc", ">"
+	if desc {
+		direction, op = "desc", "<"
+	}
+	if cursor != nil {
+		value, err := parseCursorValue(cursor.Value, col.Kind)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		vars := append(append([]interface{}{}, col.Vars...), value, cursor.ID)
+		query = query.Where(fmt.Sprintf("(%s, %s) %s (?, ?)", col.Expr, id.Expr, op), vars...)
+	}
+	err = query.Clauses(clause.OrderBy{Expression: clause.Expr{
+		SQL:                fmt.Sprintf("%s %s, %s %s", col.Expr, direction, id.Expr, direction),
+		Vars:               col.Vars,
+		WithoutParentheses: true,
+	}}).Limit(req.Limit + 1).Find(dest).Error
+	if err != nil {
+		return nil, err
+	}
+
+	rows := reflect.ValueOf(dest).Elem()
+	if rows.Len() > req.Limit {
+		rows.Set(rows.Slice(0, req.Limit))
+		last := rows.Index(req.Limit - 1)
+		page.HasMore = true
+		page.NextCursor = encodeCursor(pageCursor{
+			Value: formatCursorValue(last.FieldByName(col.Field)),
+			ID:    uint(last.FieldByName(id.Field).Uint()),
+		})
+	}
+	page.Data = rows.Interface()
+	return &page, nil
+}
@@ -0,0 +1,318 @@
+package models
+
+import (
+	"errors"
+	"html"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ActionCheckout = "checkout"
+	ActionRenew    = "renew"
+	ActionHold     = "hold"
+
+	AnyType = "*"
+
+	DefaultPatronType = "standard"
+	DefaultItemType   = "standard"
+
+	defaultMaxLoans = 5
+	defaultMaxHolds = 5
+)
+
+var ErrPolicyNotFound = errors.New("policy does not exist")
+
+// CirculationPolicy sets the lending rules for one kind of patron borrowing
+// one kind of item. Either type can be "*" to match anything.
+type CirculationPolicy struct {
+	gorm.Model
+	PatronType           string `gorm:"size:50;not null;uniqueIndex:idx_policy_types" json:"patron_type"`
+	ItemType             string `gorm:"size:50;not null;uniqueIndex:idx_policy_types" json:"item_type"`
+	MaxLoans             int    `gorm:"not null" json:"max_loans"`
+	LoanPeriodDays       int    `gorm:"not null" json:"loan_period_days"`
+	MaxRenewals          int    `gorm:"not null" json:"max_renewals"`
+	MaxHolds             int    `gorm:"not null" json:"max_holds"`
+	HoldPickupDays       int    `gorm:"not null" json:"hold_pickup_days"`
+	FinePerDayCents      int64  `gorm:"not null" json:"fine_per_day_cents"`
+	FineCapCents         int64  `gorm:"not null" json:"fine_cap_cents"`
+	LostItemChargeCents  int64  `gorm:"not null" json:"lost_item_charge_cents"`
+	BlockingBalanceCents int64  `gorm:"not null" json:"blocking_balance_cents"`
+}
+
+type DenialReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// PolicyDenial lists every rule a circulation request broke.
+type PolicyDenial struct {
+	Action  string
+	Reasons []DenialReason
+}
+
+func (d *PolicyDenial) Error() string {
+	return d.Reasons[0].Message
+}
+
+// CirculationRequest describes what a patron is trying to do. Checkout is
+// only needed for renewals.
+type CirculationRequest struct {
+	Action   string
+	UserId   uint
+	BookId   uint64
+	ItemType string
+	Checkout *Checkout
+}
+
+// DefaultPolicy applies when no stored policy matches. Its values come from
+// the environment so a library can run without configuring any policies.
+func DefaultPolicy() *CirculationPolicy {
+	return &CirculationPolicy{
+		PatronType:           AnyType,
+		ItemType:             AnyType,
+		MaxLoans:             envInt("MAX_LOANS", defaultMaxLoans),
+		LoanPeriodDays:       int(LoanPeriod().Hours() / 24),
+		MaxRenewals:          MaxRenewals(),
+		MaxHolds:             envInt("MAX_HOLDS", defaultMaxHolds),
+		HoldPickupDays:       int(HoldPickupPeriod().Hours() / 24),
+		FinePerDayCents:      FinePerDayCents(),
+		FineCapCents:         FineCapCents(),
+		LostItemChargeCents:  LostItemChargeCents(),
+		BlockingBalanceCents: BlockingBalanceCents(),
+	}
+}
+
+func (p *CirculationPolicy) LoanPeriod() time.Duration {
+	return time.Duration(p.LoanPeriodDays) * 24 * time.Hour
+}
+
+func (p *CirculationPolicy) HoldPickupPeriod() time.Duration {
+	return time.Duration(p.HoldPickupDays) * 24 * time.Hour
+}
+
+func (p *CirculationPolicy) Prepare() {
+	p.PatronType = html.EscapeString(strings.ToLower(strings.TrimSpace(p.PatronType)))
+	p.ItemType = html.EscapeString(strings.ToLower(strings.TrimSpace(p.ItemType)))
+}
+
+func (p *CirculationPolicy) Validate() error {
+	if p.PatronType == "" {
+		return errors.New("Required Patron Type")
+	}
+	if p.ItemType == "" {
+		return errors.New("Required Item Type")
+	}
+	if p.MaxLoans < 1 {
+		return errors.New("Max Loans must be at least 1")
+	}
+	if p.LoanPeriodDays < 1 {
+		return errors.New("Loan Period must be at least 1 day")
+	}
+	if p.HoldPickupDays < 1 {
+		return errors.New("Hold Pickup must be at least 1 day")
+	}
+	if p.MaxRenewals < 0 || p.MaxHolds < 0 || p.FinePerDayCents < 0 || p.FineCapCents < 0 || p.LostItemChargeCents < 0 || p.BlockingBalanceCents < 0 {
+		return errors.New("Limits and charges cannot be negative")
+	}
+	return nil
+}
+
+// ResolvePolicy finds the most specific stored policy for a patron and item
+// type, trying the exact pair first and the wildcards after.
+func ResolvePolicy(db *gorm.DB, patronType, itemType string) (*CirculationPolicy, error) {
+	if patronType == "" {
+		patronType = DefaultPatronType
+	}
+	candidates := [][2]string{{patronType, AnyType}, {AnyType, AnyType}}
+	if itemType != "" && itemType != AnyType {
+		candidates = [][2]string{{patronType, itemType}, {patronType, AnyType}, {AnyType, itemType}, {AnyType, AnyType}}
+	}
+	for _, c := range candidates {
+		policy := CirculationPolicy{}
+		err := db.Where("patron_type = ? AND item_type = ?", c[0], c[1]).Take(&policy).Error
+		if err == nil {
+			return &policy, nil
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+	return DefaultPolicy(), nil
+}
+
+func policyForUser(db *gorm.DB, uid uint, itemType string) (*CirculationPolicy, error) {
+	user := User{}
+	err := db.Model(&User{}).Select("id, patron_type").Where("id = ?", uid).Take(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	return ResolvePolicy(db, user.PatronType, itemType)
+}
+
+func itemTypeOfCopy(db *gorm.DB, cid uint64) (string, error) {
+	if cid == 0 {
+		return "", nil
+	}
+	item, err := FindCopyByID(db, cid)
+	if err != nil {
+		return "", err
+	}
+	return item.ItemType, nil
+}
+
+// lockPatron takes the patron's row for update. Their loans and balance are
+// read by EvaluateCirculation, and without it two requests for different
+// books, which lock different book rows, could both pass the limits. Take
+// it after the book or loan row, so the locks are always taken in the same
+// order.
+func lockPatron(tx *gorm.DB, uid uint) error {
+	return tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id").Where("id = ?", uid).Take(&User{}).Error
+}
+
+// EvaluateCirculation is the single place lending rules are enforced. It
+// returns the policy that applies, or a *PolicyDenial listing every rule the
+// request breaks.
+func EvaluateCirculation(db *gorm.DB, req CirculationRequest) (*CirculationPolicy, error) {
+	policy, err := policyForUser(db, req.UserId, req.ItemType)
+	if err != nil {
+		return nil, err
+	}
+	denial := PolicyDenial{Action: req.Action}
+
+	balance, err := GetBalanceOfUserWithID(db, req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if balance > policy.BlockingBalanceCents {
+		denial.Reasons = append(denial.Reasons, DenialReason{Code: "balance_blocked", Message: "You owe too much in fines to borrow books."})
+	}
+
+	switch req.Action {
+	case ActionCheckout:
+		var loans int64
+		err = db.Model(&Checkout{}).Where("user_id = ? AND checked_in = false", req.UserId).Count(&loans).Error
+		if err != nil {
+			return nil, err
+		}
+		if loans >= int64(policy.MaxLoans) {
+			denial.Reasons = append(denial.Reasons, DenialReason{Code: "max_loans", Message: "You have checked out too many books."})
+		}
+	case ActionRenew:
+		if req.Checkout.RenewalCount >= policy.MaxRenewals {
+			denial.Reasons = append(denial.Reasons, DenialReason{Code: "max_renewals", Message: "This book has been renewed the maximum number of times"})
+		}
+		var waiting int64
+		err = db.Model(&Hold{}).Where("book_id = ? AND status = ?", req.Checkout.BookId, HoldWaiting).Count(&waiting).Error
+		if err != nil {
+			return nil, err
+		}
+		if waiting > 0 {
+			denial.Reasons = append(denial.Reasons, DenialReason{Code: "holds_waiting", Message: "Other patrons are waiting for this book so it cannot be renewed"})
+		}
+	case ActionHold:
+		var holds int64
+		err = db.Model(&Hold{}).Where("user_id = ? AND status IN ?", req.UserId, []string{HoldWaiting, HoldReady}).Count(&holds).Error
+		if err != nil {
+			return nil, err
+		}
+		if holds >= int64(policy.MaxHolds) {
+			denial.Reasons = append(denial.Reasons, DenialReason{Code: "max_holds", Message: "You have placed too many holds."})
+		}
+	}
+
+	if len(denial.Reasons) > 0 {
+		return policy, &denial
+	}
+	return policy, nil
+}
+
+func (p *CirculationPolicy) SavePolicy(db *gorm.DB, actor Actor) (*CirculationPolicy, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&p).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "policy.create", "policy", p.ID, nil, p)
+	})
+	if err != nil {
+		return &CirculationPolicy{}, err
+	}
+	return p, nil
+}
+
+func FindAllPolicies(db *gorm.DB) (*[]CirculationPolicy, error) {
+	var err error
+	policies := []CirculationPolicy{}
+	err = db.Model(&CirculationPolicy{}).Order("patron_type asc, item_type asc").Limit(100).Find(&policies).Error
+	if err != nil {
+		return &[]CirculationPolicy{}, err
+	}
+	return &policies, nil
+}
+
+func FindPolicyByID(db *gorm.DB, pid uint64) (*CirculationPolicy, error) {
+	policy := CirculationPolicy{}
+	err := db.Model(&CirculationPolicy{}).Where("id = ?", pid).Take(&policy).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPolicyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *CirculationPolicy) UpdateAPolicy(db *gorm.DB, actor Actor) (*CirculationPolicy, error) {
+	var updated *CirculationPolicy
+	err := db.Transaction(func(tx *gorm.DB) error {
+		current, err := FindPolicyByID(tx, uint64(p.ID))
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&CirculationPolicy{}).Where("id = ?", p.ID).Updates(map[string]interface{}{
+			"patron_type":            p.PatronType,
+			"item_type":              p.ItemType,
+			"max_loans":              p.MaxLoans,
+			"loan_period_days":       p.LoanPeriodDays,
+			"max_renewals":           p.MaxRenewals,
+			"max_holds":              p.MaxHolds,
+			"hold_pickup_days":       p.HoldPickupDays,
+			"fine_per_day_cents":     p.FinePerDayCents,
+			"fine_cap_cents":         p.FineCapCents,
+			"lost_item_charge_cents": p.LostItemChargeCents,
+			"blocking_balance_cents": p.BlockingBalanceCents,
+		}).Error
+		if err != nil {
+			return err
+		}
+		updated, err = FindPolicyByID(tx, uint64(p.ID))
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "policy.update", "policy", p.ID, current, updated)
+	})
+	if err != nil {
+		return &CirculationPolicy{}, err
+	}
+	return updated, nil
+}
+
+func (p *CirculationPolicy) DeleteAPolicy(db *gorm.DB, actor Actor) (int64, error) {
+	var deleted int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Delete(&p)
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return RecordAudit(tx, actor, "policy.delete", "policy", p.ID, p, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
@@ -0,0 +1,308 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const (
+	RolePatron      = "patron"
+	RoleCirculation = "circulation"
+	RoleLibrarian   = "librarian"
+	RoleAdmin       = "admin"
+
+	// legacyRolePatron is what patrons were called before roles had
+	// permissions. Old clients still send it at signup.
+	legacyRolePatron = "user"
+)
+
+const (
+	PermBooksWrite        = "books:write"
+	PermBooksExport       = "books:export"
+	PermUsersRead         = "users:read"
+	PermUsersWrite        = "users:write"
+	PermCheckoutsRead     = "checkouts:read"
+	PermCheckoutsOverride = "checkouts:override"
+	PermHoldsManage       = "holds:manage"
+	PermAccountsManage    = "accounts:manage"
+	PermPoliciesWrite     = "policies:write"
+	PermRolesManage       = "roles:manage"
+	PermLoginsManage      = "logins:manage"
+	PermAuditRead         = "audit:read"
+	PermUsersPurge        = "users:purge"
+)
+
+var (
+	ErrRoleNotFound   = errors.New("role does not exist")
+	ErrRoleExists     = errors.New("A role with this name already exists")
+	ErrRoleInUse      = errors.New("This role is still given to some users")
+	ErrRoleBuiltIn    = errors.New("Built in roles cannot be deleted")
+	ErrAdminRoleFixed = errors.New("The admin role always has every permission")
+	ErrLastAdmin      = errors.New("The last admin cannot be given another role")
+)
+
+type Permission struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Permissions lists everything a role can be allowed to do. Handlers check
+// these names, so new ones are added here rather than through the API.
+var Permissions = []Permission{
+	{PermBooksWrite, "Add, edit, delete and import books and their copies"},
+	{PermBooksExport, "Export the catalog"},
+	{PermUsersRead, "List users and see their full accounts"},
+	{PermUsersWrite, "Upload and restore users and change patron types"},
+	{PermCheckoutsRead, "See overdue checkouts"},
+	{PermCheckoutsOverride, "Declare checkouts lost"},
+	{PermHoldsManage, "See hold queues and cancel anyone's hold"},
+	{PermAccountsManage, "See any patron's account and record payments and waivers"},
+	{PermPoliciesWrite, "Manage circulation policies"},
+	{PermRolesManage, "Manage roles and give them to users"},
+	{PermLoginsManage, "Unlock accounts locked out after failed logins"},
+	{PermAuditRead, "Read and verify the audit log"},
+	{PermUsersPurge, "Erase deleted users and everything kept about them"},
+}
+
+// Role is a named set of permissions. Every user has exactly one role and
+// the role travels in their token.
+type Role struct {
+	gorm.Model
+	Name        string     `gorm:"size:50;not null;unique" json:"name"`
+	Description string     `gorm:"size:255" json:"description"`
+	Permissions StringList `json:"permissions"`
+}
+
+var roleName = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+func allPermissions() StringList {
+	names := StringList{}
+	for _, p := range Permissions {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// builtInRoles are created on startup. Their permissions can be changed,
+// except for admin which always has all of them.
+func builtInRoles() []Role {
+	circulation := StringList{PermCheckoutsRead, PermCheckoutsOverride, PermHoldsManage, PermAccountsManage}
+	librarian := append(StringList{PermBooksWrite, PermBooksExport, PermUsersWrite}, circulation...)
+	return []Role{
+		{Name: RolePatron, Description: "Borrows books", Permissions: StringList{}},
+		{Name: RoleCirculation, Description: "Works the circulation desk", Permissions: circulation},
+		{Name: RoleLibrarian, Description: "Looks after the catalog and patrons", Permissions: librarian},
+		{Name: RoleAdmin, Description: "Runs the library", Permissions: allPermissions()},
+	}
+}
+
+func isBuiltInRole(name string) bool {
+	for _, role := range builtInRoles() {
+		if role.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (ro *Role) Prepare() {
+	ro.Name = strings.ToLower(strings.TrimSpace(ro.Name))
+	ro.Description = html.EscapeString(strings.TrimSpace(ro.Description))
+	permissions := StringList{}
+	seen := map[string]bool{}
+	for _, p := range ro.Permissions {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p != "" && !seen[p] {
+			seen[p] = true
+			permissions = append(permissions, p)
+		}
+	}
+	ro.Permissions = permissions
+}
+
+func (ro *Role) Validate() error {
+	if ro.Name == "" {
+		return errors.New("Required Name")
+	}
+	if !roleName.MatchString(ro.Name) || len(ro.Name) > 50 {
+		return errors.New("Name must be lowercase letters, digits and underscores")
+	}
+	known := map[string]bool{}
+	for _, p := range Permissions {
+		known[p.Name] = true
+	}
+	for _, p := range ro.Permissions {
+		if !known[p] {
+			return fmt.Errorf("Unknown permission '%s'", p)
+		}
+	}
+	return nil
+}
+
+func (ro *Role) Allows(permission string) bool {
+	for _, p := range ro.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleHasPermission is the check behind every permission protected handler.
+// A role that does not exist has no permissions.
+func RoleHasPermission(db *gorm.DB, name, permission string) (bool, error) {
+	role, err := FindRoleByName(db, name)
+	if errors.Is(err, ErrRoleNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return role.Allows(permission), nil
+}
+
+func (ro *Role) SaveRole(db *gorm.DB, actor Actor) (*Role, error) {
+	var err error
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&Role{}).Where("name = ?", ro.Name).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRoleExists
+		}
+		err = tx.Create(&ro).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "role.create", "role", ro.ID, nil, ro)
+	})
+	if err != nil {
+		return &Role{}, err
+	}
+	return ro, nil
+}
+
+func FindAllRoles(db *gorm.DB) (*[]Role, error) {
+	var err error
+	roles := []Role{}
+	err = db.Model(&Role{}).Order("name asc").Limit(100).Find(&roles).Error
+	if err != nil {
+		return &[]Role{}, err
+	}
+	return &roles, nil
+}
+
+func FindRoleByID(db *gorm.DB, rid uint64) (*Role, error) {
+	role := Role{}
+	err := db.Model(&Role{}).Where("id = ?", rid).Take(&role).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+func FindRoleByName(db *gorm.DB, name string) (*Role, error) {
+	role := Role{}
+	err := db.Model(&Role{}).Where("name = ?", name).Take(&role).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// UpdateARole changes a role's description and permissions. Roles are not
+// renamed because the name is baked into tokens that are already out.
+func (ro *Role) UpdateARole(db *gorm.DB, actor Actor) (*Role, error) {
+	var updated *Role
+	err := db.Transaction(func(tx *gorm.DB) error {
+		current, err := FindRoleByID(tx, uint64(ro.ID))
+		if err != nil {
+			return err
+		}
+		if current.Name == RoleAdmin {
+			return ErrAdminRoleFixed
+		}
+		err = tx.Model(&Role{}).Where("id = ?", ro.ID).Updates(map[string]interface{}{
+			"description": ro.Description,
+			"permissions": ro.Permissions,
+		}).Error
+		if err != nil {
+			return err
+		}
+		updated, err = FindRoleByID(tx, uint64(ro.ID))
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "role.update", "role", ro.ID, current, updated)
+	})
+	if err != nil {
+		return &Role{}, err
+	}
+	return updated, nil
+}
+
+func (ro *Role) DeleteARole(db *gorm.DB, actor Actor) (int64, error) {
+	if isBuiltInRole(ro.Name) {
+		return 0, ErrRoleBuiltIn
+	}
+	var deleted int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&User{}).Where("role = ?", ro.Name).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRoleInUse
+		}
+		result := tx.Unscoped().Delete(&ro)
+		if result.Error != nil {
+			return result.Error
+		}
+		deleted = result.RowsAffected
+		return RecordAudit(tx, actor, "role.delete", "role", ro.ID, ro, nil)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// MigrateRoles creates any missing built in roles, gives admin every
+// permission there is and moves users with the old "user" role to patron.
+func MigrateRoles(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, role := range builtInRoles() {
+			role := role
+			var count int64
+			err := tx.Model(&Role{}).Where("name = ?", role.Name).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				err = tx.Create(&role).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err := tx.Model(&Role{}).Where("name = ?", RoleAdmin).Update("permissions", allPermissions()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Model(&User{}).Where("role = ?", legacyRolePatron).UpdateColumn("role", RolePatron).Error
+	})
+}
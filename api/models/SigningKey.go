@@ -0,0 +1,44 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// signingKeyLock is the advisory lock held while the signing keys are
+// rotated, so only one instance makes the next key.
+const signingKeyLock = 7146855
+
+// SigningKey is a private key access tokens are signed with. Keeping it in
+// the database lets every instance sign and check with the same keys.
+type SigningKey struct {
+	ID        string    `gorm:"primaryKey;size:64"`
+	Pem       string    `gorm:"type:text;not null"`
+	CreatedAt time.Time `gorm:"not null"`
+}
+
+func FindSigningKeys(db *gorm.DB) ([]SigningKey, error) {
+	keys := []SigningKey{}
+	err := db.Order("created_at, id").Find(&keys).Error
+	return keys, err
+}
+
+func (k *SigningKey) SaveSigningKey(db *gorm.DB) error {
+	return db.Create(k).Error
+}
+
+func DeleteSigningKey(db *gorm.DB, id string) error {
+	return db.Where("id = ?", id).Delete(&SigningKey{}).Error
+}
+
+// WithSigningKeyLock runs fn in a transaction holding the rotation lock.
+func WithSigningKeyLock(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Exec("SELECT pg_advisory_xact_lock(?)", signingKeyLock).Error
+		if err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
@@ -0,0 +1,203 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const defaultRefreshTokenDays = 30
+
+var ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+
+// RefreshToken lets a client get a new access token without the password.
+// Only a hash of it is stored. Every token can be used once, and the one
+// issued in its place joins the same family. A used token coming back means
+// it was copied, so the whole family is revoked.
+type RefreshToken struct {
+	gorm.Model
+	UserId    uint      `gorm:"not null;index"`
+	FamilyId  string    `gorm:"size:64;not null;index"`
+	TokenHash string    `gorm:"size:64;not null;unique"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+}
+
+// RevokedToken is an access token that must be refused even though it has
+// not expired yet. Rows are only needed until then.
+type RevokedToken struct {
+	Jti       string    `gorm:"primaryKey;size:64"`
+	UserId    uint      `gorm:"not null;index"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+// RefreshTokenPeriod reads REFRESH_TOKEN_DAYS, falling back to 30 days.
+func RefreshTokenPeriod() time.Duration {
+	return time.Duration(envInt("REFRESH_TOKEN_DAYS", defaultRefreshTokenDays)) * 24 * time.Hour
+}
+
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func issueRefreshToken(tx *gorm.DB, uid uint, family string, now time.Time) (string, error) {
+	secret, err := randomSecret()
+	if err != nil {
+		return "", err
+	}
+	err = tx.Create(&RefreshToken{
+		UserId:    uid,
+		FamilyId:  family,
+		TokenHash: hashSecret(secret),
+		ExpiresAt: now.Add(RefreshTokenPeriod()),
+	}).Error
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// IssueRefreshToken starts a new family of refresh tokens at login.
+func IssueRefreshToken(db *gorm.DB, uid uint) (string, error) {
+	family, err := randomSecret()
+	if err != nil {
+		return "", err
+	}
+	return issueRefreshToken(db, uid, hashSecret(family), time.Now())
+}
+
+// RotateRefreshToken spends a refresh token and returns its user along with
+// the token that replaces it.
+func RotateRefreshToken(db *gorm.DB, secret string) (*User, string, error) {
+	user := User{}
+	next := ""
+	reused := false
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		current := RefreshToken{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("token_hash = ?", hashSecret(secret)).Take(&current).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		if current.UsedAt != nil || current.RevokedAt != nil {
+			// commit the revocation before refusing the token
+			reused = true
+			return revokeRefreshFamily(tx, current.FamilyId, now)
+		}
+		if !now.Before(current.ExpiresAt) {
+			return ErrInvalidRefreshToken
+		}
+		err = tx.Model(&RefreshToken{}).Where("id = ?", current.ID).UpdateColumn("used_at", now).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&User{}).Where("id = ?", current.UserId).Take(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+		next, err = issueRefreshToken(tx, user.ID, current.FamilyId, now)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if reused {
+		return nil, "", ErrInvalidRefreshToken
+	}
+	return &user, next, nil
+}
+
+func revokeRefreshFamily(tx *gorm.DB, family string, now time.Time) error {
+	return tx.Model(&RefreshToken{}).Where("family_id = ? AND revoked_at IS NULL", family).UpdateColumn("revoked_at", now).Error
+}
+
+// RevokeRefreshToken ends the session a refresh token belongs to. Unknown
+// tokens are ignored, there is nothing to revoke.
+func RevokeRefreshToken(db *gorm.DB, secret string) error {
+	current := RefreshToken{}
+	err := db.Where("token_hash = ?", hashSecret(secret)).Take(&current).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return revokeRefreshFamily(db, current.FamilyId, time.Now())
+}
+
+// RevokeUserTokens ends every session of a user, so none of their refresh
+// tokens can be used again.
+func RevokeUserTokens(db *gorm.DB, uid uint) error {
+	return db.Model(&RefreshToken{}).Where("user_id = ? AND revoked_at IS NULL", uid).UpdateColumn("revoked_at", time.Now()).Error
+}
+
+// RevokeUserAccessTokens refuses every access token issued to a user so
+// far, for when what the tokens say about the user is no longer true.
+func RevokeUserAccessTokens(db *gorm.DB, uid uint) error {
+	return db.Model(&User{}).Where("id = ?", uid).UpdateColumn("tokens_revoked_at", time.Now()).Error
+}
+
+// RevokeToken puts an access token on the revocation list until it expires,
+// clearing out entries that are no longer needed while it is at it.
+func RevokeToken(db *gorm.DB, jti string, uid uint, expiresAt time.Time) error {
+	if jti == "" {
+		return nil
+	}
+	err := db.Where("expires_at < ?", time.Now()).Delete(&RevokedToken{}).Error
+	if err != nil {
+		return err
+	}
+	return db.Clauses(clause.OnConflict{DoNothing: true}).Create(&RevokedToken{Jti: jti, UserId: uid, ExpiresAt: expiresAt}).Error
+}
+
+func IsTokenRevoked(db *gorm.DB, jti string) (bool, error) {
+	var count int64
+	err := db.Model(&RevokedToken{}).Where("jti = ?", jti).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// TokenRevocations is the revocation list the auth package checks every
+// token against. Tokens of users who were deleted are refused as well.
+type TokenRevocations struct {
+	DB *gorm.DB
+}
+
+func (t TokenRevocations) IsRevoked(jti string, uid uint, issuedAt time.Time) (bool, error) {
+	revoked, err := IsTokenRevoked(t.DB, jti)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	var count int64
+	err = t.DB.Model(&User{}).Where("id = ? AND (tokens_revoked_at IS NULL OR tokens_revoked_at <= ?)", uid, issuedAt).Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
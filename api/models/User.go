@@ -3,19 +3,34 @@ package models
 import (
 	"errors"
 	"html"
-	"log"
 	"strings"
+	"time"
 
 	"github.com/badoux/checkmail"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+var (
+	ErrEmailTaken     = errors.New("Email Already Taken")
+	ErrWrongPassword  = errors.New("Current password is incorrect")
+	ErrAdminOnly      = errors.New("Only admins can give or take away the admin role")
+	ErrUserHasLoans   = errors.New("Every book on loan has to be returned before the account is deleted")
+	ErrUserNotDeleted = errors.New("This user has not been deleted")
+)
+
+const maxDisplayNameLength = 100
+
 type User struct {
 	gorm.Model
-	Email    string `gorm:"size:100;not null;unique" json:"email"`
-	Password string `gorm:"size:100;not null;" json:"password"`
-	Role     string `gorm:"size:100;not null;" json:"role"`
+	Email           string     `gorm:"size:100;not null;unique" json:"email"`
+	Password        string     `gorm:"size:100;not null;" json:"password"`
+	Role            string     `gorm:"size:100;not null;" json:"role"`
+	PatronType      string     `gorm:"size:50;not null;default:standard" json:"patron_type"`
+	DisplayName     string     `gorm:"size:100" json:"display_name"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	TokensRevokedAt *time.Time `json:"-"`
 }
 
 func Hash(password string) ([]byte, error) {
@@ -37,7 +52,11 @@ func (u *User) BeforeSave(db *gorm.DB) error {
 
 func (u *User) Prepare() {
 	u.Email = html.EscapeString(strings.TrimSpace(u.Email))
-	u.Role = html.EscapeString(strings.TrimSpace(u.Role))
+	u.Role = html.EscapeString(strings.ToLower(strings.TrimSpace(u.Role)))
+	if u.Role == legacyRolePatron {
+		u.Role = RolePatron
+	}
+	u.PatronType = html.EscapeString(strings.ToLower(strings.TrimSpace(u.PatronType)))
 }
 
 func (u *User) Validate(action string) error {
@@ -63,8 +82,8 @@ func (u *User) Validate(action string) error {
 		if u.Role == "" {
 			return errors.New("Required Role")
 		}
-		if u.Role != "admin" && u.Role != "user" {
-			return errors.New("Role must be 'user' or 'admin'")
+		if !roleName.MatchString(u.Role) {
+			return errors.New("Invalid Role")
 		}
 		if err := checkmail.ValidateFormat(u.Email); err != nil {
 			return errors.New("Invalid Email")
@@ -75,6 +94,10 @@ func (u *User) Validate(action string) error {
 
 func (u *User) SaveUser(db *gorm.DB) (*User, error) {
 	var err error
+	_, err = FindRoleByName(db, u.Role)
+	if err != nil {
+		return &User{}, err
+	}
 	err = db.Create(&u).Error
 	if err != nil {
 		return &User{}, err
@@ -82,14 +105,105 @@ func (u *User) SaveUser(db *gorm.DB) (*User, error) {
 	return u, nil
 }
 
-func (u *User) FindAllUsers(db *gorm.DB) (*[]User, error) {
-	var err error
-	users := []User{}
-	err = db.Model(&User{}).Limit(100).Find(&users).Error
+// CreateUserAs adds a user on behalf of staff, who may pick any role but
+// admin unless they are admins themselves. The new account is recorded in
+// the audit log.
+func (u *User) CreateUserAs(db *gorm.DB, actor Actor) (*User, error) {
+	if u.Role == RoleAdmin && actor.Role != RoleAdmin {
+		return &User{}, ErrAdminOnly
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := u.SaveUser(tx)
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, AuditUserCreate, "user", u.ID, nil, map[string]string{"role": u.Role})
+	})
 	if err != nil {
-		return &[]User{}, err
+		return &User{}, err
+	}
+	return u, nil
+}
+
+// BootstrapAdmin creates the first admin of a new library. Once any admin
+// exists it does nothing and returns nil, so it is safe to run on every
+// start.
+func BootstrapAdmin(db *gorm.DB, email, password string) (*User, error) {
+	user := User{Email: email, Password: password, Role: RoleAdmin}
+	user.Prepare()
+	err := user.Validate("")
+	if err != nil {
+		return nil, err
+	}
+	created := false
+	err = db.Transaction(func(tx *gorm.DB) error {
+		var admins int64
+		err := tx.Model(&User{}).Where("role = ?", RoleAdmin).Count(&admins).Error
+		if err != nil || admins > 0 {
+			return err
+		}
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+		_, err = user.SaveUser(tx)
+		if err != nil {
+			return err
+		}
+		created = true
+		return RecordAudit(tx, Actor{}, AuditAdminBootstrap, "user", user.ID, nil, map[string]string{"role": user.Role})
+	})
+	if err != nil || !created {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// SaveUsers adds a batch of users in one transaction, so either every user
+// is saved and audited or none are.
+func SaveUsers(db *gorm.DB, users []User, actor Actor) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for i := range users {
+			_, err := users[i].CreateUserAs(tx, actor)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FindTakenEmails returns which of the given emails already have an account.
+func FindTakenEmails(db *gorm.DB, emails []string) ([]string, error) {
+	taken := []string{}
+	if len(emails) == 0 {
+		return taken, nil
+	}
+	err := db.Model(&User{}).Where("email IN ?", emails).Pluck("email", &taken).Error
+	if err != nil {
+		return nil, err
+	}
+	return taken, nil
+}
+
+var (
+	userSortColumns = map[string]sortColumn{
+		"email":      {Expr: "users.email", Kind: sortText, Field: "Email"},
+		"created_at": {Expr: "users.created_at", Kind: sortTime, Field: "CreatedAt"},
 	}
-	return &users, err
+	userIDColumn = sortColumn{Expr: "users.id", Field: "ID"}
+)
+
+func (u *User) FindAllUsers(db *gorm.DB, req *PageRequest) (*Page, error) {
+	req.Prepare("created_at")
+	users := []User{}
+	return paginate(db.Model(&User{}), req, userSortColumns, userIDColumn, &users)
+}
+
+// FindDeletedUsers lists soft deleted users, who can still be restored or
+// purged.
+func FindDeletedUsers(db *gorm.DB, req *PageRequest) (*Page, error) {
+	req.Prepare("created_at")
+	users := []User{}
+	return paginate(db.Unscoped().Model(&User{}).Where("users.deleted_at IS NOT NULL"), req, userSortColumns, userIDColumn, &users)
 }
 
 func (u *User) FindUserByID(db *gorm.DB, uid uint) (*User, error) {
@@ -102,33 +216,330 @@ func (u *User) FindUserByID(db *gorm.DB, uid uint) (*User, error) {
 	return &user, err
 }
 
-func (u *User) UpdateAUser(db *gorm.DB, uid uint32) (*User, error) {
-	err := u.BeforeSave(db)
+// ProfileChange is a partial update of a user's profile. Fields left nil
+// are not touched.
+type ProfileChange struct {
+	Email       *string `json:"email"`
+	DisplayName *string `json:"display_name"`
+}
+
+func (p *ProfileChange) Prepare() {
+	if p.Email != nil {
+		email := html.EscapeString(strings.TrimSpace(*p.Email))
+		p.Email = &email
+	}
+	if p.DisplayName != nil {
+		name := html.EscapeString(strings.TrimSpace(*p.DisplayName))
+		p.DisplayName = &name
+	}
+}
+
+func (p *ProfileChange) Validate() error {
+	if p.Email != nil {
+		if *p.Email == "" {
+			return errors.New("Required Email")
+		}
+		if err := checkmail.ValidateFormat(*p.Email); err != nil {
+			return errors.New("Invalid Email")
+		}
+	}
+	if p.DisplayName != nil && len(*p.DisplayName) > maxDisplayNameLength {
+		return errors.New("Display name is too long")
+	}
+	return nil
+}
+
+// UpdateProfile applies a profile change. A new email address has to be
+// verified again, which emailChanged tells the caller.
+func UpdateProfile(db *gorm.DB, uid uint, change ProfileChange, actor Actor) (user *User, emailChanged bool, err error) {
+	err = db.Transaction(func(tx *gorm.DB) error {
+		current := User{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", uid).Take(&current).Error
+		if err != nil {
+			return err
+		}
+		columns := map[string]interface{}{}
+		// the log only says which fields changed, never what they hold
+		changed := []string{}
+		if change.Email != nil && *change.Email != current.Email {
+			var taken int64
+			err = tx.Model(&User{}).Where("email = ? AND id <> ?", *change.Email, uid).Count(&taken).Error
+			if err != nil {
+				return err
+			}
+			if taken > 0 {
+				return ErrEmailTaken
+			}
+			columns["email"] = *change.Email
+			columns["email_verified_at"] = nil
+			changed = append(changed, "email")
+			emailChanged = true
+		}
+		if change.DisplayName != nil && *change.DisplayName != current.DisplayName {
+			columns["display_name"] = *change.DisplayName
+			changed = append(changed, "display_name")
+		}
+		if len(columns) > 0 {
+			columns["updated_at"] = time.Now()
+			err = tx.Model(&User{}).Where("id = ?", uid).UpdateColumns(columns).Error
+			if err != nil {
+				return err
+			}
+		}
+		after := current
+		if emailChanged {
+			after.EmailVerifiedAt = nil
+		}
+		return RecordAudit(tx, actor, "user.profile", "user", uid, NewAuditUser(&current), map[string]interface{}{"user": NewAuditUser(&after), "changed": changed})
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	user, err = (&User{}).FindUserByID(db, uid)
+	if err != nil {
+		return nil, false, err
+	}
+	return user, emailChanged, nil
+}
+
+// ChangePassword sets a new password once the current one has been
+// confirmed. Every refresh and access token of the user is revoked, so
+// other sessions have to log in again.
+func ChangePassword(db *gorm.DB, uid uint, current, password string, actor Actor) (*User, error) {
+	user := User{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", uid).Take(&user).Error
+		if err != nil {
+			return err
+		}
+		if VerifyPassword(user.Password, current) != nil {
+			return ErrWrongPassword
+		}
+		hashedPassword, err := Hash(password)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&User{}).Where("id = ?", uid).UpdateColumns(map[string]interface{}{
+			"password":   string(hashedPassword),
+			"updated_at": time.Now(),
+		}).Error
+		if err != nil {
+			return err
+		}
+		err = RevokeUserTokens(tx, uid)
+		if err != nil {
+			return err
+		}
+		err = RevokeUserAccessTokens(tx, uid)
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "user.password", "user", uid, nil, nil)
+	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	db = db.Model(&User{}).Where("id = ?", uid).Take(&User{}).UpdateColumns(
-		map[string]interface{}{
-			"password": u.Password,
-			"email":    u.Email,
-		},
-	)
-	if db.Error != nil {
-		return &User{}, db.Error
+	return &user, nil
+}
+
+func (u *User) UpdatePatronType(db *gorm.DB, uid uint, actor Actor) (*User, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		current := User{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", uid).Take(&current).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&User{}).Where("id = ?", uid).UpdateColumn("patron_type", u.PatronType).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "user.patron_type", "user", uid, map[string]string{"patron_type": current.PatronType}, map[string]string{"patron_type": u.PatronType})
+	})
+	if err != nil {
+		return &User{}, err
 	}
-	err = db.Model(&User{}).Where("id = ?", uid).Take(&u).Error
+	return u.FindUserByID(db, uid)
+}
+
+// UpdateRole gives a user another role and records who did it. Only admins
+// make or unmake admins, and the last admin cannot be demoted, or nobody
+// would be left to manage roles.
+func (u *User) UpdateRole(db *gorm.DB, uid uint, actor Actor) (*User, error) {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		_, err := FindRoleByName(tx, u.Role)
+		if err != nil {
+			return err
+		}
+		current := User{}
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", uid).Take(&current).Error
+		if err != nil {
+			return err
+		}
+		if (current.Role == RoleAdmin || u.Role == RoleAdmin) && actor.Role != RoleAdmin {
+			return ErrAdminOnly
+		}
+		if current.Role == RoleAdmin && u.Role != RoleAdmin {
+			var admins int64
+			err = tx.Model(&User{}).Where("role = ? AND id <> ?", RoleAdmin, uid).Count(&admins).Error
+			if err != nil {
+				return err
+			}
+			if admins == 0 {
+				return ErrLastAdmin
+			}
+		}
+		if current.Role == u.Role {
+			return nil
+		}
+		err = tx.Model(&User{}).Where("id = ?", uid).UpdateColumn("role", u.Role).Error
+		if err != nil {
+			return err
+		}
+		// the user's tokens still carry the old role
+		err = RevokeUserTokens(tx, uid)
+		if err == nil {
+			err = RevokeUserAccessTokens(tx, uid)
+		}
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, AuditUserRole, "user", uid, map[string]string{"role": current.Role}, map[string]string{"role": u.Role})
+	})
 	if err != nil {
 		return &User{}, err
 	}
-	return u, nil
+	return u.FindUserByID(db, uid)
+}
+
+func refuseOpenLoans(tx *gorm.DB, uid uint) error {
+	var onLoan int64
+	err := tx.Model(&Checkout{}).Where("user_id = ? AND checked_in = false", uid).Count(&onLoan).Error
+	if err != nil {
+		return err
+	}
+	if onLoan > 0 {
+		return ErrUserHasLoans
+	}
+	return nil
 }
 
-func (u *User) DeleteAUser(db *gorm.DB, uid uint) (int64, error) {
+// DeleteAUser soft deletes the user, cancels their holds and ends every
+// session. It is refused while they still have books out.
+func (u *User) DeleteAUser(db *gorm.DB, uid uint, actor Actor) (int64, error) {
+	var deleted int64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		user := User{}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", uid).Take(&user).Error
+		if err != nil {
+			return err
+		}
+		err = refuseOpenLoans(tx, uid)
+		if err != nil {
+			return err
+		}
+
+		holds := []Hold{}
+		err = tx.Model(&Hold{}).Where("user_id = ? AND status IN ?", uid, []string{HoldWaiting, HoldReady}).Find(&holds).Error
+		if err != nil {
+			return err
+		}
+		for i := range holds {
+			err = holds[i].CancelAHold(tx, actor)
+			if err != nil {
+				return err
+			}
+		}
+		err = RevokeUserTokens(tx, uid)
+		if err != nil {
+			return err
+		}
+		err = RevokeUserAccessTokens(tx, uid)
+		if err != nil {
+			return err
+		}
 
-	db.Delete(&u)
-	if db.Error != nil {
-		return 0, db.Error
+		result := tx.Delete(&User{}, uid)
+		deleted = result.RowsAffected
+		if result.Error != nil {
+			return result.Error
+		}
+		return RecordAudit(tx, actor, "user.delete", "user", uid, nil, nil)
+	})
+	if err != nil {
+		return 0, err
 	}
+	return deleted, nil
+}
 
-	return db.RowsAffected, nil
+func lockDeletedUser(tx *gorm.DB, uid uint) (*User, error) {
+	user := User{}
+	err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", uid).Take(&user).Error
+	if err != nil {
+		return nil, err
+	}
+	if !user.DeletedAt.Valid {
+		return nil, ErrUserNotDeleted
+	}
+	return &user, nil
+}
+
+// RestoreUser undoes DeleteAUser. The user signs in again, since their
+// tokens were revoked, and their holds stay cancelled.
+func RestoreUser(db *gorm.DB, uid uint, actor Actor) (*User, error) {
+	var user *User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, err = lockDeletedUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		// UpdateColumn skips BeforeSave, which would hash the password again
+		err = tx.Unscoped().Model(&User{}).Where("id = ?", uid).UpdateColumn("deleted_at", nil).Error
+		if err != nil {
+			return err
+		}
+		user.DeletedAt = gorm.DeletedAt{}
+		return RecordAudit(tx, actor, "user.restore", "user", uid, nil, NewAuditUser(user))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// PurgeUser erases a deleted user for good, along with their loans, holds,
+// account lines, tokens and failed logins. The audit log is append only and
+// keeps its entries about them, which only ever hold their ID.
+func PurgeUser(db *gorm.DB, uid uint, actor Actor) (*User, error) {
+	var user *User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		user, err = lockDeletedUser(tx, uid)
+		if err != nil {
+			return err
+		}
+		err = refuseOpenLoans(tx, uid)
+		if err != nil {
+			return err
+		}
+		for _, model := range []interface{}{&Checkout{}, &Hold{}, &LedgerEntry{}, &RefreshToken{}, &RevokedToken{}} {
+			err = tx.Unscoped().Where("user_id = ?", uid).Delete(model).Error
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Where("subject IN ?", []string{accountSubject(user.Email), resetSubject(user.Email)}).Delete(&LoginThrottle{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Unscoped().Delete(&User{}, uid).Error
+		if err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, "user.purge", "user", uid, nil, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
 }
@@ -1,31 +1,56 @@
 package api
 
 import (
-	"log"
+	"flag"
+	"fmt"
+	"io"
 	"os"
 
 	"github.com/brianhumphreys/library_app/api/controllers"
-	"github.com/brianhumphreys/library_app/seed"
-	"github.com/joho/godotenv"
 )
 
-var server = controllers.Server{}
+const serveUsage = `Usage: library_app serve [-addr ADDR]
 
-func Run() {
-	var err error
-	err = godotenv.Load()
-	if err != nil {
-		log.Println("Could not load you .env file: %v", err)
-		server.InitializeDev()
-		// seed.Load(server.DB)
+Runs the web server. It refuses to start, with exit code 3, until every
+migration has been applied. When ADMIN_EMAIL and ADMIN_PASSWORD are set
+and the library has no admin yet, the first admin is created.
 
-		server.Run(":" + os.Getenv("PORT"))
-	} else {
-		log.Println("Loaded values from .env file")
-		server.Initialize(os.Getenv("DB_DRIVER"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"), os.Getenv("DB_PORT"), os.Getenv("DB_HOST"), os.Getenv("DB_NAME"))
-		seed.Load(server.DB)
+Flags:
+  -addr ADDR    address to listen on, :$PORT when PORT is set, else :8080
+`
 
-		server.Run(":8080")
+func defaultAddr() string {
+	if port := os.Getenv("PORT"); port != "" {
+		return ":" + port
+	}
+	return ":8080"
+}
+
+func serve(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, serveUsage) }
+	addr := flags.String("addr", defaultAddr(), "address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return exitUsage
 	}
 
+	db, code := openDatabase(stderr)
+	if code != exitOK {
+		return code
+	}
+	server := controllers.Server{}
+	err := server.Initialize(db)
+	if err == nil {
+		err = server.BootstrapAdmin()
+	}
+	if err == nil {
+		err = server.Run(*addr)
+	}
+	fmt.Fprintln(stderr, err)
+	return exitFailed
 }
@@ -0,0 +1,90 @@
+package isbn
+
+import (
+	"errors"
+	"strings"
+)
+
+var ErrInvalid = errors.New("Invalid Isbn")
+
+// clean drops an "ISBN" prefix, hyphens and spaces, and upper cases the
+// ISBN-10 check character.
+func clean(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "ISBN-13")
+	s = strings.TrimPrefix(s, "ISBN-10")
+	s = strings.TrimPrefix(s, "ISBN")
+	s = strings.TrimPrefix(s, ":")
+	return strings.NewReplacer("-", "", " ", "").Replace(s)
+}
+
+func digits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func check13(s string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		d := int(s[i] - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func check10(s string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += int(s[i]-'0') * (10 - i)
+	}
+	c := (11 - sum%11) % 11
+	if c == 10 {
+		return 'X'
+	}
+	return byte('0' + c)
+}
+
+// Valid13 reports whether s is a well formed ISBN-13 with a correct check digit.
+func Valid13(s string) bool {
+	return len(s) == 13 && digits(s) && (strings.HasPrefix(s, "978") || strings.HasPrefix(s, "979")) && check13(s) == s[12]
+}
+
+// Valid10 reports whether s is a well formed ISBN-10 with a correct check digit.
+func Valid10(s string) bool {
+	return len(s) == 10 && digits(s[:9]) && check10(s) == s[9]
+}
+
+// To13 converts a valid ISBN-10 to its ISBN-13 form.
+func To13(s string) string {
+	s = "978" + s[:9]
+	return s + string(check13(s))
+}
+
+// To10 converts an ISBN-13 to ISBN-10. Only 978 numbers have one.
+func To10(s string) (string, bool) {
+	if !strings.HasPrefix(s, "978") {
+		return "", false
+	}
+	s = s[3:12]
+	return s + string(check10(s)), true
+}
+
+// Normalize accepts an ISBN-10 or ISBN-13 in any common notation and returns
+// the bare ISBN-13 that books are stored under.
+func Normalize(s string) (string, error) {
+	s = clean(s)
+	if Valid13(s) {
+		return s, nil
+	}
+	if Valid10(s) {
+		return To13(s), nil
+	}
+	return "", ErrInvalid
+}
@@ -0,0 +1,47 @@
+package views
+
+import (
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/models"
+)
+
+// LedgerEntry is one charge or credit on a patron's account.
+type LedgerEntry struct {
+	ID          uint      `json:"id"`
+	UserId      uint      `json:"user_id"`
+	CheckoutId  *uint     `json:"checkout_id"`
+	Kind        string    `json:"kind"`
+	AmountCents int64     `json:"amount_cents"`
+	Note        string    `json:"note"`
+	CreatedBy   uint      `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Account is the balance of a patron and the entries that make it up.
+type Account struct {
+	UserId       uint          `json:"user_id"`
+	BalanceCents int64         `json:"balance_cents"`
+	Entries      []LedgerEntry `json:"entries"`
+}
+
+func NewLedgerEntry(le *models.LedgerEntry) LedgerEntry {
+	return LedgerEntry{
+		ID:          le.ID,
+		UserId:      le.UserId,
+		CheckoutId:  le.CheckoutId,
+		Kind:        le.Kind,
+		AmountCents: le.AmountCents,
+		Note:        le.Note,
+		CreatedBy:   le.CreatedBy,
+		CreatedAt:   le.CreatedAt,
+	}
+}
+
+func NewAccount(a *models.Account) Account {
+	entries := make([]LedgerEntry, len(a.Entries))
+	for i := range a.Entries {
+		entries[i] = NewLedgerEntry(&a.Entries[i])
+	}
+	return Account{UserId: a.UserId, BalanceCents: a.BalanceCents, Entries: entries}
+}
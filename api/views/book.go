@@ -0,0 +1,107 @@
+package views
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/models"
+)
+
+// Book is a catalog entry as the API shows it.
+type Book struct {
+	ID              uint      `json:"id"`
+	Title           string    `json:"title"`
+	Author          string    `json:"author"`
+	Isbn            string    `json:"isbn"`
+	Description     string    `json:"description"`
+	Publisher       string    `json:"publisher"`
+	PublicationYear int       `json:"publication_year"`
+	Subjects        []string  `json:"subjects"`
+	CoverUrl        string    `json:"cover_url"`
+	Available       bool      `json:"available"`
+	CopiesTotal     int       `json:"copies_total"`
+	CopiesAvailable int       `json:"copies_available"`
+	Copies          []Copy    `json:"copies,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// Copy is one physical item of a book.
+type Copy struct {
+	ID            uint      `json:"id"`
+	BookId        uint64    `json:"book_id"`
+	Barcode       string    `json:"barcode"`
+	ShelfLocation string    `json:"shelf_location"`
+	Condition     string    `json:"condition"`
+	ItemType      string    `json:"item_type"`
+	Status        string    `json:"status"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+func NewBook(b *models.Book) Book {
+	subjects := []string(b.Subjects)
+	if subjects == nil {
+		subjects = []string{}
+	}
+	book := Book{
+		ID:              b.ID,
+		Title:           b.Title,
+		Author:          b.Author,
+		Isbn:            b.Isbn,
+		Description:     b.Description,
+		Publisher:       b.Publisher,
+		PublicationYear: b.PublicationYear,
+		Subjects:        subjects,
+		CoverUrl:        b.CoverUrl,
+		Available:       b.Available,
+		CopiesTotal:     b.CopiesTotal,
+		CopiesAvailable: b.CopiesAvailable,
+		CreatedAt:       b.CreatedAt,
+		UpdatedAt:       b.UpdatedAt,
+	}
+	if len(b.Copies) > 0 {
+		book.Copies = NewCopies(b.Copies)
+	}
+	return book
+}
+
+func NewBooks(books []models.Book) []Book {
+	data := make([]Book, len(books))
+	for i := range books {
+		data[i] = NewBook(&books[i])
+	}
+	return data
+}
+
+// BookPage swaps the books on a page for their API view.
+func BookPage(page *models.Page) (*models.Page, error) {
+	books, ok := page.Data.([]models.Book)
+	if !ok {
+		return nil, fmt.Errorf("views: BookPage got a page of %T", page.Data)
+	}
+	page.Data = NewBooks(books)
+	return page, nil
+}
+
+func NewCopy(c *models.BookCopy) Copy {
+	return Copy{
+		ID:            c.ID,
+		BookId:        c.BookId,
+		Barcode:       c.Barcode,
+		ShelfLocation: c.ShelfLocation,
+		Condition:     c.Condition,
+		ItemType:      c.ItemType,
+		Status:        c.Status,
+		CreatedAt:     c.CreatedAt,
+		UpdatedAt:     c.UpdatedAt,
+	}
+}
+
+func NewCopies(copies []models.BookCopy) []Copy {
+	data := make([]Copy, len(copies))
+	for i := range copies {
+		data[i] = NewCopy(&copies[i])
+	}
+	return data
+}
@@ -0,0 +1,100 @@
+package views
+
+import (
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/models"
+)
+
+// Checkout is a loan as shown to the borrower and to staff.
+type Checkout struct {
+	ID           uint       `json:"id"`
+	UserId       uint       `json:"user_id"`
+	BookId       uint64     `json:"book_id"`
+	CopyId       uint64     `json:"copy_id"`
+	CheckedIn    bool       `json:"checked_in"`
+	CheckedOut   time.Time  `json:"checked_out"`
+	DueAt        time.Time  `json:"due_at"`
+	ReturnedAt   *time.Time `json:"returned_at"`
+	RenewalCount int        `json:"renewal_count"`
+}
+
+func NewCheckout(c *models.Checkout) Checkout {
+	return Checkout{
+		ID:           c.ID,
+		UserId:       c.UserId,
+		BookId:       c.BookId,
+		CopyId:       c.CopyId,
+		CheckedIn:    c.CheckedIn,
+		CheckedOut:   c.CreatedAt,
+		DueAt:        c.DueAt,
+		ReturnedAt:   c.ReturnedAt,
+		RenewalCount: c.RenewalCount,
+	}
+}
+
+// Overdue is a loan past its due date, for the staff chasing it.
+type Overdue struct {
+	CheckoutId uint      `json:"checkout_id"`
+	UserId     uint      `json:"user_id"`
+	Email      string    `json:"email"`
+	BookId     uint64    `json:"book_id"`
+	Title      string    `json:"title"`
+	CheckedOut time.Time `json:"checked_out"`
+	DueAt      time.Time `json:"due_at"`
+	DaysLate   int       `json:"days_late"`
+}
+
+// Hold is a patron's place in the queue for a book.
+type Hold struct {
+	ID        uint       `json:"id"`
+	UserId    uint       `json:"user_id"`
+	BookId    uint64     `json:"book_id"`
+	Status    string     `json:"status"`
+	CopyId    *uint64    `json:"copy_id"`
+	ReadyAt   *time.Time `json:"ready_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Position  int        `json:"position,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+func NewOverdues(records []models.OverdueRecord) []Overdue {
+	data := make([]Overdue, len(records))
+	for i, o := range records {
+		data[i] = Overdue{
+			CheckoutId: o.CheckoutId,
+			UserId:     o.UserId,
+			Email:      o.Email,
+			BookId:     o.BookId,
+			Title:      o.Title,
+			CheckedOut: o.CheckedOut,
+			DueAt:      o.DueAt,
+			DaysLate:   o.DaysLate,
+		}
+	}
+	return data
+}
+
+func NewHold(h *models.Hold) Hold {
+	return Hold{
+		ID:        h.ID,
+		UserId:    h.UserId,
+		BookId:    h.BookId,
+		Status:    h.Status,
+		CopyId:    h.CopyId,
+		ReadyAt:   h.ReadyAt,
+		ExpiresAt: h.ExpiresAt,
+		Position:  h.Position,
+		CreatedAt: h.CreatedAt,
+		UpdatedAt: h.UpdatedAt,
+	}
+}
+
+func NewHolds(holds []models.Hold) []Hold {
+	data := make([]Hold, len(holds))
+	for i := range holds {
+		data[i] = NewHold(&holds[i])
+	}
+	return data
+}
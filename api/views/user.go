@@ -0,0 +1,76 @@
+package views
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/models"
+)
+
+// PublicUser is what anyone may see about a user. The role is left out,
+// or strangers could list who the staff are.
+type PublicUser struct {
+	ID          uint   `json:"id"`
+	DisplayName string `json:"display_name"`
+}
+
+// SelfUser is what users see about their own account.
+type SelfUser struct {
+	ID              uint       `json:"id"`
+	Email           string     `json:"email"`
+	DisplayName     string     `json:"display_name"`
+	Role            string     `json:"role"`
+	PatronType      string     `json:"patron_type"`
+	EmailVerified   bool       `json:"email_verified"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// AdminUser is what staff who manage accounts see.
+type AdminUser struct {
+	SelfUser
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+func NewPublicUser(u *models.User) PublicUser {
+	return PublicUser{ID: u.ID, DisplayName: u.DisplayName}
+}
+
+func NewSelfUser(u *models.User) SelfUser {
+	return SelfUser{
+		ID:              u.ID,
+		Email:           u.Email,
+		DisplayName:     u.DisplayName,
+		Role:            u.Role,
+		PatronType:      u.PatronType,
+		EmailVerified:   u.EmailVerifiedAt != nil,
+		EmailVerifiedAt: u.EmailVerifiedAt,
+		CreatedAt:       u.CreatedAt,
+		UpdatedAt:       u.UpdatedAt,
+	}
+}
+
+func NewAdminUser(u *models.User) AdminUser {
+	admin := AdminUser{SelfUser: NewSelfUser(u)}
+	if u.DeletedAt.Valid {
+		deletedAt := u.DeletedAt.Time
+		admin.DeletedAt = &deletedAt
+	}
+	return admin
+}
+
+// AdminUserPage swaps the users on a page for their admin view. A page of
+// anything else is a bug, and serving it empty would hide it.
+func AdminUserPage(page *models.Page) (*models.Page, error) {
+	users, ok := page.Data.([]models.User)
+	if !ok {
+		return nil, fmt.Errorf("views: AdminUserPage got a page of %T", page.Data)
+	}
+	data := make([]AdminUser, len(users))
+	for i := range users {
+		data[i] = NewAdminUser(&users[i])
+	}
+	page.Data = data
+	return page, nil
+}
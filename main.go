@@ -1,7 +1,11 @@
 package main
 
-import "github.com/brianhumphreys/library_app/api"
+import (
+	"os"
+
+	"github.com/brianhumphreys/library_app/api"
+)
 
 func main() {
-	api.Run()
+	os.Exit(api.Main(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
 }
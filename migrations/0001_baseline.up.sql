@@ -0,0 +1,14 @@
+-- The schema as the last release before versioned migrations left it: the
+-- server only ever AutoMigrated users and books, and checkouts exists where
+-- the seed ran. Every statement is guarded, so that database is recorded at
+-- this version without being changed, and the versions after it bring it up
+-- to date.
+
+CREATE TABLE IF NOT EXISTS "users" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"email" varchar(100) NOT NULL UNIQUE,"password" varchar(100) NOT NULL,"role" varchar(100) NOT NULL,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "books" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"title" varchar(255) NOT NULL,"author" varchar(255) NOT NULL,"isbn" varchar(255) NOT NULL,"description" varchar(4096) NOT NULL,"available" boolean NOT NULL,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_books_deleted_at" ON "books" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "checkouts" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"user_id" bigint NOT NULL,"book_id" bigint NOT NULL,"checked_in" boolean,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_checkouts_deleted_at" ON "checkouts" ("deleted_at");
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS "login_throttles", "revoked_tokens", "refresh_tokens", "roles";
+ALTER TABLE "users" DROP COLUMN IF EXISTS "email_verified_at", DROP COLUMN IF EXISTS "display_name", DROP COLUMN IF EXISTS "patron_type";
@@ -0,0 +1,27 @@
+-- Everyone who signed up before email verification counts as verified. The
+-- backfill only runs when the column is new, so nobody who signed up since
+-- is verified by it.
+DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'users' AND column_name = 'email_verified_at') THEN
+		ALTER TABLE "users" ADD COLUMN "email_verified_at" timestamptz;
+		UPDATE "users" SET "email_verified_at" = "created_at";
+	END IF;
+END
+$$;
+
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "patron_type" varchar(50) NOT NULL DEFAULT 'standard', ADD COLUMN IF NOT EXISTS "display_name" varchar(100);
+
+CREATE TABLE IF NOT EXISTS "roles" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"name" varchar(50) NOT NULL UNIQUE,"description" varchar(255),"permissions" text,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_roles_deleted_at" ON "roles" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "refresh_tokens" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"user_id" bigint NOT NULL,"family_id" varchar(64) NOT NULL,"token_hash" varchar(64) NOT NULL UNIQUE,"expires_at" timestamptz NOT NULL,"used_at" timestamptz,"revoked_at" timestamptz,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_refresh_tokens_family_id" ON "refresh_tokens" ("family_id");
+CREATE INDEX IF NOT EXISTS "idx_refresh_tokens_user_id" ON "refresh_tokens" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_refresh_tokens_deleted_at" ON "refresh_tokens" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "revoked_tokens" ("jti" varchar(64),"user_id" bigint NOT NULL,"expires_at" timestamptz NOT NULL,"created_at" timestamptz,PRIMARY KEY ("jti"));
+CREATE INDEX IF NOT EXISTS "idx_revoked_tokens_expires_at" ON "revoked_tokens" ("expires_at");
+CREATE INDEX IF NOT EXISTS "idx_revoked_tokens_user_id" ON "revoked_tokens" ("user_id");
+
+CREATE TABLE IF NOT EXISTS "login_throttles" ("subject" varchar(200),"failures" bigint NOT NULL DEFAULT 0,"last_failure_at" timestamptz,"locked_until" timestamptz,PRIMARY KEY ("subject"));
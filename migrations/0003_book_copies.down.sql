@@ -0,0 +1,8 @@
+-- A book is available again when any of its copies is.
+ALTER TABLE "books" ADD COLUMN IF NOT EXISTS "available" boolean NOT NULL DEFAULT false;
+UPDATE "books" SET "available" = EXISTS (SELECT 1 FROM "book_copies" WHERE "book_copies"."book_id" = "books"."id" AND "book_copies"."status" = 'available' AND "book_copies"."deleted_at" IS NULL);
+ALTER TABLE "books" ALTER COLUMN "available" DROP DEFAULT;
+DROP TABLE IF EXISTS "book_copies";
+
+ALTER TABLE "checkouts" DROP COLUMN IF EXISTS "copy_id", DROP COLUMN IF EXISTS "due_at", DROP COLUMN IF EXISTS "returned_at", DROP COLUMN IF EXISTS "renewal_count";
+ALTER TABLE "books" DROP COLUMN IF EXISTS "publisher", DROP COLUMN IF EXISTS "publication_year", DROP COLUMN IF EXISTS "subjects", DROP COLUMN IF EXISTS "cover_url";
@@ -0,0 +1,32 @@
+ALTER TABLE "books" ADD COLUMN IF NOT EXISTS "publisher" varchar(255), ADD COLUMN IF NOT EXISTS "publication_year" bigint, ADD COLUMN IF NOT EXISTS "subjects" text, ADD COLUMN IF NOT EXISTS "cover_url" varchar(512);
+
+CREATE TABLE IF NOT EXISTS "book_copies" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"book_id" bigint NOT NULL,"barcode" varchar(64) NOT NULL UNIQUE,"shelf_location" varchar(255),"condition" varchar(100),"item_type" varchar(50) NOT NULL DEFAULT 'standard',"status" varchar(20) NOT NULL DEFAULT 'available',PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_book_copies_status" ON "book_copies" ("status");
+CREATE INDEX IF NOT EXISTS "idx_book_copies_book_id" ON "book_copies" ("book_id");
+CREATE INDEX IF NOT EXISTS "idx_book_copies_deleted_at" ON "book_copies" ("deleted_at");
+
+ALTER TABLE "checkouts" ADD COLUMN IF NOT EXISTS "copy_id" bigint NOT NULL DEFAULT 0, ADD COLUMN IF NOT EXISTS "due_at" timestamptz, ADD COLUMN IF NOT EXISTS "returned_at" timestamptz, ADD COLUMN IF NOT EXISTS "renewal_count" bigint NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS "idx_checkouts_due_at" ON "checkouts" ("due_at");
+CREATE INDEX IF NOT EXISTS "idx_checkouts_copy_id" ON "checkouts" ("copy_id");
+
+-- Loans from before due dates were due after the default two weeks, and a
+-- returned loan was last updated when it came back.
+UPDATE "checkouts" SET "due_at" = "created_at" + interval '14 days' WHERE "due_at" IS NULL;
+UPDATE "checkouts" SET "returned_at" = "updated_at" WHERE "checked_in" AND "returned_at" IS NULL;
+
+-- Every book from before copies gets a single copy, which takes over the
+-- book's availability flag and then its loans.
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'books' AND column_name = 'available') THEN
+		INSERT INTO "book_copies" ("created_at", "updated_at", "book_id", "barcode", "status")
+			SELECT now(), now(), "books"."id", 'B' || lpad("books"."id"::text, 6, '0') || '-01',
+				CASE WHEN "books"."available" THEN 'available' ELSE 'checked_out' END
+			FROM "books" WHERE NOT EXISTS (SELECT 1 FROM "book_copies" WHERE "book_copies"."book_id" = "books"."id");
+		ALTER TABLE "books" DROP COLUMN "available";
+	END IF;
+END
+$$;
+ALTER TABLE "books" DROP COLUMN IF EXISTS "on_hold_shelf";
+UPDATE "checkouts" SET "copy_id" = "book_copies"."id" FROM "book_copies"
+	WHERE "checkouts"."copy_id" = 0 AND "book_copies"."book_id" = "checkouts"."book_id";
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS "circulation_policies", "ledger_entries", "holds";
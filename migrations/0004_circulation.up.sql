@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS "holds" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"user_id" bigint NOT NULL,"book_id" bigint NOT NULL,"status" varchar(20) NOT NULL DEFAULT 'waiting',"copy_id" bigint,"ready_at" timestamptz,"expires_at" timestamptz,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_holds_book_id" ON "holds" ("book_id");
+CREATE INDEX IF NOT EXISTS "idx_holds_user_id" ON "holds" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_holds_deleted_at" ON "holds" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "ledger_entries" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"user_id" bigint NOT NULL,"checkout_id" bigint,"kind" varchar(20) NOT NULL,"amount_cents" bigint NOT NULL,"note" varchar(512),"created_by" bigint,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_ledger_entries_checkout_id" ON "ledger_entries" ("checkout_id");
+CREATE INDEX IF NOT EXISTS "idx_ledger_entries_user_id" ON "ledger_entries" ("user_id");
+CREATE INDEX IF NOT EXISTS "idx_ledger_entries_deleted_at" ON "ledger_entries" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "circulation_policies" ("id" bigserial,"created_at" timestamptz,"updated_at" timestamptz,"deleted_at" timestamptz,"patron_type" varchar(50) NOT NULL,"item_type" varchar(50) NOT NULL,"max_loans" bigint NOT NULL,"loan_period_days" bigint NOT NULL,"max_renewals" bigint NOT NULL,"max_holds" bigint NOT NULL,"hold_pickup_days" bigint NOT NULL,"fine_per_day_cents" bigint NOT NULL,"fine_cap_cents" bigint NOT NULL,"lost_item_charge_cents" bigint NOT NULL,"blocking_balance_cents" bigint NOT NULL,PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_policy_types" ON "circulation_policies" ("patron_type","item_type");
+CREATE INDEX IF NOT EXISTS "idx_circulation_policies_deleted_at" ON "circulation_policies" ("deleted_at");
@@ -0,0 +1,3 @@
+-- ISBNs stay in their ISBN-13 form, which the older code accepts too.
+DROP INDEX IF EXISTS idx_books_search;
+DROP INDEX IF EXISTS idx_books_isbn;
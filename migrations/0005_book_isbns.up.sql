@@ -0,0 +1,47 @@
+-- Every valid ISBN is stored in its bare ISBN-13 form, the way
+-- isbn.Normalize in api/utils/isbn does it, so the unique index below
+-- covers it. Rows whose ISBN cannot be parsed are left for staff to fix and
+-- are not covered by the index.
+CREATE OR REPLACE FUNCTION migrate_isbn13(raw text) RETURNS text AS $$
+DECLARE
+	s text := translate(regexp_replace(upper(btrim(raw)), '^ISBN(-1[03])?:?', ''), '- ', '');
+	total int := 0;
+	c int;
+BEGIN
+	IF s ~ '^97[89][0-9]{10}$' THEN
+		FOR i IN 1..12 LOOP
+			total := total + substr(s, i, 1)::int * CASE WHEN i % 2 = 0 THEN 3 ELSE 1 END;
+		END LOOP;
+		IF (10 - total % 10) % 10 <> substr(s, 13, 1)::int THEN
+			RETURN NULL;
+		END IF;
+		RETURN s;
+	END IF;
+	IF s !~ '^[0-9]{9}[0-9X]$' THEN
+		RETURN NULL;
+	END IF;
+	FOR i IN 1..9 LOOP
+		total := total + substr(s, i, 1)::int * (11 - i);
+	END LOOP;
+	c := (11 - total % 11) % 11;
+	IF CASE WHEN c = 10 THEN 'X' ELSE c::text END <> substr(s, 10, 1) THEN
+		RETURN NULL;
+	END IF;
+	s := '978' || substr(s, 1, 9);
+	total := 0;
+	FOR i IN 1..12 LOOP
+		total := total + substr(s, i, 1)::int * CASE WHEN i % 2 = 0 THEN 3 ELSE 1 END;
+	END LOOP;
+	RETURN s || ((10 - total % 10) % 10)::text;
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+UPDATE "books" SET "isbn" = migrate_isbn13("isbn") WHERE "isbn" !~ '^97[89][0-9]{10}$' AND migrate_isbn13("isbn") IS NOT NULL;
+DROP FUNCTION migrate_isbn13(text);
+
+-- This fails when two books share an ISBN, they have to be merged first.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_books_isbn ON books (isbn) WHERE deleted_at IS NULL AND isbn ~ '^97[89][0-9]{10}$';
+
+-- The expression has to match bookSearchVector in api/models/BookSearch.go,
+-- or catalog search will not use the index.
+CREATE INDEX IF NOT EXISTS idx_books_search ON books USING GIN ((setweight(to_tsvector('english', books.title), 'A') || setweight(to_tsvector('english', books.author), 'B') || setweight(to_tsvector('simple', books.isbn), 'A') || setweight(to_tsvector('english', books.description), 'C')));
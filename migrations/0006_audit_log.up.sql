@@ -0,0 +1,20 @@
+CREATE TABLE IF NOT EXISTS "audit_entries" ("id" bigserial,"actor_id" bigint NOT NULL,"action" varchar(100) NOT NULL,"target_type" varchar(50) NOT NULL,"target_id" bigint NOT NULL,"before" text,"after" text,"request_id" varchar(64),"ip" varchar(64),"prev_hash" varchar(64) NOT NULL,"hash" varchar(64) NOT NULL UNIQUE,"created_at" timestamptz,PRIMARY KEY ("id"));
+CREATE INDEX IF NOT EXISTS "idx_audit_target" ON "audit_entries" ("target_type","target_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_action" ON "audit_entries" ("action");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_actor_id" ON "audit_entries" ("actor_id");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_created_at" ON "audit_entries" ("created_at");
+CREATE INDEX IF NOT EXISTS "idx_audit_entries_request_id" ON "audit_entries" ("request_id");
+
+-- The database itself refuses to change or remove audit entries. Dropping
+-- the table still works, so a tampered copy is spotted by the chain check
+-- rather than prevented outright.
+CREATE OR REPLACE FUNCTION audit_entries_append_only() RETURNS trigger AS $$
+BEGIN
+	RAISE EXCEPTION 'audit_entries is append only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_entries_no_change ON audit_entries;
+CREATE TRIGGER audit_entries_no_change BEFORE UPDATE OR DELETE ON audit_entries FOR EACH ROW EXECUTE PROCEDURE audit_entries_append_only();
+DROP TRIGGER IF EXISTS audit_entries_no_truncate ON audit_entries;
+CREATE TRIGGER audit_entries_no_truncate BEFORE TRUNCATE ON audit_entries FOR EACH STATEMENT EXECUTE PROCEDURE audit_entries_append_only();
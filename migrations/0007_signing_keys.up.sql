@@ -0,0 +1,5 @@
+CREATE TABLE IF NOT EXISTS "signing_keys" (
+	"id" varchar(64) PRIMARY KEY,
+	"pem" text NOT NULL,
+	"created_at" timestamptz NOT NULL
+);
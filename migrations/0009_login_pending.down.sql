@@ -0,0 +1,2 @@
+ALTER TABLE "login_throttles" DROP COLUMN IF EXISTS "pending_at";
+ALTER TABLE "login_throttles" DROP COLUMN IF EXISTS "pending";
@@ -0,0 +1,2 @@
+ALTER TABLE "login_throttles" ADD COLUMN IF NOT EXISTS "pending" bigint NOT NULL DEFAULT 0;
+ALTER TABLE "login_throttles" ADD COLUMN IF NOT EXISTS "pending_at" timestamptz;
@@ -1,127 +1,161 @@
 package seed
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"sort"
+	"time"
 
 	"github.com/brianhumphreys/library_app/api/models"
 	"gorm.io/gorm"
 )
 
-var users = []models.User{
-	models.User{
-		Email:    "batya@pt.com",
-		Password: "batya123",
-		Role:     "admin",
-	},
-	models.User{
-		Email:    "rob@pt.com",
-		Password: "rob123",
-		Role:     "admin",
-	},
-	models.User{
-		Email:    "brian@pt.com",
-		Password: "brian123",
-		Role:     "user",
-	},
-}
+var (
+	// ErrUnknownFixture is returned by Load for a name Names does not list.
+	ErrUnknownFixture = errors.New("There is no fixture with that name")
+	// ErrNotEmpty is returned by Load when the database already has users.
+	ErrNotEmpty = errors.New("The database already has users, only an empty one is seeded")
+)
 
-var books = []models.Book{
-	models.Book{
-		Title:       "A Little Life",
-		Author:      "Hanya Yanagihara",
-		Isbn:        "isbn",
-		Description: "description",
-		Available:   false,
-	},
-	models.Book{
-		Title:       "The Anthropocene Reviewed",
-		Author:      "John Green",
-		Isbn:        "isbn",
-		Description: "description",
-		Available:   false,
-	},
-	models.Book{
-		Title:       "The Handmaid's Tale",
-		Author:      "Margaret Atwood",
-		Isbn:        "isbn",
-		Description: "description",
-		Available:   false,
-	},
-	models.Book{
-		Title:       "The Perks of Being a Wallflower",
-		Author:      "Stephen Chbosky",
-		Isbn:        "isbn",
-		Description: "description",
-		Available:   false,
-	},
-	models.Book{
-		Title:       "Memoirs of a Geisha",
-		Author:      "Arthur Golden",
-		Isbn:        "isbn",
-		Description: "description",
-		Available:   true,
-	},
-	models.Book{
-		Title:       "The Souls of Black Folk",
-		Author:      "W. E. B. Du Bois",
-		Isbn:        "isbn",
-		Description: "description",
-		Available:   true,
-	},
+// loan checks a book out to a user, both given by their place in the
+// fixture.
+type loan struct {
+	User int
+	Book int
 }
 
-var checkouts = []models.Checkout{
-	models.Checkout{
-		BookId: 1,
-		UserId: 2,
-	},
-	models.Checkout{
-		BookId: 2,
-		UserId: 2,
-	},
-	models.Checkout{
-		BookId: 3,
-		UserId: 2,
-	},
-	models.Checkout{
-		BookId: 4,
-		UserId: 2,
-	},
-}
+// fixture is a set of sample data. Each call builds it afresh, since
+// saving fills in the ids.
+type fixture func() ([]models.User, []models.Book, []loan)
 
-func Load(db *gorm.DB) {
-	db.Migrator().DropTable(&models.Checkout{}, &models.Book{}, &models.User{})
-	db.AutoMigrate(&models.User{}, &models.Book{}, &models.Checkout{})
+var fixtures = map[string]fixture{
+	"demo":    demo,
+	"catalog": catalog,
+}
 
-	var createErr error
-	for i, _ := range users {
-		createErr = db.Create(&users[i]).Error
-		if createErr != nil {
-			log.Fatalf("User table could not be seeded: %v", createErr)
-		}
+// Names lists the fixtures Load knows.
+func Names() []string {
+	names := []string{}
+	for name := range fixtures {
+		names = append(names, name)
 	}
-	fmt.Println("User table seeded.")
+	sort.Strings(names)
+	return names
+}
 
-	for i, _ := range books {
-		createErr = db.Create(&books[i]).Error
-		if createErr != nil {
-			log.Fatalf("Book table could not be seeded: %v", createErr)
-		}
+func demoBooks() []models.Book {
+	return []models.Book{
+		models.Book{
+			Title:       "A Little Life",
+			Author:      "Hanya Yanagihara",
+			Isbn:        "9780385539258",
+			Description: "description",
+		},
+		models.Book{
+			Title:       "The Anthropocene Reviewed",
+			Author:      "John Green",
+			Isbn:        "9780525555216",
+			Description: "description",
+		},
+		models.Book{
+			Title:       "The Handmaid's Tale",
+			Author:      "Margaret Atwood",
+			Isbn:        "9780385490818",
+			Description: "description",
+		},
+		models.Book{
+			Title:       "The Perks of Being a Wallflower",
+			Author:      "Stephen Chbosky",
+			Isbn:        "9780671027346",
+			Description: "description",
+		},
+		models.Book{
+			Title:       "Memoirs of a Geisha",
+			Author:      "Arthur Golden",
+			Isbn:        "9780679781585",
+			Description: "description",
+		},
+		models.Book{
+			Title:       "The Souls of Black Folk",
+			Author:      "W. E. B. Du Bois",
+			Isbn:        "9780486280417",
+			Description: "description",
+		},
 	}
-	fmt.Println("Book table seeded.")
+}
 
-	for i, _ := range checkouts {
-		createErr = db.Create(&checkouts[i]).Error
-		if createErr != nil {
-			log.Fatalf("Checkout table could not be seeded: %v", createErr)
-		}
+// demo has a few patrons and books, with one patron holding four of them.
+func demo() ([]models.User, []models.Book, []loan) {
+	users := []models.User{
+		models.User{
+			Email:    "batya@pt.com",
+			Password: "batya123",
+			Role:     models.RolePatron,
+		},
+		models.User{
+			Email:    "rob@pt.com",
+			Password: "rob123",
+			Role:     models.RolePatron,
+		},
+		models.User{
+			Email:    "brian@pt.com",
+			Password: "brian123",
+			Role:     models.RolePatron,
+		},
 	}
+	loans := []loan{{User: 1, Book: 0}, {User: 1, Book: 1}, {User: 1, Book: 2}, {User: 1, Book: 3}}
+	return users, demoBooks(), loans
+}
+
+// catalog has the demo books and nothing else.
+func catalog() ([]models.User, []models.Book, []loan) {
+	return []models.User{}, demoBooks(), []loan{}
+}
 
-	booksResult := []models.Book{}
-	err := db.Table("users").Select("books.title, books.author, books.isbn, books.description").Joins("JOIN checkouts on checkouts.user_id = users.id").Joins("JOIN books on books.id = checkouts.book_id").Where("checkouts.user_id = ?", 5).Limit(100).Find(&booksResult).Error
+// Load fills an empty database with the named fixture. The schema has to be
+// migrated and the roles set up first, nothing is dropped or created here.
+func Load(db *gorm.DB, name string) error {
+	build, ok := fixtures[name]
+	if !ok {
+		return ErrUnknownFixture
+	}
+	var count int64
+	err := db.Model(&models.User{}).Unscoped().Count(&count).Error
 	if err != nil {
-		fmt.Println(err)
+		return fmt.Errorf("Users could not be counted: %v", err)
+	}
+	if count > 0 {
+		return ErrNotEmpty
 	}
-	fmt.Println("Checkout table seeded.")
+	users, books, loans := build()
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		// seeded accounts are ready to use without going through email
+		verifiedAt := time.Now()
+		for i := range users {
+			users[i].EmailVerifiedAt = &verifiedAt
+			_, err := users[i].SaveUser(tx)
+			if err != nil {
+				return fmt.Errorf("User table could not be seeded: %v", err)
+			}
+		}
+		for i := range books {
+			_, err := books[i].SaveBook(tx)
+			if err != nil {
+				return fmt.Errorf("Book table could not be seeded: %v", err)
+			}
+		}
+		for _, l := range loans {
+			bookCopy := &books[l.Book].Copies[0]
+			err := tx.Model(bookCopy).UpdateColumn("status", models.CopyCheckedOut).Error
+			if err == nil {
+				err = tx.Create(&models.Checkout{UserId: users[l.User].ID, BookId: uint64(books[l.Book].ID), CopyId: uint64(bookCopy.ID)}).Error
+			}
+			if err != nil {
+				return fmt.Errorf("Checkout table could not be seeded: %v", err)
+			}
+		}
+		fmt.Printf("Seeded %d users, %d books and %d checkouts\n", len(users), len(books), len(loans))
+		return nil
+	})
 }
@@ -0,0 +1,215 @@
+package authtests
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/models"
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopkg.in/go-playground/assert.v1"
+	"gorm.io/gorm"
+)
+
+func loadRing(t *testing.T, dir, alg string, hmacUntil time.Time) *auth.KeyRing {
+	ring, err := auth.LoadKeyRing(auth.KeyRingConfig{
+		Dir:         dir,
+		Alg:         alg,
+		RotateEvery: 30 * 24 * time.Hour,
+		HMACUntil:   hmacUntil,
+	})
+	if err != nil {
+		t.Fatalf("Could not load the key ring: %v", err)
+	}
+	return ring
+}
+
+func tokenHeader(t *testing.T, token string) map[string]interface{} {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatalf("Could not read the token: %v", err)
+	}
+	return parsed.Header
+}
+
+func TestKeyRing(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hmacToken, err := auth.CreateToken(models.User{Model: gorm.Model{ID: 4}, Role: models.RolePatron})
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+
+	ring := loadRing(t, dir, "RS256", time.Now().Add(time.Hour))
+	auth.UseKeyRing(ring)
+	defer auth.UseKeyRing(nil)
+
+	user := models.User{Model: gorm.Model{ID: 4}, Role: models.RolePatron}
+	first, err := auth.CreateToken(user)
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	header := tokenHeader(t, first)
+	assert.Equal(t, header["alg"], "RS256")
+	firstKid, _ := header["kid"].(string)
+	assert.NotEqual(t, firstKid, "")
+	_, err = auth.Authenticate(requestWithToken(first))
+	assert.Equal(t, err, nil)
+
+	keys := ring.JWKS().Keys
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Kid, firstKid)
+	assert.Equal(t, keys[0].Kty, "RSA")
+	assert.Equal(t, keys[0].E, "AQAB")
+
+	// old HS256 tokens work during the migration window
+	_, err = auth.Authenticate(requestWithToken(hmacToken))
+	assert.Equal(t, err, nil)
+
+	// another instance loading the same directory shares the key
+	other := loadRing(t, dir, "RS256", time.Time{})
+	assert.Equal(t, other.JWKS().Keys[0].Kid, firstKid)
+
+	// a new key takes over once the current one is due, the old one still
+	// checks the tokens it signed
+	err = ring.Rotate(time.Now().Add(31 * 24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Could not rotate: %v", err)
+	}
+	assert.Equal(t, len(ring.JWKS().Keys), 2)
+	second, err := auth.CreateToken(user)
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	assert.NotEqual(t, tokenHeader(t, second)["kid"], firstKid)
+	_, err = auth.Authenticate(requestWithToken(first))
+	assert.Equal(t, err, nil)
+	_, err = auth.Authenticate(requestWithToken(second))
+	assert.Equal(t, err, nil)
+
+	// once its tokens have expired the old key is dropped
+	err = ring.Rotate(time.Now().Add(31*24*time.Hour + 2*time.Hour))
+	if err != nil {
+		t.Fatalf("Could not rotate: %v", err)
+	}
+	assert.Equal(t, len(ring.JWKS().Keys), 1)
+	_, err = auth.Authenticate(requestWithToken(first))
+	assert.NotEqual(t, err, nil)
+	_, err = auth.Authenticate(requestWithToken(second))
+	assert.Equal(t, err, nil)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pem"))
+	assert.Equal(t, len(files), 1)
+
+	// after the window closes HS256 tokens are refused
+	auth.UseKeyRing(other)
+	_, err = auth.Authenticate(requestWithToken(hmacToken))
+	assert.NotEqual(t, err, nil)
+
+	// a token cannot pick another algorithm for the key it names
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"user_id": 4, "role": "admin", "exp": time.Now().Add(time.Hour).Unix()})
+	forged.Header["kid"] = firstKid
+	forgedToken, err := forged.SignedString([]byte(os.Getenv("API_SECRET")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = auth.Authenticate(requestWithToken(forgedToken))
+	assert.NotEqual(t, err, nil)
+}
+
+func TestEdDSAKeyRing(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ring := loadRing(t, dir, "EdDSA", time.Time{})
+	auth.UseKeyRing(ring)
+	defer auth.UseKeyRing(nil)
+
+	token, err := auth.CreateToken(models.User{Model: gorm.Model{ID: 9}, Role: models.RoleAdmin})
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	assert.Equal(t, tokenHeader(t, token)["alg"], "EdDSA")
+	principal, err := auth.Authenticate(requestWithToken(token))
+	if err != nil {
+		t.Fatalf("Could not authenticate: %v", err)
+	}
+	assert.Equal(t, principal.UserID, uint(9))
+
+	keys := ring.JWKS().Keys
+	assert.Equal(t, len(keys), 1)
+	assert.Equal(t, keys[0].Kty, "OKP")
+	assert.Equal(t, keys[0].Crv, "Ed25519")
+	x, err := base64.RawURLEncoding.DecodeString(keys[0].X)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(x), ed25519.PublicKeySize)
+
+	// a tampered token fails the signature check
+	parts := strings.Split(token, ".")
+	claims := jwt.EncodeSegment([]byte(`{"user_id":1,"role":"admin","exp":9999999999}`))
+	_, err = auth.Authenticate(requestWithToken(parts[0] + "." + claims + "." + parts[2]))
+	assert.NotEqual(t, err, nil)
+
+	_, err = auth.LoadKeyRing(auth.KeyRingConfig{Dir: dir, Alg: "none", RotateEvery: time.Hour})
+	assert.NotEqual(t, err, nil)
+}
+
+func TestKeyRingsShareKeys(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := loadRing(t, dir, "EdDSA", time.Time{})
+	second := loadRing(t, dir, "EdDSA", time.Time{})
+	defer auth.UseKeyRing(nil)
+
+	// both instances find the key due at once, only one makes the next
+	later := time.Now().Add(31 * 24 * time.Hour)
+	errs := make(chan error, 2)
+	for _, ring := range []*auth.KeyRing{first, second} {
+		go func(ring *auth.KeyRing) { errs <- ring.Rotate(later) }(ring)
+	}
+	assert.Equal(t, <-errs, nil)
+	assert.Equal(t, <-errs, nil)
+	files, _ := filepath.Glob(filepath.Join(dir, "*.pem"))
+	assert.Equal(t, len(files), 2)
+	assert.Equal(t, first.JWKS().Keys[1].Kid, second.JWKS().Keys[1].Kid)
+
+	// a key made after an instance last rotated is picked up when a token
+	// signed with it comes in
+	third := loadRing(t, dir, "EdDSA", time.Time{})
+	err = first.Rotate(time.Now().Add(62 * 24 * time.Hour))
+	if err != nil {
+		t.Fatalf("Could not rotate: %v", err)
+	}
+	auth.UseKeyRing(first)
+	token, err := auth.CreateToken(models.User{Model: gorm.Model{ID: 3}, Role: models.RolePatron})
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	kid := tokenHeader(t, token)["kid"]
+	keys := third.JWKS().Keys
+	assert.NotEqual(t, keys[len(keys)-1].Kid, kid)
+	auth.UseKeyRing(third)
+	_, err = auth.Authenticate(requestWithToken(token))
+	assert.Equal(t, err, nil)
+	keys = third.JWKS().Keys
+	assert.Equal(t, keys[len(keys)-1].Kid, kid)
+}
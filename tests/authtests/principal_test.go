@@ -0,0 +1,149 @@
+package authtests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/middlewares"
+	"github.com/brianhumphreys/library_app/api/models"
+	jwt "github.com/dgrijalva/jwt-go"
+	"gopkg.in/go-playground/assert.v1"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	os.Setenv("API_SECRET", "principal-test-secret")
+	os.Exit(m.Run())
+}
+
+func requestWithToken(token string) *http.Request {
+	req, err := http.NewRequest("GET", "/", nil)
+	if err != nil {
+		panic(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
+	}
+	return req
+}
+
+func signClaims(claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(os.Getenv("API_SECRET")))
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
+
+func TestAuthenticate(t *testing.T) {
+
+	user := models.User{Model: gorm.Model{ID: 7}, Role: models.RoleLibrarian}
+	token, err := auth.CreateToken(user)
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	principal, err := auth.Authenticate(requestWithToken(token))
+	if err != nil {
+		t.Fatalf("Could not authenticate: %v", err)
+	}
+	assert.Equal(t, principal.UserID, uint(7))
+	assert.Equal(t, principal.Role, models.RoleLibrarian)
+	assert.Equal(t, len(principal.TokenID), 32)
+	assert.Equal(t, principal.ExpiresAt.After(time.Now().Add(59*time.Minute)), true)
+
+	// every token gets its own id
+	other, err := auth.CreateToken(user)
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	second, err := auth.Authenticate(requestWithToken(other))
+	if err != nil {
+		t.Fatalf("Could not authenticate: %v", err)
+	}
+	assert.NotEqual(t, second.TokenID, principal.TokenID)
+
+	exp := time.Now().Add(time.Hour).Unix()
+	samples := []struct {
+		name  string
+		token string
+	}{
+		{"no token", ""},
+		{"garbage", "not.a.token"},
+		{"no expiry", signClaims(jwt.MapClaims{"user_id": 7, "role": "admin"})},
+		{"expired", signClaims(jwt.MapClaims{"user_id": 7, "role": "admin", "exp": time.Now().Add(-time.Minute).Unix()})},
+		{"no user", signClaims(jwt.MapClaims{"role": "admin", "exp": exp})},
+		{"user id zero", signClaims(jwt.MapClaims{"user_id": 0, "role": "admin", "exp": exp})},
+		{"user id text", signClaims(jwt.MapClaims{"user_id": "7", "role": "admin", "exp": exp})},
+		{"no role", signClaims(jwt.MapClaims{"user_id": 7, "exp": exp})},
+	}
+	for _, v := range samples {
+		_, err := auth.Authenticate(requestWithToken(v.token))
+		if err == nil {
+			t.Errorf("%s: expected the token to be rejected", v.name)
+		}
+	}
+}
+
+func TestMiddlewareSetsPrincipal(t *testing.T) {
+
+	_, ok := auth.PrincipalFrom(context.Background())
+	assert.Equal(t, ok, false)
+
+	var seen *auth.Principal
+	handler := middlewares.SetMiddlewareAuthentication(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = auth.PrincipalFrom(r.Context())
+	})
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, requestWithToken(""))
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	assert.Equal(t, seen == nil, true)
+
+	token, err := auth.CreateToken(models.User{Model: gorm.Model{ID: 3}, Role: models.RolePatron})
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, requestWithToken(token))
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, seen.UserID, uint(3))
+	assert.Equal(t, seen.Role, models.RolePatron)
+}
+
+type revokedIDs map[string]bool
+
+func (r revokedIDs) IsRevoked(jti string, uid uint, issuedAt time.Time) (bool, error) {
+	return r[jti], nil
+}
+
+func TestRevokedToken(t *testing.T) {
+
+	revoked := revokedIDs{}
+	auth.UseRevocationList(revoked)
+	defer auth.UseRevocationList(nil)
+
+	token, err := auth.CreateToken(models.User{Model: gorm.Model{ID: 5}, Role: models.RolePatron})
+	if err != nil {
+		t.Fatalf("Could not create a token: %v", err)
+	}
+	principal, err := auth.Authenticate(requestWithToken(token))
+	if err != nil {
+		t.Fatalf("Could not authenticate: %v", err)
+	}
+
+	revoked[principal.TokenID] = true
+	_, err = auth.Authenticate(requestWithToken(token))
+	assert.Equal(t, err, auth.ErrInvalidToken)
+	assert.Equal(t, auth.TokenValid(requestWithToken(token)) != nil, true)
+
+	// tokens without an id are not looked up
+	legacy := signClaims(jwt.MapClaims{"user_id": 5, "role": "patron", "exp": time.Now().Add(time.Hour).Unix()})
+	_, err = auth.Authenticate(requestWithToken(legacy))
+	assert.Equal(t, err, nil)
+}
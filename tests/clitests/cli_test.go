@@ -0,0 +1,73 @@
+package clitests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// run calls the CLI the way main does and returns the exit code and what
+// was written to stdout and stderr.
+func run(stdin string, args ...string) (int, string, string) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	code := api.Main(args, strings.NewReader(stdin), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestHelp(t *testing.T) {
+
+	code, stdout, _ := run("", "help")
+	assert.Equal(t, code, 0)
+	for _, command := range []string{"serve", "migrate", "seed", "create-admin", "import-books", "export"} {
+		assert.Equal(t, strings.Contains(stdout, command), true)
+	}
+}
+
+// every one of these is refused before the database is touched
+func TestBadUsageExitsWith2(t *testing.T) {
+
+	samples := [][]string{
+		{"frobnicate"},
+		{"serve", "extra"},
+		{"serve", "-port", "80"},
+		{"migrate"},
+		{"migrate", "sideways"},
+		{"migrate", "to"},
+		{"migrate", "to", "-1"},
+		{"seed", "-fixture", "nothing"},
+		{"create-admin"},
+		{"create-admin", "-email", "not-an-email"},
+		{"import-books"},
+		{"import-books", "a.csv", "b.csv"},
+		{"export", "-format", "pdf"},
+		{"export", "extra"},
+	}
+	for _, args := range samples {
+		code, _, stderr := run("secret123\n", args...)
+		assert.Equal(t, code, 2)
+		assert.NotEqual(t, stderr, "")
+	}
+}
+
+func TestCommandHelpShowsFlags(t *testing.T) {
+
+	code, _, stderr := run("", "seed", "-h")
+	assert.Equal(t, code, 2)
+	assert.Equal(t, strings.Contains(stderr, "demo"), true)
+	assert.Equal(t, strings.Contains(stderr, "catalog"), true)
+
+	code, _, stderr = run("", "import-books", "-h")
+	assert.Equal(t, code, 2)
+	assert.Equal(t, strings.Contains(stderr, "-dry-run"), true)
+}
+
+func TestImportBooksMissingFile(t *testing.T) {
+
+	code, _, stderr := run("", "import-books", "does-not-exist.csv")
+	assert.Equal(t, code, 1)
+	assert.Equal(t, strings.Contains(stderr, "does-not-exist.csv"), true)
+}
@@ -0,0 +1,228 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/middlewares"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/gorilla/mux"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// sendWithRequestID goes through the request ID middleware like the router
+// does.
+func sendWithRequestID(handler http.HandlerFunc, method, body, token, requestID string, vars map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/", bytes.NewBufferString(body))
+	if err != nil {
+		log.Fatalf("this is the error: %v\n", err)
+	}
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("X-Request-ID", requestID)
+	rr := httptest.NewRecorder()
+	middlewares.RequestID(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+type auditPage struct {
+	Data  []models.AuditEntry `json:"data"`
+	Total int64               `json:"total"`
+}
+
+func readAudit(t *testing.T, token string, query url.Values) auditPage {
+	req, err := http.NewRequest("GET", "/api/v1/admin/audit?"+query.Encode(), nil)
+	if err != nil {
+		t.Fatalf("this is the error: %v\n", err)
+	}
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	guarded(models.PermAuditRead, server.GetAuditLog).ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	page := auditPage{}
+	err = json.Unmarshal(rr.Body.Bytes(), &page)
+	if err != nil {
+		t.Fatalf("Cannot convert to json: %v", err)
+	}
+	return page
+}
+
+func TestAuditLog(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, patronToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+
+	book := `{"title": "Audited", "author": "Someone", "isbn": "9780316769488", "description": "A book"}`
+	rr := sendWithRequestID(guarded(models.PermBooksWrite, server.CreateBook), "POST", book, adminTokenString, "create-1", nil)
+	assert.Equal(t, rr.Code, http.StatusCreated)
+	assert.Equal(t, rr.Header().Get("X-Request-ID"), "create-1")
+	created := readSession(t, rr.Body.String())
+	bookID := strconv.Itoa(int(created["id"].(float64)))
+
+	update := `{"title": "Audited Again", "author": "Someone", "isbn": "9780316769488", "description": "A book"}`
+	rr = sendWithRequestID(guarded(models.PermBooksWrite, server.UpdateBook), "PUT", update, adminTokenString, "", map[string]string{"id": bookID})
+	assert.Equal(t, rr.Code, http.StatusOK)
+	// a request without an ID is given one
+	assert.Equal(t, len(rr.Header().Get("X-Request-ID")), 32)
+	rr = sendWithRequestID(guarded(models.PermBooksWrite, server.DeleteBook), "DELETE", "", adminTokenString, "delete-1", map[string]string{"id": bookID})
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+
+	// only those allowed to read the log can
+	rr = sendAs(guarded(models.PermAuditRead, server.GetAuditLog), "GET", "", fmt.Sprintf("Bearer %v", patronToken), nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	page := readAudit(t, adminTokenString, url.Values{"target_type": {"book"}, "target_id": {bookID}})
+	assert.Equal(t, page.Total, int64(3))
+	// newest first
+	assert.Equal(t, page.Data[0].Action, "book.delete")
+	assert.Equal(t, page.Data[0].RequestId, "delete-1")
+	assert.Equal(t, page.Data[0].ActorId, users[0].ID)
+	assert.Equal(t, page.Data[0].After, "")
+	assert.Equal(t, page.Data[1].Action, "book.update")
+	before := map[string]interface{}{}
+	err = json.Unmarshal([]byte(page.Data[1].Before), &before)
+	if err != nil {
+		t.Fatalf("Cannot convert to json: %v", err)
+	}
+	assert.Equal(t, before["title"], "Audited")
+	assert.Equal(t, page.Data[2].Action, "book.create")
+	assert.Equal(t, page.Data[2].PrevHash != "", true)
+
+	page = readAudit(t, adminTokenString, url.Values{"request_id": {"create-1"}})
+	assert.Equal(t, page.Total, int64(1))
+	page = readAudit(t, adminTokenString, url.Values{"action": {"book"}, "actor_id": {strconv.Itoa(int(users[1].ID))}})
+	assert.Equal(t, page.Total, int64(0))
+
+	rr = sendAs(guarded(models.PermAuditRead, server.GetAuditLog), "GET", "", adminTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	req, _ := http.NewRequest("GET", "/api/v1/admin/audit?target_id=abc", nil)
+	req.Header.Set("Authorization", adminTokenString)
+	rr = httptest.NewRecorder()
+	guarded(models.PermAuditRead, server.GetAuditLog).ServeHTTP(rr, req)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+
+	rr = sendAs(guarded(models.PermAuditRead, server.VerifyAuditLog), "GET", "", adminTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, readSession(t, rr.Body.String())["valid"], true)
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+	for i := 0; i < 3; i++ {
+		err = models.RecordAudit(server.DB, models.Actor{UserID: users[0].ID}, "book.create", "book", uint(i+1), nil, map[string]int{"n": i})
+		if err != nil {
+			t.Fatalf("Could not record: %v", err)
+		}
+	}
+	entries := []models.AuditEntry{}
+	server.DB.Order("id").Find(&entries)
+
+	// the database refuses changes
+	err = server.DB.Model(&models.AuditEntry{}).Where("id = ?", entries[1].ID).UpdateColumn("target_id", 99).Error
+	assert.NotEqual(t, err, nil)
+	err = server.DB.Where("id = ?", entries[1].ID).Delete(&models.AuditEntry{}).Error
+	assert.NotEqual(t, err, nil)
+
+	// and a change made behind its back is found
+	err = server.DB.Exec("ALTER TABLE audit_entries DISABLE TRIGGER audit_entries_no_change").Error
+	if err != nil {
+		t.Fatalf("Could not disable the trigger: %v", err)
+	}
+	err = server.DB.Model(&models.AuditEntry{}).Where("id = ?", entries[1].ID).UpdateColumn("target_id", 99).Error
+	if err != nil {
+		t.Fatalf("Could not tamper: %v", err)
+	}
+	rr := sendAs(guarded(models.PermAuditRead, server.VerifyAuditLog), "GET", "", adminTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	result := readSession(t, rr.Body.String())
+	assert.Equal(t, result["valid"], false)
+	assert.Equal(t, result["entry_id"], float64(entries[1].ID))
+	assert.Equal(t, result["checked"], float64(1))
+
+	// removing an entry breaks the link of the next one
+	err = server.DB.Model(&models.AuditEntry{}).Where("id = ?", entries[1].ID).UpdateColumn("target_id", 2).Error
+	if err == nil {
+		err = server.DB.Where("id = ?", entries[1].ID).Delete(&models.AuditEntry{}).Error
+	}
+	if err != nil {
+		t.Fatalf("Could not tamper: %v", err)
+	}
+	_, err = models.VerifyAuditChain(server.DB)
+	broken, ok := err.(*models.AuditChainError)
+	assert.Equal(t, ok, true)
+	assert.Equal(t, broken.EntryID, entries[2].ID)
+	server.DB.Exec("ALTER TABLE audit_entries ENABLE TRIGGER audit_entries_no_change")
+}
+
+func TestChangesAreUndoneWhenTheAuditFails(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	// with the log out of reach every audit insert fails
+	err = server.DB.Exec("ALTER TABLE audit_entries RENAME TO audit_entries_away").Error
+	if err != nil {
+		t.Fatalf("Could not move the audit log: %v", err)
+	}
+	book := `{"title": "Unaudited", "author": "Someone", "isbn": "9780316769488", "description": "A book"}`
+	rr := sendAs(guarded(models.PermBooksWrite, server.CreateBook), "POST", book, fmt.Sprintf("Bearer %v", adminToken), nil)
+	err = server.DB.Exec("ALTER TABLE audit_entries_away RENAME TO audit_entries").Error
+	if err != nil {
+		t.Fatalf("Could not move the audit log back: %v", err)
+	}
+	assert.Equal(t, rr.Code, http.StatusInternalServerError)
+
+	var count int64
+	err = server.DB.Model(&models.Book{}).Where("title = ?", "Unaudited").Count(&count).Error
+	if err != nil {
+		t.Fatalf("Could not count the books: %v", err)
+	}
+	assert.Equal(t, count, int64(0))
+}
@@ -54,25 +54,27 @@ func TestCreateBook(t *testing.T) {
 		errorMessage string
 	}{
 		{
-			inputJSON:    `{"title":"Memoirs of a Geisha", "author": "Arthur Golden", "isbn": "isbn", "description": "description"}`,
+			inputJSON:    `{"title":"Memoirs of a Geisha", "author": "Arthur Golden", "isbn": "978-0-679-78158-5", "description": "description"}`,
 			statusCode:   201,
 			tokenGiven:   adminTokenString,
 			title:        "Memoirs of a Geisha",
 			author:       "Arthur Golden",
-			isbn:         "isbn",
+			isbn:         "9780679781585",
 			description:  "description",
 			errorMessage: "",
 		},
 		{
-			// duplicate creations are allowed
-			inputJSON:    `{"title":"Memoirs of a Geisha", "author": "Arthur Golden", "isbn": "isbn", "description": "description"}`,
-			statusCode:   201,
+			// the same book cannot be added twice, even by its ISBN-10
+			inputJSON:    `{"title":"Memoirs of a Geisha", "author": "Arthur Golden", "isbn": "0679781587", "description": "description"}`,
+			statusCode:   409,
 			tokenGiven:   adminTokenString,
-			title:        "Memoirs of a Geisha",
-			author:       "Arthur Golden",
-			isbn:         "isbn",
-			description:  "description",
-			errorMessage: "",
+			errorMessage: "A book with this Isbn is already in the library",
+		},
+		{
+			inputJSON:    `{"title":"Memoirs of a Geisha", "author": "Arthur Golden", "isbn": "9780679781586", "description": "description"}`,
+			statusCode:   422,
+			tokenGiven:   adminTokenString,
+			errorMessage: "Invalid Isbn",
 		},
 		{
 			// non admin users cannot create books
@@ -127,7 +129,7 @@ func TestCreateBook(t *testing.T) {
 			t.Errorf("this is the error: %v\n", err)
 		}
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(server.CreateBook)
+		handler := guarded(models.PermBooksWrite, server.CreateBook)
 
 		req.Header.Set("Authorization", v.tokenGiven)
 		handler.ServeHTTP(rr, req)
@@ -144,7 +146,7 @@ func TestCreateBook(t *testing.T) {
 			assert.Equal(t, responseMap["isbn"], v.isbn)
 			assert.Equal(t, responseMap["description"], v.description)
 		}
-		if v.statusCode == 401 || v.statusCode == 422 || v.statusCode == 500 && v.errorMessage != "" {
+		if v.statusCode == 401 || v.statusCode == 409 || v.statusCode == 422 || v.statusCode == 500 && v.errorMessage != "" {
 			assert.Equal(t, responseMap["error"], v.errorMessage)
 		}
 	}
@@ -167,11 +169,15 @@ func TestGetBooks(t *testing.T) {
 	handler := http.HandlerFunc(server.GetBooks)
 	handler.ServeHTTP(rr, req)
 
-	var books []models.Book
-	err = json.Unmarshal([]byte(rr.Body.String()), &books)
+	var page struct {
+		Data  []models.Book `json:"data"`
+		Total int64         `json:"total"`
+	}
+	err = json.Unmarshal([]byte(rr.Body.String()), &page)
 
 	assert.Equal(t, rr.Code, http.StatusOK)
-	assert.Equal(t, len(books), 2)
+	assert.Equal(t, len(page.Data), 2)
+	assert.Equal(t, page.Total, int64(2))
 }
 
 func TestGetBookByID(t *testing.T) {
@@ -275,11 +281,11 @@ func TestUpdateBook(t *testing.T) {
 	}{
 		{
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "9780525555216", "description": "New Description"}`,
 			statusCode:   200,
 			title:        "New Title",
 			author:       "New Author",
-			isbn:         "New Isbn",
+			isbn:         "9780525555216",
 			description:  "New Description",
 			tokenGiven:   adminTokenString,
 			errorMessage: "",
@@ -287,11 +293,11 @@ func TestUpdateBook(t *testing.T) {
 		{
 			// Duplicate Titles are allowed
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "9780525555216", "description": "New Description"}`,
 			statusCode:   200,
 			title:        "New Title",
 			author:       "New Author",
-			isbn:         "New Isbn",
+			isbn:         "9780525555216",
 			description:  "New Description",
 			tokenGiven:   adminTokenString,
 			errorMessage: "",
@@ -299,7 +305,7 @@ func TestUpdateBook(t *testing.T) {
 		{
 			// non admin users cannot create a book
 			id:           strconv.Itoa(int(books[1].ID)),
-			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "9780525555216", "description": "New Description"}`,
 			tokenGiven:   userTokenString,
 			statusCode:   401,
 			errorMessage: "Unauthorized",
@@ -307,7 +313,7 @@ func TestUpdateBook(t *testing.T) {
 		{
 			// When no token is provided
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "9780525555216", "description": "New Description"}`,
 			tokenGiven:   "",
 			statusCode:   401,
 			errorMessage: "Unauthorized",
@@ -315,21 +321,21 @@ func TestUpdateBook(t *testing.T) {
 		{
 			// When incorrect token is provided
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "9780525555216", "description": "New Description"}`,
 			tokenGiven:   "this is an incorrect token",
 			statusCode:   401,
 			errorMessage: "Unauthorized",
 		},
 		{
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"", "author": "New Author", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"", "author": "New Author", "isbn": "9780525555216", "description": "New Description"}`,
 			statusCode:   422,
 			tokenGiven:   adminTokenString,
 			errorMessage: "Required Title",
 		},
 		{
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"New Title", "author": "", "isbn": "New Isbn", "description": "New Description"}`,
+			updateJSON:   `{"title":"New Title", "author": "", "isbn": "9780525555216", "description": "New Description"}`,
 			statusCode:   422,
 			tokenGiven:   adminTokenString,
 			errorMessage: "Required Author",
@@ -343,7 +349,7 @@ func TestUpdateBook(t *testing.T) {
 		},
 		{
 			id:           strconv.Itoa(int(books[0].ID)),
-			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "New Isbn", "description": ""}`,
+			updateJSON:   `{"title":"New Title", "author": "New Author", "isbn": "9780525555216", "description": ""}`,
 			statusCode:   422,
 			tokenGiven:   adminTokenString,
 			errorMessage: "Required Description",
@@ -351,6 +357,7 @@ func TestUpdateBook(t *testing.T) {
 		{
 			id:         "bad request",
 			statusCode: 400,
+			tokenGiven: adminTokenString,
 		},
 	}
 
@@ -362,7 +369,7 @@ func TestUpdateBook(t *testing.T) {
 		}
 		req = mux.SetURLVars(req, map[string]string{"id": v.id})
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(server.UpdateBook)
+		handler := guarded(models.PermBooksWrite, server.UpdateBook)
 
 		req.Header.Set("Authorization", v.tokenGiven)
 
@@ -476,7 +483,7 @@ func TestDeleteBook(t *testing.T) {
 		req = mux.SetURLVars(req, map[string]string{"id": v.id})
 
 		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(server.DeleteBook)
+		handler := guarded(models.PermBooksWrite, server.DeleteBook)
 
 		req.Header.Set("Authorization", v.tokenGiven)
 
@@ -495,3 +502,319 @@ func TestDeleteBook(t *testing.T) {
 		}
 	}
 }
+
+func TestRestoreBook(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, books, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+	_, patronToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	bookID := map[string]string{"id": strconv.Itoa(int(books[0].ID))}
+
+	loan := models.Checkout{UserId: users[1].ID, BookId: uint64(books[0].ID)}
+	err = server.DB.Create(&loan).Error
+	if err != nil {
+		t.Fatalf("Could not seed a checkout: %v", err)
+	}
+
+	// a book on loan cannot be deleted
+	rr := sendAs(guarded(models.PermBooksWrite, server.DeleteBook), "DELETE", "", adminTokenString, bookID)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	server.DB.Model(&models.Checkout{}).Where("id = ?", loan.ID).Update("checked_in", true)
+	rr = sendAs(guarded(models.PermBooksWrite, server.DeleteBook), "DELETE", "", adminTokenString, bookID)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+
+	// the deleted book drops out of the patron's history
+	history, err := models.GetBookCheckoutHistoryOfUserWithID(server.DB, users[1].ID, &models.PageRequest{})
+	if err != nil {
+		t.Fatalf("Could not read the history: %v", err)
+	}
+	assert.Equal(t, history.Total, int64(0))
+
+	rr = sendAs(guarded(models.PermBooksWrite, server.RestoreBook), "POST", "", fmt.Sprintf("Bearer %v", patronToken), bookID)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(guarded(models.PermBooksWrite, server.RestoreBook), "POST", "", adminTokenString, map[string]string{"id": "99"})
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+	rr = sendAs(guarded(models.PermBooksWrite, server.RestoreBook), "POST", "", adminTokenString, bookID)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, readSession(t, rr.Body.String())["title"], books[0].Title)
+	rr = sendAs(guarded(models.PermBooksWrite, server.RestoreBook), "POST", "", adminTokenString, bookID)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	history, err = models.GetBookCheckoutHistoryOfUserWithID(server.DB, users[1].ID, &models.PageRequest{})
+	if err != nil {
+		t.Fatalf("Could not read the history: %v", err)
+	}
+	assert.Equal(t, history.Total, int64(1))
+
+	// a book whose isbn was taken while it was deleted stays deleted
+	otherID := map[string]string{"id": strconv.Itoa(int(books[1].ID))}
+	rr = sendAs(guarded(models.PermBooksWrite, server.DeleteBook), "DELETE", "", adminTokenString, otherID)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+	err = server.DB.Create(&models.Book{Title: "Again", Author: "Someone", Isbn: books[1].Isbn, Description: "A book"}).Error
+	if err != nil {
+		t.Fatalf("Could not seed a book: %v", err)
+	}
+	rr = sendAs(guarded(models.PermBooksWrite, server.RestoreBook), "POST", "", adminTokenString, otherID)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+}
+
+func TestCreateCopy(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	book := models.Book{
+		Title:       "Copied Title",
+		Author:      "Copied Author",
+		Isbn:        "9780679781585",
+		Description: "Copied Description",
+	}
+	_, err = book.SaveBook(server.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, userToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	samples := []struct {
+		inputJSON    string
+		tokenGiven   string
+		statusCode   int
+		errorMessage string
+	}{
+		{
+			inputJSON:  `{"barcode": "C-0002", "shelf_location": "FIC GOL", "condition": "good"}`,
+			tokenGiven: fmt.Sprintf("Bearer %v", adminToken),
+			statusCode: 201,
+		},
+		{
+			inputJSON:  `{"barcode": "C-0003", "shelf_location": "FIC GOL", "condition": "worn", "status": "in_repair"}`,
+			tokenGiven: fmt.Sprintf("Bearer %v", adminToken),
+			statusCode: 201,
+		},
+		{
+			inputJSON:    `{"barcode": "C-0004", "status": "checked_out"}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", adminToken),
+			statusCode:   422,
+			errorMessage: "Status must be 'available', 'lost', 'in_repair' or 'withdrawn'",
+		},
+		{
+			inputJSON:    `{"shelf_location": "FIC GOL"}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", adminToken),
+			statusCode:   422,
+			errorMessage: "Required Barcode",
+		},
+		{
+			// non admin users cannot add copies
+			inputJSON:    `{"barcode": "C-0005"}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", userToken),
+			statusCode:   401,
+			errorMessage: "Unauthorized",
+		},
+	}
+
+	for _, v := range samples {
+		req, err := http.NewRequest("POST", "/books/copies", bytes.NewBufferString(v.inputJSON))
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(book.ID))})
+		req.Header.Set("Authorization", v.tokenGiven)
+		rr := httptest.NewRecorder()
+		handler := guarded(models.PermBooksWrite, server.CreateCopy)
+		handler.ServeHTTP(rr, req)
+
+		responseMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+		if err != nil {
+			t.Errorf("Cannot convert to json: %v", err)
+		}
+		assert.Equal(t, rr.Code, v.statusCode)
+		if v.errorMessage != "" {
+			assert.Equal(t, responseMap["error"], v.errorMessage)
+		}
+	}
+
+	req, err := http.NewRequest("GET", "/books", nil)
+	if err != nil {
+		t.Errorf("this is the error: %v\n", err)
+	}
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(int(book.ID))})
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(server.GetBook)
+	handler.ServeHTTP(rr, req)
+
+	responseMap := make(map[string]interface{})
+	err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, responseMap["copies_total"], float64(3))
+	assert.Equal(t, responseMap["copies_available"], float64(2))
+	assert.Equal(t, responseMap["available"], true)
+}
+
+func TestSearchBooks(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	books := []models.Book{
+		models.Book{Title: "The Hobbit", Author: "J.R.R. Tolkien", Isbn: "9780547928227", Description: "A hobbit goes on an adventure with dwarves"},
+		models.Book{Title: "The Fellowship of the Ring", Author: "J.R.R. Tolkien", Isbn: "9780547928210", Description: "The ring must be destroyed"},
+		models.Book{Title: "Dune", Author: "Frank Herbert", Isbn: "9780441172719", Description: "Spice, sand and a desert planet"},
+	}
+	for i := range books {
+		_, err = books[i].SaveBook(server.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = server.DB.Model(&models.BookCopy{}).Where("book_id = ?", books[1].ID).Update("status", models.CopyCheckedOut).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	type searchResult struct {
+		Data       []models.Book     `json:"data"`
+		NextCursor string            `json:"next_cursor"`
+		Facets     models.BookFacets `json:"facets"`
+	}
+	search := func(query string) (int, searchResult) {
+		req, err := http.NewRequest("GET", "/books/search?"+query, nil)
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(server.SearchBooks)
+		handler.ServeHTTP(rr, req)
+
+		result := searchResult{}
+		if rr.Code == http.StatusOK {
+			err = json.Unmarshal([]byte(rr.Body.String()), &result)
+			if err != nil {
+				t.Errorf("Cannot convert to json: %v", err)
+			}
+		}
+		return rr.Code, result
+	}
+
+	code, result := search("q=hobbit")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(result.Data), 1)
+	assert.Equal(t, result.Data[0].Title, "The Hobbit")
+
+	code, result = search("q=9780441172719")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(result.Data), 1)
+	assert.Equal(t, result.Data[0].Title, "Dune")
+
+	code, result = search("author=j.r.r.%20tolkien&available=true")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(result.Data), 1)
+	assert.Equal(t, result.Data[0].Title, "The Hobbit")
+
+	// the author is not a pattern
+	for _, pattern := range []string{"%25", "j.r.r.%25", "j.r.r._tolkien"} {
+		code, result = search("author=" + pattern)
+		assert.Equal(t, code, http.StatusOK)
+		assert.Equal(t, len(result.Data), 0)
+	}
+
+	code, result = search("")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, len(result.Facets.Author), 2)
+	assert.Equal(t, result.Facets.Author[0], models.FacetCount{Value: "J.R.R. Tolkien", Count: 2})
+	assert.Equal(t, result.Facets.Availability[0], models.FacetCount{Value: "available", Count: 2})
+	assert.Equal(t, result.Facets.Availability[1], models.FacetCount{Value: "unavailable", Count: 1})
+
+	// walk the catalog one title at a time
+	titles := []string{}
+	cursor := ""
+	for i := 0; i < len(books)+1; i++ {
+		code, result = search("sort=title&limit=1&cursor=" + cursor)
+		assert.Equal(t, code, http.StatusOK)
+		for _, b := range result.Data {
+			titles = append(titles, b.Title)
+		}
+		cursor = result.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Equal(t, titles, []string{"Dune", "The Fellowship of the Ring", "The Hobbit"})
+
+	code, _ = search("sort=isbn")
+	assert.Equal(t, code, http.StatusBadRequest)
+	code, _ = search("sort=relevance")
+	assert.Equal(t, code, http.StatusBadRequest)
+	code, _ = search("cursor=not-a-cursor")
+	assert.Equal(t, code, http.StatusBadRequest)
+}
+
+func TestGetBookByIsbn(t *testing.T) {
+
+	_, book, err := seedPatronsAndOneBook(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	samples := []struct {
+		isbn       string
+		statusCode int
+	}{
+		{isbn: "9780316769488", statusCode: 200},
+		{isbn: "0-316-76948-7", statusCode: 200},
+		{isbn: "9780306406157", statusCode: 404},
+		{isbn: "not-an-isbn", statusCode: 400},
+	}
+	for _, v := range samples {
+		req, err := http.NewRequest("GET", "/books/isbn", nil)
+		if err != nil {
+			t.Errorf("This is the error: %v\n", err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"isbn": v.isbn})
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(server.GetBookByIsbn)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, rr.Code, v.statusCode)
+		if v.statusCode == 200 {
+			responseMap := make(map[string]interface{})
+			err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+			if err != nil {
+				t.Errorf("Cannot convert to json: %v", err)
+			}
+			assert.Equal(t, responseMap["title"], book.Title)
+			assert.Equal(t, responseMap["isbn"], "9780316769488")
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/middlewares"
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/gorilla/mux"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func seedPatronsAndOneBook(count int) ([]models.User, models.Book, error) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		return []models.User{}, models.Book{}, err
+	}
+
+	verifiedAt := time.Now()
+	users := []models.User{}
+	for i := 0; i < count; i++ {
+		user := models.User{
+			Email:           fmt.Sprintf("patron%d@a.com", i),
+			Password:        "patron123",
+			Role:            "patron",
+			EmailVerifiedAt: &verifiedAt,
+		}
+		err = server.DB.Model(&models.User{}).Create(&user).Error
+		if err != nil {
+			return []models.User{}, models.Book{}, err
+		}
+		users = append(users, user)
+	}
+
+	book := models.Book{
+		Title:       "Popular Book",
+		Author:      "Popular Author",
+		Isbn:        "9780316769488",
+		Description: "Popular Description",
+	}
+	_, err = book.SaveBook(server.DB)
+	if err != nil {
+		return []models.User{}, models.Book{}, err
+	}
+	return users, book, nil
+}
+
+func TestConcurrentCheckoutOfSameBook(t *testing.T) {
+
+	patrons := 20
+	users, book, err := seedPatronsAndOneBook(patrons)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+
+	tokens := make([]string, len(users))
+	for i := range users {
+		_, token, err := server.SignIn(users[i].Email, "patron123")
+		if err != nil {
+			log.Fatalf("Could not Login: %v\n", err)
+		}
+		tokens[i] = fmt.Sprintf("Bearer %v", token)
+	}
+
+	handler := middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(server.CheckoutABook))
+
+	codes := make([]int, len(users))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inputJSON := fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, users[i].ID, book.ID)
+			req, err := http.NewRequest("POST", "/api/v1/checkouts/checkout", bytes.NewBufferString(inputJSON))
+			if err != nil {
+				t.Errorf("this is the error: %v\n", err)
+				return
+			}
+			req.Header.Set("Authorization", tokens[i])
+			rr := httptest.NewRecorder()
+
+			<-start
+			handler.ServeHTTP(rr, req)
+			codes[i] = rr.Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created, conflicts := 0, 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+			conflicts++
+		default:
+			t.Errorf("unexpected status code: %d", code)
+		}
+	}
+	assert.Equal(t, created, 1)
+	assert.Equal(t, conflicts, patrons-1)
+
+	owners, err := models.GetCurrentOwnerOfBookWithID(server.DB, uint64(book.ID))
+	if err != nil {
+		t.Errorf("There was an error getting the owner: %v\n", err)
+	}
+	assert.Equal(t, len(owners), 1)
+
+	foundBook, err := models.FindBookByID(server.DB, uint64(book.ID))
+	if err != nil {
+		t.Errorf("There was an error getting the book: %v\n", err)
+	}
+	assert.Equal(t, (*foundBook)[0].Available, false)
+	assert.Equal(t, (*foundBook)[0].CopiesAvailable, 0)
+}
+
+func TestConcurrentCheckoutOfDifferentBooks(t *testing.T) {
+
+	users, first, err := seedPatronsAndOneBook(1)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	books := []models.Book{first}
+	for i, isbn := range []string{"9780061120084", "9780140449136", "9780451524935", "9780743273565"} {
+		book := models.Book{Title: fmt.Sprintf("Other Book %d", i), Author: "Other Author", Isbn: isbn, Description: "Other Description"}
+		_, err = book.SaveBook(server.DB)
+		if err != nil {
+			log.Fatalf("Book could not be saved %v\n", err)
+		}
+		books = append(books, book)
+	}
+	policy := models.CirculationPolicy{PatronType: "*", ItemType: "*", MaxLoans: 1, LoanPeriodDays: 14, HoldPickupDays: 7}
+	_, err = policy.SavePolicy(server.DB, models.Actor{})
+	if err != nil {
+		log.Fatalf("Policy could not be saved %v\n", err)
+	}
+	_, token, err := server.SignIn(users[0].Email, "patron123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	// each request locks a different book, the patron's row still keeps
+	// them from all passing the loan limit
+	handler := middlewares.SetMiddlewareJSON(middlewares.SetMiddlewareAuthentication(server.CheckoutABook))
+	codes := make([]int, len(books))
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range books {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			inputJSON := fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, users[0].ID, books[i].ID)
+			req, err := http.NewRequest("POST", "/api/v1/checkouts/checkout", bytes.NewBufferString(inputJSON))
+			if err != nil {
+				t.Errorf("this is the error: %v\n", err)
+				return
+			}
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
+			rr := httptest.NewRecorder()
+
+			<-start
+			handler.ServeHTTP(rr, req)
+			codes[i] = rr.Code
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	created, denied := 0, 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusForbidden:
+			denied++
+		default:
+			t.Errorf("unexpected status code: %d", code)
+		}
+	}
+	assert.Equal(t, created, 1)
+	assert.Equal(t, denied, len(books)-1)
+
+	var open int64
+	server.DB.Model(&models.Checkout{}).Where("user_id = ? AND checked_in = false", users[0].ID).Count(&open)
+	assert.Equal(t, open, int64(1))
+}
+
+func TestCheckinABook(t *testing.T) {
+
+	users, book, err := seedPatronsAndOneBook(2)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	checkout := models.Checkout{
+		UserId: users[0].ID,
+		BookId: uint64(book.ID),
+	}
+	err = checkout.MakeACheckout(server.DB, models.Actor{})
+	if err != nil {
+		log.Fatalf("Checkout could not be made %v\n", err)
+	}
+
+	_, ownerToken, err := server.SignIn(users[0].Email, "patron123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, otherToken, err := server.SignIn(users[1].Email, "patron123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	samples := []struct {
+		inputJSON  string
+		tokenGiven string
+		statusCode int
+	}{
+		{
+			// someone who does not hold the book
+			inputJSON:  fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, users[1].ID, book.ID),
+			tokenGiven: fmt.Sprintf("Bearer %v", otherToken),
+			statusCode: 403,
+		},
+		{
+			inputJSON:  fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, users[0].ID, book.ID),
+			tokenGiven: fmt.Sprintf("Bearer %v", ownerToken),
+			statusCode: 202,
+		},
+		{
+			// the book is already back on the shelf
+			inputJSON:  fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, users[0].ID, book.ID),
+			tokenGiven: fmt.Sprintf("Bearer %v", ownerToken),
+			statusCode: 403,
+		},
+	}
+
+	for _, v := range samples {
+		req, err := http.NewRequest("POST", "/checkouts/checkin", bytes.NewBufferString(v.inputJSON))
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req.Header.Set("Authorization", v.tokenGiven)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(server.CheckinABook)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, rr.Code, v.statusCode)
+	}
+}
+
+func TestRenewACheckout(t *testing.T) {
+
+	os.Setenv("MAX_RENEWALS", "1")
+	defer os.Unsetenv("MAX_RENEWALS")
+
+	users, book, err := seedPatronsAndOneBook(2)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	checkout := models.Checkout{
+		UserId: users[0].ID,
+		BookId: uint64(book.ID),
+	}
+	err = checkout.MakeACheckout(server.DB, models.Actor{})
+	if err != nil {
+		log.Fatalf("Checkout could not be made %v\n", err)
+	}
+
+	_, ownerToken, err := server.SignIn(users[0].Email, "patron123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, otherToken, err := server.SignIn(users[1].Email, "patron123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	samples := []struct {
+		id           string
+		tokenGiven   string
+		statusCode   int
+		renewals     float64
+		errorMessage string
+	}{
+		{
+			// only the borrower can renew
+			id:           strconv.Itoa(int(checkout.ID)),
+			tokenGiven:   fmt.Sprintf("Bearer %v", otherToken),
+			statusCode:   403,
+			errorMessage: "You do not currently have this book checked out",
+		},
+		{
+			id:         strconv.Itoa(int(checkout.ID)),
+			tokenGiven: fmt.Sprintf("Bearer %v", ownerToken),
+			statusCode: 200,
+			renewals:   1,
+		},
+		{
+			id:           strconv.Itoa(int(checkout.ID)),
+			tokenGiven:   fmt.Sprintf("Bearer %v", ownerToken),
+			statusCode:   403,
+			errorMessage: "This book has been renewed the maximum number of times",
+		},
+		{
+			id:         "999",
+			tokenGiven: fmt.Sprintf("Bearer %v", ownerToken),
+			statusCode: 404,
+		},
+		{
+			id:         "bad request",
+			tokenGiven: fmt.Sprintf("Bearer %v", ownerToken),
+			statusCode: 400,
+		},
+	}
+
+	for _, v := range samples {
+		req, err := http.NewRequest("POST", "/checkouts/renew", nil)
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req = mux.SetURLVars(req, map[string]string{"id": v.id})
+		req.Header.Set("Authorization", v.tokenGiven)
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(server.RenewACheckout)
+		handler.ServeHTTP(rr, req)
+
+		responseMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+		if err != nil {
+			t.Errorf("Cannot convert to json: %v", err)
+		}
+		assert.Equal(t, rr.Code, v.statusCode)
+		if v.statusCode == 200 {
+			assert.Equal(t, responseMap["renewal_count"], v.renewals)
+		}
+		if v.statusCode == 403 {
+			assert.Equal(t, responseMap["error"], v.errorMessage)
+		}
+	}
+}
+
+func TestGetOverdueCheckouts(t *testing.T) {
+
+	users, book, err := seedPatronsAndOneBook(1)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	admin := models.User{
+		Email:    "admin@a.com",
+		Password: "admin123",
+		Role:     "admin",
+	}
+	err = server.DB.Model(&models.User{}).Create(&admin).Error
+	if err != nil {
+		log.Fatalf("User table could not be seeded: %v", err)
+	}
+	checkout := models.Checkout{
+		UserId: users[0].ID,
+		BookId: uint64(book.ID),
+		DueAt:  time.Now().Add(-72 * time.Hour),
+	}
+	err = server.DB.Model(&models.Checkout{}).Create(&checkout).Error
+	if err != nil {
+		log.Fatalf("Checkout table could not be seeded: %v", err)
+	}
+
+	_, adminToken, err := server.SignIn(admin.Email, "admin123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, userToken, err := server.SignIn(users[0].Email, "patron123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	samples := []struct {
+		tokenGiven string
+		statusCode int
+	}{
+		{
+			tokenGiven: fmt.Sprintf("Bearer %v", adminToken),
+			statusCode: 200,
+		},
+		{
+			// patrons cannot see everyone's overdue books
+			tokenGiven: fmt.Sprintf("Bearer %v", userToken),
+			statusCode: 401,
+		},
+	}
+
+	for _, v := range samples {
+		req, err := http.NewRequest("GET", "/checkouts/overdue", nil)
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req.Header.Set("Authorization", v.tokenGiven)
+		rr := httptest.NewRecorder()
+		handler := guarded(models.PermCheckoutsRead, server.GetOverdueCheckouts)
+		handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, rr.Code, v.statusCode)
+		if v.statusCode == 200 {
+			var overdue []models.OverdueRecord
+			err = json.Unmarshal([]byte(rr.Body.String()), &overdue)
+			if err != nil {
+				t.Errorf("Cannot convert to json: %v", err)
+			}
+			assert.Equal(t, len(overdue), 1)
+			assert.Equal(t, overdue[0].DaysLate, 3)
+		}
+	}
+}
@@ -3,10 +3,14 @@ package controllertests
 import (
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"testing"
 
+	"github.com/brianhumphreys/library_app/api/auth"
 	"github.com/brianhumphreys/library_app/api/controllers"
+	"github.com/brianhumphreys/library_app/api/middlewares"
+	"github.com/brianhumphreys/library_app/api/migrations"
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -44,11 +48,41 @@ func Database() {
 	} else {
 		fmt.Printf("Connection to %s database was successful\n", TestDbDriver)
 	}
+	auth.UseRevocationList(models.TokenRevocations{DB: server.DB})
+}
+
+// guarded puts a handler behind the permission check its route has in
+// routes.go, since the handlers leave that check to the middleware.
+func guarded(permission string, handler http.HandlerFunc) http.HandlerFunc {
+	return middlewares.RequirePermission(server.DB, permission, handler)
+}
+
+// resetSchema rolls every migration back and applies them again, which
+// leaves every table empty. Migrating up first takes over tables left by a
+// run from before migrations, so they are dropped too.
+func resetSchema() error {
+	migrator, err := migrations.Open(server.DB, "../../migrations")
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up()
+	if err == nil {
+		_, err = migrator.To(0)
+	}
+	if err == nil {
+		_, err = migrator.Up()
+	}
+	if err != nil {
+		return err
+	}
+	return models.MigrateRoles(server.DB)
 }
 
 func refreshUserTable() error {
-	server.DB.Migrator().DropTable(&models.User{})
-	server.DB.AutoMigrate(&models.User{})
+	err := resetSchema()
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Successfully refreshed table")
 	return nil
@@ -82,7 +116,7 @@ func SeedUsers() ([]models.User, error) {
 		models.User{
 			Email:    "j@a.com",
 			Password: "jwoma123",
-			Role:     "user",
+			Role:     "patron",
 		},
 	}
 
@@ -96,9 +130,10 @@ func SeedUsers() ([]models.User, error) {
 }
 
 func refreshUserAndBookAndCheckoutTable() error {
-
-	server.DB.Migrator().DropTable(&models.Checkout{}, &models.Book{}, &models.User{})
-	server.DB.AutoMigrate(&models.User{}, &models.Book{}, &models.Checkout{})
+	err := resetSchema()
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Successfully refreshed tables")
 	return nil
@@ -126,7 +161,7 @@ func seedOneUserAndTwoBookAndOneCheckout() (models.User, []models.Book, models.C
 	book1 := models.Book{
 		Title:       "Test Book",
 		Author:      "Test Author",
-		Isbn:        "Test Isbn",
+		Isbn:        "9780306406157",
 		Description: "Test Description",
 	}
 	err = server.DB.Model(&models.Book{}).Create(&book1).Error
@@ -137,7 +172,7 @@ func seedOneUserAndTwoBookAndOneCheckout() (models.User, []models.Book, models.C
 	book2 := models.Book{
 		Title:       "Test Book 2",
 		Author:      "Test Author 2",
-		Isbn:        "Test Isbn 2",
+		Isbn:        "9780804429573",
 		Description: "Test Description 2",
 	}
 	err = server.DB.Model(&models.Book{}).Create(&book2).Error
@@ -173,20 +208,20 @@ func seedUsersAndBook() ([]models.User, []models.Book, error) {
 		models.User{
 			Email:    "test2@gmail.com",
 			Password: "test2",
-			Role:     "user",
+			Role:     "patron",
 		},
 	}
 	var posts = []models.Book{
 		models.Book{
 			Title:       "Test Title 1",
 			Author:      "Test Author 1",
-			Isbn:        "Test Isbn 1",
+			Isbn:        "9780143127741",
 			Description: "Test Description 1",
 		},
 		models.Book{
 			Title:       "Test Title 1",
 			Author:      "Test Author 1",
-			Isbn:        "Test Isbn 1",
+			Isbn:        "9780062316097",
 			Description: "Test Description 1",
 		},
 	}
@@ -0,0 +1,139 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestHoldQueue(t *testing.T) {
+
+	users, book, err := seedPatronsAndOneBook(3)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	tokens := make([]string, len(users))
+	for i := range users {
+		_, token, err := server.SignIn(users[i].Email, "patron123")
+		if err != nil {
+			log.Fatalf("Could not Login: %v\n", err)
+		}
+		tokens[i] = fmt.Sprintf("Bearer %v", token)
+	}
+
+	post := func(handler http.HandlerFunc, uid uint, token string) *httptest.ResponseRecorder {
+		inputJSON := fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, uid, book.ID)
+		req, err := http.NewRequest("POST", "/", bytes.NewBufferString(inputJSON))
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// nobody needs a hold on a book that is on the shelf
+	rr := post(server.CreateHold, users[1].ID, tokens[1])
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	rr = post(server.CheckoutABook, users[0].ID, tokens[0])
+	assert.Equal(t, rr.Code, http.StatusCreated)
+
+	rr = post(server.CreateHold, users[1].ID, tokens[1])
+	assert.Equal(t, rr.Code, http.StatusCreated)
+	rr = post(server.CreateHold, users[2].ID, tokens[2])
+	assert.Equal(t, rr.Code, http.StatusCreated)
+
+	responseMap := make(map[string]interface{})
+	err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	assert.Equal(t, responseMap["position"], float64(2))
+
+	// a second hold by the same patron is rejected
+	rr = post(server.CreateHold, users[2].ID, tokens[2])
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	rr = post(server.CheckinABook, users[0].ID, tokens[0])
+	assert.Equal(t, rr.Code, http.StatusAccepted)
+
+	copies, err := models.FindCopiesOfBookWithID(server.DB, uint64(book.ID))
+	if err != nil {
+		t.Errorf("There was an error getting the copies: %v\n", err)
+	}
+	assert.Equal(t, (*copies)[0].Status, models.CopyOnHoldShelf)
+
+	queue, err := models.FindHoldQueueOfBookWithID(server.DB, uint64(book.ID))
+	if err != nil {
+		t.Errorf("There was an error getting the hold queue: %v\n", err)
+	}
+	assert.Equal(t, len(*queue), 2)
+	assert.Equal(t, (*queue)[0].UserId, users[1].ID)
+	assert.Equal(t, (*queue)[0].Status, models.HoldReady)
+	assert.Equal(t, *(*queue)[0].CopyId, uint64((*copies)[0].ID))
+
+	// only the patron at the head of the queue may take the book
+	rr = post(server.CheckoutABook, users[2].ID, tokens[2])
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	rr = post(server.CheckoutABook, users[1].ID, tokens[1])
+	assert.Equal(t, rr.Code, http.StatusCreated)
+
+	queue, err = models.FindHoldQueueOfBookWithID(server.DB, uint64(book.ID))
+	if err != nil {
+		t.Errorf("There was an error getting the hold queue: %v\n", err)
+	}
+	assert.Equal(t, len(*queue), 1)
+	assert.Equal(t, (*queue)[0].UserId, users[2].ID)
+	assert.Equal(t, (*queue)[0].Status, models.HoldWaiting)
+}
+
+func TestCancelHoldSetAsideSinceItWasRead(t *testing.T) {
+
+	users, book, err := seedPatronsAndOneBook(3)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	checkout := models.Checkout{UserId: users[0].ID, BookId: uint64(book.ID)}
+	err = checkout.MakeACheckout(server.DB, models.Actor{})
+	if err != nil {
+		t.Fatalf("Could not check the book out: %v", err)
+	}
+	holds := []models.Hold{{UserId: users[1].ID, BookId: uint64(book.ID)}, {UserId: users[2].ID, BookId: uint64(book.ID)}}
+	for i := range holds {
+		err = holds[i].PlaceAHold(server.DB, models.Actor{})
+		if err != nil {
+			t.Fatalf("Could not place a hold: %v", err)
+		}
+	}
+
+	// the cancel was read while the hold still waited, then the checkin
+	// set the copy aside for it
+	stale, err := models.FindHoldByID(server.DB, uint64(holds[0].ID))
+	if err != nil {
+		t.Fatalf("Could not read the hold: %v", err)
+	}
+	err = checkout.CheckinABook(server.DB, models.Actor{})
+	if err != nil {
+		t.Fatalf("Could not check the book in: %v", err)
+	}
+	err = stale.CancelAHold(server.DB, models.Actor{})
+	assert.Equal(t, err, nil)
+
+	// the copy went on to the next patron instead of staying on the shelf
+	queue, err := models.FindHoldQueueOfBookWithID(server.DB, uint64(book.ID))
+	if err != nil {
+		t.Errorf("There was an error getting the hold queue: %v\n", err)
+	}
+	assert.Equal(t, len(*queue), 1)
+	assert.Equal(t, (*queue)[0].UserId, users[2].ID)
+	assert.Equal(t, (*queue)[0].Status, models.HoldReady)
+}
@@ -0,0 +1,134 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/metadata"
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+const openLibraryHobbit = `{"ISBN:9780547928227": {
+	"title": "The Hobbit",
+	"authors": [{"name": "J.R.R. Tolkien"}],
+	"publishers": [{"name": "Houghton Mifflin Harcourt"}],
+	"publish_date": "September 18, 2012",
+	"subjects": [{"name": "Fantasy"}, {"name": "Middle Earth"}],
+	"notes": "A hobbit is swept into a quest for treasure.",
+	"cover": {"large": "https://covers.openlibrary.org/b/id/1-L.jpg"}
+}}`
+
+func TestImportBook(t *testing.T) {
+
+	var lookups int32
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.URL.Query().Get("bibkeys") == "ISBN:9780547928227" {
+			fmt.Fprint(w, openLibraryHobbit)
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer stub.Close()
+	server.Metadata = metadata.NewCache(metadata.NewOpenLibrary(stub.URL), time.Hour, 100)
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, userToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	samples := []struct {
+		inputJSON    string
+		tokenGiven   string
+		statusCode   int
+		errorMessage string
+	}{
+		{
+			// preview by ISBN-10
+			inputJSON:  `{"isbn": "054792822X"}`,
+			tokenGiven: fmt.Sprintf("Bearer %v", adminToken),
+			statusCode: 200,
+		},
+		{
+			inputJSON:  `{"isbn": "978-0-547-92822-7", "save": true}`,
+			tokenGiven: fmt.Sprintf("Bearer %v", adminToken),
+			statusCode: 201,
+		},
+		{
+			inputJSON:    `{"isbn": "9780547928227", "save": true}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", adminToken),
+			statusCode:   409,
+			errorMessage: "A book with this Isbn is already in the library",
+		},
+		{
+			inputJSON:    `{"isbn": "9780306406157"}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", adminToken),
+			statusCode:   404,
+			errorMessage: "No metadata was found for this Isbn",
+		},
+		{
+			inputJSON:    `{"isbn": "12345"}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", adminToken),
+			statusCode:   422,
+			errorMessage: "Invalid Isbn",
+		},
+		{
+			inputJSON:    `{"isbn": "9780547928227"}`,
+			tokenGiven:   fmt.Sprintf("Bearer %v", userToken),
+			statusCode:   401,
+			errorMessage: "Unauthorized",
+		},
+	}
+	for _, v := range samples {
+		req, err := http.NewRequest("POST", "/books/import", bytes.NewBufferString(v.inputJSON))
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req.Header.Set("Authorization", v.tokenGiven)
+		rr := httptest.NewRecorder()
+		handler := guarded(models.PermBooksWrite, server.ImportBook)
+		handler.ServeHTTP(rr, req)
+
+		responseMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+		if err != nil {
+			t.Errorf("Cannot convert to json: %v", err)
+		}
+		assert.Equal(t, rr.Code, v.statusCode)
+		if v.statusCode == 200 || v.statusCode == 201 {
+			assert.Equal(t, responseMap["title"], "The Hobbit")
+			assert.Equal(t, responseMap["author"], "J.R.R. Tolkien")
+			assert.Equal(t, responseMap["isbn"], "9780547928227")
+			assert.Equal(t, responseMap["publisher"], "Houghton Mifflin Harcourt")
+			assert.Equal(t, responseMap["publication_year"], float64(2012))
+			assert.Equal(t, responseMap["subjects"], []interface{}{"Fantasy", "Middle Earth"})
+			assert.Equal(t, responseMap["cover_url"], "https://covers.openlibrary.org/b/id/1-L.jpg")
+		}
+		if v.errorMessage != "" {
+			assert.Equal(t, responseMap["error"], v.errorMessage)
+		}
+	}
+
+	// the hobbit and the missing isbn were each fetched once
+	assert.Equal(t, atomic.LoadInt32(&lookups), int32(2))
+}
@@ -5,11 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/brianhumphreys/library_app/api/models"
 	"gopkg.in/go-playground/assert.v1"
+	"gorm.io/gorm"
 )
 
 func TestSignIn(t *testing.T) {
@@ -32,12 +37,12 @@ func TestSignIn(t *testing.T) {
 		{
 			email:        user.Email,
 			password:     "Wrong password",
-			errorMessage: "crypto/bcrypt: hashedPassword is not the hash of the given password",
+			errorMessage: "Incorrect email or password",
 		},
 		{
 			email:        "Wrong email",
 			password:     "password",
-			errorMessage: "record not found",
+			errorMessage: "Incorrect email or password",
 		},
 	}
 
@@ -74,7 +79,7 @@ func TestLogin(t *testing.T) {
 		{
 			inputJSON:    `{"email": "test@gmail.com", "password": "wrong password"}`,
 			statusCode:   422,
-			errorMessage: "Incorrect Password",
+			errorMessage: "Incorrect email or password",
 		},
 		{
 			inputJSON:    `{"email": "", "password": "password"}`,
@@ -89,7 +94,7 @@ func TestLogin(t *testing.T) {
 		{
 			inputJSON:    `{"email": "wrongemail@gmail.com", "password": "password"}`,
 			statusCode:   422,
-			errorMessage: "Incorrect Details",
+			errorMessage: "Incorrect email or password",
 		},
 		{
 			inputJSON:    `{"email": "invalidemail.com", "password": "password"}`,
@@ -123,3 +128,180 @@ func TestLogin(t *testing.T) {
 		}
 	}
 }
+
+func loginFrom(ip, email, password string) *httptest.ResponseRecorder {
+	inputJSON := fmt.Sprintf(`{"email": "%s", "password": "%s"}`, email, password)
+	req, err := http.NewRequest("POST", "/login", bytes.NewBufferString(inputJSON))
+	if err != nil {
+		log.Fatalf("this is the error: %v\n", err)
+	}
+	req.RemoteAddr = ip + ":40000"
+	rr := httptest.NewRecorder()
+	server.Login(rr, req)
+	return rr
+}
+
+func loginError(t *testing.T, rr *httptest.ResponseRecorder) interface{} {
+	responseMap := make(map[string]interface{})
+	err := json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	return responseMap["error"]
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	user, err := seedOneUser()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("LOGIN_MAX_ATTEMPTS", "3")
+	defer os.Unsetenv("LOGIN_MAX_ATTEMPTS")
+
+	// a failure looks the same whether or not the account exists
+	for i := 0; i < 3; i++ {
+		rr := loginFrom("10.0.0.1", user.Email, "wrong password")
+		assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+		assert.Equal(t, loginError(t, rr), models.ErrInvalidCredentials.Error())
+		rr = loginFrom("10.0.0.2", "nobody@gmail.com", "wrong password")
+		assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+		assert.Equal(t, loginError(t, rr), models.ErrInvalidCredentials.Error())
+	}
+
+	// the account is locked from every address, even with the right password
+	rr := loginFrom("10.0.0.3", user.Email, "test")
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+	assert.Equal(t, rr.Header().Get("Retry-After"), "30")
+	rr = loginFrom("10.0.0.3", "nobody@gmail.com", "wrong password")
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+	assert.Equal(t, loginError(t, rr), (&models.LoginLockedError{}).Error())
+
+	// each failure after the lock runs out doubles the wait
+	throttle, err := models.FindLoginThrottle(server.DB, user.Email)
+	if err != nil {
+		t.Fatalf("this is the error getting the throttle: %v\n", err)
+	}
+	assert.Equal(t, throttle.Failures, 3)
+	assert.Equal(t, throttle.LockedUntil.Sub(throttle.LastFailureAt), 30*time.Second)
+	for _, wait := range []time.Duration{60 * time.Second, 120 * time.Second} {
+		err = server.DB.Model(&models.LoginThrottle{}).Where("subject = ?", throttle.Subject).UpdateColumn("locked_until", time.Now().Add(-time.Second)).Error
+		if err != nil {
+			t.Fatalf("this is the error updating the throttle: %v\n", err)
+		}
+		rr = loginFrom("10.0.0.3", user.Email, "wrong password")
+		assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+		throttle, err = models.FindLoginThrottle(server.DB, user.Email)
+		if err != nil {
+			t.Fatalf("this is the error getting the throttle: %v\n", err)
+		}
+		assert.Equal(t, throttle.LockedUntil.Sub(throttle.LastFailureAt), wait)
+	}
+
+	// a good login clears the count
+	err = server.DB.Model(&models.LoginThrottle{}).Where("subject = ?", throttle.Subject).UpdateColumn("locked_until", time.Now().Add(-time.Second)).Error
+	if err != nil {
+		t.Fatalf("this is the error updating the throttle: %v\n", err)
+	}
+	rr = loginFrom("10.0.0.3", user.Email, "test")
+	assert.Equal(t, rr.Code, http.StatusOK)
+	_, err = models.FindLoginThrottle(server.DB, user.Email)
+	assert.Equal(t, err, gorm.ErrRecordNotFound)
+}
+
+func TestLoginLockoutByAddress(t *testing.T) {
+
+	user, err := seedOneUser()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("LOGIN_MAX_IP_ATTEMPTS", "4")
+	defer os.Unsetenv("LOGIN_MAX_IP_ATTEMPTS")
+
+	// guessing one password each for many accounts still gets caught
+	for i := 0; i < 4; i++ {
+		rr := loginFrom("10.0.1.1", fmt.Sprintf("guess%d@gmail.com", i), "password")
+		assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+	}
+	rr := loginFrom("10.0.1.1", user.Email, "test")
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+	rr = loginFrom("10.0.1.2", user.Email, "test")
+	assert.Equal(t, rr.Code, http.StatusOK)
+}
+
+func TestUnlockUser(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, patronToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		loginFrom("10.0.2.1", users[1].Email, "wrong password")
+	}
+	rr := loginFrom("10.0.2.2", users[1].Email, "test2")
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+
+	patronID := map[string]string{"id": fmt.Sprintf("%d", users[1].ID)}
+	rr = sendAs(guarded(models.PermLoginsManage, server.UnlockUser), "POST", "", fmt.Sprintf("Bearer %v", patronToken), patronID)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(guarded(models.PermLoginsManage, server.UnlockUser), "POST", "", fmt.Sprintf("Bearer %v", adminToken), map[string]string{"id": "9999"})
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+	rr = sendAs(guarded(models.PermLoginsManage, server.UnlockUser), "POST", "", fmt.Sprintf("Bearer %v", adminToken), patronID)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+
+	rr = loginFrom("10.0.2.2", users[1].Email, "test2")
+	assert.Equal(t, rr.Code, http.StatusOK)
+}
+
+func TestConcurrentLoginsStayUnderTheLimit(t *testing.T) {
+
+	user, err := seedOneUser()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("LOGIN_MAX_ATTEMPTS", "3")
+	defer os.Unsetenv("LOGIN_MAX_ATTEMPTS")
+
+	// every guess is counted before its password is checked, so a burst
+	// cannot get more than the limit through
+	codes := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			codes <- loginFrom(fmt.Sprintf("10.0.2.%d", i), user.Email, "wrong password").Code
+		}(i)
+	}
+	checked := 0
+	for i := 0; i < 20; i++ {
+		code := <-codes
+		if code == http.StatusUnprocessableEntity {
+			checked++
+		} else {
+			assert.Equal(t, code, http.StatusTooManyRequests)
+		}
+	}
+	assert.Equal(t, checked <= 3, true)
+
+	throttle, err := models.FindLoginThrottle(server.DB, user.Email)
+	if err != nil {
+		t.Fatalf("this is the error getting the throttle: %v\n", err)
+	}
+	assert.Equal(t, throttle.Failures, checked)
+	assert.Equal(t, throttle.Pending, 0)
+	if checked == 3 {
+		rr := loginFrom("10.0.2.100", user.Email, "test")
+		assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,139 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/marc"
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+type marcReport struct {
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	Results  []struct {
+		Record int    `json:"record"`
+		Isbn   string `json:"isbn"`
+		BookId uint   `json:"book_id"`
+		Error  string `json:"error"`
+	} `json:"results"`
+}
+
+func importMarcFixture(t *testing.T, name, contentType, token string) (int, marcReport) {
+	body, err := ioutil.ReadFile("../fixtures/marc/" + name)
+	if err != nil {
+		log.Fatalf("Could not read fixture %v\n", err)
+	}
+	req, err := http.NewRequest("POST", "/books/import/marc", bytes.NewReader(body))
+	if err != nil {
+		t.Errorf("this is the error: %v\n", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	handler := guarded(models.PermBooksWrite, server.ImportMarcBooks)
+	handler.ServeHTTP(rr, req)
+
+	report := marcReport{}
+	if rr.Code == http.StatusOK {
+		err = json.Unmarshal([]byte(rr.Body.String()), &report)
+		if err != nil {
+			t.Errorf("Cannot convert to json: %v", err)
+		}
+	}
+	return rr.Code, report
+}
+
+func TestImportAndExportMarc(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, userToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+
+	code, _ := importMarcFixture(t, "books.mrc", "application/marc", fmt.Sprintf("Bearer %v", userToken))
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	code, report := importMarcFixture(t, "books.mrc", "application/marc", adminTokenString)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, report.Imported, 2)
+	assert.Equal(t, report.Failed, 2)
+	assert.Equal(t, len(report.Results), 4)
+	assert.Equal(t, report.Results[0].Isbn, "9780547928227")
+	assert.NotEqual(t, report.Results[0].BookId, uint(0))
+	assert.Equal(t, report.Results[1].Error, "")
+	assert.NotEqual(t, report.Results[2].Error, "")
+	assert.Equal(t, report.Results[3].Error, "Invalid Isbn")
+
+	// the same records as MARCXML are now duplicates
+	code, report = importMarcFixture(t, "books.xml", "application/marcxml+xml", adminTokenString)
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, report.Imported, 0)
+	assert.Equal(t, report.Failed, 3)
+	assert.Equal(t, report.Results[0].Error, "A book with this Isbn is already in the library")
+
+	export := func(format string) (*httptest.ResponseRecorder, []*marc.Record) {
+		req, err := http.NewRequest("GET", "/books/export?format="+format, nil)
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		req.Header.Set("Authorization", adminTokenString)
+		rr := httptest.NewRecorder()
+		handler := guarded(models.PermBooksExport, server.ExportBooks)
+		handler.ServeHTTP(rr, req)
+
+		var reader marc.RecordReader = marc.NewXMLReader(bytes.NewReader(rr.Body.Bytes()))
+		if format == "marc" {
+			reader = marc.NewReader(bytes.NewReader(rr.Body.Bytes()))
+		}
+		records := []*marc.Record{}
+		for {
+			rec, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("Could not read the export: %v\n", err)
+				break
+			}
+			records = append(records, rec)
+		}
+		return rr, records
+	}
+
+	for _, format := range []string{"marcxml", "marc"} {
+		rr, records := export(format)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		// two seeded books and the two imported ones
+		assert.Equal(t, len(records), 4)
+		assert.Equal(t, records[2].Subfield("020", "a"), "9780547928227")
+		assert.Equal(t, records[2].Subfield("245", "a"), "The hobbit, or, There and back again")
+		assert.Equal(t, records[3].Subfield("100", "a"), "Herbert, Frank.")
+	}
+	rr, _ := export("marcxml")
+	assert.Equal(t, rr.Header().Get("Content-Type"), "application/marcxml+xml; charset=utf-8")
+
+	rr, _ = export("csv")
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+}
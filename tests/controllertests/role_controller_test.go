@@ -0,0 +1,222 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/gorilla/mux"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func sendAs(handler http.HandlerFunc, method, body, token string, vars map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "/", bytes.NewBufferString(body))
+	if err != nil {
+		log.Fatalf("this is the error: %v\n", err)
+	}
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRolesAndPermissions(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, patronToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+	patronTokenString := fmt.Sprintf("Bearer %v", patronToken)
+
+	rr := sendAs(guarded(models.PermRolesManage, server.GetRoles), "GET", "", patronTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	rr = sendAs(guarded(models.PermRolesManage, server.GetRoles), "GET", "", adminTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	roles := []models.Role{}
+	err = json.Unmarshal([]byte(rr.Body.String()), &roles)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	assert.Equal(t, len(roles), 4)
+
+	// circulation desk staff can see overdue loans but cannot edit the catalog
+	desk := models.User{Email: "desk@library.org", Password: "desk123", Role: models.RoleCirculation}
+	err = server.DB.Create(&desk).Error
+	if err != nil {
+		log.Fatalf("cannot seed users table: %v", err)
+	}
+	_, deskToken, err := server.SignIn(desk.Email, "desk123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	deskTokenString := fmt.Sprintf("Bearer %v", deskToken)
+	rr = sendAs(guarded(models.PermCheckoutsRead, server.GetOverdueCheckouts), "GET", "", deskTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	rr = sendAs(guarded(models.PermCheckoutsRead, server.GetOverdueCheckouts), "GET", "", patronTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(guarded(models.PermBooksExport, server.ExportBooks), "GET", "", deskTokenString, nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	samples := []struct {
+		inputJSON    string
+		statusCode   int
+		errorMessage string
+	}{
+		{
+			inputJSON:  `{"name": "cataloguer", "description": "Exports records", "permissions": ["books:export"]}`,
+			statusCode: 201,
+		},
+		{
+			inputJSON:    `{"name": "cataloguer", "permissions": []}`,
+			statusCode:   409,
+			errorMessage: models.ErrRoleExists.Error(),
+		},
+		{
+			inputJSON:    `{"name": "wizard", "permissions": ["spells:cast"]}`,
+			statusCode:   422,
+			errorMessage: "Unknown permission 'spells:cast'",
+		},
+		{
+			inputJSON:    `{"name": "Head Wizard", "permissions": []}`,
+			statusCode:   422,
+			errorMessage: "Name must be lowercase letters, digits and underscores",
+		},
+	}
+	var cataloguer models.Role
+	for _, v := range samples {
+		rr = sendAs(guarded(models.PermRolesManage, server.CreateRole), "POST", v.inputJSON, adminTokenString, nil)
+		assert.Equal(t, rr.Code, v.statusCode)
+		responseMap := make(map[string]interface{})
+		err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+		if err != nil {
+			t.Errorf("Cannot convert to json: %v", err)
+		}
+		if v.statusCode == 201 {
+			err = json.Unmarshal([]byte(rr.Body.String()), &cataloguer)
+			if err != nil {
+				t.Errorf("Cannot convert to json: %v", err)
+			}
+		} else {
+			assert.Equal(t, responseMap["error"], v.errorMessage)
+		}
+	}
+
+	// a new role takes effect at the user's next login
+	patronID := fmt.Sprintf("%d", users[1].ID)
+	rr = sendAs(guarded(models.PermRolesManage, server.UpdateUserRole), "PUT", `{"role": "cataloguer"}`, adminTokenString, map[string]string{"id": patronID})
+	assert.Equal(t, rr.Code, http.StatusOK)
+	_, patronToken, err = server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	rr = sendAs(guarded(models.PermBooksExport, server.ExportBooks), "GET", "", fmt.Sprintf("Bearer %v", patronToken), nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	roleID := fmt.Sprintf("%d", cataloguer.ID)
+	rr = sendAs(guarded(models.PermRolesManage, server.DeleteRole), "DELETE", "", adminTokenString, map[string]string{"id": roleID})
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	patronRole, err := models.FindRoleByName(server.DB, models.RolePatron)
+	if err != nil {
+		t.Errorf("this is the error getting the patron role: %v\n", err)
+	}
+	rr = sendAs(guarded(models.PermRolesManage, server.DeleteRole), "DELETE", "", adminTokenString, map[string]string{"id": fmt.Sprintf("%d", patronRole.ID)})
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	adminRole, err := models.FindRoleByName(server.DB, models.RoleAdmin)
+	if err != nil {
+		t.Errorf("this is the error getting the admin role: %v\n", err)
+	}
+	rr = sendAs(guarded(models.PermRolesManage, server.UpdateRole), "PUT", `{"name": "admin", "permissions": []}`, adminTokenString, map[string]string{"id": fmt.Sprintf("%d", adminRole.ID)})
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	// the only admin cannot demote themselves
+	rr = sendAs(guarded(models.PermRolesManage, server.UpdateUserRole), "PUT", `{"role": "patron"}`, adminTokenString, map[string]string{"id": fmt.Sprintf("%d", users[0].ID)})
+	assert.Equal(t, rr.Code, http.StatusConflict)
+
+	rr = sendAs(guarded(models.PermRolesManage, server.UpdateUserRole), "PUT", `{"role": "patron"}`, adminTokenString, map[string]string{"id": patronID})
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	// the demoted user's token still says cataloguer, so it is refused
+	// even where any logged in user may go
+	rr = sendAs(server.GetAccount, "GET", "", fmt.Sprintf("Bearer %v", patronToken), map[string]string{"id": patronID})
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	_, patronToken, err = server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	rr = sendAs(server.GetAccount, "GET", "", fmt.Sprintf("Bearer %v", patronToken), map[string]string{"id": patronID})
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	// every change of a user's role is in the audit log
+	entries := []models.AuditEntry{}
+	err = server.DB.Where("action = ? AND target_id = ?", models.AuditUserRole, users[1].ID).Order("id").Find(&entries).Error
+	if err != nil {
+		t.Fatalf("Could not read the audit log: %v", err)
+	}
+	assert.Equal(t, len(entries), 2)
+	assert.Equal(t, entries[0].ActorId, users[0].ID)
+	assert.Equal(t, entries[0].Before, `{"role":"patron"}`)
+	assert.Equal(t, entries[0].After, `{"role":"cataloguer"}`)
+	assert.Equal(t, entries[1].After, `{"role":"patron"}`)
+
+	rr = sendAs(guarded(models.PermRolesManage, server.DeleteRole), "DELETE", "", adminTokenString, map[string]string{"id": roleID})
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+}
+
+func TestRequirePermission(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, patronToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	reached := false
+	handler := guarded(models.PermBooksWrite, func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		w.WriteHeader(http.StatusOK)
+	})
+
+	rr := sendAs(handler, "GET", "", "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(handler, "GET", "", fmt.Sprintf("Bearer %v", patronToken), nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	assert.Equal(t, reached, false)
+	rr = sendAs(handler, "GET", "", fmt.Sprintf("Bearer %v", adminToken), nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, reached, true)
+}
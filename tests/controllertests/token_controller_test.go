@@ -0,0 +1,114 @@
+package controllertests
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/auth"
+	"github.com/brianhumphreys/library_app/api/controllers"
+
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func readSession(t *testing.T, body string) map[string]interface{} {
+	session := make(map[string]interface{})
+	err := json.Unmarshal([]byte(body), &session)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	return session
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	user, err := seedOneUser()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rr := sendAs(server.Login, "POST", fmt.Sprintf(`{"email": "%s", "password": "test"}`, user.Email), "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	login := readSession(t, rr.Body.String())
+	firstRefresh, _ := login["refresh_token"].(string)
+	assert.NotEqual(t, firstRefresh, "")
+
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, firstRefresh), "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	refreshed := readSession(t, rr.Body.String())
+	secondRefresh, _ := refreshed["refresh_token"].(string)
+	assert.NotEqual(t, secondRefresh, "")
+	assert.NotEqual(t, secondRefresh, firstRefresh)
+	assert.Equal(t, refreshed["email"], user.Email)
+	accessToken := fmt.Sprintf("Bearer %v", refreshed["token"])
+
+	// using a spent token again kills every token descended from it
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, firstRefresh), "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, secondRefresh), "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	rr = sendAs(server.RefreshToken, "POST", `{"refresh_token": "made-up"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.RefreshToken, "POST", `{}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+
+	// logging out revokes the access token before it expires
+	rr = sendAs(server.Login, "POST", fmt.Sprintf(`{"email": "%s", "password": "test"}`, user.Email), "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	login = readSession(t, rr.Body.String())
+	logoutRefresh, _ := login["refresh_token"].(string)
+
+	rr = sendAs(server.GetAccount, "GET", "", accessToken, map[string]string{"id": fmt.Sprintf("%d", user.ID)})
+	assert.Equal(t, rr.Code, http.StatusOK)
+	rr = sendAs(server.Logout, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, logoutRefresh), accessToken, nil)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+	rr = sendAs(server.GetAccount, "GET", "", accessToken, map[string]string{"id": fmt.Sprintf("%d", user.ID)})
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.Logout, "POST", "", accessToken, nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, logoutRefresh), "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+}
+
+func TestDatabaseKeyStore(t *testing.T) {
+
+	err := refreshUserTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	load := func() *auth.KeyRing {
+		ring, err := auth.LoadKeyRing(auth.KeyRingConfig{
+			Store:       controllers.DatabaseKeyStore{DB: server.DB},
+			Alg:         "EdDSA",
+			RotateEvery: 30 * 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatalf("Could not load the key ring: %v", err)
+		}
+		return ring
+	}
+	first := load()
+	second := load()
+	assert.Equal(t, second.JWKS().Keys[0].Kid, first.JWKS().Keys[0].Kid)
+
+	// under the advisory lock only one instance makes the next key
+	later := time.Now().Add(31 * 24 * time.Hour)
+	errs := make(chan error, 2)
+	for _, ring := range []*auth.KeyRing{first, second} {
+		go func(ring *auth.KeyRing) { errs <- ring.Rotate(later) }(ring)
+	}
+	assert.Equal(t, <-errs, nil)
+	assert.Equal(t, <-errs, nil)
+	stored, err := controllers.DatabaseKeyStore{DB: server.DB}.ListKeys()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(stored), 2)
+	assert.Equal(t, first.JWKS().Keys[1].Kid, second.JWKS().Keys[1].Kid)
+}
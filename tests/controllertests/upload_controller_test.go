@@ -0,0 +1,195 @@
+package controllertests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+type uploadReport struct {
+	DryRun  bool `json:"dry_run"`
+	Rows    int  `json:"rows"`
+	Valid   int  `json:"valid"`
+	Invalid int  `json:"invalid"`
+	Created int  `json:"created"`
+	Errors  []struct {
+		Row   int    `json:"row"`
+		Key   string `json:"key"`
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+func uploadCsvFixture(t *testing.T, handler http.HandlerFunc, name, query, token string) *httptest.ResponseRecorder {
+	contents, err := ioutil.ReadFile("../fixtures/csv/" + name)
+	if err != nil {
+		log.Fatalf("Could not read fixture %v\n", err)
+	}
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("file", name)
+	if err != nil {
+		t.Errorf("this is the error: %v\n", err)
+	}
+	part.Write(contents)
+	form.Close()
+
+	req, err := http.NewRequest("POST", "/upload"+query, body)
+	if err != nil {
+		t.Errorf("this is the error: %v\n", err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", token)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func readUploadReport(t *testing.T, rr *httptest.ResponseRecorder) uploadReport {
+	report := uploadReport{}
+	err := json.Unmarshal([]byte(rr.Body.String()), &report)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	return report
+}
+
+func TestUploadBooks(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, userToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+
+	rr := uploadCsvFixture(t, guarded(models.PermBooksWrite, server.UploadBooks), "books.csv", "", fmt.Sprintf("Bearer %v", userToken))
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	// a dry run reports the same errors without adding anything
+	rr = uploadCsvFixture(t, guarded(models.PermBooksWrite, server.UploadBooks), "books.csv", "?dry_run=true", adminTokenString)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	report := readUploadReport(t, rr)
+	assert.Equal(t, report.DryRun, true)
+	assert.Equal(t, report.Rows, 7)
+	assert.Equal(t, report.Valid, 2)
+	assert.Equal(t, report.Invalid, 5)
+	assert.Equal(t, report.Created, 0)
+	rows := []int{}
+	for _, rowError := range report.Errors {
+		rows = append(rows, rowError.Row)
+	}
+	assert.Equal(t, rows, []int{4, 5, 6, 7, 8})
+	assert.Equal(t, report.Errors[3].Error, models.ErrDuplicateIsbn.Error())
+
+	_, err = models.FindBookByIsbn(server.DB, "9780441013593")
+	assert.Equal(t, err, models.ErrBookNotFound)
+
+	rr = uploadCsvFixture(t, guarded(models.PermBooksWrite, server.UploadBooks), "books.csv", "", adminTokenString)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	report = readUploadReport(t, rr)
+	assert.Equal(t, report.Created, 2)
+
+	book, err := models.FindBookByIsbn(server.DB, "9780441013593")
+	if err != nil {
+		t.Errorf("this is the error getting the uploaded book: %v\n", err)
+	}
+	assert.Equal(t, book.Title, "Dune")
+	assert.Equal(t, book.PublicationYear, 2005)
+	assert.Equal(t, book.CopiesTotal, 1)
+
+	// the error report downloads as CSV, and this time the first two rows are
+	// already in the library
+	rr = uploadCsvFixture(t, guarded(models.PermBooksWrite, server.UploadBooks), "books.csv", "?dry_run=true&report=csv", adminTokenString)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Header().Get("Content-Type"), "text/csv; charset=utf-8")
+	lines, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Errorf("Cannot read the error report: %v", err)
+	}
+	assert.Equal(t, len(lines), 8)
+	assert.Equal(t, lines[0], []string{"row", "key", "error"})
+	assert.Equal(t, lines[1][0], "2")
+}
+
+func TestUploadUsers(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+	mail, restore := useOutbox()
+	defer restore()
+
+	rr := uploadCsvFixture(t, guarded(models.PermUsersWrite, server.UploadUsers), "users.csv", "?dry_run=maybe", adminTokenString)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+
+	rr = uploadCsvFixture(t, guarded(models.PermUsersWrite, server.UploadUsers), "books.csv", "", adminTokenString)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+
+	rr = uploadCsvFixture(t, guarded(models.PermUsersWrite, server.UploadUsers), "users.csv", "", adminTokenString)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	report := readUploadReport(t, rr)
+	assert.Equal(t, report.Rows, 6)
+	assert.Equal(t, report.Valid, 2)
+	assert.Equal(t, report.Invalid, 4)
+	assert.Equal(t, report.Created, 2)
+	for _, rowError := range report.Errors {
+		if rowError.Row == 7 {
+			assert.Equal(t, rowError.Error, "Email Already Taken")
+		}
+	}
+
+	_, token, err := server.SignIn("reader2@example.com", "reader123")
+	if err != nil {
+		t.Errorf("the uploaded patron could not log in: %v\n", err)
+	}
+	assert.NotEqual(t, token, "")
+
+	user := models.User{}
+	err = server.DB.Model(&models.User{}).Where("email = ?", "reader2@example.com").Take(&user).Error
+	if err != nil {
+		t.Errorf("this is the error getting the uploaded user: %v\n", err)
+	}
+	assert.Equal(t, user.Role, models.RolePatron)
+	assert.Equal(t, user.PatronType, "student")
+
+	// the imported patrons are asked to verify their addresses
+	assert.Equal(t, user.EmailVerifiedAt == nil, true)
+	mail.waitFor(t, 2)
+	assert.Equal(t, mail.messages[len(mail.messages)-1].To, "reader2@example.com")
+	verifiedUser, err := models.VerifyEmail(server.DB, mail.lastToken(t), models.Actor{})
+	if err != nil {
+		t.Fatalf("Could not verify: %v", err)
+	}
+	assert.Equal(t, verifiedUser.ID, user.ID)
+}
@@ -8,7 +8,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/gorilla/mux"
@@ -32,20 +34,23 @@ func TestCreateUser(t *testing.T) {
 			inputJSON:    `{"email": "brianhumphreys@gmail.com", "password": "password", "role": "user"}`,
 			statusCode:   201,
 			email:        "brianhumphreys@gmail.com",
-			role:         "user",
+			role:         "patron",
 			errorMessage: "",
 		},
 		{
+			// signing up never makes anyone staff
 			inputJSON:    `{"email": "brianhumphreys2@gmail.com", "password": "password2", "role": "admin"}`,
 			statusCode:   201,
 			email:        "brianhumphreys2@gmail.com",
-			role:         "admin",
+			role:         "patron",
 			errorMessage: "",
 		},
 		{
-			inputJSON:    `{"email": "newemail@gmail.com", "password": "password2", "role": "not valid"}`,
-			statusCode:   422,
-			errorMessage: "Role must be 'user' or 'admin'",
+			inputJSON:    `{"email": "newemail@gmail.com", "password": "password2", "role": "wizard"}`,
+			statusCode:   201,
+			email:        "newemail@gmail.com",
+			role:         "patron",
+			errorMessage: "",
 		},
 		{
 			inputJSON:    `{"email": "brianhumphreys@gmail.com", "password": "password", "role": "admin"}`,
@@ -67,11 +72,6 @@ func TestCreateUser(t *testing.T) {
 			statusCode:   422,
 			errorMessage: "Required Password",
 		},
-		{
-			inputJSON:    `{"email": "brye@gmail.com", "password": "password", "role": ""}`,
-			statusCode:   422,
-			errorMessage: "Required Role",
-		},
 	}
 
 	for _, v := range samples {
@@ -91,6 +91,7 @@ func TestCreateUser(t *testing.T) {
 		assert.Equal(t, rr.Code, v.statusCode)
 		if v.statusCode == 201 {
 			assert.Equal(t, responseMap["email"], v.email)
+			assert.Equal(t, responseMap["role"], v.role)
 		}
 		if v.statusCode == 422 || v.statusCode == 500 && v.errorMessage != "" {
 			assert.Equal(t, responseMap["error"], v.errorMessage)
@@ -98,32 +99,197 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
-func TestGetUsers(t *testing.T) {
+func TestCreateAdminUser(t *testing.T) {
+
+	err := refreshUserTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, err := SeedUsers()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "bumq123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	_, patronToken, err := server.SignIn(users[1].Email, "jwoma123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	// a custom role that may manage roles still cannot make admins
+	err = server.DB.Create(&models.Role{Name: "deputy", Permissions: models.StringList{models.PermRolesManage}}).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	deputy := models.User{Email: "deputy@a.com", Password: "deputy123", Role: "deputy"}
+	err = server.DB.Create(&deputy).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, deputyToken, err := server.SignIn(deputy.Email, "deputy123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	samples := []struct {
+		inputJSON    string
+		token        string
+		statusCode   int
+		role         string
+		errorMessage string
+	}{
+		{
+			inputJSON:    `{"email": "staff@a.com", "password": "password", "role": "librarian"}`,
+			statusCode:   401,
+			errorMessage: "Unauthorized",
+		},
+		{
+			inputJSON:    `{"email": "staff@a.com", "password": "password", "role": "librarian"}`,
+			token:        patronToken,
+			statusCode:   401,
+			errorMessage: "Unauthorized",
+		},
+		{
+			inputJSON:  `{"email": "staff@a.com", "password": "password", "role": "librarian"}`,
+			token:      adminToken,
+			statusCode: 201,
+			role:       "librarian",
+		},
+		{
+			inputJSON:  `{"email": "boss@a.com", "password": "password", "role": "admin"}`,
+			token:      adminToken,
+			statusCode: 201,
+			role:       "admin",
+		},
+		{
+			inputJSON:    `{"email": "other@a.com", "password": "password", "role": "admin"}`,
+			token:        deputyToken,
+			statusCode:   403,
+			errorMessage: "Only admins can give or take away the admin role",
+		},
+		{
+			inputJSON:  `{"email": "desk@a.com", "password": "password", "role": "circulation"}`,
+			token:      deputyToken,
+			statusCode: 201,
+			role:       "circulation",
+		},
+		{
+			inputJSON:    `{"email": "newemail@gmail.com", "password": "password2", "role": "not valid"}`,
+			token:        adminToken,
+			statusCode:   422,
+			errorMessage: "Invalid Role",
+		},
+		{
+			inputJSON:    `{"email": "newemail@gmail.com", "password": "password2", "role": "wizard"}`,
+			token:        adminToken,
+			statusCode:   422,
+			errorMessage: "role does not exist",
+		},
+		{
+			inputJSON:    `{"email": "brye@gmail.com", "password": "password", "role": ""}`,
+			token:        adminToken,
+			statusCode:   422,
+			errorMessage: "Required Role",
+		},
+	}
+	for _, v := range samples {
+		token := ""
+		if v.token != "" {
+			token = fmt.Sprintf("Bearer %v", v.token)
+		}
+		rr := sendAs(guarded(models.PermRolesManage, server.CreateAdminUser), "POST", v.inputJSON, token, nil)
+		assert.Equal(t, rr.Code, v.statusCode)
+		responseMap := readSession(t, rr.Body.String())
+		if v.statusCode == 201 {
+			assert.Equal(t, responseMap["role"], v.role)
+		}
+		if v.errorMessage != "" {
+			assert.Equal(t, responseMap["error"], v.errorMessage)
+		}
+	}
+
+	entries := []models.AuditEntry{}
+	err = server.DB.Where("action = ?", models.AuditUserCreate).Order("id").Find(&entries).Error
+	if err != nil {
+		t.Fatalf("Could not read the audit log: %v", err)
+	}
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, entries[0].ActorId, users[0].ID)
+	assert.Equal(t, entries[0].After, `{"role":"librarian"}`)
+	assert.Equal(t, entries[2].ActorId, deputy.ID)
+}
+
+func TestBootstrapAdmin(t *testing.T) {
 
 	err := refreshUserTable()
 	if err != nil {
 		log.Fatal(err)
 	}
+	_, err = models.BootstrapAdmin(server.DB, "first@a.com", "")
+	assert.Equal(t, err.Error(), "Required Password")
+
+	admin, err := models.BootstrapAdmin(server.DB, "first@a.com", "first123")
+	if err != nil {
+		t.Fatalf("Could not create the first admin: %v", err)
+	}
+	assert.Equal(t, admin.Role, models.RoleAdmin)
+	assert.Equal(t, admin.EmailVerifiedAt != nil, true)
+
+	// once there is an admin nothing more is created
+	admin, err = models.BootstrapAdmin(server.DB, "second@a.com", "second123")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, admin == nil, true)
+	var count int64
+	server.DB.Model(&models.User{}).Count(&count)
+	assert.Equal(t, count, int64(1))
+
+	_, _, err = server.SignIn("first@a.com", "first123")
+	assert.Equal(t, err, nil)
+}
+
+func TestGetUsers(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	_, err = SeedUsers()
+	users, err := SeedUsers()
 	if err != nil {
 		log.Fatal(err)
 	}
-	req, err := http.NewRequest("GET", "/users", nil)
+	_, adminToken, err := server.SignIn(users[0].Email, "bumq123")
 	if err != nil {
-		t.Errorf("Additional Information: %v\n", err)
+		log.Fatalf("Could not Login: %v\n", err)
 	}
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(server.GetUsers)
-	handler.ServeHTTP(rr, req)
+	_, patronToken, err := server.SignIn(users[1].Email, "jwoma123")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+
+	// only staff who manage accounts may list them
+	rr := sendAs(server.GetUsers, "GET", "", "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.GetUsers, "GET", "", fmt.Sprintf("Bearer %v", patronToken), nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
 
-	var users []models.User
-	err = json.Unmarshal([]byte(rr.Body.String()), &users)
+	rr = sendAs(server.GetUsers, "GET", "", fmt.Sprintf("Bearer %v", adminToken), nil)
+	var page struct {
+		Data  []map[string]interface{} `json:"data"`
+		Total int64                    `json:"total"`
+	}
+	err = json.Unmarshal([]byte(rr.Body.String()), &page)
 	if err != nil {
 		log.Fatalf("Cannot convert to json: %v\n", err)
 	}
 	assert.Equal(t, rr.Code, http.StatusOK)
-	assert.Equal(t, len(users), 2)
+	assert.Equal(t, len(page.Data), 2)
+	assert.Equal(t, page.Total, int64(2))
+	for _, user := range page.Data {
+		_, leaked := user["password"]
+		assert.Equal(t, leaked, false)
+	}
 }
 
 func TestGetUserByID(t *testing.T) {
@@ -132,16 +298,28 @@ func TestGetUserByID(t *testing.T) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	_, token, err := server.SignIn(user.Email, "test")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
 	userSample := []struct {
-		id           string
-		statusCode   int
-		email        string
-		errorMessage string
+		id         string
+		token      string
+		statusCode int
+		email      string
+		role       string
 	}{
 		{
 			id:         strconv.Itoa(int(user.ID)),
+			token:      fmt.Sprintf("Bearer %v", token),
 			statusCode: 200,
 			email:      user.Email,
+			role:       user.Role,
+		},
+		{
+			// strangers only see the public view, without the role
+			id:         strconv.Itoa(int(user.ID)),
+			statusCode: 200,
 		},
 		{
 			id:         "unknwon",
@@ -150,14 +328,7 @@ func TestGetUserByID(t *testing.T) {
 	}
 	for _, v := range userSample {
 
-		req, err := http.NewRequest("GET", "/users", nil)
-		if err != nil {
-			t.Errorf("Additional Information: %v\n", err)
-		}
-		req = mux.SetURLVars(req, map[string]string{"id": v.id})
-		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(server.GetUser)
-		handler.ServeHTTP(rr, req)
+		rr := sendAs(server.GetUser, "GET", "", v.token, map[string]string{"id": v.id})
 
 		responseMap := make(map[string]interface{})
 		err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
@@ -168,14 +339,19 @@ func TestGetUserByID(t *testing.T) {
 		assert.Equal(t, rr.Code, v.statusCode)
 
 		if v.statusCode == 200 {
-			assert.Equal(t, user.Email, responseMap["email"])
+			email, _ := responseMap["email"].(string)
+			assert.Equal(t, email, v.email)
+			role, _ := responseMap["role"].(string)
+			assert.Equal(t, role, v.role)
+			_, leaked := responseMap["password"]
+			assert.Equal(t, leaked, false)
 		}
 	}
 }
 
-func TestUpdateUser(t *testing.T) {
+func TestUpdateProfile(t *testing.T) {
 
-	err := refreshUserTable()
+	err := refreshUserAndBookAndCheckoutTable()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -183,99 +359,94 @@ func TestUpdateUser(t *testing.T) {
 	if err != nil {
 		log.Fatalf("Error seeding user: %v\n", err)
 	}
-	// Test update of first user
-	currentID := users[0].ID
-	currentEmail := users[0].Email
-	currentPassword := "bumq123"
+	err = server.DB.Model(&users[0]).UpdateColumn("email_verified_at", time.Now()).Error
+	if err != nil {
+		log.Fatal(err)
+	}
+	currentID := strconv.Itoa(int(users[0].ID))
 
-	// First login
-	_, token, err := server.SignIn(currentEmail, currentPassword)
+	_, token, err := server.SignIn(users[0].Email, "bumq123")
 	if err != nil {
 		log.Fatalf("cannot login: %v\n", err)
 	}
 	tokenString := fmt.Sprintf("Bearer %v", token)
+	mail, restore := useOutbox()
+	defer restore()
 
 	samples := []struct {
 		id           string
 		updateJSON   string
 		statusCode   int
 		updateEmail  string
-		role         string
+		displayName  string
+		verified     bool
 		tokenGiven   string
 		errorMessage string
 	}{
 		{
-			// Convert int32 to int first before converting to string
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "newbhumq@gmail.com", "password": "newpassword", "role": "admin"}`,
-			statusCode:   200,
-			updateEmail:  "newbhumq@gmail.com",
-			role:         "admin",
-			tokenGiven:   tokenString,
-			errorMessage: "",
+			// only the display name changes, the address stays verified
+			id:          currentID,
+			updateJSON:  `{"display_name": "Bea"}`,
+			statusCode:  200,
+			updateEmail: "b@a.com",
+			displayName: "Bea",
+			verified:    true,
+			tokenGiven:  tokenString,
 		},
 		{
-			// When password field is empty
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "bhumq@gmail.com", "password": "", "role": "admin"}`,
-			statusCode:   422,
-			tokenGiven:   tokenString,
-			errorMessage: "Required Password",
+			id:          currentID,
+			updateJSON:  `{"email": "newbhumq@gmail.com", "role": "patron"}`,
+			statusCode:  200,
+			updateEmail: "newbhumq@gmail.com",
+			displayName: "Bea",
+			verified:    false,
+			tokenGiven:  tokenString,
 		},
 		{
-			// When no token was passed
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "test3@gmail.com", "password": "test3", "role": "admin"}`,
+			id:           currentID,
+			updateJSON:   `{"email": "test3@gmail.com"}`,
 			statusCode:   401,
 			tokenGiven:   "",
 			errorMessage: "Unauthorized",
 		},
 		{
-			// When incorrect token was passed
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "b@g.com", "password": "password", "role": "admin"}`,
+			id:           currentID,
+			updateJSON:   `{"email": "b@g.com"}`,
 			statusCode:   401,
 			tokenGiven:   "This is incorrect token",
 			errorMessage: "Unauthorized",
 		},
 		{
-			// Remember "kenny@gmail.com" belongs to user 2
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "j@a.com", "password": "jwoma123", "role": "admin"}`,
-			statusCode:   500,
+			// "j@a.com" belongs to the second user
+			id:           currentID,
+			updateJSON:   `{"email": "j@a.com"}`,
+			statusCode:   409,
 			tokenGiven:   tokenString,
 			errorMessage: "Email Already Taken",
 		},
 		{
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "brianhumphreys.com", "password": "password", "role": "admin"}`,
+			id:           currentID,
+			updateJSON:   `{"email": "brianhumphreys.com"}`,
 			statusCode:   422,
 			tokenGiven:   tokenString,
 			errorMessage: "Invalid Email",
 		},
 		{
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "", "password": "password", "role": "admin"}`,
+			id:           currentID,
+			updateJSON:   `{"email": ""}`,
 			statusCode:   422,
 			tokenGiven:   tokenString,
 			errorMessage: "Required Email",
 		},
-		{
-			id:           strconv.Itoa(int(currentID)),
-			updateJSON:   `{"email": "j@a.com", "password": "password", "role": ""}`,
-			statusCode:   422,
-			tokenGiven:   tokenString,
-			errorMessage: "Required Role",
-		},
 		{
 			id:         "bad request",
 			tokenGiven: tokenString,
 			statusCode: 400,
 		},
 		{
-			// When user 2 is using user 1 token
-			id:           strconv.Itoa(int(2)),
-			updateJSON:   `{"email": "j@a.com", "password": "jwoma123"}`,
+			// the second user cannot be changed with the first user's token
+			id:           strconv.Itoa(int(users[1].ID)),
+			updateJSON:   `{"display_name": "Someone"}`,
 			tokenGiven:   tokenString,
 			statusCode:   401,
 			errorMessage: "Unauthorized",
@@ -283,18 +454,7 @@ func TestUpdateUser(t *testing.T) {
 	}
 
 	for _, v := range samples {
-		req, err := http.NewRequest("POST", "/users", bytes.NewBufferString(v.updateJSON))
-		if err != nil {
-			t.Errorf("This is the error: %v\n", err)
-		}
-		req = mux.SetURLVars(req, map[string]string{"id": v.id})
-
-		rr := httptest.NewRecorder()
-		handler := http.HandlerFunc(server.UpdateUser)
-
-		req.Header.Set("Authorization", v.tokenGiven)
-
-		handler.ServeHTTP(rr, req)
+		rr := sendAs(server.UpdateProfile, "PATCH", v.updateJSON, v.tokenGiven, map[string]string{"id": v.id})
 
 		responseMap := make(map[string]interface{})
 		err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
@@ -304,16 +464,172 @@ func TestUpdateUser(t *testing.T) {
 		assert.Equal(t, rr.Code, v.statusCode)
 		if v.statusCode == 200 {
 			assert.Equal(t, responseMap["email"], v.updateEmail)
+			assert.Equal(t, responseMap["display_name"], v.displayName)
+			assert.Equal(t, responseMap["email_verified"], v.verified)
+			assert.Equal(t, responseMap["role"], "admin")
+		}
+		if v.errorMessage != "" {
+			assert.Equal(t, responseMap["error"], v.errorMessage)
 		}
-		if v.statusCode == 401 || v.statusCode == 422 || v.statusCode == 500 && v.errorMessage != "" {
+	}
+
+	// only the new address is sent a link
+	assert.Equal(t, mail.count(), 1)
+	assert.Equal(t, mail.messages[0].To, "newbhumq@gmail.com")
+}
+
+func TestUpdateUserIsADeprecatedProfileUpdate(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	patronID := strconv.Itoa(int(users[1].ID))
+	_, token, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("cannot login: %v\n", err)
+	}
+	_, restore := useOutbox()
+	defer restore()
+
+	// the old body still works, but cannot raise the role or skip the
+	// current password
+	rr := sendAs(server.UpdateUser, "PUT", `{"email": "test2@gmail.com", "display_name": "Tess", "role": "admin", "password": "hijacked"}`, fmt.Sprintf("Bearer %v", token), map[string]string{"id": patronID})
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, rr.Header().Get("Deprecation"), "true")
+	responseMap := make(map[string]interface{})
+	err = json.Unmarshal([]byte(rr.Body.String()), &responseMap)
+	if err != nil {
+		t.Errorf("Cannot convert to json: %v", err)
+	}
+	assert.Equal(t, responseMap["display_name"], "Tess")
+	assert.Equal(t, responseMap["role"], models.RolePatron)
+
+	_, _, err = server.SignIn(users[1].Email, "hijacked")
+	assert.Equal(t, err, models.ErrInvalidCredentials)
+	_, _, err = server.SignIn(users[1].Email, "test2")
+	assert.Equal(t, err, nil)
+
+	rr = sendAs(server.UpdateUser, "PUT", `{"display_name": "Someone"}`, fmt.Sprintf("Bearer %v", token), map[string]string{"id": strconv.Itoa(int(users[0].ID))})
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+}
+
+func TestChangePassword(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, err := SeedUsers()
+	if err != nil {
+		log.Fatalf("Error seeding user: %v\n", err)
+	}
+	currentID := strconv.Itoa(int(users[0].ID))
+
+	rr := sendAs(server.Login, "POST", `{"email": "b@a.com", "password": "bumq123"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	session := readSession(t, rr.Body.String())
+	tokenString := fmt.Sprintf("Bearer %v", session["token"])
+	oldRefresh, _ := session["refresh_token"].(string)
+	_, otherToken, err := server.SignIn("b@a.com", "bumq123")
+	if err != nil {
+		log.Fatalf("cannot login: %v\n", err)
+	}
+
+	samples := []struct {
+		id           string
+		body         string
+		tokenGiven   string
+		statusCode   int
+		errorMessage string
+	}{
+		{
+			id:           currentID,
+			body:         `{"current_password": "bumq123", "new_password": "newpass1"}`,
+			statusCode:   401,
+			errorMessage: "Unauthorized",
+		},
+		{
+			id:           strconv.Itoa(int(users[1].ID)),
+			body:         `{"current_password": "jwoma123", "new_password": "newpass1"}`,
+			tokenGiven:   tokenString,
+			statusCode:   401,
+			errorMessage: "Unauthorized",
+		},
+		{
+			id:           currentID,
+			body:         `{"new_password": "newpass1"}`,
+			tokenGiven:   tokenString,
+			statusCode:   422,
+			errorMessage: "Required Current Password",
+		},
+		{
+			id:           currentID,
+			body:         `{"current_password": "bumq123", "new_password": ""}`,
+			tokenGiven:   tokenString,
+			statusCode:   422,
+			errorMessage: "Required Password",
+		},
+		{
+			id:           currentID,
+			body:         `{"current_password": "wrong", "new_password": "newpass1"}`,
+			tokenGiven:   tokenString,
+			statusCode:   422,
+			errorMessage: "Current password is incorrect",
+		},
+		{
+			id:         currentID,
+			body:       `{"current_password": "bumq123", "new_password": "newpass1"}`,
+			tokenGiven: tokenString,
+			statusCode: 200,
+		},
+	}
+	var fresh map[string]interface{}
+	for _, v := range samples {
+		rr := sendAs(server.ChangePassword, "POST", v.body, v.tokenGiven, map[string]string{"id": v.id})
+		assert.Equal(t, rr.Code, v.statusCode)
+		responseMap := readSession(t, rr.Body.String())
+		if v.errorMessage != "" {
 			assert.Equal(t, responseMap["error"], v.errorMessage)
 		}
+		if v.statusCode == 200 {
+			fresh = responseMap
+		}
+	}
+
+	_, _, err = server.SignIn("b@a.com", "bumq123")
+	assert.Equal(t, err, models.ErrInvalidCredentials)
+	_, _, err = server.SignIn("b@a.com", "newpass1")
+	assert.Equal(t, err, nil)
+
+	// the old session is over, the one handed back works
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, oldRefresh), "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.UpdateProfile, "PATCH", `{"display_name": "Bea"}`, tokenString, map[string]string{"id": currentID})
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	// so are the other sessions, access tokens included
+	rr = sendAs(server.UpdateProfile, "PATCH", `{"display_name": "Bea"}`, fmt.Sprintf("Bearer %v", otherToken), map[string]string{"id": currentID})
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.UpdateProfile, "PATCH", `{"display_name": "Bea"}`, fmt.Sprintf("Bearer %v", fresh["token"]), map[string]string{"id": currentID})
+	assert.Equal(t, rr.Code, http.StatusOK)
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, fresh["refresh_token"]), "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	// wrong guesses count as failed logins
+	throttle, err := models.FindLoginThrottle(server.DB, "b@a.com")
+	if err != nil {
+		t.Fatalf("Could not find the throttle: %v", err)
 	}
+	assert.Equal(t, throttle.Failures, 1)
 }
 
 func TestDeleteUser(t *testing.T) {
 
-	err := refreshUserTable()
+	err := refreshUserAndBookAndCheckoutTable()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -332,6 +648,7 @@ func TestDeleteUser(t *testing.T) {
 		log.Fatalf("cannot login: %v\n", err)
 	}
 	tokenString := fmt.Sprintf("Bearer %v", token)
+	signedIn := time.Now()
 
 	userSample := []struct {
 		id           string
@@ -396,4 +713,154 @@ func TestDeleteUser(t *testing.T) {
 			assert.Equal(t, responseMap["error"], v.errorMessage)
 		}
 	}
+
+	// every token of a deleted user is refused, old or new
+	revocations := models.TokenRevocations{DB: server.DB}
+	for _, issuedAt := range []time.Time{signedIn, time.Now()} {
+		revoked, err := revocations.IsRevoked("", currentID, issuedAt)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, revoked, true)
+	}
+}
+
+func TestRestoreAndPurgeUser(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, books, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+	_, patronToken, err := server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	patronID := map[string]string{"id": strconv.Itoa(int(users[1].ID))}
+
+	loan := models.Checkout{UserId: users[1].ID, BookId: uint64(books[0].ID)}
+	err = server.DB.Create(&loan).Error
+	if err != nil {
+		t.Fatalf("Could not seed a checkout: %v", err)
+	}
+	err = server.DB.Create(&models.LedgerEntry{UserId: users[1].ID, Kind: "fine", AmountCents: 100}).Error
+	if err != nil {
+		t.Fatalf("Could not seed a ledger entry: %v", err)
+	}
+
+	// the book has to come back first
+	rr := sendAs(server.DeleteUser, "DELETE", "", fmt.Sprintf("Bearer %v", patronToken), patronID)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	server.DB.Model(&models.Checkout{}).Where("id = ?", loan.ID).Update("checked_in", true)
+	rr = sendAs(server.DeleteUser, "DELETE", "", fmt.Sprintf("Bearer %v", patronToken), patronID)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+	_, _, err = server.SignIn(users[1].Email, "test2")
+	assert.NotEqual(t, err, nil)
+
+	req, _ := http.NewRequest("GET", "/api/v1/users?deleted=true", nil)
+	req.Header.Set("Authorization", adminTokenString)
+	rr = httptest.NewRecorder()
+	server.GetUsers(rr, req)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, readSession(t, rr.Body.String())["total"], float64(1))
+
+	// only deleted users can be restored or purged
+	rr = sendAs(guarded(models.PermUsersPurge, server.PurgeUser), "POST", "", adminTokenString, map[string]string{"id": strconv.Itoa(int(users[0].ID))})
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	rr = sendAs(guarded(models.PermUsersWrite, server.RestoreUser), "POST", "", "", patronID)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+
+	rr = sendAs(guarded(models.PermUsersWrite, server.RestoreUser), "POST", "", adminTokenString, patronID)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	assert.Equal(t, readSession(t, rr.Body.String())["email"], users[1].Email)
+	rr = sendAs(guarded(models.PermUsersWrite, server.RestoreUser), "POST", "", adminTokenString, patronID)
+	assert.Equal(t, rr.Code, http.StatusConflict)
+	_, patronToken, err = server.SignIn(users[1].Email, "test2")
+	if err != nil {
+		t.Fatalf("Could not login after the restore: %v", err)
+	}
+
+	rr = sendAs(server.DeleteUser, "DELETE", "", fmt.Sprintf("Bearer %v", patronToken), patronID)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+	rr = sendAs(guarded(models.PermUsersPurge, server.PurgeUser), "POST", "", adminTokenString, patronID)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+
+	var left int64
+	server.DB.Unscoped().Model(&models.User{}).Where("id = ?", users[1].ID).Count(&left)
+	assert.Equal(t, left, int64(0))
+	server.DB.Unscoped().Model(&models.Checkout{}).Where("user_id = ?", users[1].ID).Count(&left)
+	assert.Equal(t, left, int64(0))
+	server.DB.Unscoped().Model(&models.LedgerEntry{}).Where("user_id = ?", users[1].ID).Count(&left)
+	assert.Equal(t, left, int64(0))
+	rr = sendAs(guarded(models.PermUsersPurge, server.PurgeUser), "POST", "", adminTokenString, patronID)
+	assert.Equal(t, rr.Code, http.StatusNotFound)
+}
+
+func TestPurgeLeavesNoPersonalDataInTheAuditLog(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	users, _, err := seedUsersAndBook()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, adminToken, err := server.SignIn(users[0].Email, "test1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	adminTokenString := fmt.Sprintf("Bearer %v", adminToken)
+	_, restore := useOutbox()
+	defer restore()
+
+	// every change to the account that the audit log records
+	rr := sendAs(server.CreateUser, "POST", `{"email": "gone@a.com", "password": "password"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusCreated)
+	uid := uint(readSession(t, rr.Body.String())["id"].(float64))
+	id := map[string]string{"id": strconv.Itoa(int(uid))}
+	_, token, err := server.SignIn("gone@a.com", "password")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	rr = sendAs(server.UpdateProfile, "PATCH", `{"email": "still-gone@a.com", "display_name": "Gwen Gone"}`, fmt.Sprintf("Bearer %v", token), id)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	rr = sendAs(server.DeleteUser, "DELETE", "", fmt.Sprintf("Bearer %v", token), id)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+	rr = sendAs(guarded(models.PermUsersWrite, server.RestoreUser), "POST", "", adminTokenString, id)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	_, token, err = server.SignIn("still-gone@a.com", "password")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	rr = sendAs(server.DeleteUser, "DELETE", "", fmt.Sprintf("Bearer %v", token), id)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+	rr = sendAs(guarded(models.PermUsersPurge, server.PurgeUser), "POST", "", adminTokenString, id)
+	assert.Equal(t, rr.Code, http.StatusNoContent)
+
+	// the entries about the user are still there, but nothing names them
+	entries := []models.AuditEntry{}
+	err = server.DB.Order("id").Find(&entries).Error
+	if err != nil {
+		t.Fatalf("Could not read the audit log: %v", err)
+	}
+	about := 0
+	for _, entry := range entries {
+		if entry.TargetType == "user" && entry.TargetId == uid {
+			about++
+		}
+		for _, personal := range []string{"gone@a.com", "still-gone@a.com", "Gwen Gone"} {
+			assert.Equal(t, strings.Contains(entry.Before, personal), false)
+			assert.Equal(t, strings.Contains(entry.After, personal), false)
+		}
+	}
+	assert.Equal(t, about, 6)
+	_, err = models.VerifyAuditChain(server.DB)
+	assert.Equal(t, err, nil)
 }
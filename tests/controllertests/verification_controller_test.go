@@ -0,0 +1,198 @@
+package controllertests
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/mailer"
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// outbox keeps mail instead of sending it.
+type outbox struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (o *outbox) Send(msg mailer.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, msg)
+	return nil
+}
+
+func (o *outbox) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.messages)
+}
+
+// waitFor waits for mail that is sent in the background.
+func (o *outbox) waitFor(t *testing.T, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for o.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d messages, got %d", n, o.count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+var linkToken = regexp.MustCompile(`token=([^\s]+)`)
+
+// lastToken reads the token from the link in the latest message.
+func (o *outbox) lastToken(t *testing.T) string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.messages) == 0 {
+		t.Fatalf("No mail was sent")
+	}
+	match := linkToken.FindStringSubmatch(o.messages[len(o.messages)-1].Body)
+	if match == nil {
+		t.Fatalf("The mail has no link")
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatalf("Could not read the link: %v", err)
+	}
+	return token
+}
+
+func useOutbox() (*outbox, func()) {
+	mail := &outbox{}
+	previous := server.Mailer
+	server.Mailer = mail
+	return mail, func() { server.Mailer = previous }
+}
+
+func TestVerifyEmail(t *testing.T) {
+
+	_, book, err := seedPatronsAndOneBook(0)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	mail, restore := useOutbox()
+	defer restore()
+
+	// the signup body cannot mark the address as verified
+	rr := sendAs(server.CreateUser, "POST", `{"email": "new@library.org", "password": "secret1", "role": "patron", "email_verified_at": "2020-01-01T00:00:00Z"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusCreated)
+	assert.Equal(t, mail.count(), 1)
+	assert.Equal(t, mail.messages[0].To, "new@library.org")
+	token := mail.lastToken(t)
+
+	user, accessToken, err := server.SignIn("new@library.org", "secret1")
+	if err != nil {
+		log.Fatalf("Could not Login: %v\n", err)
+	}
+	assert.Equal(t, user.EmailVerifiedAt == nil, true)
+	checkout := fmt.Sprintf(`{"user_id": %d, "book_id": %d}`, user.ID, book.ID)
+	rr = sendAs(server.CheckoutABook, "POST", checkout, fmt.Sprintf("Bearer %v", accessToken), nil)
+	assert.Equal(t, rr.Code, http.StatusForbidden)
+	assert.Equal(t, readSession(t, rr.Body.String())["error"], models.ErrEmailNotVerified.Error())
+
+	samples := []struct {
+		token      string
+		statusCode int
+	}{
+		{token: "", statusCode: http.StatusBadRequest},
+		{token: token + "x", statusCode: http.StatusBadRequest},
+		{token: token, statusCode: http.StatusOK},
+		// links work once
+		{token: token, statusCode: http.StatusBadRequest},
+	}
+	for _, v := range samples {
+		req, err := http.NewRequest("GET", "/api/v1/verify?token="+url.QueryEscape(v.token), nil)
+		if err != nil {
+			t.Errorf("this is the error: %v\n", err)
+		}
+		rr := httptest.NewRecorder()
+		server.VerifyEmail(rr, req)
+		assert.Equal(t, rr.Code, v.statusCode)
+	}
+
+	rr = sendAs(server.CheckoutABook, "POST", checkout, fmt.Sprintf("Bearer %v", accessToken), nil)
+	assert.Equal(t, rr.Code, http.StatusCreated)
+}
+
+func TestResetPassword(t *testing.T) {
+
+	users, _, err := seedPatronsAndOneBook(1)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	mail, restore := useOutbox()
+	defer restore()
+
+	rr := sendAs(server.Login, "POST", fmt.Sprintf(`{"email": "%s", "password": "patron123"}`, users[0].Email), "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	oldSession := readSession(t, rr.Body.String())
+	oldRefresh, _ := oldSession["refresh_token"].(string)
+
+	// unknown addresses get the same answer but no mail
+	rr = sendAs(server.ForgotPassword, "POST", `{"email": "nobody@library.org"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusAccepted)
+	rr = sendAs(server.ForgotPassword, "POST", fmt.Sprintf(`{"email": "%s"}`, users[0].Email), "", nil)
+	assert.Equal(t, rr.Code, http.StatusAccepted)
+	mail.waitFor(t, 1)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, mail.count(), 1)
+	assert.Equal(t, mail.messages[0].To, users[0].Email)
+	token := mail.lastToken(t)
+
+	rr = sendAs(server.ResetPassword, "POST", fmt.Sprintf(`{"token": "%s", "password": ""}`, token), "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnprocessableEntity)
+	rr = sendAs(server.ResetPassword, "POST", `{"token": "made.up", "password": "newpass1"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+	rr = sendAs(server.ResetPassword, "POST", fmt.Sprintf(`{"token": "%s", "password": "newpass1"}`, token), "", nil)
+	assert.Equal(t, rr.Code, http.StatusOK)
+	rr = sendAs(server.ResetPassword, "POST", fmt.Sprintf(`{"token": "%s", "password": "again123"}`, token), "", nil)
+	assert.Equal(t, rr.Code, http.StatusBadRequest)
+
+	_, _, err = server.SignIn(users[0].Email, "patron123")
+	assert.NotEqual(t, err, nil)
+	_, _, err = server.SignIn(users[0].Email, "newpass1")
+	assert.Equal(t, err, nil)
+
+	// sessions started with the old password are over
+	rr = sendAs(server.RefreshToken, "POST", fmt.Sprintf(`{"refresh_token": "%s"}`, oldRefresh), "", nil)
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	rr = sendAs(server.GetAccount, "GET", "", fmt.Sprintf("Bearer %v", oldSession["token"]), map[string]string{"id": fmt.Sprintf("%d", users[0].ID)})
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+}
+
+func TestForgotPasswordIsThrottled(t *testing.T) {
+
+	users, _, err := seedPatronsAndOneBook(1)
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	mail, restore := useOutbox()
+	defer restore()
+
+	body := fmt.Sprintf(`{"email": "%s"}`, users[0].Email)
+	for i := 0; i < 3; i++ {
+		rr := sendAs(server.ForgotPassword, "POST", body, "", nil)
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+	}
+	rr := sendAs(server.ForgotPassword, "POST", body, "", nil)
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+	assert.Equal(t, rr.Header().Get("Retry-After") != "", true)
+	// an unknown address is throttled just the same
+	for i := 0; i < 3; i++ {
+		rr = sendAs(server.ForgotPassword, "POST", `{"email": "nobody@library.org"}`, "", nil)
+		assert.Equal(t, rr.Code, http.StatusAccepted)
+	}
+	rr = sendAs(server.ForgotPassword, "POST", `{"email": "nobody@library.org"}`, "", nil)
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+
+	mail.waitFor(t, 3)
+}
@@ -0,0 +1,111 @@
+package mailertests
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/mailer"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// received is what the fake server was sent in one session.
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP accepts a single session on a local port and reports what it
+// was sent.
+func fakeSMTP(t *testing.T) (string, chan received) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	done := make(chan received, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		mail := received{}
+		text.PrintfLine("220 fake ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(line)
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				text.PrintfLine("250 fake")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				mail.from = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				text.PrintfLine("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				mail.to = append(mail.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+				text.PrintfLine("250 OK")
+			case command == "DATA":
+				text.PrintfLine("354 Go ahead")
+				lines, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				mail.data = strings.Join(lines, "\n")
+				text.PrintfLine("250 Queued")
+			case command == "QUIT":
+				text.PrintfLine("221 Bye")
+				done <- mail
+				return
+			default:
+				text.PrintfLine("502 Unknown command")
+			}
+		}
+	}()
+	return listener.Addr().String(), done
+}
+
+func TestSMTPSend(t *testing.T) {
+
+	addr, done := fakeSMTP(t)
+	smtp := mailer.NewSMTP(addr, "library@example.org", "", "")
+	err := smtp.Send(mailer.Message{
+		To:      "patron@example.org",
+		Subject: "Please verify your email address",
+		Body:    "Open this link:\n\nhttp://localhost/verify?token=abc\n.\nThanks",
+	})
+	if err != nil {
+		t.Fatalf("Could not send: %v", err)
+	}
+
+	mail := <-done
+	assert.Equal(t, mail.from, "library@example.org")
+	assert.Equal(t, mail.to, []string{"patron@example.org"})
+	assert.Equal(t, strings.Contains(mail.data, "Subject: Please verify your email address\n"), true)
+	assert.Equal(t, strings.Contains(mail.data, "To: patron@example.org\n"), true)
+	assert.Equal(t, strings.Contains(mail.data, "Content-Type: text/plain; charset=UTF-8\n"), true)
+	// a line holding only a dot must not end the message early
+	assert.Equal(t, strings.HasSuffix(mail.data, "token=abc\n.\nThanks"), true)
+}
+
+func TestHeaderInjection(t *testing.T) {
+
+	samples := []mailer.Message{
+		{To: "patron@example.org\r\nBcc: everyone@example.org", Subject: "Hello"},
+		{To: "patron@example.org", Subject: "Hello\nBcc: everyone@example.org"},
+		{To: "", Subject: "Hello"},
+	}
+	for i, v := range samples {
+		err := mailer.NewSMTP("127.0.0.1:1", "library@example.org", "", "").Send(v)
+		assert.NotEqual(t, err, nil)
+		err = mailer.Console{}.Send(v)
+		if err == nil {
+			t.Errorf("sample %d: expected the message to be refused", i)
+		}
+	}
+}
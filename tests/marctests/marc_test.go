@@ -0,0 +1,114 @@
+package marctests
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/marc"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func readAll(reader marc.RecordReader) ([]*marc.Record, []error) {
+	records := []*marc.Record{}
+	errs := []error{}
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			return records, errs
+		}
+		records = append(records, rec)
+		errs = append(errs, err)
+	}
+}
+
+func openFixture(name string) *os.File {
+	f, err := os.Open("../fixtures/marc/" + name)
+	if err != nil {
+		log.Fatalf("Could not open fixture %v\n", err)
+	}
+	return f
+}
+
+func TestReadMarcFixture(t *testing.T) {
+
+	f := openFixture("books.mrc")
+	defer f.Close()
+
+	records, errs := readAll(marc.NewReader(f))
+	assert.Equal(t, len(records), 4)
+
+	assert.Equal(t, errs[0], nil)
+	assert.Equal(t, records[0].ControlField("001"), "ocm00001")
+	assert.Equal(t, records[0].Subfield("020", "a"), "9780547928227 (pbk.)")
+	assert.Equal(t, records[0].Subfield("100", "a"), "Tolkien, J. R. R.,")
+	assert.Equal(t, records[0].Subfield("245", "a"), "The hobbit, or, There and back again /")
+	assert.Equal(t, records[0].Subfield("520", "a"), "Bilbo Baggins is swept into a quest to reclaim the dwarves’ treasure.")
+	assert.Equal(t, records[0].Fields("245")[0].Ind2, "4")
+
+	assert.Equal(t, errs[1], nil)
+	assert.Equal(t, records[1].Subfield("245", "b"), "a novel /")
+
+	// the junk between records is reported and skipped
+	assert.Equal(t, errors.Is(errs[2], marc.ErrMalformed), true)
+
+	assert.Equal(t, errs[3], nil)
+	assert.Equal(t, records[3].ControlField("001"), "ocm00003")
+}
+
+func TestReadMarcXMLFixture(t *testing.T) {
+
+	f := openFixture("books.xml")
+	defer f.Close()
+
+	records, errs := readAll(marc.NewXMLReader(f))
+	assert.Equal(t, len(records), 3)
+	for _, err := range errs {
+		assert.Equal(t, err, nil)
+	}
+	assert.Equal(t, records[0].Subfield("020", "a"), "9780547928227 (pbk.)")
+	assert.Equal(t, records[0].Subfield("520", "a"), "Bilbo Baggins is swept into a quest to reclaim the dwarves’ treasure.")
+	assert.Equal(t, records[1].Subfield("100", "a"), "Herbert, Frank.")
+	assert.Equal(t, records[2].Subfield("245", "a"), "A record with a bad checksum.")
+}
+
+func TestMarcRoundTrip(t *testing.T) {
+
+	rec := marc.Record{Leader: marc.DefaultLeader}
+	rec.AddControlField("001", "42")
+	rec.AddDataField("020", " ", " ", marc.Subfield{Code: "a", Value: "9780306406157"})
+	rec.AddDataField("245", "1", "0", marc.Subfield{Code: "a", Value: "Ünïcödé title"}, marc.Subfield{Code: "b", Value: "subtitle"})
+
+	raw, err := marc.Marshal(&rec)
+	if err != nil {
+		t.Fatalf("Could not marshal the record: %v\n", err)
+	}
+	binary, err := marc.NewReader(bytes.NewReader(raw)).Next()
+	if err != nil {
+		t.Fatalf("Could not read the record back: %v\n", err)
+	}
+	assert.Equal(t, binary.ControlFields, rec.ControlFields)
+	assert.Equal(t, binary.DataFields, rec.DataFields)
+	assert.Equal(t, binary.Leader[:5], fmt.Sprintf("%05d", len(raw)))
+	assert.Equal(t, binary.Leader[12:17], fmt.Sprintf("%05d", 24+3*12+1))
+
+	var buf bytes.Buffer
+	writer := marc.NewXMLWriter(&buf)
+	err = writer.Write(&rec)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err != nil {
+		t.Fatalf("Could not write MARCXML: %v\n", err)
+	}
+	fromXML, err := marc.NewXMLReader(&buf).Next()
+	if err != nil {
+		t.Fatalf("Could not read MARCXML back: %v\n", err)
+	}
+	assert.Equal(t, fromXML.ControlFields, rec.ControlFields)
+	assert.Equal(t, fromXML.DataFields, rec.DataFields)
+}
@@ -0,0 +1,58 @@
+package metadatatests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/metadata"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// countingProvider answers every lookup and counts how often it was asked.
+type countingProvider struct {
+	calls map[string]int
+}
+
+func (p *countingProvider) LookupIsbn(ctx context.Context, isbn string) (*metadata.Record, error) {
+	p.calls[isbn]++
+	return &metadata.Record{Isbn: isbn}, nil
+}
+
+func TestCacheDropsTheLeastRecentlyUsed(t *testing.T) {
+	provider := &countingProvider{calls: map[string]int{}}
+	cache := metadata.NewCache(provider, time.Hour, 2)
+	ctx := context.Background()
+
+	cache.LookupIsbn(ctx, "9780000000001")
+	cache.LookupIsbn(ctx, "9780000000002")
+	// using the first again makes the second the oldest
+	cache.LookupIsbn(ctx, "9780000000001")
+	cache.LookupIsbn(ctx, "9780000000003")
+	assert.Equal(t, cache.Len(), 2)
+
+	cache.LookupIsbn(ctx, "9780000000001")
+	cache.LookupIsbn(ctx, "9780000000002")
+	assert.Equal(t, provider.calls["9780000000001"], 1)
+	assert.Equal(t, provider.calls["9780000000002"], 2)
+}
+
+func TestCacheDropsExpiredEntries(t *testing.T) {
+	provider := &countingProvider{calls: map[string]int{}}
+	cache := metadata.NewCache(provider, 10*time.Millisecond, 100)
+	ctx := context.Background()
+
+	for _, isbn := range []string{"9780000000001", "9780000000002", "9780000000003"} {
+		cache.LookupIsbn(ctx, isbn)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	record, err := cache.LookupIsbn(ctx, "9780000000004")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, record.Isbn, "9780000000004")
+	// adding a lookup sweeps out the ones that have expired
+	assert.Equal(t, cache.Len(), 1)
+
+	cache.LookupIsbn(ctx, "9780000000001")
+	assert.Equal(t, provider.calls["9780000000001"], 2)
+}
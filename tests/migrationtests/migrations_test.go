@@ -0,0 +1,115 @@
+package migrationtests
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/migrations"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+// migrationDir writes the given files to a fresh directory.
+func migrationDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		log.Fatalf("Could not create a directory: %v\n", err)
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+		if err != nil {
+			log.Fatalf("Could not write %s: %v\n", name, err)
+		}
+	}
+	return dir
+}
+
+func TestLoadRepoMigrations(t *testing.T) {
+
+	loaded, err := migrations.Load("../../migrations")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(loaded) > 0, true)
+	for i, m := range loaded {
+		if i > 0 {
+			assert.Equal(t, m.Version > loaded[i-1].Version, true)
+		}
+		assert.NotEqual(t, strings.TrimSpace(m.Up), "")
+		assert.NotEqual(t, strings.TrimSpace(m.Down), "")
+	}
+	assert.Equal(t, loaded[0].Name, "baseline")
+}
+
+// the baseline is recorded without changes on a database from before
+// migrations, so anything added since belongs in a later version
+func TestBaselineIsTheOldSchema(t *testing.T) {
+
+	loaded, err := migrations.Load("../../migrations")
+	assert.Equal(t, err, nil)
+	for _, later := range []string{"email_verified_at", "patron_type", "book_copies", "copy_id", "due_at", "audit_entries"} {
+		assert.Equal(t, strings.Contains(loaded[0].Up, later), false)
+	}
+	assert.Equal(t, strings.Contains(loaded[0].Up, `"available" boolean NOT NULL`), true)
+}
+
+func TestLoadOrdersAndPairsFiles(t *testing.T) {
+
+	dir := migrationDir(t, map[string]string{
+		"0010_later.up.sql":    "CREATE TABLE later (id int);",
+		"0010_later.down.sql":  "DROP TABLE later;",
+		"0002_first.up.sql":    "CREATE TABLE first (id int);",
+		"0002_first.down.sql":  "DROP TABLE first;",
+		"README.md":            "not a migration",
+		"0003_skipped.sql.bak": "not a migration either",
+	})
+	defer os.RemoveAll(dir)
+
+	loaded, err := migrations.Load(dir)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(loaded), 2)
+	assert.Equal(t, loaded[0].Version, int64(2))
+	assert.Equal(t, loaded[0].Name, "first")
+	assert.Equal(t, loaded[0].Down, "DROP TABLE first;")
+	assert.Equal(t, loaded[1].Version, int64(10))
+}
+
+func TestLoadRejectsBrokenSets(t *testing.T) {
+
+	samples := []map[string]string{
+		// no down file
+		{"0001_only_up.up.sql": "SELECT 1;"},
+		// an empty down file
+		{"0001_empty.up.sql": "SELECT 1;", "0001_empty.down.sql": "  \n"},
+		// the two halves disagree on the name
+		{"0001_one.up.sql": "SELECT 1;", "0001_two.down.sql": "SELECT 1;"},
+		// not named like a migration
+		{"create_books.sql": "SELECT 1;"},
+		// version 0 means an empty database
+		{"0000_zero.up.sql": "SELECT 1;", "0000_zero.down.sql": "SELECT 1;"},
+	}
+	for _, files := range samples {
+		dir := migrationDir(t, files)
+		_, err := migrations.Load(dir)
+		assert.NotEqual(t, err, nil)
+		os.RemoveAll(dir)
+	}
+
+	_, err := migrations.Load("does-not-exist")
+	assert.NotEqual(t, err, nil)
+}
+
+func TestBehindErrorNamesPendingVersions(t *testing.T) {
+
+	err := &migrations.BehindError{Pending: []int64{2, 3}}
+	assert.Equal(t, strings.Contains(err.Error(), "2, 3"), true)
+	assert.Equal(t, strings.Contains(err.Error(), "migrate up"), true)
+}
+
+func TestDirPrefersMigrationsDir(t *testing.T) {
+
+	os.Setenv("MIGRATIONS_DIR", "/srv/library/migrations")
+	defer os.Unsetenv("MIGRATIONS_DIR")
+	assert.Equal(t, migrations.Dir(), "/srv/library/migrations")
+}
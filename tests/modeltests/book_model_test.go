@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/brianhumphreys/library_app/api/models"
+	"github.com/brianhumphreys/library_app/api/utils/isbn"
 	"gopkg.in/go-playground/assert.v1"
 )
 
@@ -13,12 +14,14 @@ func TestFindAllBooks(t *testing.T) {
 	if err != nil {
 		log.Fatalf("Tables could not be seeded %v\n", err)
 	}
-	foundBooks, err := books[0].FindAllBooks(server.DB)
+	page, err := books[0].FindAllBooks(server.DB, &models.PageRequest{})
 	if err != nil {
 		t.Errorf("There was an error getting the books: %v\n", err)
 		return
 	}
-	assert.Equal(t, len(*foundBooks), 2)
+	assert.Equal(t, len(page.Data.([]models.Book)), 2)
+	assert.Equal(t, page.Total, int64(2))
+	assert.Equal(t, page.HasMore, false)
 }
 
 func TestSaveBook(t *testing.T) {
@@ -28,7 +31,7 @@ func TestSaveBook(t *testing.T) {
 	newBook := models.Book{
 		Title:       "Test Book",
 		Author:      "Test Author",
-		Isbn:        "Test Isbn",
+		Isbn:        "9780385539258",
 		Description: "Test Description",
 	}
 	savedBook, err := newBook.SaveBook(server.DB)
@@ -72,12 +75,12 @@ func TestUpdateAPost(t *testing.T) {
 	book1 := models.Book{
 		Title:       "Test Book",
 		Author:      "CORRECTED Test Author",
-		Isbn:        "NEW Test Isbn",
+		Isbn:        "9780525555216",
 		Description: "NEW Test Description",
 	}
 	book1.ID = 1
 
-	updatedBook, err := book1.UpdateABook(server.DB)
+	updatedBook, err := book1.UpdateABook(server.DB, models.Actor{})
 	if err != nil {
 		t.Errorf("this is the error updating the user: %v\n", err)
 		return
@@ -95,13 +98,39 @@ func TestDeleteAPost(t *testing.T) {
 	if err != nil {
 		log.Fatalf("Error Seeding tables")
 	}
-	_, err = books[0].DeleteABook(server.DB)
+	// the first book is checked out
+	_, err = books[0].DeleteABook(server.DB, models.Actor{})
+	assert.Equal(t, err, models.ErrBookOnLoan)
+
+	_, err = books[1].DeleteABook(server.DB, models.Actor{})
 	if err != nil {
 		t.Errorf("this is the error updating the user: %v\n", err)
 		return
 	}
 
-	foundUser2, err := models.FindBookByID(server.DB, uint64(books[0].ID))
+	foundUser2, err := models.FindBookByID(server.DB, uint64(books[1].ID))
 
 	assert.Equal(t, len(*foundUser2), 0)
 }
+
+func TestNormalizeIsbn(t *testing.T) {
+
+	samples := []struct {
+		input string
+		isbn  string
+		err   error
+	}{
+		{input: "9780306406157", isbn: "9780306406157"},
+		{input: "978-0-306-40615-7", isbn: "9780306406157"},
+		{input: "0-306-40615-2", isbn: "9780306406157"},
+		{input: "ISBN 080442957x", isbn: "9780804429573"},
+		{input: "9780306406158", err: isbn.ErrInvalid},
+		{input: "0306406153", err: isbn.ErrInvalid},
+		{input: "isbn", err: isbn.ErrInvalid},
+	}
+	for _, v := range samples {
+		normalized, err := isbn.Normalize(v.input)
+		assert.Equal(t, err, v.err)
+		assert.Equal(t, normalized, v.isbn)
+	}
+}
@@ -0,0 +1,93 @@
+package modeltests
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestOverdueFine(t *testing.T) {
+
+	due := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	samples := []struct {
+		returnedAt time.Time
+		fine       int64
+	}{
+		{returnedAt: due.Add(-time.Hour), fine: 0},
+		{returnedAt: due, fine: 0},
+		{returnedAt: due.Add(time.Minute), fine: 25},
+		{returnedAt: due.Add(72 * time.Hour), fine: 75},
+		{returnedAt: due.Add(90 * 24 * time.Hour), fine: 1000},
+	}
+	for _, v := range samples {
+		assert.Equal(t, models.OverdueFine(due, v.returnedAt, 25, 1000), v.fine)
+	}
+}
+
+func TestLateCheckinChargesAFine(t *testing.T) {
+
+	user, _, _, err := seedOneUserAndTwoBookAndOneCheckout()
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	book := models.Book{
+		Title:       "Late Book",
+		Author:      "Late Author",
+		Isbn:        "9780451524935",
+		Description: "Late Description",
+	}
+	_, err = book.SaveBook(server.DB)
+	if err != nil {
+		log.Fatalf("Book could not be saved %v\n", err)
+	}
+
+	checkout := models.Checkout{
+		UserId: user.ID,
+		BookId: uint64(book.ID),
+		DueAt:  time.Now().Add(-50 * time.Hour),
+	}
+	err = checkout.MakeACheckout(server.DB, models.Actor{})
+	if err != nil {
+		t.Errorf("There was an error checking out the book: %v\n", err)
+		return
+	}
+	err = checkout.CheckinABook(server.DB, models.Actor{})
+	if err != nil {
+		t.Errorf("There was an error checking in the book: %v\n", err)
+		return
+	}
+
+	account, err := models.GetAccountOfUserWithID(server.DB, user.ID)
+	if err != nil {
+		t.Errorf("There was an error getting the account: %v\n", err)
+		return
+	}
+	assert.Equal(t, len(account.Entries), 1)
+	assert.Equal(t, account.Entries[0].Kind, models.LedgerFine)
+	assert.Equal(t, account.BalanceCents, models.FinePerDayCents()*3)
+
+	payment := models.LedgerEntry{
+		UserId:      user.ID,
+		Kind:        models.LedgerPayment,
+		AmountCents: account.BalanceCents + 1,
+	}
+	_, err = payment.CreditAccount(server.DB, models.Actor{})
+	assert.Equal(t, err, models.ErrCreditExceedsBalance)
+
+	payment.AmountCents = account.BalanceCents
+	_, err = payment.CreditAccount(server.DB, models.Actor{})
+	if err != nil {
+		t.Errorf("There was an error recording the payment: %v\n", err)
+		return
+	}
+	balance, err := models.GetBalanceOfUserWithID(server.DB, user.ID)
+	if err != nil {
+		t.Errorf("There was an error getting the balance: %v\n", err)
+		return
+	}
+	assert.Equal(t, balance, int64(0))
+}
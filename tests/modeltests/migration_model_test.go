@@ -0,0 +1,138 @@
+package modeltests
+
+import (
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/migrations"
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+	"gorm.io/gorm"
+)
+
+// The tables as the last release before versioned migrations AutoMigrated
+// them.
+type baselineUser struct {
+	gorm.Model
+	Email    string `gorm:"size:100;not null;unique"`
+	Password string `gorm:"size:100;not null;"`
+	Role     string `gorm:"size:100;not null;"`
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineBook struct {
+	gorm.Model
+	Title       string `gorm:"size:255;not null"`
+	Author      string `gorm:"size:255;not null"`
+	Isbn        string `gorm:"size:255;not null"`
+	Description string `gorm:"size:4096;not null"`
+	Available   bool   `gorm:"not null"`
+}
+
+func (baselineBook) TableName() string { return "books" }
+
+type baselineCheckout struct {
+	gorm.Model
+	UserId    uint   `gorm:"size:100;not null;"`
+	BookId    uint64 `gorm:"size:100;not null;"`
+	CheckedIn bool
+}
+
+func (baselineCheckout) TableName() string { return "checkouts" }
+
+func TestMigrateFromBaseline(t *testing.T) {
+
+	migrator, err := migrations.Open(server.DB, "../../migrations")
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = migrator.Up()
+	if err == nil {
+		_, err = migrator.To(0)
+	}
+	if err == nil {
+		err = server.DB.AutoMigrate(&baselineUser{}, &baselineBook{}, &baselineCheckout{})
+	}
+	if err != nil {
+		log.Fatalf("Could not build the baseline schema: %v", err)
+	}
+
+	password, _ := models.Hash("old123")
+	users := []baselineUser{
+		{Email: "old@a.com", Password: string(password), Role: "user"},
+		{Email: "older@a.com", Password: string(password), Role: "admin"},
+	}
+	books := []baselineBook{
+		{Title: "On the shelf", Author: "A", Isbn: "0-306-40615-2", Description: "d", Available: true},
+		{Title: "On loan", Author: "B", Isbn: "978-0-385-53925-8", Description: "d", Available: false},
+		{Title: "Typo", Author: "C", Isbn: "not an isbn", Description: "d", Available: true},
+	}
+	if err = server.DB.Create(&users).Error; err == nil {
+		err = server.DB.Create(&books).Error
+	}
+	checkouts := []baselineCheckout{
+		{UserId: users[0].ID, BookId: uint64(books[0].ID), CheckedIn: true},
+		{UserId: users[0].ID, BookId: uint64(books[1].ID), CheckedIn: false},
+	}
+	if err == nil {
+		err = server.DB.Create(&checkouts).Error
+	}
+	if err != nil {
+		log.Fatalf("Could not fill the baseline schema: %v", err)
+	}
+
+	_, err = migrator.Up()
+	assert.Equal(t, err, nil)
+	assert.Equal(t, migrator.Check(), nil)
+	err = models.MigrateRoles(server.DB)
+	assert.Equal(t, err, nil)
+
+	migrated := []models.User{}
+	server.DB.Order("id").Find(&migrated)
+	assert.Equal(t, len(migrated), 2)
+	for _, user := range migrated {
+		assert.Equal(t, user.EmailVerifiedAt != nil, true)
+		assert.Equal(t, user.PatronType, "standard")
+	}
+	assert.Equal(t, migrated[0].Role, models.RolePatron)
+	assert.Equal(t, models.VerifyPassword(migrated[0].Password, "old123"), nil)
+
+	// every book has a copy that carries its old availability
+	for i, status := range []string{models.CopyAvailable, models.CopyCheckedOut, models.CopyAvailable} {
+		copies, err := models.FindCopiesOfBookWithID(server.DB, uint64(books[i].ID))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(*copies), 1)
+		assert.Equal(t, (*copies)[0].Status, status)
+	}
+
+	found, err := models.FindBookByID(server.DB, uint64(books[0].ID))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, (*found)[0].Isbn, "9780306406157")
+	found, _ = models.FindBookByID(server.DB, uint64(books[1].ID))
+	assert.Equal(t, (*found)[0].Isbn, "9780385539258")
+	found, _ = models.FindBookByID(server.DB, uint64(books[2].ID))
+	assert.Equal(t, (*found)[0].Isbn, "not an isbn")
+
+	// the open loan moved onto the copy and the old number is still unique
+	owners, err := models.GetCurrentOwnerOfBookWithID(server.DB, uint64(books[1].ID))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(owners), 1)
+	loans := []models.Checkout{}
+	server.DB.Order("id").Find(&loans)
+	assert.Equal(t, loans[0].ReturnedAt != nil, true)
+	assert.Equal(t, loans[1].ReturnedAt == nil, true)
+	assert.Equal(t, loans[1].DueAt.IsZero(), false)
+	copies, _ := models.FindCopiesOfBookWithID(server.DB, uint64(books[1].ID))
+	assert.Equal(t, loans[1].CopyId, uint64((*copies)[0].ID))
+
+	duplicate := models.Book{Title: "Again", Author: "A", Isbn: "9780306406157", Description: "d"}
+	_, err = duplicate.SaveBook(server.DB)
+	assert.Equal(t, errors.Is(err, models.ErrDuplicateIsbn), true)
+
+	err = resetSchema()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/brianhumphreys/library_app/api/controllers"
+	"github.com/brianhumphreys/library_app/api/migrations"
 	"github.com/brianhumphreys/library_app/api/models"
 	"github.com/joho/godotenv"
 	"gorm.io/driver/postgres"
@@ -46,9 +47,32 @@ func Database() {
 	}
 }
 
+// resetSchema rolls every migration back and applies them again, which
+// leaves every table empty. Migrating up first takes over tables left by a
+// run from before migrations, so they are dropped too.
+func resetSchema() error {
+	migrator, err := migrations.Open(server.DB, "../../migrations")
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up()
+	if err == nil {
+		_, err = migrator.To(0)
+	}
+	if err == nil {
+		_, err = migrator.Up()
+	}
+	if err != nil {
+		return err
+	}
+	return models.MigrateRoles(server.DB)
+}
+
 func refreshUserTable() error {
-	server.DB.Migrator().DropTable(&models.User{})
-	server.DB.AutoMigrate(&models.User{})
+	err := resetSchema()
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Successfully refreshed table")
 	return nil
@@ -61,7 +85,7 @@ func seedOneUser() (models.User, error) {
 	user := models.User{
 		Email:    "test@gmail.com",
 		Password: "test",
-		Role:     "user",
+		Role:     "patron",
 	}
 
 	err := server.DB.Model(&models.User{}).Create(&user).Error
@@ -77,7 +101,7 @@ func seedUsers() error {
 		models.User{
 			Email:    "b@a.com",
 			Password: "bumq123",
-			Role:     "user",
+			Role:     "patron",
 		},
 		models.User{
 			Email:    "j@a.com",
@@ -96,9 +120,10 @@ func seedUsers() error {
 }
 
 func refreshUserAndBookAndCheckoutTable() error {
-
-	server.DB.Migrator().DropTable(&models.Checkout{}, &models.Book{}, &models.User{})
-	server.DB.AutoMigrate(&models.User{}, &models.Book{}, &models.Checkout{})
+	err := resetSchema()
+	if err != nil {
+		return err
+	}
 
 	log.Printf("Successfully refreshed tables")
 	return nil
@@ -126,7 +151,7 @@ func seedOneUserAndTwoBookAndOneCheckout() (models.User, []models.Book, models.C
 	book1 := models.Book{
 		Title:       "Test Book",
 		Author:      "Test Author",
-		Isbn:        "Test Isbn",
+		Isbn:        "9780306406157",
 		Description: "Test Description",
 	}
 	err = server.DB.Model(&models.Book{}).Create(&book1).Error
@@ -137,7 +162,7 @@ func seedOneUserAndTwoBookAndOneCheckout() (models.User, []models.Book, models.C
 	book2 := models.Book{
 		Title:       "Test Book 2",
 		Author:      "Test Author 2",
-		Isbn:        "Test Isbn 2",
+		Isbn:        "9780804429573",
 		Description: "Test Description 2",
 	}
 	err = server.DB.Model(&models.Book{}).Create(&book2).Error
@@ -168,7 +193,7 @@ func seedUsersAndBook() ([]models.User, []models.Book, error) {
 		models.User{
 			Email:    "test1@gmail.com",
 			Password: "test1",
-			Role:     "user",
+			Role:     "patron",
 		},
 		models.User{
 			Email:    "test2@gmail.com",
@@ -180,13 +205,13 @@ func seedUsersAndBook() ([]models.User, []models.Book, error) {
 		models.Book{
 			Title:       "Test Title 1",
 			Author:      "Test Author 1",
-			Isbn:        "Test Isbn 1",
+			Isbn:        "9780143127741",
 			Description: "Test Description 1",
 		},
 		models.Book{
 			Title:       "Test Title 1",
 			Author:      "Test Author 1",
-			Isbn:        "Test Isbn 1",
+			Isbn:        "9780062316097",
 			Description: "Test Description 1",
 		},
 	}
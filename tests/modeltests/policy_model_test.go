@@ -0,0 +1,86 @@
+package modeltests
+
+import (
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/brianhumphreys/library_app/api/models"
+	"gopkg.in/go-playground/assert.v1"
+)
+
+func TestResolvePolicy(t *testing.T) {
+
+	err := refreshUserAndBookAndCheckoutTable()
+	if err != nil {
+		log.Fatalf("Tables could not be refreshed %v\n", err)
+	}
+
+	policies := []models.CirculationPolicy{
+		models.CirculationPolicy{PatronType: "*", ItemType: "*", MaxLoans: 3, LoanPeriodDays: 14, HoldPickupDays: 7},
+		models.CirculationPolicy{PatronType: "faculty", ItemType: "*", MaxLoans: 20, LoanPeriodDays: 90, HoldPickupDays: 7},
+		models.CirculationPolicy{PatronType: "*", ItemType: "reference", MaxLoans: 1, LoanPeriodDays: 1, HoldPickupDays: 1},
+	}
+	for i := range policies {
+		_, err = policies[i].SavePolicy(server.DB, models.Actor{})
+		if err != nil {
+			log.Fatalf("Policy could not be saved %v\n", err)
+		}
+	}
+
+	samples := []struct {
+		patronType string
+		itemType   string
+		maxLoans   int
+	}{
+		{patronType: "standard", itemType: "standard", maxLoans: 3},
+		{patronType: "faculty", itemType: "standard", maxLoans: 20},
+		{patronType: "faculty", itemType: "reference", maxLoans: 20},
+		{patronType: "standard", itemType: "reference", maxLoans: 1},
+	}
+	for _, v := range samples {
+		policy, err := models.ResolvePolicy(server.DB, v.patronType, v.itemType)
+		if err != nil {
+			t.Errorf("There was an error resolving the policy: %v\n", err)
+			continue
+		}
+		assert.Equal(t, policy.MaxLoans, v.maxLoans)
+	}
+}
+
+func TestEvaluateCirculationDeniesOverLimit(t *testing.T) {
+
+	user, _, _, err := seedOneUserAndTwoBookAndOneCheckout()
+	if err != nil {
+		log.Fatalf("Tables could not be seeded %v\n", err)
+	}
+	book := models.Book{
+		Title:       "Limit Book",
+		Author:      "Limit Author",
+		Isbn:        "9780061120084",
+		Description: "Limit Description",
+	}
+	_, err = book.SaveBook(server.DB)
+	if err != nil {
+		log.Fatalf("Book could not be saved %v\n", err)
+	}
+	policy := models.CirculationPolicy{PatronType: "*", ItemType: "*", MaxLoans: 1, LoanPeriodDays: 14, HoldPickupDays: 7}
+	_, err = policy.SavePolicy(server.DB, models.Actor{})
+	if err != nil {
+		log.Fatalf("Policy could not be saved %v\n", err)
+	}
+
+	checkout := models.Checkout{
+		UserId: user.ID,
+		BookId: uint64(book.ID),
+	}
+	err = checkout.MakeACheckout(server.DB, models.Actor{})
+
+	var denial *models.PolicyDenial
+	if !errors.As(err, &denial) {
+		t.Errorf("Expected a policy denial but got: %v\n", err)
+		return
+	}
+	assert.Equal(t, denial.Action, models.ActionCheckout)
+	assert.Equal(t, denial.Reasons[0].Code, "max_loans")
+}
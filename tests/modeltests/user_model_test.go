@@ -20,12 +20,36 @@ func TestFindAllUsers(t *testing.T) {
 		log.Fatal(err)
 	}
 
-	users, err := userInstance.FindAllUsers(server.DB)
+	page, err := userInstance.FindAllUsers(server.DB, &models.PageRequest{})
 	if err != nil {
 		t.Errorf("error running TestFindAllUsers: %v\n", err)
 		return
 	}
-	assert.Equal(t, len(*users), 2)
+	assert.Equal(t, len(page.Data.([]models.User)), 2)
+
+	// page through one user at a time
+	page, err = userInstance.FindAllUsers(server.DB, &models.PageRequest{Limit: 1, Sort: "email"})
+	if err != nil {
+		t.Errorf("error running TestFindAllUsers: %v\n", err)
+		return
+	}
+	first := page.Data.([]models.User)
+	assert.Equal(t, len(first), 1)
+	assert.Equal(t, page.Total, int64(2))
+	assert.Equal(t, page.HasMore, true)
+
+	page, err = userInstance.FindAllUsers(server.DB, &models.PageRequest{Limit: 1, Sort: "email", Cursor: page.NextCursor})
+	if err != nil {
+		t.Errorf("error running TestFindAllUsers: %v\n", err)
+		return
+	}
+	second := page.Data.([]models.User)
+	assert.Equal(t, len(second), 1)
+	assert.Equal(t, page.HasMore, false)
+	assert.Equal(t, first[0].Email < second[0].Email, true)
+
+	_, err = userInstance.FindAllUsers(server.DB, &models.PageRequest{Sort: "password"})
+	assert.Equal(t, err, models.ErrInvalidSort)
 }
 
 func TestSaveUser(t *testing.T) {
@@ -37,7 +61,7 @@ func TestSaveUser(t *testing.T) {
 	newUser := models.User{
 		Email:    "test1@gmail.com",
 		Password: "password",
-		Role:     "user",
+		Role:     "patron",
 	}
 	savedUser, err := newUser.SaveUser(server.DB)
 	if err != nil {
@@ -74,7 +98,7 @@ func TestDeleteAUser(t *testing.T) {
 		log.Fatalf("User table could not be seeded: %v", err)
 	}
 
-	_, err = user.DeleteAUser(server.DB, user.ID)
+	_, err = user.DeleteAUser(server.DB, user.ID, models.Actor{})
 	if err != nil {
 		t.Errorf("There was an error while deleting the user: %v\n", err)
 		return